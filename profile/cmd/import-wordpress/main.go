@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/config"
+	"github.com/ganis/okblog/profile/pkg/database"
+	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/wordpress"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// import-wordpress loads wp_users rows into the profiles table. Password
+// hashes are copied as is and upgraded by the profile service on first login.
+func main() {
+	file := flag.String("file", "", "path to the wp_users export (.json or .csv)")
+	format := flag.String("format", "", "export format: json or csv (default: from the file extension)")
+	dryRun := flag.Bool("dry-run", false, "parse and report without writing to the database")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to the profile service config file")
+	flag.Parse()
+
+	var logger log.Logger
+	logger = log.NewLogfmtLogger(os.Stderr)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	if *file == "" {
+		level.Error(logger).Log("msg", "-file is required")
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*file)), ".")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to open export", "file", *file, "err", err)
+		os.Exit(1)
+	}
+	users, err := wordpress.ParseUsers(f, *format)
+	f.Close()
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to parse export", "file", *file, "err", err)
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Parsed export", "file", *file, "users", len(users))
+
+	var repo repository.Repository
+	if !*dryRun {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid configuration", "err", err)
+			os.Exit(1)
+		}
+		switch cfg.Database.Driver {
+		case repository.DriverSQLite:
+			db, err := database.NewSQLiteDB(cfg.Database.Path, logger)
+			if err != nil {
+				level.Error(logger).Log("msg", "Failed to open database", "err", err)
+				os.Exit(1)
+			}
+			defer db.Close()
+			repo = repository.NewSQLiteRepository(db, logger)
+		case repository.DriverMemory:
+			level.Error(logger).Log("msg", "Importing into the memory driver would lose every profile, use -dry-run")
+			os.Exit(1)
+		default:
+			db, err := database.NewPostgresDB(cfg.Database.Postgres(), logger)
+			if err != nil {
+				level.Error(logger).Log("msg", "Failed to connect to database", "err", err)
+				os.Exit(1)
+			}
+			defer db.Close()
+			repo = repository.NewPostgresRepository(db, logger)
+		}
+	}
+
+	// Stop between rows on Ctrl-C instead of leaving a half-written profile
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	now := time.Now()
+	var imported, skipped, failed int
+
+	for _, user := range users {
+		if ctx.Err() != nil {
+			level.Warn(logger).Log("msg", "Import interrupted")
+			failed++
+			break
+		}
+		if err := user.Validate(); err != nil {
+			level.Warn(logger).Log("msg", "Skipping invalid row", "wp_id", user.ID, "err", err)
+			skipped++
+			continue
+		}
+
+		if *dryRun {
+			level.Info(logger).Log("msg", "Would import user", "wp_id", user.ID, "username", user.Login)
+			imported++
+			continue
+		}
+
+		if _, err := repo.GetProfileByUsername(ctx, user.Login); err == nil {
+			level.Info(logger).Log("msg", "Skipping existing user", "wp_id", user.ID, "username", user.Login)
+			skipped++
+			continue
+		}
+
+		profile := user.Profile(now)
+		if err := repo.CreateProfile(ctx, profile); err != nil {
+			level.Error(logger).Log("msg", "Failed to import user", "wp_id", user.ID, "username", user.Login, "err", err)
+			failed++
+			continue
+		}
+		level.Info(logger).Log("msg", "Imported user", "wp_id", user.ID, "username", user.Login, "id", profile.ID)
+		imported++
+	}
+
+	level.Info(logger).Log("msg", "Import finished", "imported", imported, "skipped", skipped, "failed", failed, "dry_run", *dryRun)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ganis/okblog/profile/migrations"
+	"github.com/ganis/okblog/profile/pkg/database"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/service"
+)
+
+// command is a subcommand. run parses its own flags from args.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error
+}
+
+// commands in the order of the usage text
+var commands = []command{
+	{"create-user", "[-role admin] [-password-stdin] -username name -email address", "create a profile without an invitation", createUser},
+	{"reset-password", "[-password-stdin] <user>", "set a new password and revoke every session of the profile", resetPassword},
+	{"set-role", "<user> <user|admin>", "change the role of a profile", setRole},
+	{"lock", "<user>", "block logins of a profile and revoke its sessions", lockUser},
+	{"unlock", "<user>", "allow a locked profile to log in again", unlockUser},
+	{"sessions", "<user>", "list the active sessions of a profile", listSessions},
+	{"rotate-jwt-key", "[-keep n]", "generate a new JWT signing key and print the settings to deploy", rotateJWTKey},
+	{"export-subscribers", "", "write the newsletter subscribers to stdout as CSV", exportSubscribers},
+	{"send-digest", "", "send the posts queued for the newsletter now", sendDigest},
+	{"migrate", "", "apply the pending database migrations", migrate},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// parse parses the flags of a command and checks it got n arguments
+func parse(flags *flag.FlagSet, args []string, n int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() != n {
+		return errUsage
+	}
+	return nil
+}
+
+// generatedPasswordBytes is the entropy of generated passwords
+const generatedPasswordBytes = 18
+
+// newPassword reads the password from stdin, or generates one that passes
+// the password policy. generated reports which it did.
+func (a *app) newPassword(fromStdin bool) (password string, generated bool, err error) {
+	if fromStdin {
+		line, err := bufio.NewReader(a.stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", false, err
+		}
+		password = strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", false, errors.New("no password on stdin")
+		}
+		return password, false, nil
+	}
+
+	policy, err := a.cfg.Password.Policy()
+	if err != nil {
+		return "", false, err
+	}
+	for {
+		b := make([]byte, generatedPasswordBytes)
+		if _, err := rand.Read(b); err != nil {
+			return "", false, err
+		}
+		// Random base64 almost always mixes enough character classes
+		password = base64.RawURLEncoding.EncodeToString(b)
+		if policy.Check(password) == "" {
+			return password, true, nil
+		}
+	}
+}
+
+func createUser(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	var req model.CreateProfileRequest
+	flags.StringVar(&req.Username, "username", "", "username (required)")
+	flags.StringVar(&req.Email, "email", "", "email address (required)")
+	flags.StringVar(&req.FirstName, "first-name", "", "first name")
+	flags.StringVar(&req.LastName, "last-name", "", "last name")
+	flags.StringVar(&req.Bio, "bio", "", "bio")
+	flags.StringVar(&req.Role, "role", model.RoleUser, "role: user or admin")
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	if req.Username == "" || req.Email == "" {
+		return errUsage
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	var generated bool
+	req.Password, generated, err = a.newPassword(*passwordStdin)
+	if err != nil {
+		return err
+	}
+	profile, err := svc.CreateProfile(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	result := accountResult{Profile: profile}
+	if generated {
+		result.Password = req.Password
+	}
+	return a.out.print(result, result.text)
+}
+
+func resetPassword(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	profile, err := a.lookup(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	password, generated, err := a.newPassword(*passwordStdin)
+	if err != nil {
+		return err
+	}
+	if err := svc.ResetPassword(ctx, profile.ID, password); err != nil {
+		return err
+	}
+
+	profile.Password = ""
+	result := accountResult{Profile: profile}
+	if generated {
+		result.Password = password
+	}
+	return a.out.print(result, result.text)
+}
+
+func setRole(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 2); err != nil {
+		return err
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	profile, err := a.lookup(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	profile, err = svc.SetRole(ctx, profile.ID, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	result := accountResult{Profile: profile}
+	return a.out.print(result, result.text)
+}
+
+func lockUser(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	return changeLock(ctx, a, flags, args, true)
+}
+
+func unlockUser(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	return changeLock(ctx, a, flags, args, false)
+}
+
+func changeLock(ctx context.Context, a *app, flags *flag.FlagSet, args []string, lock bool) error {
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	profile, err := a.lookup(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if lock {
+		profile, err = svc.LockProfile(ctx, profile.ID)
+	} else {
+		profile, err = svc.UnlockProfile(ctx, profile.ID)
+	}
+	if err != nil {
+		return err
+	}
+	result := accountResult{Profile: profile}
+	return a.out.print(result, result.text)
+}
+
+func listSessions(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 1); err != nil {
+		return err
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	profile, err := a.lookup(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	sessions, err := svc.ListSessions(ctx, profile.ID)
+	if err != nil {
+		return err
+	}
+	if sessions == nil {
+		sessions = []model.Session{}
+	}
+
+	return a.out.print(sessions, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tCREATED\tLAST SEEN\tEXPIRES\tIP\tUSER AGENT")
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, formatTime(s.CreatedAt), formatTime(s.LastSeenAt),
+				formatTime(s.ExpiresAt), s.IP, s.UserAgent)
+		}
+	})
+}
+
+// exportSubscribers always writes CSV, the format the export is imported in
+func exportSubscribers(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	subscribers, err := svc.ListSubscribers(ctx)
+	if err != nil {
+		return err
+	}
+	return service.WriteSubscribersCSV(a.out.w, subscribers)
+}
+
+// digestResult is the number of subscribers a digest was sent to
+type digestResult struct {
+	Sent int `json:"sent"`
+}
+
+func sendDigest(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	svc, err := a.service()
+	if err != nil {
+		return err
+	}
+	sent, err := svc.SendNewsletterDigest(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := digestResult{Sent: sent}
+	return a.out.print(result, func(w *tabwriter.Writer) {
+		if sent == 0 {
+			fmt.Fprintln(w, "No new posts to send")
+			return
+		}
+		fmt.Fprintf(w, "Sent the digest to %d subscribers\n", sent)
+	})
+}
+
+// jwtKeyBytes is the entropy of generated signing keys. Encoded, they are
+// well above config.MinJWTSigningKeyLength.
+const jwtKeyBytes = 48
+
+// rotationResult is the configuration to deploy after a key rotation
+type rotationResult struct {
+	SigningKey          string   `json:"signingKey"`
+	PreviousSigningKeys []string `json:"previousSigningKeys"`
+}
+
+// rotateJWTKey only prints the new settings: the configuration is owned by
+// the deployment, and every replica has to pick up the same keys
+func rotateJWTKey(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	keep := flags.Int("keep", 1, "how many previous keys keep verifying tokens, counting the current key")
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return errUsage
+	}
+
+	b := make([]byte, jwtKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	result := rotationResult{
+		SigningKey:          base64.RawURLEncoding.EncodeToString(b),
+		PreviousSigningKeys: append([]string{a.cfg.Auth.JWTSigningKey}, a.cfg.Auth.JWTPreviousSigningKeys...),
+	}
+	if len(result.PreviousSigningKeys) > *keep {
+		result.PreviousSigningKeys = result.PreviousSigningKeys[:*keep]
+	}
+
+	return a.out.print(result, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "JWT_SIGNING_KEY=%s\n", result.SigningKey)
+		fmt.Fprintf(w, "JWT_PREVIOUS_SIGNING_KEYS=%s\n", strings.Join(result.PreviousSigningKeys, ","))
+	})
+}
+
+// migrationResult lists the migrations that were applied
+type migrationResult struct {
+	Applied []string `json:"applied"`
+}
+
+func migrate(ctx context.Context, a *app, flags *flag.FlagSet, args []string) error {
+	if err := parse(flags, args, 0); err != nil {
+		return err
+	}
+
+	result := migrationResult{Applied: []string{}}
+	switch a.cfg.Database.Driver {
+	case repository.DriverSQLite:
+		// The SQLite schema is created and upgraded when it is opened
+		if _, err := a.repository(); err != nil {
+			return err
+		}
+	case repository.DriverMemory:
+		return errors.New("the memory driver has no schema to migrate")
+	default:
+		db, err := database.NewPostgresDB(a.cfg.Database.Postgres(), a.logger)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		applied, err := database.Migrate(ctx, db, migrations.Files, a.logger)
+		result.Applied = append(result.Applied, applied...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.out.print(result, func(w *tabwriter.Writer) {
+		if len(result.Applied) == 0 {
+			fmt.Fprintln(w, "The database is up to date")
+		}
+		for _, file := range result.Applied {
+			fmt.Fprintf(w, "Applied %s\n", file)
+		}
+	})
+}
+
+// accountResult is a profile after a change, with the password when
+// profilectl generated it
+type accountResult struct {
+	Profile  *model.Profile `json:"profile"`
+	Password string         `json:"password,omitempty"`
+}
+
+func (r accountResult) text(w *tabwriter.Writer) {
+	locked := "no"
+	if r.Profile.Locked() {
+		locked = "since " + formatTime(*r.Profile.LockedAt)
+	}
+	fmt.Fprintf(w, "ID\t%s\n", r.Profile.ID)
+	fmt.Fprintf(w, "Username\t%s\n", r.Profile.Username)
+	fmt.Fprintf(w, "Email\t%s\n", r.Profile.Email)
+	fmt.Fprintf(w, "Role\t%s\n", r.Profile.Role)
+	fmt.Fprintf(w, "Locked\t%s\n", locked)
+	if r.Password != "" {
+		fmt.Fprintf(w, "Password\t%s\n", r.Password)
+	}
+}
+
+// printer writes results as JSON for scripts, or as aligned text
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func (p *printer) print(v interface{}, text func(w *tabwriter.Writer)) error {
+	if p.json {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	text(w)
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,245 @@
+// profilectl runs administrative tasks against the database of the profile
+// service: creating accounts, resetting passwords, changing roles, locking
+// accounts, listing sessions, rotating the JWT signing key, exporting
+// newsletter subscribers, sending the digest and applying migrations. It
+// reads the same configuration as the server and goes through
+// service.Service, so the same validation and session rules apply.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ganis/okblog/profile/pkg/config"
+	"github.com/ganis/okblog/profile/pkg/database"
+	"github.com/ganis/okblog/profile/pkg/logging"
+	"github.com/ganis/okblog/profile/pkg/mailer"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/webhook"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/redis/go-redis/v9"
+)
+
+// errUsage is returned by commands called with the wrong arguments
+var errUsage = errors.New("wrong arguments")
+
+// operator is the caller the service sees. It has no profile, so it owns no
+// sessions.
+var operator = &model.TokenClaims{Username: "profilectl", Role: model.RoleAdmin}
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes the command line args and returns the exit code: 0 on
+// success, 1 when the command failed and 2 for usage errors
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("profilectl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "path to the profile service config file; environment variables take precedence")
+	jsonOutput := flags.Bool("json", false, "print results as JSON")
+	verbose := flags.Bool("v", false, "log every service call and query to stderr")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: profilectl [flags] <command> [command flags] [arguments]\n\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(stderr, "  %-15s %s\n", cmd.name, cmd.summary)
+		}
+		fmt.Fprintf(stderr, "\nUsers are given by profile ID or username. Run profilectl <command> -h for its flags.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	cmd, ok := findCommand(flags.Arg(0))
+	if !ok {
+		fmt.Fprintf(stderr, "profilectl: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "profilectl: invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	// Only warnings and errors unless -v; results go to stdout
+	redactKeys := append(append([]string{}, logging.DefaultRedactKeys...), cfg.Logging.RedactKeys...)
+	var logger log.Logger
+	logger = logging.NewRedactingLogger(log.NewLogfmtLogger(stderr), redactKeys, logging.DefaultRedactPatterns())
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+	if !*verbose {
+		logger = level.NewFilter(logger, level.AllowWarn(), level.SquelchNoLevel(true))
+	}
+
+	a := &app{
+		cfg:    cfg,
+		logger: logger,
+		stdin:  stdin,
+		out:    &printer{w: stdout, json: *jsonOutput},
+	}
+	defer a.close()
+
+	ctx = requestid.NewContext(ctx, requestid.New())
+	ctx = service.NewContextWithClaims(ctx, operator)
+
+	cmdFlags := flag.NewFlagSet("profilectl "+cmd.name, flag.ContinueOnError)
+	cmdFlags.SetOutput(stderr)
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: profilectl %s %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+		cmdFlags.PrintDefaults()
+	}
+	err = cmd.run(ctx, a, cmdFlags, flags.Args()[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		cmdFlags.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "profilectl %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+// app holds what the commands share. The repository and the service are
+// opened by the first command that needs them.
+type app struct {
+	cfg    config.Config
+	logger log.Logger
+	stdin  io.Reader
+	out    *printer
+
+	repo    repository.Repository
+	svc     service.Service
+	closers []func() error
+}
+
+func (a *app) close() {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		a.closers[i]()
+	}
+}
+
+// repository opens the database of the configured driver. With a shared
+// Valkey cache, writes go through the caching repository so the servers
+// don't keep serving the old profile or session.
+func (a *app) repository() (repository.Repository, error) {
+	if a.repo != nil {
+		return a.repo, nil
+	}
+
+	var repo repository.Repository
+	switch a.cfg.Database.Driver {
+	case repository.DriverSQLite:
+		db, err := database.NewSQLiteDB(a.cfg.Database.Path, a.logger)
+		if err != nil {
+			return nil, err
+		}
+		a.closers = append(a.closers, db.Close)
+		repo = repository.NewSQLiteRepository(db, a.logger)
+	case repository.DriverMemory:
+		return nil, errors.New("the memory driver keeps profiles inside the server process, profilectl can't reach them")
+	default:
+		db, err := database.NewPostgresDB(a.cfg.Database.Postgres(), a.logger)
+		if err != nil {
+			return nil, err
+		}
+		a.closers = append(a.closers, db.Close)
+		repo = repository.NewPostgresRepository(db, a.logger)
+	}
+
+	switch a.cfg.Cache.Driver {
+	case repository.CacheDriverValkey:
+		client := redis.NewClient(&redis.Options{
+			Addr:     a.cfg.Cache.Valkey.Addr,
+			Username: a.cfg.Cache.Valkey.Username,
+			Password: a.cfg.Cache.Valkey.Password,
+			DB:       a.cfg.Cache.Valkey.DB,
+		})
+		a.closers = append(a.closers, client.Close)
+		repo = repository.NewCachingRepository(repo, repository.NewValkeyCache(client, a.cfg.Cache.Valkey.Prefix), a.logger,
+			repository.WithCacheTTL(a.cfg.Cache.TTL),
+			repository.WithNegativeCacheTTL(a.cfg.Cache.NegativeTTL),
+		)
+	case repository.CacheDriverMemory:
+		level.Warn(a.logger).Log("msg", "Servers cache profiles in their own memory, they see changes once the entries expire", "ttl", a.cfg.Cache.TTL)
+	}
+
+	a.repo = repo
+	return repo, nil
+}
+
+// service returns the profile service configured like the server's
+func (a *app) service() (service.Service, error) {
+	if a.svc != nil {
+		return a.svc, nil
+	}
+	repo, err := a.repository()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := a.cfg.Password.Policy()
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := service.NewPasswordHasher(a.cfg.Password.Hasher())
+	if err != nil {
+		return nil, err
+	}
+
+	options := []service.Option{
+		service.WithPasswordPolicy(policy),
+		service.WithPasswordHasher(hasher),
+		service.WithJWTSigningKey([]byte(a.cfg.Auth.JWTSigningKey)),
+		service.WithPreviousJWTSigningKeys(a.cfg.Auth.PreviousSigningKeys()...),
+		// Accounts created here notify the webhooks too; the server sends
+		// the deliveries
+		service.WithWebhooks(webhook.NewHTTPSender(a.cfg.Webhooks.Timeout), a.cfg.Webhooks.Service()),
+	}
+	if a.cfg.Newsletter.Enabled() {
+		m, err := mailer.New(a.cfg.Mail.Mailer())
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, service.WithNewsletter(m, a.cfg.Newsletter.Service()))
+	}
+
+	svc := service.NewService(repo, a.logger, options...)
+	a.svc = service.LoggingMiddleware(a.logger)(svc)
+	return a.svc, nil
+}
+
+// lookup finds a profile by ID, then by username
+func (a *app) lookup(ctx context.Context, user string) (*model.Profile, error) {
+	repo, err := a.repository()
+	if err != nil {
+		return nil, err
+	}
+	user = strings.TrimSpace(user)
+	profile, err := repo.GetProfile(ctx, user)
+	if err != nil && err.Error() == "profile not found" {
+		profile, err = repo.GetProfileByUsername(ctx, user)
+	}
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return nil, fmt.Errorf("no profile has the id or username %q", user)
+		}
+		return nil, err
+	}
+	return profile, nil
+}
@@ -1,80 +1,267 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/ganis/okblog/profile/pkg/config"
 	"github.com/ganis/okblog/profile/pkg/database"
+	"github.com/ganis/okblog/profile/pkg/endpoint"
 	"github.com/ganis/okblog/profile/pkg/logging"
+	"github.com/ganis/okblog/profile/pkg/mailer"
+	"github.com/ganis/okblog/profile/pkg/metrics"
+	"github.com/ganis/okblog/profile/pkg/posts"
 	"github.com/ganis/okblog/profile/pkg/repository"
 	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/tracing"
+	grpctransport "github.com/ganis/okblog/profile/pkg/transport/grpc"
 	httptransport "github.com/ganis/okblog/profile/pkg/transport/http"
+	"github.com/ganis/okblog/profile/pkg/webhook"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
 )
 
 func main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file; environment variables take precedence")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	flag.Parse()
+
+	cfg, err := config.Read(*configFile)
+	if err == nil && *printConfig {
+		out, _ := cfg.Redacted().YAML()
+		os.Stdout.Write(out)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		return
+	}
+
+	// Secrets are masked before a line reaches stderr or Elasticsearch
+	redactKeys := append(append([]string{}, logging.DefaultRedactKeys...), cfg.Logging.RedactKeys...)
+	redactPatterns := logging.DefaultRedactPatterns()
+
 	// Create a base logger
 	var logger log.Logger
-	logger = log.NewLogfmtLogger(os.Stderr)
+	logger = logging.NewRedactingLogger(log.NewLogfmtLogger(os.Stderr), redactKeys, redactPatterns)
 	logger = log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
 
 	// Setup Kibana logger if enabled
-	useKibana := getEnvBool("USE_KIBANA_LOGGING", false)
-	if useKibana {
-		// Get Kibana logger configuration
-		kibanaConfig := logging.DefaultConfig()
-
-		// Create Kibana logger
-		kibanaLogger, err := logging.NewKibanaLogger(kibanaConfig, logger)
+	var kibanaLogger *logging.KibanaLogger
+	if cfg.Logging.Kibana {
+		kibanaLogger, err = logging.NewKibanaLogger(cfg.Kibana(), logger)
 		if err != nil {
 			level.Error(logger).Log("msg", "Failed to initialize Kibana logger", "err", err)
 		} else {
 			// Use Kibana logger as the primary logger
-			logger = kibanaLogger
+			logger = logging.NewRedactingLogger(kibanaLogger, redactKeys, redactPatterns)
 			level.Info(logger).Log("msg", "Kibana logging enabled")
 		}
 	}
+	level.Info(logger).Log("msg", "Configuration loaded", "environment", cfg.Environment, "file", *configFile)
+	if cfg.UsesDefaultJWTSigningKey() {
+		level.Warn(logger).Log("msg", "Tokens are signed with the default development key, set JWT_SIGNING_KEY")
+	}
 
-	dbConfig := getDbConfig(logger)
-	db, err := database.NewPostgresDB(dbConfig, logger)
+	// Initialize repository. db is nil for the memory driver.
+	repo, db, err := newRepository(cfg.Database, logger)
 	if err != nil {
-		level.Error(logger).Log("msg", "Failed to connect to database", "err", err)
+		level.Error(logger).Log("msg", "Failed to connect to database", "driver", cfg.Database.Driver, "err", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+	if db != nil {
+		defer db.Close()
+	} else {
+		level.Warn(logger).Log("msg", "Profiles are kept in memory and lost on restart")
+	}
 
-	// Check if we should only allow one profile
-	onlyOneProfile := getEnvBool("ONLY_ONE_PROFILE", true)
+	// Metrics are exported on /metrics of the HTTP server
+	registry := metrics.NewRegistry()
+	instruments := metrics.New(registry)
+	if db != nil {
+		if err := metrics.RegisterDBStats(registry, db, cfg.Database.Name); err != nil {
+			level.Error(logger).Log("msg", "Failed to register database metrics", "err", err)
+		}
+	}
 
-	// Initialize repository
-	repo := repository.NewPostgresRepository(db, logger)
+	// Profiles and sessions are cached because every validate-token call
+	// reads them
+	cache, closeCache, err := newRepositoryCache(cfg.Cache, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to create cache", "err", err)
+		os.Exit(1)
+	}
+	defer closeCache()
+	if cache != nil {
+		opts := []repository.CacheOption{
+			repository.WithCacheTTL(cfg.Cache.TTL),
+			repository.WithNegativeCacheTTL(cfg.Cache.NegativeTTL),
+			repository.WithCacheCounter(instruments.CacheRequests),
+		}
+		// A session revoked on one replica must not stay valid on the others
+		if cfg.Cache.Driver == repository.CacheDriverMemory {
+			opts = append(opts, repository.WithoutSessionCache())
+		}
+		repo = repository.NewCachingRepository(repo, cache, logger, opts...)
+		level.Info(logger).Log("msg", "Repository cache enabled", "driver", cfg.Cache.Driver, "ttl", cfg.Cache.TTL)
+	}
 
 	// Create service with repository and logging middleware
 	var svc service.Service
-	svc = service.NewService(repo, logger, onlyOneProfile)
+	hasher, err := service.NewPasswordHasher(cfg.Password.Hasher())
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid password hashing configuration", "err", err)
+		os.Exit(1)
+	}
+	serviceOptions := []service.Option{
+		service.WithOpenRegistration(cfg.Auth.OpenRegistration),
+		service.WithInvitationTTL(cfg.Auth.InvitationTTL),
+		service.WithSessionTouchInterval(cfg.Auth.SessionTouchInterval),
+		service.WithSessionlessTokens(cfg.Auth.AllowSessionlessTokens),
+		service.WithImpersonationTTL(cfg.Auth.ImpersonationTTL),
+		service.WithPasswordPolicy(getPasswordPolicy(cfg.Password, logger)),
+		service.WithPasswordHasher(service.InstrumentHasher(hasher, instruments.PasswordHashDuration)),
+		service.WithJWTSigningKey([]byte(cfg.Auth.JWTSigningKey)),
+		service.WithPreviousJWTSigningKeys(cfg.Auth.PreviousSigningKeys()...),
+		service.WithWebhooks(webhook.NewHTTPSender(cfg.Webhooks.Timeout), cfg.Webhooks.Service()),
+	}
+	if cfg.Auth.MagicLinkURL != "" || cfg.Newsletter.Enabled() {
+		m, err := mailer.New(cfg.Mail.Mailer())
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to create mailer", "err", err)
+			os.Exit(1)
+		}
+		if cfg.Auth.MagicLinkURL != "" {
+			serviceOptions = append(serviceOptions, service.WithMagicLinks(m, cfg.Auth.MagicLinkURL, cfg.Auth.MagicLinkTTL))
+			level.Info(logger).Log("msg", "Magic link login enabled", "mail_driver", cfg.Mail.Driver)
+		}
+		if cfg.Newsletter.Enabled() {
+			serviceOptions = append(serviceOptions, service.WithNewsletter(m, cfg.Newsletter.Service()))
+			level.Info(logger).Log("msg", "Newsletter enabled", "mail_driver", cfg.Mail.Driver, "digest_interval", cfg.Newsletter.DigestInterval)
+		}
+	}
+	svc = service.NewService(repo, logger, serviceOptions...)
 	svc = service.LoggingMiddleware(logger)(svc)
+	svc = service.InstrumentingMiddleware(instruments.Logins)(svc)
+	endpointMetrics := endpoint.InstrumentingMiddleware(instruments.EndpointDuration, instruments.EndpointErrors)
 
-	// Initialize New Relic
-	appName := getEnv("NEW_RELIC_APP_NAME", "okblog-profile")
-	licenseKey := getEnv("NEW_RELIC_LICENSE_KEY", "")
-	newRelicApp := httptransport.InitNewRelic(appName, licenseKey, logger)
+	// Set up tracing
+	tracingConfig := cfg.Tracer()
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to set up tracing", "err", err)
+		os.Exit(1)
+	}
+	level.Info(logger).Log("msg", "Tracing configured", "exporter", tracingConfig.Exporter)
+
+	// Readiness depends on the database, and on Elasticsearch when logs go there
+	var readinessChecks []httptransport.ReadinessCheck
+	if db != nil {
+		readinessChecks = append(readinessChecks, httptransport.ReadinessCheck{Name: "database", Check: db.PingContext})
+	}
+	if kibanaLogger != nil {
+		readinessChecks = append(readinessChecks, httptransport.ReadinessCheck{Name: "elasticsearch", Check: kibanaLogger.Ping})
+	}
 
 	// Create HTTP server with the service
-	server := httptransport.NewServer(svc, logger, newRelicApp)
+	server := httptransport.NewServer(
+		svc, logger,
+		httptransport.WithReadinessChecks(readinessChecks...),
+		httptransport.WithCORS(cfg.CORS()),
+		httptransport.WithTrustedProxies(cfg.TrustedProxies()...),
+		httptransport.WithEndpointMiddleware(endpointMetrics),
+		httptransport.WithInstrumenting(instruments.RequestDuration),
+		httptransport.WithMetricsHandler(metrics.Handler(registry)),
+	)
+	httpServer := &http.Server{
+		Addr:              ":" + strconv.Itoa(cfg.HTTP.Port),
+		Handler:           server,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+	}
 
 	// Create a channel to listen for errors coming from the listener.
 	errs := make(chan error, 2)
 
 	// Start the server
 	go func() {
-		port := getEnv("PORT", "8080")
-		logger.Log("transport", "HTTP", "addr", ":"+port, "msg", "Starting server")
-		errs <- http.ListenAndServe(":"+port, server)
+		logger.Log("transport", "HTTP", "addr", httpServer.Addr, "msg", "Starting server")
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+
+	// Start the gRPC server on its own port
+	grpcServer := grpctransport.NewServer(svc, logger,
+		endpoint.TracingMiddleware(otel.GetTracerProvider()), endpointMetrics)
+	go func() {
+		addr := ":" + strconv.Itoa(cfg.GRPC.Port)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			errs <- err
+			return
+		}
+		logger.Log("transport", "gRPC", "addr", addr, "msg", "Starting server")
+		errs <- grpcServer.Serve(listener)
+	}()
+
+	// Background jobs stop before the servers drain
+	background, stopBackground := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		runWebhookDelivery(background, svc, cfg.Webhooks.PollInterval, logger)
 	}()
+	if cfg.Newsletter.Enabled() {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			runNewsletterDigest(background, svc, cfg.Newsletter.DigestInterval, logger)
+		}()
+	}
+
+	// One consumer of the posts topic feeds the author statistics and the
+	// newsletter
+	var consumer *posts.Consumer
+	if len(cfg.Kafka.Brokers) > 0 {
+		handlers := []posts.Handler{service.AuthorStatsHandler(svc)}
+		if cfg.Newsletter.Enabled() {
+			handlers = append(handlers, service.NewsletterPostHandler(svc))
+		}
+		consumer, err = posts.NewConsumer(cfg.Kafka.Posts(), posts.Handlers(handlers...), logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Failed to create posts consumer", "err", err)
+			os.Exit(1)
+		}
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			logger.Log("topic", cfg.Kafka.PostsTopic, "group", cfg.Kafka.GroupID, "msg", "Consuming post changes")
+			consumer.Run(background)
+		}()
+	} else {
+		level.Warn(logger).Log("msg", "No Kafka brokers set, author statistics and the newsletter get no posts")
+	}
 
 	// Listen for an interrupt signal
 	go func() {
@@ -86,46 +273,131 @@ func main() {
 	}()
 
 	logger.Log("exit", <-errs)
-}
 
-func getDbConfig(logger log.Logger) database.Config {
-	dbPortStr := getEnv("DB_PORT", "5432")
-	dbPort, err := strconv.Atoi(dbPortStr)
-	if err != nil {
-		level.Error(logger).Log("msg", "Invalid DB_PORT", "value", dbPortStr, "err", err)
-		dbPort = 5432 // Default to 5432 if invalid
+	stopBackground()
+	jobs.Wait()
+	if consumer != nil {
+		if err := consumer.Close(); err != nil {
+			level.Error(logger).Log("msg", "Failed to close posts consumer", "err", err)
+		}
 	}
 
-	// Database configuration
-	dbConfig := database.Config{
-		Host:     getEnv("DB_HOST", "localhost"),
-		Port:     dbPort,
-		User:     getEnv("DB_USER", "postgres"),
-		Password: getEnv("DB_PASSWORD", "postgres"),
-		DBName:   getEnv("DB_NAME", "profile"),
-		SSLMode:  getEnv("DB_SSLMODE", "disable"),
+	// Fail readiness first so no new traffic arrives, then drain both servers
+	server.Drain()
+	time.Sleep(cfg.HTTP.ShutdownDelay) // give load balancers time to notice
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		level.Error(logger).Log("msg", "HTTP server did not drain in time", "err", err)
+	}
+	grpcServer.Shutdown(ctx)
+	if err := shutdownTracing(ctx); err != nil {
+		level.Error(logger).Log("msg", "Failed to flush spans", "err", err)
+	}
+	logger.Log("msg", "Shutdown complete")
+	if kibanaLogger != nil {
+		// Ship the queued log entries, including the ones above
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+		defer cancel()
+		kibanaLogger.Shutdown(ctx)
 	}
-	return dbConfig
 }
 
-// getEnv gets an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+// runNewsletterDigest sends the digest of new posts every interval until ctx
+// is canceled. A failed digest is sent again at the next tick.
+func runNewsletterDigest(ctx context.Context, svc service.Service, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := svc.SendNewsletterDigest(ctx); err != nil && ctx.Err() == nil {
+				level.Error(logger).Log("msg", "Failed to send newsletter digest", "err", err)
+			}
+		}
 	}
-	return value
 }
 
-// getEnvBool gets a boolean environment variable or returns a default value
-func getEnvBool(key string, defaultValue bool) bool {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+// runWebhookDelivery sends the webhook deliveries that are due every interval
+// until ctx is canceled. Deliveries interrupted by the shutdown are sent again
+// once their lease expired, by this replica or another.
+func runWebhookDelivery(ctx context.Context, svc service.Service, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := svc.DeliverWebhooks(ctx); err != nil && ctx.Err() == nil {
+				level.Error(logger).Log("msg", "Failed to deliver webhooks", "err", err)
+			}
+		}
 	}
-	boolValue, err := strconv.ParseBool(value)
+}
+
+func getPasswordPolicy(cfg config.PasswordConfig, logger log.Logger) service.PasswordPolicy {
+	policy, err := cfg.Policy()
 	if err != nil {
-		return defaultValue
+		level.Error(logger).Log("msg", "Failed to load breached password list", "path", cfg.BreachedList, "err", err)
+	} else if cfg.BreachedList != "" {
+		level.Info(logger).Log("msg", "Loaded breached password list", "path", cfg.BreachedList, "count", len(policy.Breached))
+	}
+	return policy
+}
+
+// newRepository opens the storage selected by cfg.Driver. The returned
+// database is nil for the memory driver.
+func newRepository(cfg config.DatabaseConfig, logger log.Logger) (repository.Repository, *sql.DB, error) {
+	switch cfg.Driver {
+	case repository.DriverSQLite:
+		db, err := database.NewSQLiteDB(cfg.Path, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return repository.NewSQLiteRepository(db, logger), db, nil
+	case repository.DriverMemory:
+		return repository.NewMemoryRepository(), nil, nil
+	default:
+		db, err := database.NewPostgresDB(cfg.Postgres(), logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return repository.NewPostgresRepository(db, logger), db, nil
+	}
+}
+
+// newRepositoryCache builds the cache selected by cfg.Driver, or nil for
+// none. An unreachable Valkey is only logged: lookups fall back to the
+// database until it comes back.
+func newRepositoryCache(cfg config.CacheConfig, logger log.Logger) (repository.Cache, func() error, error) {
+	noop := func() error { return nil }
+
+	switch cfg.Driver {
+	case repository.CacheDriverMemory:
+		cache, err := repository.NewLRUCache(cfg.Size)
+		return cache, noop, err
+	case repository.CacheDriverValkey:
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.Valkey.Addr,
+			Username: cfg.Valkey.Username,
+			Password: cfg.Valkey.Password,
+			DB:       cfg.Valkey.DB,
+		})
+		cache := repository.NewValkeyCache(client, cfg.Valkey.Prefix)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := cache.Ping(ctx); err != nil {
+			level.Warn(logger).Log("msg", "Valkey is not reachable, reading from the database", "addr", cfg.Valkey.Addr, "err", err)
+		}
+		return cache, client.Close, nil
+	default:
+		return nil, noop, nil
 	}
-	return boolValue
 }
@@ -0,0 +1,25 @@
+-- Roles replace the ONLY_ONE_PROFILE switch
+ALTER TABLE profiles ADD COLUMN IF NOT EXISTS role VARCHAR(32) NOT NULL DEFAULT 'user';
+
+-- The owner of an existing single-profile installation becomes its admin
+UPDATE profiles SET role = 'admin'
+WHERE id = (SELECT id FROM profiles ORDER BY created_at LIMIT 1)
+  AND NOT EXISTS (SELECT 1 FROM profiles WHERE role = 'admin');
+
+-- Create invitations table. Only a SHA-256 hash of the code is stored.
+CREATE TABLE IF NOT EXISTS invitations (
+    id VARCHAR(36) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(32) NOT NULL,
+    code_hash VARCHAR(64) NOT NULL UNIQUE,
+    created_by VARCHAR(36) REFERENCES profiles(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    used_by VARCHAR(36),
+    revoked_at TIMESTAMP
+);
+
+-- Index for listing pending invitations
+CREATE INDEX IF NOT EXISTS idx_invitations_pending ON invitations(expires_at)
+    WHERE used_at IS NULL AND revoked_at IS NULL;
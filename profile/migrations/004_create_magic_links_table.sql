@@ -0,0 +1,14 @@
+-- Create magic_links table. Only SHA-256 hashes of the token and of the
+-- requesting client's fingerprint are stored.
+CREATE TABLE IF NOT EXISTS magic_links (
+    id VARCHAR(36) PRIMARY KEY,
+    profile_id VARCHAR(36) NOT NULL REFERENCES profiles(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    fingerprint_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Index for case-insensitive email lookups of magic link requests
+CREATE INDEX IF NOT EXISTS idx_profiles_email_lower ON profiles(LOWER(email));
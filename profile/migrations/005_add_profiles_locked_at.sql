@@ -0,0 +1,2 @@
+-- Accounts locked by an admin can't log in until they are unlocked
+ALTER TABLE profiles ADD COLUMN IF NOT EXISTS locked_at TIMESTAMP;
@@ -0,0 +1,29 @@
+-- Create subscribers table. Subscribers are readers, not profiles. Only a
+-- SHA-256 hash of the confirmation token is stored; the unsubscribe token is
+-- kept as is because every digest links to it.
+CREATE TABLE IF NOT EXISTS subscribers (
+    id VARCHAR(36) PRIMARY KEY,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    confirm_token_hash VARCHAR(64) NOT NULL UNIQUE,
+    confirm_expires_at TIMESTAMP NOT NULL,
+    unsubscribe_token VARCHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    unsubscribed_at TIMESTAMP
+);
+
+-- Create newsletter_posts table. Published posts wait here for the next
+-- digest; the primary key keeps a post from being sent twice.
+CREATE TABLE IF NOT EXISTS newsletter_posts (
+    id VARCHAR(36) PRIMARY KEY,
+    title TEXT NOT NULL,
+    slug VARCHAR(255) NOT NULL,
+    excerpt TEXT NOT NULL DEFAULT '',
+    published_at TIMESTAMP NOT NULL,
+    queued_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP
+);
+
+-- Index for finding the posts of the next digest
+CREATE INDEX IF NOT EXISTS idx_newsletter_posts_unsent ON newsletter_posts(published_at)
+    WHERE sent_at IS NULL;
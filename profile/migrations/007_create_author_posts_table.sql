@@ -0,0 +1,17 @@
+-- Create author_posts table. It holds the last known state of every post of
+-- the post service, as read from its change stream, so the statistics of a
+-- profile can be counted without calling the post service. There is no
+-- foreign key: posts can arrive before their profile and outlive it.
+CREATE TABLE IF NOT EXISTS author_posts (
+    id VARCHAR(36) PRIMARY KEY,
+    profile_id VARCHAR(36) NOT NULL,
+    is_published BOOLEAN NOT NULL DEFAULT FALSE,
+    view_count BIGINT NOT NULL DEFAULT 0,
+    published_at TIMESTAMP,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    version BIGINT NOT NULL
+);
+
+-- Index for counting the posts of a profile
+CREATE INDEX IF NOT EXISTS idx_author_posts_profile_id ON author_posts(profile_id)
+    WHERE NOT deleted;
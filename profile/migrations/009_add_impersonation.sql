@@ -0,0 +1,20 @@
+-- Sessions started by an admin impersonating the profile record the admin
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS impersonator_id VARCHAR(36) REFERENCES profiles(id) ON DELETE CASCADE;
+
+-- Create audit_events table. The audit trail records impersonations and the
+-- changes made with them. It keeps plain IDs, not foreign keys, so entries
+-- outlive the profiles they mention.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id VARCHAR(36) PRIMARY KEY,
+    action VARCHAR(64) NOT NULL,
+    profile_id VARCHAR(36) NOT NULL,
+    actor_id VARCHAR(36) NOT NULL,
+    target VARCHAR(255) NOT NULL DEFAULT '',
+    request_id VARCHAR(128) NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Indexes for the audit trail of a profile and of an admin
+CREATE INDEX IF NOT EXISTS idx_audit_events_profile_id ON audit_events(profile_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id, created_at);
@@ -0,0 +1,3 @@
+-- Settings that follow an author across devices. The service validates the
+-- document against its JSON Schema before storing it.
+ALTER TABLE profiles ADD COLUMN IF NOT EXISTS preferences JSONB NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,3 @@
+-- A digest claims the posts it sends until claimed_until, so replicas
+-- running the digest job at the same time don't send them twice
+ALTER TABLE newsletter_posts ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMP;
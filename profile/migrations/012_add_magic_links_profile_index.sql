@@ -0,0 +1,3 @@
+-- Index for counting the recent magic links of a profile, which throttles
+-- magic link requests
+CREATE INDEX IF NOT EXISTS idx_magic_links_profile_id ON magic_links(profile_id, created_at);
@@ -0,0 +1,10 @@
+// Package migrations embeds the PostgreSQL schema migrations, so they ship
+// inside the binaries that apply them
+package migrations
+
+import "embed"
+
+// Files holds the migrations, applied in file name order
+//
+//go:embed *.sql
+var Files embed.FS
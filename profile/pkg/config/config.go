@@ -0,0 +1,599 @@
+// Package config loads the profile service configuration from an optional
+// YAML file and the environment, and validates it before anything starts.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/database"
+	"github.com/ganis/okblog/profile/pkg/logging"
+	"github.com/ganis/okblog/profile/pkg/mailer"
+	"github.com/ganis/okblog/profile/pkg/posts"
+	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/tracing"
+	httptransport "github.com/ganis/okblog/profile/pkg/transport/http"
+	"github.com/ganis/okblog/profile/pkg/webhook"
+	"gopkg.in/yaml.v3"
+)
+
+// Environments. Production refuses to start with default secrets.
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// Defaults of the secrets, only acceptable for local development
+const (
+	DefaultJWTSigningKey = "my_secret_key"
+	DefaultDBPassword    = "postgres"
+)
+
+// MinJWTSigningKeyLength is the minimum length in bytes of a configured JWT
+// signing key. HS256 keys should be at least as long as the hash.
+const MinJWTSigningKeyLength = 32
+
+// Config is the complete configuration of the profile service
+type Config struct {
+	Environment string `yaml:"environment"`
+	ServiceName string `yaml:"service_name"`
+
+	HTTP       HTTPConfig       `yaml:"http"`
+	GRPC       GRPCConfig       `yaml:"grpc"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Cache      CacheConfig      `yaml:"cache"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Password   PasswordConfig   `yaml:"password"`
+	Mail       MailConfig       `yaml:"mail"`
+	Newsletter NewsletterConfig `yaml:"newsletter"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	Webhooks   WebhookConfig    `yaml:"webhooks"`
+	Logging    LoggingConfig    `yaml:"logging"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+}
+
+// HTTPConfig configures the HTTP server and shutdown
+type HTTPConfig struct {
+	Port              int           `yaml:"port"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// ShutdownDelay is how long readiness fails before the servers drain
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	CORS            CORSConfig    `yaml:"cors"`
+	// TrustedProxies are the addresses or CIDR ranges of the proxies, like
+	// nginx, whose X-Real-IP and X-Forwarded-For headers are believed
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// CORSConfig configures cross-origin requests made straight to the service.
+// It is off without allowed origins, as nginx handles CORS in front of it.
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// GRPCConfig configures the gRPC server
+type GRPCConfig struct {
+	Port int `yaml:"port"`
+}
+
+// DatabaseConfig configures where profiles are stored
+type DatabaseConfig struct {
+	// Driver is postgres, sqlite or memory
+	Driver string `yaml:"driver"`
+	// Path is the database file of the sqlite driver
+	Path     string `yaml:"path"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// CacheConfig configures the profile and session cache in front of the
+// database
+type CacheConfig struct {
+	// Driver is none, memory (per replica) or valkey (shared)
+	Driver string `yaml:"driver"`
+	// Size is the number of entries of the memory driver
+	Size        int           `yaml:"size"`
+	TTL         time.Duration `yaml:"ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	Valkey      ValkeyConfig  `yaml:"valkey"`
+}
+
+// ValkeyConfig configures the valkey cache driver
+type ValkeyConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	Prefix   string `yaml:"prefix"`
+}
+
+// AuthConfig configures tokens and registration
+type AuthConfig struct {
+	JWTSigningKey string `yaml:"jwt_signing_key"`
+	// JWTPreviousSigningKeys verify tokens signed before the current key was
+	// rotated in. Drop a key once its tokens have expired.
+	JWTPreviousSigningKeys []string `yaml:"jwt_previous_signing_keys"`
+	// OpenRegistration lets anyone register; otherwise only the first
+	// profile and holders of an invitation can
+	OpenRegistration bool          `yaml:"open_registration"`
+	InvitationTTL    time.Duration `yaml:"invitation_ttl"`
+	// SessionTouchInterval throttles recording the last use of a session
+	SessionTouchInterval time.Duration `yaml:"session_touch_interval"`
+	// AllowSessionlessTokens accepts tokens issued before sessions existed,
+	// as long as their profile is unchanged. Turn it off once they expired.
+	AllowSessionlessTokens bool `yaml:"allow_sessionless_tokens"`
+	// ImpersonationTTL is how long the tokens admins get to act as another
+	// profile are valid
+	ImpersonationTTL time.Duration `yaml:"impersonation_ttl"`
+	// MagicLinkURL is the frontend page that redeems magic links; the token
+	// is added as a query parameter. Magic links are disabled when empty.
+	MagicLinkURL string        `yaml:"magic_link_url"`
+	MagicLinkTTL time.Duration `yaml:"magic_link_ttl"`
+}
+
+// MailConfig configures how emails are sent
+type MailConfig struct {
+	Driver string `yaml:"driver"`
+	From   string `yaml:"from"`
+	// OutboxDir is where the file driver writes messages
+	OutboxDir string     `yaml:"outbox_dir"`
+	SMTP      SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig configures the smtp mail driver
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// NewsletterConfig configures newsletter subscriptions and the new post
+// digest. The newsletter is disabled without a confirmation URL.
+type NewsletterConfig struct {
+	// ConfirmURL and UnsubscribeURL are the frontend pages of the links sent
+	// to subscribers; the token is added as a query parameter
+	ConfirmURL     string `yaml:"confirm_url"`
+	UnsubscribeURL string `yaml:"unsubscribe_url"`
+	// SiteURL is the public URL of the blog, posts are linked below it
+	SiteURL    string        `yaml:"site_url"`
+	ConfirmTTL time.Duration `yaml:"confirm_ttl"`
+	// DigestInterval is how often the posts published since the last
+	// digest are sent
+	DigestInterval time.Duration `yaml:"digest_interval"`
+}
+
+// KafkaConfig configures the consumer of the post service's change stream.
+// Nothing is consumed without brokers.
+type KafkaConfig struct {
+	Brokers    []string `yaml:"brokers"`
+	PostsTopic string   `yaml:"posts_topic"`
+	GroupID    string   `yaml:"group_id"`
+}
+
+// WebhookConfig configures the delivery of webhooks
+type WebhookConfig struct {
+	// Timeout is how long a receiver has to answer
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	// RetryBackoff is the wait before the first retry, it doubles with
+	// every attempt
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// PollInterval is how often deliveries that are due are sent
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// PasswordConfig configures the password policy and hashing
+type PasswordConfig struct {
+	MinLength int `yaml:"min_length"`
+	MinScore  int `yaml:"min_score"`
+	// BreachedList is the path of a newline separated list of breached passwords
+	BreachedList      string `yaml:"breached_list"`
+	HashAlgorithm     string `yaml:"hash_algorithm"`
+	Argon2Memory      uint32 `yaml:"argon2_memory_kib"`
+	Argon2Iterations  uint32 `yaml:"argon2_iterations"`
+	Argon2Parallelism uint8  `yaml:"argon2_parallelism"`
+	BcryptCost        int    `yaml:"bcrypt_cost"`
+}
+
+// LoggingConfig configures redaction and shipping logs to Elasticsearch
+type LoggingConfig struct {
+	// RedactKeys are masked in addition to logging.DefaultRedactKeys
+	RedactKeys    []string            `yaml:"redact_keys"`
+	Kibana        bool                `yaml:"kibana"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+}
+
+// ElasticsearchConfig configures the Kibana logger
+type ElasticsearchConfig struct {
+	URL            string        `yaml:"url"`
+	Index          string        `yaml:"index"`
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	QueueSize      int           `yaml:"queue_size"`
+	BatchSize      int           `yaml:"batch_size"`
+	FlushInterval  time.Duration `yaml:"flush_interval"`
+	OverflowPolicy string        `yaml:"overflow_policy"`
+	MaxRetries     int           `yaml:"max_retries"`
+	RetryBackoff   time.Duration `yaml:"retry_backoff"`
+}
+
+// TracingConfig configures the span exporter
+type TracingConfig struct {
+	// Exporter defaults to newrelic when a license key is set, none otherwise
+	Exporter           string  `yaml:"exporter"`
+	Endpoint           string  `yaml:"endpoint"`
+	Insecure           bool    `yaml:"insecure"`
+	SampleRatio        float64 `yaml:"sample_ratio"`
+	NewRelicLicenseKey string  `yaml:"new_relic_license_key"`
+}
+
+// Default returns the configuration used for everything that isn't set
+func Default() Config {
+	hasher := service.DefaultHasherConfig()
+	policy := service.DefaultPasswordPolicy()
+	cors := httptransport.DefaultCORSConfig()
+
+	return Config{
+		Environment: EnvDevelopment,
+		ServiceName: "profile-service",
+		HTTP: HTTPConfig{
+			Port:              8080,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      15 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			ShutdownTimeout:   20 * time.Second,
+			CORS: CORSConfig{
+				AllowedMethods: cors.AllowedMethods,
+				AllowedHeaders: cors.AllowedHeaders,
+				ExposedHeaders: cors.ExposedHeaders,
+				MaxAge:         cors.MaxAge,
+			},
+		},
+		GRPC: GRPCConfig{Port: 9090},
+		Database: DatabaseConfig{
+			Driver:   repository.DriverPostgres,
+			Path:     "profile.db",
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: DefaultDBPassword,
+			Name:     "profile",
+			SSLMode:  "disable",
+		},
+		Cache: CacheConfig{
+			Driver:      repository.CacheDriverMemory,
+			Size:        10000,
+			TTL:         repository.DefaultCacheTTL,
+			NegativeTTL: repository.DefaultNegativeCacheTTL,
+			Valkey: ValkeyConfig{
+				Addr:   "localhost:6379",
+				Prefix: "okblog:profile:",
+			},
+		},
+		Auth: AuthConfig{
+			JWTSigningKey: DefaultJWTSigningKey,
+			InvitationTTL: service.DefaultInvitationTTL,
+
+			SessionTouchInterval:   service.DefaultSessionTouchInterval,
+			AllowSessionlessTokens: true,
+			ImpersonationTTL:       service.DefaultImpersonationTTL,
+			MagicLinkTTL:           service.DefaultMagicLinkTTL,
+		},
+		Password: PasswordConfig{
+			MinLength:         policy.MinLength,
+			MinScore:          policy.MinScore,
+			HashAlgorithm:     hasher.Algorithm,
+			Argon2Memory:      hasher.Argon2id.Memory,
+			Argon2Iterations:  hasher.Argon2id.Iterations,
+			Argon2Parallelism: hasher.Argon2id.Parallelism,
+			BcryptCost:        hasher.BcryptCost,
+		},
+		Mail: MailConfig{
+			Driver:    mailer.DriverFile,
+			From:      "okblog <noreply@localhost>",
+			OutboxDir: "outbox",
+			SMTP:      SMTPConfig{Port: 587},
+		},
+		Newsletter: NewsletterConfig{
+			ConfirmTTL:     service.DefaultSubscriptionConfirmTTL,
+			DigestInterval: 24 * time.Hour,
+		},
+		Kafka: KafkaConfig{
+			PostsTopic: posts.DefaultTopic,
+			GroupID:    "profile-service",
+		},
+		Webhooks: WebhookConfig{
+			Timeout:      webhook.DefaultTimeout,
+			MaxAttempts:  service.DefaultWebhookMaxAttempts,
+			RetryBackoff: service.DefaultWebhookRetryBackoff,
+			PollInterval: 5 * time.Second,
+		},
+		Logging: LoggingConfig{
+			Elasticsearch: ElasticsearchConfig{
+				URL:            "http://localhost:9200",
+				Index:          "profile-service-logs",
+				QueueSize:      4096,
+				BatchSize:      500,
+				FlushInterval:  2 * time.Second,
+				OverflowPolicy: logging.OverflowDrop,
+				MaxRetries:     3,
+				RetryBackoff:   500 * time.Millisecond,
+			},
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load reads the configuration like Read and validates it
+func Load(path string) (Config, error) {
+	config, err := Read(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Read reads the YAML file at path, if any, on top of the defaults and
+// applies the environment variables. Unknown keys in the file and malformed
+// variables are errors; the values themselves are not validated.
+func Read(path string) (Config, error) {
+	return read(path, os.Getenv)
+}
+
+func read(path string, getenv func(string) string) (Config, error) {
+	config := Default()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("open config file: %w", err)
+		}
+		defer f.Close()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := config.applyEnv(getenv); err != nil {
+		return Config{}, err
+	}
+
+	if config.Tracing.Exporter == "" {
+		config.Tracing.Exporter = tracing.ExporterNone
+		if config.Tracing.NewRelicLicenseKey != "" {
+			config.Tracing.Exporter = tracing.ExporterNewRelic
+		}
+	}
+
+	return config, nil
+}
+
+// Redacted returns a copy with the secrets masked, for printing
+func (c Config) Redacted() Config {
+	mask := func(s *string) {
+		if *s != "" {
+			*s = logging.Redacted
+		}
+	}
+	mask(&c.Database.Password)
+	mask(&c.Cache.Valkey.Password)
+	mask(&c.Auth.JWTSigningKey)
+	// Copied so masking doesn't change the original
+	previous := make([]string, len(c.Auth.JWTPreviousSigningKeys))
+	for i := range previous {
+		previous[i] = logging.Redacted
+	}
+	if len(previous) > 0 {
+		c.Auth.JWTPreviousSigningKeys = previous
+	}
+	mask(&c.Mail.SMTP.Password)
+	mask(&c.Logging.Elasticsearch.Password)
+	mask(&c.Tracing.NewRelicLicenseKey)
+	return c
+}
+
+// YAML encodes the configuration in the format Load reads
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
+
+// UsesDefaultJWTSigningKey reports whether tokens are signed with the
+// publicly known development key
+func (c Config) UsesDefaultJWTSigningKey() bool {
+	return c.Auth.JWTSigningKey == DefaultJWTSigningKey
+}
+
+// PreviousSigningKeys returns the previous JWT signing keys for
+// service.WithPreviousJWTSigningKeys
+func (c AuthConfig) PreviousSigningKeys() [][]byte {
+	keys := make([][]byte, 0, len(c.JWTPreviousSigningKeys))
+	for _, key := range c.JWTPreviousSigningKeys {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+// Postgres returns the connection settings for database.NewPostgresDB
+func (c DatabaseConfig) Postgres() database.Config {
+	return database.Config{
+		Host:     c.Host,
+		Port:     c.Port,
+		User:     c.User,
+		Password: c.Password,
+		DBName:   c.Name,
+		SSLMode:  c.SSLMode,
+	}
+}
+
+// Enabled reports whether readers can subscribe to the newsletter
+func (c NewsletterConfig) Enabled() bool {
+	return c.ConfirmURL != ""
+}
+
+// Service returns the settings for service.WithNewsletter
+func (c NewsletterConfig) Service() service.NewsletterConfig {
+	return service.NewsletterConfig{
+		ConfirmURL:     c.ConfirmURL,
+		UnsubscribeURL: c.UnsubscribeURL,
+		SiteURL:        c.SiteURL,
+		ConfirmTTL:     c.ConfirmTTL,
+	}
+}
+
+// Posts returns the settings for posts.NewConsumer
+func (c KafkaConfig) Posts() posts.ConsumerConfig {
+	return posts.ConsumerConfig{
+		Brokers: c.Brokers,
+		Topic:   c.PostsTopic,
+		GroupID: c.GroupID,
+	}
+}
+
+// Service returns the settings for service.WithWebhooks
+func (c WebhookConfig) Service() service.WebhookConfig {
+	return service.WebhookConfig{
+		MaxAttempts:  c.MaxAttempts,
+		RetryBackoff: c.RetryBackoff,
+	}
+}
+
+// TrustedProxies returns the prefixes for httptransport.WithTrustedProxies.
+// Entries that don't parse are left out; Validate reports them.
+func (c Config) TrustedProxies() []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, proxy := range c.HTTP.TrustedProxies {
+		if prefix, err := parseProxy(proxy); err == nil {
+			proxies = append(proxies, prefix)
+		}
+	}
+	return proxies
+}
+
+// parseProxy parses a trusted proxy given as an address or a CIDR range
+func parseProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// CORS returns the policy for httptransport.WithCORS
+func (c Config) CORS() httptransport.CORSConfig {
+	cors := c.HTTP.CORS
+	return httptransport.CORSConfig{
+		AllowedOrigins:   cors.AllowedOrigins,
+		AllowedMethods:   cors.AllowedMethods,
+		AllowedHeaders:   cors.AllowedHeaders,
+		ExposedHeaders:   cors.ExposedHeaders,
+		AllowCredentials: cors.AllowCredentials,
+		MaxAge:           cors.MaxAge,
+	}
+}
+
+// Hasher returns the settings for service.NewPasswordHasher
+func (c PasswordConfig) Hasher() service.HasherConfig {
+	hasher := service.DefaultHasherConfig()
+	hasher.Algorithm = c.HashAlgorithm
+	hasher.Argon2id.Memory = c.Argon2Memory
+	hasher.Argon2id.Iterations = c.Argon2Iterations
+	hasher.Argon2id.Parallelism = c.Argon2Parallelism
+	hasher.BcryptCost = c.BcryptCost
+	return hasher
+}
+
+// Policy returns the policy for service.WithPasswordPolicy. If the breached
+// password list can't be loaded, the policy is returned without it along
+// with the error.
+func (c PasswordConfig) Policy() (service.PasswordPolicy, error) {
+	policy := service.DefaultPasswordPolicy()
+	policy.MinLength = c.MinLength
+	policy.MinScore = c.MinScore
+	if c.BreachedList == "" {
+		return policy, nil
+	}
+	breached, err := service.LoadBreachedPasswords(c.BreachedList)
+	if err != nil {
+		return policy, err
+	}
+	policy.Breached = breached
+	return policy, nil
+}
+
+// Mailer returns the settings for mailer.New
+func (c MailConfig) Mailer() mailer.Config {
+	return mailer.Config{
+		Driver:    c.Driver,
+		From:      c.From,
+		OutboxDir: c.OutboxDir,
+		SMTP: mailer.SMTPConfig{
+			Host:     c.SMTP.Host,
+			Port:     c.SMTP.Port,
+			Username: c.SMTP.Username,
+			Password: c.SMTP.Password,
+		},
+	}
+}
+
+// Kibana returns the settings for logging.NewKibanaLogger
+func (c Config) Kibana() logging.Config {
+	es := c.Logging.Elasticsearch
+	return logging.Config{
+		ElasticsearchURL: es.URL,
+		IndexName:        es.Index,
+		ServiceName:      c.ServiceName,
+		Username:         es.Username,
+		Password:         es.Password,
+		QueueSize:        es.QueueSize,
+		BatchSize:        es.BatchSize,
+		FlushInterval:    es.FlushInterval,
+		OverflowPolicy:   es.OverflowPolicy,
+		MaxRetries:       es.MaxRetries,
+		RetryBackoff:     es.RetryBackoff,
+	}
+}
+
+// Tracer returns the settings for tracing.Setup
+func (c Config) Tracer() tracing.Config {
+	return tracing.Config{
+		Exporter:           c.Tracing.Exporter,
+		ServiceName:        c.ServiceName,
+		Endpoint:           c.Tracing.Endpoint,
+		Insecure:           c.Tracing.Insecure,
+		SampleRatio:        c.Tracing.SampleRatio,
+		NewRelicLicenseKey: c.Tracing.NewRelicLicenseKey,
+	}
+}
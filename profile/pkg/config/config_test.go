@@ -0,0 +1,494 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/logging"
+	"github.com/ganis/okblog/profile/pkg/posts"
+	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const strongKey = "0123456789abcdef0123456789abcdef"
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+
+	config, err := read("", env(nil))
+	require.NoError(t, err)
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, EnvDevelopment, config.Environment)
+	assert.Equal(t, tracing.ExporterNone, config.Tracing.Exporter)
+	assert.True(t, config.UsesDefaultJWTSigningKey())
+}
+
+func TestRead_FileThenEnvironment(t *testing.T) {
+	path := writeFile(t, `
+environment: production
+http:
+  port: 8000
+  shutdown_delay: 5s
+database:
+  host: db.internal
+  password: from-file
+  sslmode: verify-full
+auth:
+  jwt_signing_key: `+strongKey+`
+logging:
+  redact_keys: [api_key]
+`)
+
+	config, err := read(path, env(map[string]string{
+		"PORT":                  "8001",
+		"DB_PASSWORD":           "from-env",
+		"LOG_REDACT_KEYS":       "api_key, session",
+		"NEW_RELIC_LICENSE_KEY": "license",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+
+	assert.Equal(t, EnvProduction, config.Environment)
+	assert.Equal(t, 8001, config.HTTP.Port)
+	assert.Equal(t, 5*time.Second, config.HTTP.ShutdownDelay)
+	assert.Equal(t, 10*time.Second, config.HTTP.ReadTimeout, "unset values keep their default")
+	assert.Equal(t, "db.internal", config.Database.Host)
+	assert.Equal(t, "from-env", config.Database.Password)
+	assert.Equal(t, []string{"api_key", "session"}, config.Logging.RedactKeys)
+	assert.Equal(t, tracing.ExporterNewRelic, config.Tracing.Exporter)
+
+	assert.Equal(t, "db.internal", config.Database.Postgres().Host)
+	assert.Equal(t, "profile", config.Database.Postgres().DBName)
+}
+
+func TestRead_CORS(t *testing.T) {
+	config, err := read("", env(map[string]string{
+		"CORS_ALLOWED_ORIGINS":   "https://admin.okblog.dev, http://localhost:3000",
+		"CORS_ALLOW_CREDENTIALS": "true",
+		"CORS_MAX_AGE":           "1h",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+
+	cors := config.CORS()
+	assert.Equal(t, []string{"https://admin.okblog.dev", "http://localhost:3000"}, cors.AllowedOrigins)
+	assert.True(t, cors.AllowCredentials)
+	assert.Equal(t, time.Hour, cors.MaxAge)
+	assert.Equal(t, []string{"GET", "POST", "PUT", "DELETE"}, cors.AllowedMethods, "unset values keep their default")
+}
+
+func TestRead_TrustedProxies(t *testing.T) {
+	config, err := read("", env(map[string]string{
+		"HTTP_TRUSTED_PROXIES": "172.18.0.0/16, 10.0.0.7",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("172.18.0.0/16"),
+		netip.MustParsePrefix("10.0.0.7/32"),
+	}, config.TrustedProxies())
+	assert.Empty(t, Default().TrustedProxies(), "no proxy is trusted by default")
+}
+
+func TestRead_PreviousSigningKeys(t *testing.T) {
+	previous := strings.Repeat("p", MinJWTSigningKeyLength)
+	config, err := read("", env(map[string]string{
+		"JWT_SIGNING_KEY":           strongKey,
+		"JWT_PREVIOUS_SIGNING_KEYS": previous + ", " + DefaultJWTSigningKey,
+	}))
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+	assert.Equal(t, [][]byte{[]byte(previous), []byte(DefaultJWTSigningKey)}, config.Auth.PreviousSigningKeys())
+
+	out, err := config.Redacted().YAML()
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), previous)
+	assert.Equal(t, previous, config.Auth.JWTPreviousSigningKeys[0], "the original is untouched")
+}
+
+func TestRead_Errors(t *testing.T) {
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := read(writeFile(t, "http:\n  prot: 8000\n"), env(nil))
+		assert.ErrorContains(t, err, "prot")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := read(filepath.Join(t.TempDir(), "missing.yaml"), env(nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("malformed variables", func(t *testing.T) {
+		_, err := read("", env(map[string]string{
+			"PORT":             "http",
+			"ONLY_ONE_PROFILE": "maybe",
+			"SHUTDOWN_TIMEOUT": "20",
+		}))
+		assert.ErrorContains(t, err, "PORT")
+		assert.ErrorContains(t, err, "ONLY_ONE_PROFILE")
+		assert.ErrorContains(t, err, "SHUTDOWN_TIMEOUT")
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		_, err := read(writeFile(t, ""), env(nil))
+		assert.NoError(t, err)
+	})
+}
+
+func TestRead_Registration(t *testing.T) {
+	config, err := read("", env(nil))
+	require.NoError(t, err)
+	assert.False(t, config.Auth.OpenRegistration)
+	assert.Equal(t, 7*24*time.Hour, config.Auth.InvitationTTL)
+
+	// The variable from before invitations still opens registration
+	config, err = read("", env(map[string]string{"ONLY_ONE_PROFILE": "false"}))
+	require.NoError(t, err)
+	assert.True(t, config.Auth.OpenRegistration)
+
+	config, err = read("", env(map[string]string{"ONLY_ONE_PROFILE": "false", "OPEN_REGISTRATION": "false"}))
+	require.NoError(t, err)
+	assert.False(t, config.Auth.OpenRegistration)
+}
+
+func TestRead_Newsletter(t *testing.T) {
+	config, err := read("", env(map[string]string{
+		"NEWSLETTER_CONFIRM_URL":     "https://okblog.dev/newsletter/confirm",
+		"NEWSLETTER_UNSUBSCRIBE_URL": "https://okblog.dev/newsletter/unsubscribe",
+		"NEWSLETTER_SITE_URL":        "https://okblog.dev",
+		"NEWSLETTER_DIGEST_INTERVAL": "1h",
+		"KAFKA_BROKERS":              "kafka-1:9092, kafka-2:9092",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+
+	assert.True(t, config.Newsletter.Enabled())
+	assert.Equal(t, time.Hour, config.Newsletter.DigestInterval)
+	assert.Equal(t, service.DefaultSubscriptionConfirmTTL, config.Newsletter.Service().ConfirmTTL)
+	assert.Equal(t, posts.ConsumerConfig{
+		Brokers: []string{"kafka-1:9092", "kafka-2:9092"},
+		Topic:   posts.DefaultTopic,
+		GroupID: "profile-service",
+	}, config.Kafka.Posts())
+}
+
+func TestRead_Webhooks(t *testing.T) {
+	config, err := read("", env(map[string]string{
+		"WEBHOOK_TIMEOUT":       "3s",
+		"WEBHOOK_MAX_ATTEMPTS":  "5",
+		"WEBHOOK_RETRY_BACKOFF": "1m",
+	}))
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+
+	assert.Equal(t, WebhookConfig{
+		Timeout:      3 * time.Second,
+		MaxAttempts:  5,
+		RetryBackoff: time.Minute,
+		PollInterval: 5 * time.Second,
+	}, config.Webhooks)
+	assert.Equal(t, service.WebhookConfig{MaxAttempts: 5, RetryBackoff: time.Minute}, config.Webhooks.Service())
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		errMsg string
+	}{
+		{
+			name:   "port out of range",
+			modify: func(c *Config) { c.HTTP.Port = 70000 },
+			errMsg: "http port 70000 is out of range",
+		},
+		{
+			name:   "same ports",
+			modify: func(c *Config) { c.GRPC.Port = c.HTTP.Port },
+			errMsg: "different ports",
+		},
+		{
+			name:   "unknown sslmode",
+			modify: func(c *Config) { c.Database.SSLMode = "on" },
+			errMsg: `unsupported database sslmode "on"`,
+		},
+		{
+			name:   "trusted proxy",
+			modify: func(c *Config) { c.HTTP.TrustedProxies = []string{"nginx"} },
+			errMsg: `trusted proxy "nginx" must be an address or a CIDR range`,
+		},
+		{
+			name:   "cors origin with path",
+			modify: func(c *Config) { c.HTTP.CORS.AllowedOrigins = []string{"https://admin.okblog.dev/"} },
+			errMsg: `cors origin "https://admin.okblog.dev/" must be * or a scheme and host`,
+		},
+		{
+			name: "cors credentials for every origin",
+			modify: func(c *Config) {
+				c.HTTP.CORS.AllowedOrigins = []string{"*"}
+				c.HTTP.CORS.AllowCredentials = true
+			},
+			errMsg: "cors credentials can't be allowed for every origin",
+		},
+		{
+			name:   "unknown database driver",
+			modify: func(c *Config) { c.Database.Driver = "mysql" },
+			errMsg: `unsupported database driver "mysql"`,
+		},
+		{
+			name: "sqlite without path",
+			modify: func(c *Config) {
+				c.Database.Driver = "sqlite"
+				c.Database.Path = ""
+			},
+			errMsg: "database path must be set",
+		},
+		{
+			name: "memory database in production",
+			modify: func(c *Config) {
+				c.Environment = EnvProduction
+				c.Auth.JWTSigningKey = strongKey
+				c.Database.Driver = "memory"
+				c.Database.Password = "secret"
+			},
+			errMsg: "the memory database driver is not allowed in production",
+		},
+		{
+			name:   "short signing key",
+			modify: func(c *Config) { c.Auth.JWTSigningKey = "too-short" },
+			errMsg: "at least 32 bytes",
+		},
+		{
+			name:   "empty signing key",
+			modify: func(c *Config) { c.Auth.JWTSigningKey = "" },
+			errMsg: "jwt signing key must be set",
+		},
+		{
+			name: "default signing key in production",
+			modify: func(c *Config) {
+				c.Environment = EnvProduction
+				c.Database.Password = "secret"
+			},
+			errMsg: "default jwt signing key is not allowed in production",
+		},
+		{
+			name:   "short previous signing key",
+			modify: func(c *Config) { c.Auth.JWTPreviousSigningKeys = []string{"too-short"} },
+			errMsg: "previous jwt signing keys must be at least 32 bytes",
+		},
+		{
+			name: "signing key also previous",
+			modify: func(c *Config) {
+				c.Auth.JWTSigningKey = strongKey
+				c.Auth.JWTPreviousSigningKeys = []string{strongKey}
+			},
+			errMsg: "must not also be a previous key",
+		},
+		{
+			name: "default previous signing key in production",
+			modify: func(c *Config) {
+				c.Environment = EnvProduction
+				c.Auth.JWTSigningKey = strongKey
+				c.Auth.JWTPreviousSigningKeys = []string{DefaultJWTSigningKey}
+				c.Database.Password = "secret"
+			},
+			errMsg: "even as a previous key",
+		},
+		{
+			name: "default database password in production",
+			modify: func(c *Config) {
+				c.Environment = EnvProduction
+				c.Auth.JWTSigningKey = strongKey
+			},
+			errMsg: "default database password is not allowed in production",
+		},
+		{
+			name:   "invitation ttl",
+			modify: func(c *Config) { c.Auth.InvitationTTL = 0 },
+			errMsg: "invitation ttl must be positive",
+		},
+		{
+			name:   "session touch interval",
+			modify: func(c *Config) { c.Auth.SessionTouchInterval = -time.Second },
+			errMsg: "session touch interval",
+		},
+		{
+			name:   "impersonation ttl",
+			modify: func(c *Config) { c.Auth.ImpersonationTTL = 0 },
+			errMsg: "impersonation ttl must be positive",
+		},
+		{
+			name:   "unknown cache driver",
+			modify: func(c *Config) { c.Cache.Driver = "memcached" },
+			errMsg: `unsupported cache driver "memcached"`,
+		},
+		{
+			name:   "cache ttl",
+			modify: func(c *Config) { c.Cache.TTL = 0 },
+			errMsg: "cache ttl must be positive",
+		},
+		{
+			name: "valkey without addr",
+			modify: func(c *Config) {
+				c.Cache.Driver = "valkey"
+				c.Cache.Valkey.Addr = ""
+			},
+			errMsg: "valkey addr must be set",
+		},
+		{
+			name:   "relative magic link url",
+			modify: func(c *Config) { c.Auth.MagicLinkURL = "/login/magic" },
+			errMsg: "magic link url must be an absolute http(s) url",
+		},
+		{
+			name: "magic link ttl",
+			modify: func(c *Config) {
+				c.Auth.MagicLinkURL = "https://okblog.example/login/magic"
+				c.Auth.MagicLinkTTL = 0
+			},
+			errMsg: "magic link ttl must be positive",
+		},
+		{
+			name:   "unknown mail driver",
+			modify: func(c *Config) { c.Mail.Driver = "pigeon" },
+			errMsg: `unsupported mail driver "pigeon"`,
+		},
+		{
+			name:   "smtp without host",
+			modify: func(c *Config) { c.Mail.Driver = "smtp" },
+			errMsg: "smtp host must be set",
+		},
+		{
+			name:   "mail from",
+			modify: func(c *Config) { c.Mail.From = "okblog" },
+			errMsg: "mail from",
+		},
+		{
+			name:   "unknown environment",
+			modify: func(c *Config) { c.Environment = "staging" },
+			errMsg: "environment must be",
+		},
+		{
+			name:   "unknown hash algorithm",
+			modify: func(c *Config) { c.Password.HashAlgorithm = "md5" },
+			errMsg: "password hashing",
+		},
+		{
+			name: "elasticsearch overflow policy",
+			modify: func(c *Config) {
+				c.Logging.Kibana = true
+				c.Logging.Elasticsearch.OverflowPolicy = "spill"
+			},
+			errMsg: "overflow policy",
+		},
+		{
+			name:   "newrelic without license key",
+			modify: func(c *Config) { c.Tracing.Exporter = tracing.ExporterNewRelic },
+			errMsg: "license key",
+		},
+		{
+			name: "newsletter without site url",
+			modify: func(c *Config) {
+				c.Newsletter.ConfirmURL = "https://okblog.dev/newsletter/confirm"
+				c.Newsletter.UnsubscribeURL = "https://okblog.dev/newsletter/unsubscribe"
+			},
+			errMsg: `newsletter site url must be an absolute http(s) url, got ""`,
+		},
+		{
+			name: "kafka without group",
+			modify: func(c *Config) {
+				c.Kafka.Brokers = []string{"kafka:9092"}
+				c.Kafka.GroupID = ""
+			},
+			errMsg: "kafka group id must be set",
+		},
+		{
+			name:   "webhook attempts",
+			modify: func(c *Config) { c.Webhooks.MaxAttempts = 0 },
+			errMsg: "webhook max attempts must be positive",
+		},
+		{
+			name:   "sample ratio",
+			modify: func(c *Config) { c.Tracing.SampleRatio = 2 },
+			errMsg: "sample ratio",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Default()
+			tt.modify(&config)
+
+			err := config.Validate()
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
+
+func TestValidate_ReportsAllErrors(t *testing.T) {
+	config := Default()
+	config.HTTP.Port = 0
+	config.Database.Host = ""
+
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Len(t, strings.Split(err.Error(), "\n"), 2)
+}
+
+func TestValidate_SQLiteSkipsPostgresSettings(t *testing.T) {
+	config := Default()
+	config.Database.Driver = "sqlite"
+	config.Database.Host = ""
+	config.Database.SSLMode = ""
+
+	assert.NoError(t, config.Validate())
+}
+
+func TestLoad_ProductionWithSecrets(t *testing.T) {
+	t.Setenv("ENVIRONMENT", EnvProduction)
+	t.Setenv("JWT_SIGNING_KEY", strongKey)
+	t.Setenv("DB_PASSWORD", "s3cret")
+
+	config, err := Load("")
+	require.NoError(t, err)
+	assert.False(t, config.UsesDefaultJWTSigningKey())
+}
+
+func TestRedacted(t *testing.T) {
+	config := Default()
+	config.Database.Password = "db-secret"
+	config.Logging.Elasticsearch.Password = "es-secret"
+	config.Mail.SMTP.Password = "smtp-secret"
+	config.Cache.Valkey.Password = "valkey-secret"
+	config.Tracing.NewRelicLicenseKey = "nr-secret"
+
+	out, err := config.Redacted().YAML()
+	require.NoError(t, err)
+
+	for _, secret := range []string{"db-secret", DefaultJWTSigningKey, "es-secret", "smtp-secret", "valkey-secret", "nr-secret"} {
+		assert.NotContains(t, string(out), secret)
+	}
+	assert.Contains(t, string(out), logging.Redacted)
+	assert.Contains(t, string(out), "read_timeout: 10s")
+
+	// The original is untouched
+	assert.Equal(t, "es-secret", config.Logging.Elasticsearch.Password)
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envLoader overrides configuration values with environment variables.
+// Unset and empty variables keep the current value; malformed ones are
+// collected as errors instead of being ignored.
+type envLoader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (l *envLoader) lookup(key string) (string, bool) {
+	value := strings.TrimSpace(l.getenv(key))
+	return value, value != ""
+}
+
+func (l *envLoader) string(key string, dst *string) {
+	if value, ok := l.lookup(key); ok {
+		*dst = value
+	}
+}
+
+func (l *envLoader) list(key string, dst *[]string) {
+	value, ok := l.lookup(key)
+	if !ok {
+		return
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*dst = list
+}
+
+func (l *envLoader) int(key string, dst *int) {
+	if value, ok := l.lookup(key); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q is not an integer", key, value))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (l *envLoader) uint32(key string, dst *uint32) {
+	if value, ok := l.lookup(key); ok {
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q is not an unsigned integer", key, value))
+			return
+		}
+		*dst = uint32(n)
+	}
+}
+
+func (l *envLoader) uint8(key string, dst *uint8) {
+	if value, ok := l.lookup(key); ok {
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q is not an integer between 0 and 255", key, value))
+			return
+		}
+		*dst = uint8(n)
+	}
+}
+
+func (l *envLoader) bool(key string, dst *bool) {
+	if value, ok := l.lookup(key); ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q is not a boolean", key, value))
+			return
+		}
+		*dst = b
+	}
+}
+
+func (l *envLoader) float(key string, dst *float64) {
+	if value, ok := l.lookup(key); ok {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q is not a number", key, value))
+			return
+		}
+		*dst = f
+	}
+}
+
+func (l *envLoader) duration(key string, dst *time.Duration) {
+	if value, ok := l.lookup(key); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			l.errs = append(l.errs, fmt.Errorf("%s: %q is not a duration", key, value))
+			return
+		}
+		*dst = d
+	}
+}
+
+// applyEnv overrides c with the environment variables the service has always
+// read, so existing deployments keep working without a config file
+func (c *Config) applyEnv(getenv func(string) string) error {
+	env := &envLoader{getenv: getenv}
+
+	env.string("ENVIRONMENT", &c.Environment)
+	env.string("SERVICE_NAME", &c.ServiceName)
+
+	env.int("PORT", &c.HTTP.Port)
+	env.duration("HTTP_READ_HEADER_TIMEOUT", &c.HTTP.ReadHeaderTimeout)
+	env.duration("HTTP_READ_TIMEOUT", &c.HTTP.ReadTimeout)
+	env.duration("HTTP_WRITE_TIMEOUT", &c.HTTP.WriteTimeout)
+	env.duration("HTTP_IDLE_TIMEOUT", &c.HTTP.IdleTimeout)
+	env.duration("SHUTDOWN_DELAY", &c.HTTP.ShutdownDelay)
+	env.duration("SHUTDOWN_TIMEOUT", &c.HTTP.ShutdownTimeout)
+	env.list("CORS_ALLOWED_ORIGINS", &c.HTTP.CORS.AllowedOrigins)
+	env.list("CORS_ALLOWED_METHODS", &c.HTTP.CORS.AllowedMethods)
+	env.list("CORS_ALLOWED_HEADERS", &c.HTTP.CORS.AllowedHeaders)
+	env.list("CORS_EXPOSED_HEADERS", &c.HTTP.CORS.ExposedHeaders)
+	env.bool("CORS_ALLOW_CREDENTIALS", &c.HTTP.CORS.AllowCredentials)
+	env.duration("CORS_MAX_AGE", &c.HTTP.CORS.MaxAge)
+	env.list("HTTP_TRUSTED_PROXIES", &c.HTTP.TrustedProxies)
+	env.int("GRPC_PORT", &c.GRPC.Port)
+
+	env.string("DB_DRIVER", &c.Database.Driver)
+	env.string("DB_PATH", &c.Database.Path)
+	env.string("DB_HOST", &c.Database.Host)
+	env.int("DB_PORT", &c.Database.Port)
+	env.string("DB_USER", &c.Database.User)
+	env.string("DB_PASSWORD", &c.Database.Password)
+	env.string("DB_NAME", &c.Database.Name)
+	env.string("DB_SSLMODE", &c.Database.SSLMode)
+
+	env.string("CACHE_DRIVER", &c.Cache.Driver)
+	env.int("CACHE_SIZE", &c.Cache.Size)
+	env.duration("CACHE_TTL", &c.Cache.TTL)
+	env.duration("CACHE_NEGATIVE_TTL", &c.Cache.NegativeTTL)
+	env.string("VALKEY_ADDR", &c.Cache.Valkey.Addr)
+	env.string("VALKEY_USERNAME", &c.Cache.Valkey.Username)
+	env.string("VALKEY_PASSWORD", &c.Cache.Valkey.Password)
+	env.int("VALKEY_DB", &c.Cache.Valkey.DB)
+	env.string("VALKEY_PREFIX", &c.Cache.Valkey.Prefix)
+
+	env.string("JWT_SIGNING_KEY", &c.Auth.JWTSigningKey)
+	env.list("JWT_PREVIOUS_SIGNING_KEYS", &c.Auth.JWTPreviousSigningKeys)
+	// ONLY_ONE_PROFILE=false predates invitations and meant open registration
+	var onlyOneProfile = true
+	env.bool("ONLY_ONE_PROFILE", &onlyOneProfile)
+	if !onlyOneProfile {
+		c.Auth.OpenRegistration = true
+	}
+	env.bool("OPEN_REGISTRATION", &c.Auth.OpenRegistration)
+	env.duration("INVITATION_TTL", &c.Auth.InvitationTTL)
+	env.duration("SESSION_TOUCH_INTERVAL", &c.Auth.SessionTouchInterval)
+	env.bool("ALLOW_SESSIONLESS_TOKENS", &c.Auth.AllowSessionlessTokens)
+	env.duration("IMPERSONATION_TTL", &c.Auth.ImpersonationTTL)
+	env.string("MAGIC_LINK_URL", &c.Auth.MagicLinkURL)
+	env.duration("MAGIC_LINK_TTL", &c.Auth.MagicLinkTTL)
+
+	env.string("MAIL_DRIVER", &c.Mail.Driver)
+	env.string("MAIL_FROM", &c.Mail.From)
+	env.string("MAIL_OUTBOX_DIR", &c.Mail.OutboxDir)
+	env.string("SMTP_HOST", &c.Mail.SMTP.Host)
+	env.int("SMTP_PORT", &c.Mail.SMTP.Port)
+	env.string("SMTP_USERNAME", &c.Mail.SMTP.Username)
+	env.string("SMTP_PASSWORD", &c.Mail.SMTP.Password)
+
+	env.string("NEWSLETTER_CONFIRM_URL", &c.Newsletter.ConfirmURL)
+	env.string("NEWSLETTER_UNSUBSCRIBE_URL", &c.Newsletter.UnsubscribeURL)
+	env.string("NEWSLETTER_SITE_URL", &c.Newsletter.SiteURL)
+	env.duration("NEWSLETTER_CONFIRM_TTL", &c.Newsletter.ConfirmTTL)
+	env.duration("NEWSLETTER_DIGEST_INTERVAL", &c.Newsletter.DigestInterval)
+	env.list("KAFKA_BROKERS", &c.Kafka.Brokers)
+	env.string("KAFKA_POSTS_TOPIC", &c.Kafka.PostsTopic)
+	env.string("KAFKA_GROUP_ID", &c.Kafka.GroupID)
+	env.duration("WEBHOOK_TIMEOUT", &c.Webhooks.Timeout)
+	env.int("WEBHOOK_MAX_ATTEMPTS", &c.Webhooks.MaxAttempts)
+	env.duration("WEBHOOK_RETRY_BACKOFF", &c.Webhooks.RetryBackoff)
+	env.duration("WEBHOOK_POLL_INTERVAL", &c.Webhooks.PollInterval)
+
+	env.int("PASSWORD_MIN_LENGTH", &c.Password.MinLength)
+	env.int("PASSWORD_MIN_SCORE", &c.Password.MinScore)
+	env.string("PASSWORD_BREACHED_LIST", &c.Password.BreachedList)
+	env.string("PASSWORD_HASH_ALGORITHM", &c.Password.HashAlgorithm)
+	env.uint32("ARGON2_MEMORY_KIB", &c.Password.Argon2Memory)
+	env.uint32("ARGON2_ITERATIONS", &c.Password.Argon2Iterations)
+	env.uint8("ARGON2_PARALLELISM", &c.Password.Argon2Parallelism)
+	env.int("BCRYPT_COST", &c.Password.BcryptCost)
+
+	env.list("LOG_REDACT_KEYS", &c.Logging.RedactKeys)
+	env.bool("USE_KIBANA_LOGGING", &c.Logging.Kibana)
+	es := &c.Logging.Elasticsearch
+	env.string("ELASTICSEARCH_URL", &es.URL)
+	env.string("ELASTICSEARCH_INDEX", &es.Index)
+	env.string("ELASTICSEARCH_USERNAME", &es.Username)
+	env.string("ELASTICSEARCH_PASSWORD", &es.Password)
+	env.int("ELASTICSEARCH_QUEUE_SIZE", &es.QueueSize)
+	env.int("ELASTICSEARCH_BATCH_SIZE", &es.BatchSize)
+	env.duration("ELASTICSEARCH_FLUSH_INTERVAL", &es.FlushInterval)
+	env.string("ELASTICSEARCH_OVERFLOW_POLICY", &es.OverflowPolicy)
+	env.int("ELASTICSEARCH_MAX_RETRIES", &es.MaxRetries)
+	env.duration("ELASTICSEARCH_RETRY_BACKOFF", &es.RetryBackoff)
+
+	env.string("TRACING_EXPORTER", &c.Tracing.Exporter)
+	env.string("TRACING_ENDPOINT", &c.Tracing.Endpoint)
+	env.bool("TRACING_INSECURE", &c.Tracing.Insecure)
+	env.float("TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio)
+	env.string("NEW_RELIC_LICENSE_KEY", &c.Tracing.NewRelicLicenseKey)
+
+	return errors.Join(env.errs...)
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+
+	"github.com/ganis/okblog/profile/pkg/logging"
+	"github.com/ganis/okblog/profile/pkg/mailer"
+	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/tracing"
+)
+
+// sslModes are the sslmode values lib/pq accepts
+var sslModes = map[string]bool{
+	"disable":     true,
+	"allow":       true,
+	"prefer":      true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+// Validate reports every problem with the configuration at once
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	validPort := func(port int) bool {
+		return port > 0 && port <= 65535
+	}
+
+	check(c.Environment == EnvDevelopment || c.Environment == EnvProduction,
+		"environment must be %q or %q, got %q", EnvDevelopment, EnvProduction, c.Environment)
+	check(c.ServiceName != "", "service name must be set")
+
+	check(validPort(c.HTTP.Port), "http port %d is out of range", c.HTTP.Port)
+	check(validPort(c.GRPC.Port), "grpc port %d is out of range", c.GRPC.Port)
+	check(c.HTTP.Port != c.GRPC.Port, "http and grpc must listen on different ports")
+	check(c.HTTP.ReadHeaderTimeout > 0 && c.HTTP.ReadTimeout > 0 && c.HTTP.WriteTimeout > 0 && c.HTTP.IdleTimeout > 0,
+		"http timeouts must be positive")
+	check(c.HTTP.ShutdownDelay >= 0, "shutdown delay must not be negative")
+	check(c.HTTP.ShutdownTimeout > 0, "shutdown timeout must be positive")
+	for _, origin := range c.HTTP.CORS.AllowedOrigins {
+		check(validOrigin(origin), "cors origin %q must be * or a scheme and host like https://admin.example.com", origin)
+		check(origin != "*" || !c.HTTP.CORS.AllowCredentials, "cors credentials can't be allowed for every origin")
+	}
+	if len(c.HTTP.CORS.AllowedOrigins) > 0 {
+		check(len(c.HTTP.CORS.AllowedMethods) > 0, "cors allowed methods must be set")
+	}
+	check(c.HTTP.CORS.MaxAge >= 0, "cors max age must not be negative")
+	for _, proxy := range c.HTTP.TrustedProxies {
+		_, err := parseProxy(proxy)
+		check(err == nil, "trusted proxy %q must be an address or a CIDR range", proxy)
+	}
+
+	switch c.Database.Driver {
+	case repository.DriverPostgres:
+		check(c.Database.Host != "", "database host must be set")
+		check(validPort(c.Database.Port), "database port %d is out of range", c.Database.Port)
+		check(c.Database.User != "", "database user must be set")
+		check(c.Database.Name != "", "database name must be set")
+		check(sslModes[c.Database.SSLMode], "unsupported database sslmode %q", c.Database.SSLMode)
+	case repository.DriverSQLite:
+		check(c.Database.Path != "", "database path must be set")
+	case repository.DriverMemory:
+	default:
+		check(false, "unsupported database driver %q", c.Database.Driver)
+	}
+
+	switch c.Cache.Driver {
+	case repository.CacheDriverNone:
+	case repository.CacheDriverMemory:
+		check(c.Cache.Size > 0, "cache size must be positive")
+	case repository.CacheDriverValkey:
+		check(c.Cache.Valkey.Addr != "", "valkey addr must be set")
+		check(c.Cache.Valkey.DB >= 0, "valkey db must not be negative")
+	default:
+		check(false, "unsupported cache driver %q", c.Cache.Driver)
+	}
+	if c.Cache.Driver != repository.CacheDriverNone {
+		check(c.Cache.TTL > 0, "cache ttl must be positive")
+		check(c.Cache.NegativeTTL >= 0, "cache negative ttl must not be negative")
+	}
+
+	// The development default is short but recognisable; anything else must
+	// be a proper key
+	key := c.Auth.JWTSigningKey
+	check(key != "", "jwt signing key must be set")
+	check(key == "" || c.UsesDefaultJWTSigningKey() || len(key) >= MinJWTSigningKeyLength,
+		"jwt signing key must be at least %d bytes", MinJWTSigningKeyLength)
+	for _, previous := range c.Auth.JWTPreviousSigningKeys {
+		check(previous == DefaultJWTSigningKey || len(previous) >= MinJWTSigningKeyLength,
+			"previous jwt signing keys must be at least %d bytes", MinJWTSigningKeyLength)
+		check(previous != key, "the jwt signing key must not also be a previous key")
+	}
+	check(c.Auth.InvitationTTL > 0, "invitation ttl must be positive")
+	check(c.Auth.SessionTouchInterval >= 0, "session touch interval must not be negative")
+	check(c.Auth.ImpersonationTTL > 0, "impersonation ttl must be positive")
+	if c.Auth.MagicLinkURL != "" {
+		check(validURL(c.Auth.MagicLinkURL), "magic link url must be an absolute http(s) url, got %q", c.Auth.MagicLinkURL)
+		check(c.Auth.MagicLinkTTL > 0, "magic link ttl must be positive")
+	}
+
+	if c.Environment == EnvProduction {
+		check(!c.UsesDefaultJWTSigningKey(), "the default jwt signing key is not allowed in production")
+		for _, previous := range c.Auth.JWTPreviousSigningKeys {
+			check(previous != DefaultJWTSigningKey, "the default jwt signing key is not allowed in production, even as a previous key")
+		}
+		check(c.Database.Driver == repository.DriverPostgres, "the %s database driver is not allowed in production", c.Database.Driver)
+		check(c.Database.Password != DefaultDBPassword, "the default database password is not allowed in production")
+	}
+
+	_, err := mail.ParseAddress(c.Mail.From)
+	check(err == nil, "mail from %q is not an email address", c.Mail.From)
+	switch c.Mail.Driver {
+	case mailer.DriverFile:
+		check(c.Mail.OutboxDir != "", "mail outbox dir must be set")
+	case mailer.DriverSMTP:
+		check(c.Mail.SMTP.Host != "", "smtp host must be set")
+		check(validPort(c.Mail.SMTP.Port), "smtp port %d is out of range", c.Mail.SMTP.Port)
+	default:
+		check(false, "unsupported mail driver %q", c.Mail.Driver)
+	}
+
+	if c.Newsletter.Enabled() {
+		n := c.Newsletter
+		check(validURL(n.ConfirmURL), "newsletter confirm url must be an absolute http(s) url, got %q", n.ConfirmURL)
+		check(validURL(n.UnsubscribeURL), "newsletter unsubscribe url must be an absolute http(s) url, got %q", n.UnsubscribeURL)
+		check(validURL(n.SiteURL), "newsletter site url must be an absolute http(s) url, got %q", n.SiteURL)
+		check(n.ConfirmTTL > 0, "newsletter confirm ttl must be positive")
+		check(n.DigestInterval > 0, "newsletter digest interval must be positive")
+	}
+	if len(c.Kafka.Brokers) > 0 {
+		check(c.Kafka.PostsTopic != "", "kafka posts topic must be set")
+		check(c.Kafka.GroupID != "", "kafka group id must be set")
+	}
+	check(c.Webhooks.Timeout > 0 && c.Webhooks.RetryBackoff > 0 && c.Webhooks.PollInterval > 0,
+		"webhook timeout, retry backoff and poll interval must be positive")
+	check(c.Webhooks.MaxAttempts > 0, "webhook max attempts must be positive")
+
+	check(c.Password.MinLength > 0, "password min length must be positive")
+	check(c.Password.MinScore >= 0 && c.Password.MinScore <= 4, "password min score must be between 0 and 4")
+	if _, err := service.NewPasswordHasher(c.Password.Hasher()); err != nil {
+		errs = append(errs, fmt.Errorf("password hashing: %w", err))
+	}
+
+	if c.Logging.Kibana {
+		es := c.Logging.Elasticsearch
+		check(es.URL != "", "elasticsearch url must be set")
+		check(es.Index != "", "elasticsearch index must be set")
+		check(es.QueueSize > 0 && es.BatchSize > 0 && es.FlushInterval > 0,
+			"elasticsearch queue size, batch size and flush interval must be positive")
+		check(es.OverflowPolicy == logging.OverflowDrop || es.OverflowPolicy == logging.OverflowBlock,
+			"elasticsearch overflow policy must be %q or %q", logging.OverflowDrop, logging.OverflowBlock)
+		check(es.MaxRetries >= 0 && es.RetryBackoff >= 0, "elasticsearch retries must not be negative")
+	}
+
+	// Empty means none, or newrelic once Read has seen a license key
+	switch c.Tracing.Exporter {
+	case "", tracing.ExporterNone, tracing.ExporterOTLPGRPC, tracing.ExporterOTLPHTTP:
+	case tracing.ExporterNewRelic:
+		check(c.Tracing.NewRelicLicenseKey != "", "the newrelic exporter needs a license key")
+	default:
+		check(false, "unsupported tracing exporter %q", c.Tracing.Exporter)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing sample ratio must be between 0 and 1")
+
+	return errors.Join(errs...)
+}
+
+// validURL reports whether s is an absolute http or https URL
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validOrigin reports whether origin is "*" or a serialized origin, a scheme
+// and host without path, as browsers send it
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.User == nil && u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
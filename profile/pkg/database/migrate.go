@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// createMigrationsTable records which migrations have been applied
+const createMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version VARCHAR(255) PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)
+`
+
+// Migrate applies the .sql files of migrations that aren't recorded in the
+// schema_migrations table, in file name order, each in its own transaction.
+// It returns the names of the files it applied.
+//
+// Databases created before the table existed have every file applied again,
+// which is safe because the migrations are written to be idempotent.
+func Migrate(ctx context.Context, db *sql.DB, migrations fs.FS, logger log.Logger) ([]string, error) {
+	if _, err := db.ExecContext(ctx, createMigrationsTable); err != nil {
+		return nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	applied := make(map[string]bool)
+	rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("list applied migrations: %w", err)
+	}
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	files, err := fs.Glob(migrations, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var done []string
+	for _, file := range files {
+		if applied[file] {
+			continue
+		}
+		if err := applyMigration(ctx, db, migrations, file); err != nil {
+			return done, fmt.Errorf("apply %s: %w", file, err)
+		}
+		level.Info(logger).Log("msg", "Applied migration", "file", file)
+		done = append(done, file)
+	}
+	return done, nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, migrations fs.FS, file string) error {
+	migration, err := fs.ReadFile(migrations, file)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, string(migration)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, file, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"testing/fstest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMigrations = fstest.MapFS{
+	"001_create.sql": {Data: []byte("CREATE TABLE a (id INT)")},
+	"002_alter.sql":  {Data: []byte("ALTER TABLE a ADD COLUMN b INT")},
+	"003_index.sql":  {Data: []byte("CREATE INDEX a_b ON a(b)")},
+	"README.md":      {Data: []byte("not a migration")},
+}
+
+func TestMigrate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS schema_migrations`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM schema_migrations`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("001_create.sql"))
+	for _, m := range []struct{ file, query string }{
+		{"002_alter.sql", "ALTER TABLE a ADD COLUMN b INT"},
+		{"003_index.sql", "CREATE INDEX a_b ON a(b)"},
+	} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(m.query)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO schema_migrations`)).
+			WithArgs(m.file, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	applied, err := Migrate(context.Background(), db, testMigrations, log.NewNopLogger())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"002_alter.sql", "003_index.sql"}, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrate_StopsAtFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS schema_migrations`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM schema_migrations`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE a`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO schema_migrations`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE a`)).WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+
+	// Later files are not tried once one fails
+	applied, err := Migrate(context.Background(), db, testMigrations, log.NewNopLogger())
+	assert.ErrorContains(t, err, "apply 002_alter.sql: syntax error")
+	assert.Equal(t, []string{"001_create.sql"}, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
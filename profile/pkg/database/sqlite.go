@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"net/url"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// NewSQLiteDB opens the SQLite database at path, creating it and its tables
+// if needed. ":memory:" gives a database that lives as long as the returned
+// handle. The driver needs cgo.
+func NewSQLiteDB(path string, logger log.Logger) (*sql.DB, error) {
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_busy_timeout", "5000")
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to open database", "path", path, "err", err)
+		return nil, err
+	}
+
+	// SQLite allows one writer at a time, and every connection to :memory:
+	// would get its own empty database
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		level.Error(logger).Log("msg", "Failed to create database schema", "path", path, "err", err)
+		return nil, err
+	}
+
+	if err := addSQLiteColumns(db); err != nil {
+		db.Close()
+		level.Error(logger).Log("msg", "Failed to upgrade database schema", "path", path, "err", err)
+		return nil, err
+	}
+
+	level.Info(logger).Log("msg", "Successfully opened the database", "path", path)
+	return db, nil
+}
+
+// sqliteAddedColumns were added to the schema after their table. CREATE TABLE
+// IF NOT EXISTS leaves existing tables alone, and SQLite has no ADD COLUMN IF
+// NOT EXISTS, so they are added here when missing.
+var sqliteAddedColumns = []struct {
+	table, column, definition string
+}{
+	{"profiles", "locked_at", "TIMESTAMP"},
+	{"sessions", "impersonator_id", "TEXT REFERENCES profiles(id) ON DELETE CASCADE"},
+	{"profiles", "preferences", "TEXT NOT NULL DEFAULT '{}'"},
+	{"newsletter_posts", "claimed_until", "TIMESTAMP"},
+}
+
+func addSQLiteColumns(db *sql.DB) error {
+	for _, c := range sqliteAddedColumns {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
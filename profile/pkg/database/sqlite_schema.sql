@@ -0,0 +1,130 @@
+-- SQLite version of the schema in migrations/, for local development. It is
+-- applied every time the database is opened, so it must stay idempotent.
+CREATE TABLE IF NOT EXISTS profiles (
+    id TEXT PRIMARY KEY,
+    username TEXT NOT NULL UNIQUE,
+    email TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    first_name TEXT,
+    last_name TEXT,
+    bio TEXT,
+    role TEXT NOT NULL DEFAULT 'user',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    locked_at TIMESTAMP,
+    preferences TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS idx_profiles_email_lower ON profiles(LOWER(email));
+
+CREATE TABLE IF NOT EXISTS invitations (
+    id TEXT PRIMARY KEY,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    code_hash TEXT NOT NULL UNIQUE,
+    created_by TEXT REFERENCES profiles(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    used_by TEXT,
+    revoked_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    profile_id TEXT NOT NULL REFERENCES profiles(id) ON DELETE CASCADE,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    impersonator_id TEXT REFERENCES profiles(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_profile_id ON sessions(profile_id);
+
+CREATE TABLE IF NOT EXISTS magic_links (
+    id TEXT PRIMARY KEY,
+    profile_id TEXT NOT NULL REFERENCES profiles(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    fingerprint_hash TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_magic_links_profile_id ON magic_links(profile_id, created_at);
+
+CREATE TABLE IF NOT EXISTS subscribers (
+    id TEXT PRIMARY KEY,
+    email TEXT NOT NULL UNIQUE,
+    confirm_token_hash TEXT NOT NULL UNIQUE,
+    confirm_expires_at TIMESTAMP NOT NULL,
+    unsubscribe_token TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP,
+    unsubscribed_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS newsletter_posts (
+    id TEXT PRIMARY KEY,
+    title TEXT NOT NULL,
+    slug TEXT NOT NULL,
+    excerpt TEXT NOT NULL DEFAULT '',
+    published_at TIMESTAMP NOT NULL,
+    queued_at TIMESTAMP NOT NULL,
+    sent_at TIMESTAMP,
+    claimed_until TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS author_posts (
+    id TEXT PRIMARY KEY,
+    profile_id TEXT NOT NULL,
+    is_published BOOLEAN NOT NULL DEFAULT FALSE,
+    view_count INTEGER NOT NULL DEFAULT 0,
+    published_at TIMESTAMP,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    version INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_author_posts_profile_id ON author_posts(profile_id);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id TEXT PRIMARY KEY,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    created_by TEXT REFERENCES profiles(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id TEXT PRIMARY KEY,
+    webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    next_attempt_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, created_at);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id TEXT PRIMARY KEY,
+    action TEXT NOT NULL,
+    profile_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    target TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_profile_id ON audit_events(profile_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id, created_at);
@@ -0,0 +1,67 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ganis/okblog/profile/pkg/service"
+	kitendpoint "github.com/go-kit/kit/endpoint"
+)
+
+var (
+	// ErrMissingAuthorization is returned when the request carries no authorization
+	ErrMissingAuthorization = errors.New("missing Authorization header")
+	// ErrInvalidAuthorization is returned when the authorization is not a bearer token
+	ErrInvalidAuthorization = errors.New("invalid Authorization header format, expected 'Bearer token'")
+)
+
+type authorizationContextKey struct{}
+
+// NewContextWithAuthorization returns a context carrying the authorization
+// the request was sent with, such as "Bearer <token>". Transports set it
+// from the Authorization header or the authorization metadata.
+func NewContextWithAuthorization(ctx context.Context, authorization string) context.Context {
+	return context.WithValue(ctx, authorizationContextKey{}, authorization)
+}
+
+// BearerToken extracts the token from an authorization value
+func BearerToken(authorization string) (string, error) {
+	if authorization == "" {
+		return "", ErrMissingAuthorization
+	}
+
+	// Check if the header has the Bearer prefix
+	tokenParts := strings.Split(authorization, " ")
+	if len(tokenParts) != 2 || strings.ToLower(tokenParts[0]) != "bearer" {
+		return "", ErrInvalidAuthorization
+	}
+
+	token := tokenParts[1]
+	if token == "" {
+		return "", fmt.Errorf("%w: empty token", ErrInvalidAuthorization)
+	}
+	return token, nil
+}
+
+// AuthenticationMiddleware validates the bearer token of the request and puts
+// the caller's claims on the context for the service to authorize. The
+// transport must have set the authorization with NewContextWithAuthorization.
+func AuthenticationMiddleware(svc service.Service) kitendpoint.Middleware {
+	return func(next kitendpoint.Endpoint) kitendpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			authorization, _ := ctx.Value(authorizationContextKey{}).(string)
+			token, err := BearerToken(authorization)
+			if err != nil {
+				return nil, err
+			}
+
+			claims, err := svc.ValidateToken(ctx, token)
+			if err != nil {
+				return nil, err
+			}
+			return next(service.NewContextWithClaims(ctx, claims), request)
+		}
+	}
+}
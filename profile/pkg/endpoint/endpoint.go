@@ -0,0 +1,472 @@
+// Package endpoint builds the go-kit endpoints of the profile service. The
+// HTTP and gRPC transports both serve them.
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/service"
+	kitendpoint "github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/log"
+)
+
+type Endpoints struct {
+	RegisterProfile kitendpoint.Endpoint
+	Login           kitendpoint.Endpoint
+	ValidateToken   kitendpoint.Endpoint
+	GetProfile      kitendpoint.Endpoint
+	UpdateProfile   kitendpoint.Endpoint
+	DeleteProfile   kitendpoint.Endpoint
+
+	RequestMagicLink kitendpoint.Endpoint
+	RedeemMagicLink  kitendpoint.Endpoint
+
+	CreateInvitation kitendpoint.Endpoint
+	ListInvitations  kitendpoint.Endpoint
+	RevokeInvitation kitendpoint.Endpoint
+
+	CreateWebhook         kitendpoint.Endpoint
+	ListWebhooks          kitendpoint.Endpoint
+	DeleteWebhook         kitendpoint.Endpoint
+	ListWebhookDeliveries kitendpoint.Endpoint
+
+	ListSessions        kitendpoint.Endpoint
+	RevokeSession       kitendpoint.Endpoint
+	RevokeOtherSessions kitendpoint.Endpoint
+
+	GetPreferences    kitendpoint.Endpoint
+	UpdatePreferences kitendpoint.Endpoint
+
+	Subscribe           kitendpoint.Endpoint
+	ConfirmSubscription kitendpoint.Endpoint
+	Unsubscribe         kitendpoint.Endpoint
+	ExportSubscribers   kitendpoint.Endpoint
+
+	GetAuthorStats kitendpoint.Endpoint
+
+	Impersonate     kitendpoint.Endpoint
+	ListAuditEvents kitendpoint.Endpoint
+}
+
+// LoggingMiddleware returns an endpoint middleware that logs endpoint performance
+func LoggingMiddleware(logger log.Logger) kitendpoint.Middleware {
+	return func(next kitendpoint.Endpoint) kitendpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer func(begin time.Time) {
+				requestid.Logger(ctx, logger).Log(
+					"endpoint_time", time.Since(begin),
+					"err", err,
+				)
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+// UpdateProfileRequest is the request of the UpdateProfile endpoint
+type UpdateProfileRequest struct {
+	ID   string                     `json:"id"`
+	Data model.UpdateProfileRequest `json:"data"`
+}
+
+// RevokeSessionRequest is the request of the RevokeSession endpoint
+type RevokeSessionRequest struct {
+	ProfileID string `json:"profileId"`
+	SessionID string `json:"sessionId"`
+}
+
+// UpdatePreferencesRequest is the request of the UpdatePreferences endpoint.
+// The body is the preferences to change, the profile comes from the path.
+// Unset holds the paths of the fields the body sets to null.
+type UpdatePreferencesRequest struct {
+	ProfileID string   `json:"-"`
+	Unset     []string `json:"-"`
+	model.Preferences
+}
+
+// Middleware builds the middleware for the endpoint with the given name
+type Middleware func(name string) kitendpoint.Middleware
+
+// InstrumentingMiddleware records the latency of every endpoint call
+// and counts the calls that return an error
+func InstrumentingMiddleware(duration metrics.Histogram, errs metrics.Counter) Middleware {
+	return func(name string) kitendpoint.Middleware {
+		return func(next kitendpoint.Endpoint) kitendpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+				defer func(begin time.Time) {
+					duration.With("endpoint", name, "success", fmt.Sprint(err == nil)).Observe(time.Since(begin).Seconds())
+					if err != nil {
+						errs.With("endpoint", name).Add(1)
+					}
+				}(time.Now())
+				return next(ctx, request)
+			}
+		}
+	}
+}
+
+// MakeEndpoints creates the endpoints of the service. Every endpoint is
+// wrapped with LoggingMiddleware and then with middlewares, in order.
+// The endpoints that change a profile or need an admin authenticate the
+// caller first.
+func MakeEndpoints(svc service.Service, logger log.Logger, middlewares ...Middleware) Endpoints {
+	// Create a middleware for all endpoints
+	loggingMiddleware := LoggingMiddleware(logger)
+	authenticate := AuthenticationMiddleware(svc)
+
+	wrap := func(name string, e kitendpoint.Endpoint) kitendpoint.Endpoint {
+		e = loggingMiddleware(e)
+		for _, mw := range middlewares {
+			e = mw(name)(e)
+		}
+		return e
+	}
+
+	return Endpoints{
+		RegisterProfile: wrap("RegisterProfile", makeRegisterProfileEndpoint(svc)),
+		Login:           wrap("Login", makeLoginEndpoint(svc)),
+		ValidateToken:   wrap("ValidateToken", makeValidateTokenEndpoint(svc)),
+		GetProfile:      wrap("GetProfile", makeGetProfileEndpoint(svc)),
+		UpdateProfile:   wrap("UpdateProfile", authenticate(makeUpdateProfileEndpoint(svc))),
+		DeleteProfile:   wrap("DeleteProfile", authenticate(makeDeleteProfileEndpoint(svc))),
+
+		RequestMagicLink: wrap("RequestMagicLink", makeRequestMagicLinkEndpoint(svc)),
+		RedeemMagicLink:  wrap("RedeemMagicLink", makeRedeemMagicLinkEndpoint(svc)),
+
+		CreateInvitation: wrap("CreateInvitation", authenticate(makeCreateInvitationEndpoint(svc))),
+		ListInvitations:  wrap("ListInvitations", authenticate(makeListInvitationsEndpoint(svc))),
+		RevokeInvitation: wrap("RevokeInvitation", authenticate(makeRevokeInvitationEndpoint(svc))),
+
+		CreateWebhook:         wrap("CreateWebhook", authenticate(makeCreateWebhookEndpoint(svc))),
+		ListWebhooks:          wrap("ListWebhooks", authenticate(makeListWebhooksEndpoint(svc))),
+		DeleteWebhook:         wrap("DeleteWebhook", authenticate(makeDeleteWebhookEndpoint(svc))),
+		ListWebhookDeliveries: wrap("ListWebhookDeliveries", authenticate(makeListWebhookDeliveriesEndpoint(svc))),
+
+		ListSessions:        wrap("ListSessions", authenticate(makeListSessionsEndpoint(svc))),
+		RevokeSession:       wrap("RevokeSession", authenticate(makeRevokeSessionEndpoint(svc))),
+		RevokeOtherSessions: wrap("RevokeOtherSessions", authenticate(makeRevokeOtherSessionsEndpoint(svc))),
+
+		GetPreferences:    wrap("GetPreferences", authenticate(makeGetPreferencesEndpoint(svc))),
+		UpdatePreferences: wrap("UpdatePreferences", authenticate(makeUpdatePreferencesEndpoint(svc))),
+
+		Subscribe:           wrap("Subscribe", makeSubscribeEndpoint(svc)),
+		ConfirmSubscription: wrap("ConfirmSubscription", makeConfirmSubscriptionEndpoint(svc)),
+		Unsubscribe:         wrap("Unsubscribe", makeUnsubscribeEndpoint(svc)),
+		ExportSubscribers:   wrap("ExportSubscribers", authenticate(makeExportSubscribersEndpoint(svc))),
+
+		GetAuthorStats: wrap("GetAuthorStats", makeGetAuthorStatsEndpoint(svc)),
+
+		Impersonate:     wrap("Impersonate", authenticate(makeImpersonateEndpoint(svc))),
+		ListAuditEvents: wrap("ListAuditEvents", authenticate(makeListAuditEventsEndpoint(svc))),
+	}
+}
+
+func makeRegisterProfileEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.RegisterProfileRequest)
+		profile, err := svc.RegisterProfile(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return profile, nil
+	}
+}
+
+func makeLoginEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.LoginRequest)
+		loginResponse, err := svc.Login(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return loginResponse, nil
+	}
+}
+
+func makeRequestMagicLinkEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.MagicLinkRequest)
+		if err := svc.RequestMagicLink(ctx, req); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeRedeemMagicLinkEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.RedeemMagicLinkRequest)
+		loginResponse, err := svc.RedeemMagicLink(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return loginResponse, nil
+	}
+}
+
+func makeValidateTokenEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.TokenValidationRequest)
+		claims, err := svc.ValidateToken(ctx, req.Token)
+		if err != nil {
+			return nil, err
+		}
+		return model.TokenValidationResponse{Valid: true, Claims: claims}, nil
+	}
+}
+
+func makeGetProfileEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		id := request.(string)
+		profile, err := svc.GetProfile(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return profile, nil
+	}
+}
+
+func makeGetAuthorStatsEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		id := request.(string)
+		stats, err := svc.GetAuthorStats(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return stats, nil
+	}
+}
+
+func makeUpdateProfileEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(UpdateProfileRequest)
+		profile, err := svc.UpdateProfile(ctx, req.ID, req.Data)
+		if err != nil {
+			return nil, err
+		}
+		return profile, nil
+	}
+}
+
+func makeDeleteProfileEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		id := request.(string)
+		err := svc.DeleteProfile(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeCreateInvitationEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CreateInvitationRequest)
+		invitation, err := svc.CreateInvitation(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return invitation, nil
+	}
+}
+
+func makeListInvitationsEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		invitations, err := svc.ListInvitations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if invitations == nil {
+			invitations = []model.Invitation{}
+		}
+		return invitations, nil
+	}
+}
+
+func makeRevokeInvitationEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		id := request.(string)
+		err := svc.RevokeInvitation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeCreateWebhookEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.CreateWebhookRequest)
+		webhook, err := svc.CreateWebhook(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return webhook, nil
+	}
+}
+
+func makeListWebhooksEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		webhooks, err := svc.ListWebhooks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if webhooks == nil {
+			webhooks = []model.Webhook{}
+		}
+		return webhooks, nil
+	}
+}
+
+func makeDeleteWebhookEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		id := request.(string)
+		err := svc.DeleteWebhook(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeListWebhookDeliveriesEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		webhookID := request.(string)
+		deliveries, err := svc.ListWebhookDeliveries(ctx, webhookID)
+		if err != nil {
+			return nil, err
+		}
+		if deliveries == nil {
+			deliveries = []model.WebhookDelivery{}
+		}
+		return deliveries, nil
+	}
+}
+
+func makeListSessionsEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		profileID := request.(string)
+		sessions, err := svc.ListSessions(ctx, profileID)
+		if err != nil {
+			return nil, err
+		}
+		if sessions == nil {
+			sessions = []model.Session{}
+		}
+		return sessions, nil
+	}
+}
+
+func makeRevokeSessionEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RevokeSessionRequest)
+		err := svc.RevokeSession(ctx, req.ProfileID, req.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeRevokeOtherSessionsEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		profileID := request.(string)
+		revoked, err := svc.RevokeOtherSessions(ctx, profileID)
+		if err != nil {
+			return nil, err
+		}
+		return model.RevokeSessionsResponse{Revoked: revoked}, nil
+	}
+}
+
+func makeGetPreferencesEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		profileID := request.(string)
+		preferences, err := svc.GetPreferences(ctx, profileID)
+		if err != nil {
+			return nil, err
+		}
+		return preferences, nil
+	}
+}
+
+func makeUpdatePreferencesEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(UpdatePreferencesRequest)
+		preferences, err := svc.UpdatePreferences(ctx, req.ProfileID, model.PreferencesUpdate{Set: req.Preferences, Unset: req.Unset})
+		if err != nil {
+			return nil, err
+		}
+		return preferences, nil
+	}
+}
+
+func makeSubscribeEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.SubscribeRequest)
+		if err := svc.Subscribe(ctx, req); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeConfirmSubscriptionEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.SubscriptionTokenRequest)
+		if err := svc.ConfirmSubscription(ctx, req); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeUnsubscribeEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(model.SubscriptionTokenRequest)
+		if err := svc.Unsubscribe(ctx, req); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+func makeExportSubscribersEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		subscribers, err := svc.ListSubscribers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return subscribers, nil
+	}
+}
+
+func makeImpersonateEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		profileID := request.(string)
+		resp, err := svc.Impersonate(ctx, profileID)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+func makeListAuditEventsEndpoint(svc service.Service) kitendpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		filter := request.(model.AuditEventFilter)
+		events, err := svc.ListAuditEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		if events == nil {
+			events = []model.AuditEvent{}
+		}
+		return events, nil
+	}
+}
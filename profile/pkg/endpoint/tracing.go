@@ -0,0 +1,32 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/ganis/okblog/profile/pkg/tracing"
+	kitendpoint "github.com/go-kit/kit/endpoint"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware starts a span for every endpoint call and records the
+// error it returns
+func TracingMiddleware(tp trace.TracerProvider) Middleware {
+	tracer := tp.Tracer(tracing.InstrumentationName)
+
+	return func(name string) kitendpoint.Middleware {
+		return func(next kitendpoint.Endpoint) kitendpoint.Endpoint {
+			return func(ctx context.Context, request interface{}) (interface{}, error) {
+				ctx, span := tracer.Start(ctx, "endpoint "+name)
+				defer span.End()
+
+				response, err := next(ctx, request)
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+				}
+				return response, err
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// bulkRequestTimeout bounds a single _bulk request
+const bulkRequestTimeout = 10 * time.Second
+
+// maxRetryBackoff caps the exponential backoff between retries
+const maxRetryBackoff = 30 * time.Second
+
+// bulkItem is a marshaled log entry and the index it goes to
+type bulkItem struct {
+	index string
+	doc   []byte
+}
+
+// bulkResponse is the part of the _bulk response needed to find failed items
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// run ships queued entries until Shutdown is called. A batch is sent when it is
+// full or FlushInterval after the last flush, whichever comes first.
+func (l *KibanaLogger) run() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]bulkItem, 0, l.config.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			l.ship(batch)
+			batch = make([]bulkItem, 0, l.config.BatchSize)
+		}
+	}
+
+	for {
+		select {
+		case item := <-l.queue:
+			batch = append(batch, item)
+			if len(batch) >= l.config.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-l.closing:
+			// Ship whatever is still queued
+			for {
+				select {
+				case item := <-l.queue:
+					batch = append(batch, item)
+					if len(batch) >= l.config.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// ship sends a batch, retrying with exponential backoff the items that failed
+// for a reason that may go away (rejections and server errors). Once Shutdown
+// is called retries are sent without waiting, and once it gives up the batch
+// is dropped.
+func (l *KibanaLogger) ship(batch []bulkItem) {
+	backoff := l.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if l.ctx.Err() != nil {
+			l.dropped.Add(uint64(len(batch)))
+			return
+		}
+
+		retry, err := l.sendBulk(batch)
+		if err == nil && len(retry) == 0 {
+			return
+		}
+		if err == nil {
+			batch = retry
+		}
+
+		if attempt >= l.config.MaxRetries {
+			level.Error(l.stdLogger).Log("msg", "Failed to ship logs to Elasticsearch", "entries", len(batch), "attempts", attempt+1, "err", err)
+			l.dropped.Add(uint64(len(batch)))
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-l.closing:
+			timer.Stop()
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// sendBulk sends one _bulk request. It returns the items worth retrying, or
+// an error if the whole request failed.
+func (l *KibanaLogger) sendBulk(batch []bulkItem) ([]bulkItem, error) {
+	var body bytes.Buffer
+	for _, item := range batch {
+		meta, _ := json.Marshal(map[string]map[string]string{"index": {"_index": item.index}})
+		body.Write(meta)
+		body.WriteByte('\n')
+		body.Write(item.doc)
+		body.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(l.ctx, bulkRequestTimeout)
+	defer cancel()
+
+	res, err := l.esClient.Bulk(bytes.NewReader(body.Bytes()), l.esClient.Bulk.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("elasticsearch responded with %s", res.Status())
+	}
+
+	var parsed bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("decode bulk response: %w", err)
+	}
+	if !parsed.Errors {
+		return nil, nil
+	}
+
+	var retry []bulkItem
+	var rejected int
+	for i, result := range parsed.Items {
+		if i >= len(batch) {
+			break
+		}
+		for _, item := range result {
+			switch {
+			case item.Status < http.StatusMultipleChoices:
+			case item.Status == http.StatusTooManyRequests || item.Status >= http.StatusInternalServerError:
+				retry = append(retry, batch[i])
+			default:
+				rejected++
+				level.Error(l.stdLogger).Log("msg", "Elasticsearch rejected log entry", "status", item.Status, "type", item.Error.Type, "reason", item.Error.Reason)
+			}
+		}
+	}
+	l.dropped.Add(uint64(rejected))
+
+	return retry, nil
+}
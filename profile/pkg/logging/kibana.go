@@ -1,25 +1,45 @@
 package logging
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/google/uuid"
 )
 
-// KibanaLogger implements logging to Elasticsearch for Kibana visualization
+// What Log does when the queue is full
+const (
+	// OverflowDrop discards the entry, so logging never slows down requests
+	OverflowDrop = "drop"
+	// OverflowBlock waits for room in the queue, so no entry is lost
+	OverflowBlock = "block"
+)
+
+// KibanaLogger implements logging to Elasticsearch for Kibana visualization.
+// Entries are queued and shipped in batches with the _bulk API by a single
+// worker; Shutdown flushes what's left.
 type KibanaLogger struct {
 	esClient    *elasticsearch.Client
 	indexName   string
 	serviceName string
 	stdLogger   log.Logger
+	config      Config
+
+	queue     chan bulkItem
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   atomic.Uint64
+
+	// ctx is canceled when Shutdown gives up, to abort the request in flight
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // LogEntry represents a log entry for Elasticsearch
@@ -33,6 +53,13 @@ type LogEntry struct {
 
 // NewKibanaLogger creates a new logger that sends logs to Elasticsearch for Kibana
 func NewKibanaLogger(config Config, fallbackLogger log.Logger) (*KibanaLogger, error) {
+	if config.QueueSize <= 0 || config.BatchSize <= 0 || config.FlushInterval <= 0 {
+		return nil, fmt.Errorf("queue size, batch size and flush interval must be positive")
+	}
+	if config.OverflowPolicy != OverflowDrop && config.OverflowPolicy != OverflowBlock {
+		return nil, fmt.Errorf("unsupported overflow policy %q", config.OverflowPolicy)
+	}
+
 	cfg := elasticsearch.Config{
 		Addresses: []string{config.ElasticsearchURL},
 		Username:  config.Username,
@@ -54,12 +81,20 @@ func NewKibanaLogger(config Config, fallbackLogger log.Logger) (*KibanaLogger, e
 
 	level.Info(fallbackLogger).Log("msg", "Connected to Elasticsearch successfully")
 
-	return &KibanaLogger{
+	l := &KibanaLogger{
 		esClient:    client,
 		indexName:   config.IndexName,
 		serviceName: config.ServiceName,
 		stdLogger:   fallbackLogger,
-	}, nil
+		config:      config,
+		queue:       make(chan bulkItem, config.QueueSize),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	go l.run()
+
+	return l, nil
 }
 
 // Config holds the configuration for the Kibana logger
@@ -69,26 +104,33 @@ type Config struct {
 	ServiceName      string
 	Username         string
 	Password         string
+
+	// QueueSize is the number of entries waiting to be shipped
+	QueueSize int
+	// BatchSize is the number of entries sent in one _bulk request
+	BatchSize int
+	// FlushInterval is the longest an entry waits for its batch to fill up
+	FlushInterval time.Duration
+	// OverflowPolicy is OverflowDrop or OverflowBlock
+	OverflowPolicy string
+	// MaxRetries is how often a failed batch is retried
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry; it doubles after each one
+	RetryBackoff time.Duration
 }
 
-// DefaultConfig returns a default configuration for the Kibana logger
-func DefaultConfig() Config {
-	return Config{
-		ElasticsearchURL: getEnv("ELASTICSEARCH_URL", "http://localhost:9200"),
-		IndexName:        getEnv("ELASTICSEARCH_INDEX", "profile-service-logs"),
-		ServiceName:      getEnv("SERVICE_NAME", "profile-service"),
-		Username:         getEnv("ELASTICSEARCH_USERNAME", ""),
-		Password:         getEnv("ELASTICSEARCH_PASSWORD", ""),
+// Ping checks that Elasticsearch is reachable, for readiness probes
+func (l *KibanaLogger) Ping(ctx context.Context) error {
+	res, err := l.esClient.Ping(l.esClient.Ping.WithContext(ctx))
+	if err != nil {
+		return err
 	}
-}
+	defer res.Body.Close()
 
-// getEnv gets an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+	if res.IsError() {
+		return fmt.Errorf("elasticsearch responded with %s", res.Status())
 	}
-	return value
+	return nil
 }
 
 // Log implements the log.Logger interface
@@ -100,8 +142,9 @@ func (l *KibanaLogger) Log(keyvals ...interface{}) error {
 	}
 
 	// Create a log entry for Elasticsearch
+	now := time.Now().UTC()
 	entry := LogEntry{
-		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Timestamp:   now.Format(time.RFC3339Nano),
 		ServiceName: l.serviceName,
 		Fields:      make(map[string]interface{}),
 	}
@@ -121,6 +164,10 @@ func (l *KibanaLogger) Log(keyvals ...interface{}) error {
 				continue
 			}
 
+			// Errors marshal to an empty object
+			if e, ok := val.(error); ok {
+				val = e.Error()
+			}
 			entry.Fields[key] = val
 		}
 	}
@@ -130,37 +177,70 @@ func (l *KibanaLogger) Log(keyvals ...interface{}) error {
 		entry.Level = "info"
 	}
 
-	// Send to Elasticsearch asynchronously
-	go func() {
-		fmt.Println("Sending log to Elasticsearch")
-		data, err := json.Marshal(entry)
-		if err != nil {
-			level.Error(l.stdLogger).Log("msg", "Failed to marshal log entry", "err", err)
-			return
-		}
+	// Marshal now, the values may change once Log returns
+	data, err := json.Marshal(entry)
+	if err != nil {
+		level.Error(l.stdLogger).Log("msg", "Failed to marshal log entry", "err", err)
+		return nil
+	}
+	l.enqueue(bulkItem{index: l.indexName + "-" + now.Format("2006.01.02"), doc: data})
 
-		// Generate a document ID
-		docID := uuid.New().String()
-
-		// Index the document
-		indexNameWithDate := l.indexName + "-" + time.Now().UTC().Format("2006.01.02")
-		res, err := l.esClient.Index(
-			indexNameWithDate,
-			bytes.NewReader(data),
-			l.esClient.Index.WithDocumentID(docID),
-			l.esClient.Index.WithContext(context.Background()),
-		)
-		if err != nil {
-			level.Error(l.stdLogger).Log("msg", "Failed to send log to Elasticsearch", "err", err)
-			return
-		}
-		defer res.Body.Close()
+	return nil
+}
 
-		if res.IsError() {
-			level.Error(l.stdLogger).Log("msg", "Error response from Elasticsearch", "status", res.Status())
-			return
+// enqueue hands an entry to the worker according to the overflow policy.
+// Entries logged after Shutdown are only written to the fallback logger.
+func (l *KibanaLogger) enqueue(item bulkItem) {
+	select {
+	case <-l.closing:
+		l.dropped.Add(1)
+		return
+	default:
+	}
+
+	if l.config.OverflowPolicy == OverflowBlock {
+		select {
+		case l.queue <- item:
+		case <-l.closing:
+			l.dropped.Add(1)
 		}
-	}()
+		return
+	}
 
-	return nil
+	select {
+	case l.queue <- item:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of entries that were not shipped because the
+// queue was full or the logger was closed
+func (l *KibanaLogger) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// Shutdown stops the worker after it has shipped the queued entries. Retries
+// no longer wait for their backoff. When ctx is done first, the request in
+// flight is aborted and the entries left are dropped and counted; Shutdown
+// then returns ctx.Err().
+func (l *KibanaLogger) Shutdown(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		close(l.closing)
+	})
+
+	var err error
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		l.cancel()
+		<-l.done
+		err = ctx.Err()
+	}
+	l.cancel()
+
+	if dropped := l.Dropped(); dropped > 0 {
+		level.Warn(l.stdLogger).Log("msg", "Log entries were not shipped to Elasticsearch", "dropped", dropped)
+	}
+	return err
 }
@@ -0,0 +1,292 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeElasticsearch records the documents of _bulk requests. respond decides
+// the answer to each bulk request; nil means every item succeeds.
+type fakeElasticsearch struct {
+	mu       sync.Mutex
+	requests int
+	docs     []string
+	respond  func(request int, w http.ResponseWriter) bool
+}
+
+func (f *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path != "/_bulk" {
+		w.Write([]byte(`{"version":{"number":"8.13.0"}}`))
+		return
+	}
+
+	f.mu.Lock()
+	f.requests++
+	request := f.requests
+	f.mu.Unlock()
+
+	if f.respond != nil && f.respond(request, w) {
+		return
+	}
+
+	var docs []string
+	scanner := bufio.NewScanner(r.Body)
+	for line := 0; scanner.Scan(); line++ {
+		// Every other line is the action metadata
+		if line%2 == 1 {
+			docs = append(docs, scanner.Text())
+		}
+	}
+
+	f.mu.Lock()
+	f.docs = append(f.docs, docs...)
+	f.mu.Unlock()
+	w.Write([]byte(`{"errors":false,"items":[]}`))
+}
+
+func (f *fakeElasticsearch) stats() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests, append([]string(nil), f.docs...)
+}
+
+func testConfig(url string) Config {
+	return Config{
+		ElasticsearchURL: url,
+		IndexName:        "profile-test",
+		ServiceName:      "profile-test",
+		QueueSize:        100,
+		BatchSize:        2,
+		FlushInterval:    time.Hour,
+		OverflowPolicy:   OverflowDrop,
+		MaxRetries:       3,
+		RetryBackoff:     time.Millisecond,
+	}
+}
+
+func TestKibanaLogger_BatchesAndFlushesOnShutdown(t *testing.T) {
+	es := &fakeElasticsearch{}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	logger, err := NewKibanaLogger(testConfig(server.URL), log.NewNopLogger())
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		logger.Log("level", "info", "msg", "hello", "i", i)
+	}
+
+	// Two full batches are sent without waiting for the flush interval
+	assert.Eventually(t, func() bool {
+		requests, _ := es.stats()
+		return requests == 2
+	}, time.Second, time.Millisecond)
+
+	// Shutdown ships the last entry
+	require.NoError(t, logger.Shutdown(context.Background()))
+	requests, docs := es.stats()
+	assert.Equal(t, 3, requests)
+	assert.Len(t, docs, 5)
+	assert.Contains(t, docs[0], `"message":"hello"`)
+	assert.Contains(t, docs[0], `"level":"info"`)
+	assert.Equal(t, uint64(0), logger.Dropped())
+}
+
+func TestKibanaLogger_FlushesOnInterval(t *testing.T) {
+	es := &fakeElasticsearch{}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	config := testConfig(server.URL)
+	config.BatchSize = 100
+	config.FlushInterval = 10 * time.Millisecond
+	logger, err := NewKibanaLogger(config, log.NewNopLogger())
+	require.NoError(t, err)
+	defer logger.Shutdown(context.Background())
+
+	logger.Log("msg", "hello")
+
+	assert.Eventually(t, func() bool {
+		_, docs := es.stats()
+		return len(docs) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestKibanaLogger_RetriesFailedRequests(t *testing.T) {
+	es := &fakeElasticsearch{respond: func(request int, w http.ResponseWriter) bool {
+		switch request {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		case 2:
+			// The whole request succeeds, but the item is rejected for now
+			w.Write([]byte(`{"errors":true,"items":[{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}}]}`))
+			return true
+		}
+		return false
+	}}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	config := testConfig(server.URL)
+	config.BatchSize = 1
+	logger, err := NewKibanaLogger(config, log.NewNopLogger())
+	require.NoError(t, err)
+
+	logger.Log("msg", "hello")
+	require.NoError(t, logger.Shutdown(context.Background()))
+
+	requests, docs := es.stats()
+	assert.Equal(t, 3, requests)
+	assert.Len(t, docs, 1)
+	assert.Equal(t, uint64(0), logger.Dropped())
+}
+
+func TestKibanaLogger_GivesUpAfterMaxRetries(t *testing.T) {
+	es := &fakeElasticsearch{respond: func(_ int, w http.ResponseWriter) bool {
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	config := testConfig(server.URL)
+	config.BatchSize = 1
+	config.MaxRetries = 2
+	logger, err := NewKibanaLogger(config, log.NewNopLogger())
+	require.NoError(t, err)
+
+	logger.Log("msg", "hello")
+	require.NoError(t, logger.Shutdown(context.Background()))
+
+	requests, _ := es.stats()
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, uint64(1), logger.Dropped())
+}
+
+func TestKibanaLogger_ShutdownSkipsBackoff(t *testing.T) {
+	es := &fakeElasticsearch{respond: func(request int, w http.ResponseWriter) bool {
+		if request == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return true
+		}
+		return false
+	}}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	config := testConfig(server.URL)
+	config.BatchSize = 1
+	config.RetryBackoff = time.Hour
+	logger, err := NewKibanaLogger(config, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// The worker waits an hour to retry, Shutdown retries at once
+	logger.Log("msg", "hello")
+	assert.Eventually(t, func() bool {
+		requests, _ := es.stats()
+		return requests == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, logger.Shutdown(ctx))
+
+	_, docs := es.stats()
+	assert.Len(t, docs, 1)
+	assert.Equal(t, uint64(0), logger.Dropped())
+}
+
+func TestKibanaLogger_ShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	es := &fakeElasticsearch{respond: func(_ int, _ http.ResponseWriter) bool {
+		<-release
+		return false
+	}}
+	server := httptest.NewServer(es)
+	defer server.Close()
+	defer close(release)
+
+	config := testConfig(server.URL)
+	config.BatchSize = 1
+	logger, err := NewKibanaLogger(config, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// The first entry hangs in a request, the others wait in the queue
+	logger.Log("msg", "first")
+	assert.Eventually(t, func() bool {
+		requests, _ := es.stats()
+		return requests == 1
+	}, time.Second, time.Millisecond)
+	logger.Log("msg", "second")
+	logger.Log("msg", "third")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, logger.Shutdown(ctx), context.DeadlineExceeded)
+
+	requests, docs := es.stats()
+	assert.Equal(t, 1, requests)
+	assert.Empty(t, docs)
+	assert.Equal(t, uint64(3), logger.Dropped())
+}
+
+func TestKibanaLogger_DropsWhenQueueIsFull(t *testing.T) {
+	release := make(chan struct{})
+	es := &fakeElasticsearch{}
+	es.respond = func(_ int, _ http.ResponseWriter) bool {
+		<-release
+		return false
+	}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	config := testConfig(server.URL)
+	config.QueueSize = 1
+	config.BatchSize = 1
+	logger, err := NewKibanaLogger(config, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// The worker takes the first entry and waits on Elasticsearch
+	logger.Log("msg", "first")
+	assert.Eventually(t, func() bool {
+		requests, _ := es.stats()
+		return requests == 1
+	}, time.Second, time.Millisecond)
+
+	// The second fills the queue, the third is dropped without blocking
+	logger.Log("msg", "second")
+	logger.Log("msg", "third")
+	assert.Equal(t, uint64(1), logger.Dropped())
+
+	close(release)
+	require.NoError(t, logger.Shutdown(context.Background()))
+	_, docs := es.stats()
+	assert.Len(t, docs, 2)
+
+	// Entries logged after Shutdown are not shipped
+	logger.Log("msg", "late")
+	assert.Equal(t, uint64(2), logger.Dropped())
+}
+
+func TestKibanaLogger_RejectsInvalidConfig(t *testing.T) {
+	config := testConfig("http://localhost:9200")
+	config.OverflowPolicy = "maybe"
+
+	_, err := NewKibanaLogger(config, log.NewNopLogger())
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "overflow policy"))
+}
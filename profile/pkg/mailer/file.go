@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileOutbox writes every message to its own .eml file in a directory
+// instead of sending it
+type FileOutbox struct {
+	dir  string
+	from string
+}
+
+// NewFileOutbox creates dir if needed and returns an outbox writing to it
+func NewFileOutbox(dir, from string) (*FileOutbox, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("outbox directory must be set")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create outbox: %w", err)
+	}
+	return &FileOutbox{dir: dir, from: from}, nil
+}
+
+// Send implements Mailer. Files are named by time, so they list in the
+// order they were sent.
+func (o *FileOutbox) Send(_ context.Context, msg Message) error {
+	now := time.Now()
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+
+	// Messages carry login links, keep them private
+	return os.WriteFile(filepath.Join(o.dir, name), format(msg, o.from, now), 0o600)
+}
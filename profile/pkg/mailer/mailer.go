@@ -0,0 +1,75 @@
+// Package mailer sends the emails of the profile service, such as magic
+// login links. The file outbox keeps messages on disk for local testing.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Drivers select the Mailer built by New
+const (
+	DriverFile = "file"
+	DriverSMTP = "smtp"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Config configures the mailer built by New
+type Config struct {
+	Driver string
+	From   string
+	// OutboxDir is where the file driver writes messages
+	OutboxDir string
+	SMTP      SMTPConfig
+}
+
+// New builds the mailer selected by config.Driver
+func New(config Config) (Mailer, error) {
+	if _, err := mail.ParseAddress(config.From); err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", config.From, err)
+	}
+
+	switch config.Driver {
+	case DriverFile:
+		return NewFileOutbox(config.OutboxDir, config.From)
+	case DriverSMTP:
+		return NewSMTP(config.SMTP, config.From)
+	default:
+		return nil, fmt.Errorf("unsupported mail driver %q", config.Driver)
+	}
+}
+
+// format renders msg as an RFC 5322 message
+func format(msg Message, from string, date time.Time) []byte {
+	var b bytes.Buffer
+	header := func(key, value string) {
+		// Header values must not break out of their line
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	header("From", from)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m, err := New(Config{Driver: DriverFile, From: "okblog <noreply@example.com>", OutboxDir: dir})
+	require.NoError(t, err)
+
+	for _, to := range []string{"first@example.com", "second@example.com"} {
+		require.NoError(t, m.Send(context.Background(), Message{To: to, Subject: "Your login link", Body: "Open\nhttps://example.com/login"}))
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "To: first@example.com\r\n")
+	assert.Contains(t, string(data), "\r\n\r\nOpen\r\nhttps://example.com/login")
+
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestFormat_HeaderInjection(t *testing.T) {
+	out := string(format(Message{To: "a@example.com\r\nBcc: evil@example.com", Subject: "Héllo"}, "noreply@example.com", time.Unix(0, 0)))
+
+	header, _, _ := strings.Cut(out, "\r\n\r\n")
+	assert.NotContains(t, header, "\r\nBcc:")
+	assert.Contains(t, header, "Subject: =?utf-8?q?H=C3=A9llo?=")
+}
+
+func TestNew_Invalid(t *testing.T) {
+	_, err := New(Config{Driver: "pigeon", From: "noreply@example.com"})
+	assert.ErrorContains(t, err, "unsupported mail driver")
+
+	_, err = New(Config{Driver: DriverFile, From: "not an address"})
+	assert.ErrorContains(t, err, "from address")
+
+	_, err = New(Config{Driver: DriverSMTP, From: "noreply@example.com"})
+	assert.ErrorContains(t, err, "smtp host")
+}
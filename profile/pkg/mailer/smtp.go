@@ -0,0 +1,61 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTPConfig configures the SMTP driver. Authentication is used when a
+// username is set; net/smtp only sends credentials over TLS or to localhost.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// SMTP sends messages through an SMTP server
+type SMTP struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTP returns a mailer sending through the configured server
+func NewSMTP(config SMTPConfig, from string) (*SMTP, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("smtp host must be set")
+	}
+	s := &SMTP{
+		addr: net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+		from: from,
+	}
+	if config.Username != "" {
+		s.auth = smtp.PlainAuth("", config.Username, config.Password, config.Host)
+	}
+	return s, nil
+}
+
+// Send implements Mailer. net/smtp doesn't take a context, so ctx is only
+// checked before connecting.
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	return smtp.SendMail(s.addr, s.auth, from.Address, []string{to.Address}, format(msg, s.from, time.Now()))
+}
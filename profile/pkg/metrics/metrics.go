@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	kitmetrics "github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes every metric of the profile service
+const Namespace = "okblog_profile"
+
+// hashBuckets cover password hashing, which is tuned to take tens to hundreds
+// of milliseconds
+var hashBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Metrics are the instruments of the profile service. They are go-kit metrics
+// so the service and transports don't depend on Prometheus.
+type Metrics struct {
+	// RequestDuration is labeled by method, route and status
+	RequestDuration kitmetrics.Histogram
+	// EndpointDuration is labeled by endpoint and success
+	EndpointDuration kitmetrics.Histogram
+	// EndpointErrors is labeled by endpoint
+	EndpointErrors kitmetrics.Counter
+	// Logins is labeled by result
+	Logins kitmetrics.Counter
+	// PasswordHashDuration is labeled by operation and algorithm
+	PasswordHashDuration kitmetrics.Histogram
+	// CacheRequests is labeled by cache and result (hit or miss)
+	CacheRequests kitmetrics.Counter
+}
+
+// New creates the instruments and registers them with reg
+func New(reg prometheus.Registerer) *Metrics {
+	requestDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	endpointDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "endpoint",
+		Name:      "duration_seconds",
+		Help:      "Duration of go-kit endpoint calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "success"})
+
+	endpointErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "endpoint",
+		Name:      "errors_total",
+		Help:      "Number of go-kit endpoint calls that returned an error.",
+	}, []string{"endpoint"})
+
+	logins := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts by result (success, failure, error).",
+	}, []string{"result"})
+
+	hashDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Subsystem: "password",
+		Name:      "hash_duration_seconds",
+		Help:      "Time spent hashing and verifying passwords.",
+		Buckets:   hashBuckets,
+	}, []string{"operation", "algorithm"})
+
+	cacheRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Number of repository cache lookups by cache and result (hit, miss).",
+	}, []string{"cache", "result"})
+
+	reg.MustRegister(requestDuration, endpointDuration, endpointErrors, logins, hashDuration, cacheRequests)
+
+	return &Metrics{
+		RequestDuration:      kitprometheus.NewHistogram(requestDuration),
+		EndpointDuration:     kitprometheus.NewHistogram(endpointDuration),
+		EndpointErrors:       kitprometheus.NewCounter(endpointErrors),
+		Logins:               kitprometheus.NewCounter(logins),
+		PasswordHashDuration: kitprometheus.NewHistogram(hashDuration),
+		CacheRequests:        kitprometheus.NewCounter(cacheRequests),
+	}
+}
+
+// NewRegistry returns a registry with the Go runtime and process collectors
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// RegisterDBStats exports the connection pool statistics of db
+func RegisterDBStats(reg prometheus.Registerer, db *sql.DB, name string) error {
+	return reg.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// Handler serves the metrics gathered by reg in the Prometheus text format
+func Handler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg})
+}
@@ -0,0 +1,54 @@
+package model
+
+import "time"
+
+// Actions recorded in the audit trail
+const (
+	AuditImpersonationStarted = "impersonation.started"
+	AuditProfileCreated       = "profile.created"
+	AuditProfileUpdated       = "profile.updated"
+	AuditProfileDeleted       = "profile.deleted"
+	AuditPasswordReset        = "profile.password_reset"
+	AuditRoleChanged          = "profile.role_changed"
+	AuditProfileLocked        = "profile.locked"
+	AuditProfileUnlocked      = "profile.unlocked"
+	AuditInvitationCreated    = "invitation.created"
+	AuditInvitationRevoked    = "invitation.revoked"
+	AuditSessionRevoked       = "session.revoked"
+	AuditSessionsRevoked      = "sessions.revoked"
+	AuditPreferencesUpdated   = "preferences.updated"
+	AuditWebhookCreated       = "webhook.created"
+	AuditWebhookDeleted       = "webhook.deleted"
+)
+
+// AuditEvent is an entry of the audit trail: an admin starting to
+// impersonate a profile, or a change the admin made while impersonating it
+type AuditEvent struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	// ProfileID is the impersonated profile, the action was made as it
+	ProfileID string `json:"profileId"`
+	// ActorID is the admin who really made the action
+	ActorID string `json:"actorId"`
+	// Target is the ID of what the action changed
+	Target    string    `json:"target,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AuditEventFilter selects entries of the audit trail. Empty fields match
+// every entry.
+type AuditEventFilter struct {
+	ProfileID string
+	ActorID   string
+	Limit     int
+}
+
+// ImpersonationResponse represents the response to starting an
+// impersonation
+type ImpersonationResponse struct {
+	Profile   *Profile  `json:"profile"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
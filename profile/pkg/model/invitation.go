@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Invitation lets someone register with the given email and role. The code
+// is only returned when the invitation is created; the database keeps a hash.
+type Invitation struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Role      string     `json:"role"`
+	Code      string     `json:"code,omitempty"`
+	CodeHash  string     `json:"-"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+	UsedBy    string     `json:"usedBy,omitempty"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Pending reports whether the invitation can still be used at now
+func (i Invitation) Pending(now time.Time) bool {
+	return i.UsedAt == nil && i.RevokedAt == nil && now.Before(i.ExpiresAt)
+}
+
+// CreateInvitationRequest represents the request to invite someone
+type CreateInvitationRequest struct {
+	Email string `json:"email"`
+	// Role defaults to RoleUser
+	Role string `json:"role,omitempty"`
+	// ExpiresAt defaults to the configured invitation lifetime
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// MagicLink is a one-time login link sent by email. The database keeps
+// hashes of its token and of the fingerprint of the client that asked for it.
+type MagicLink struct {
+	ID              string
+	ProfileID       string
+	TokenHash       string
+	FingerprintHash string
+	CreatedAt       time.Time
+	ExpiresAt       time.Time
+	UsedAt          *time.Time
+}
+
+// MagicLinkRequest represents the request to email a login link
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+	// Fingerprint is an optional secret kept by the client, e.g. in session
+	// storage, that must be sent again to redeem the link
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// RedeemMagicLinkRequest represents the request to log in with a link
+type RedeemMagicLinkRequest struct {
+	Token       string `json:"token"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
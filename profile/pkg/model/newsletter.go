@@ -0,0 +1,60 @@
+package model
+
+import "time"
+
+// Subscriber statuses, as exported to CSV
+const (
+	SubscriberPending      = "pending"
+	SubscriberActive       = "active"
+	SubscriberUnsubscribed = "unsubscribed"
+)
+
+// Subscriber is a reader who follows the blog by email. Subscribers have no
+// profile: they only receive the new post digest once they have confirmed
+// their address. The database keeps a hash of the confirmation token.
+type Subscriber struct {
+	ID               string    `json:"id"`
+	Email            string    `json:"email"`
+	ConfirmTokenHash string    `json:"-"`
+	ConfirmExpiresAt time.Time `json:"-"`
+	// UnsubscribeToken is sent in every digest, so it is stored as is. It
+	// can't do anything but unsubscribe.
+	UnsubscribeToken string     `json:"-"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ConfirmedAt      *time.Time `json:"confirmedAt,omitempty"`
+	UnsubscribedAt   *time.Time `json:"unsubscribedAt,omitempty"`
+}
+
+// Status returns SubscriberPending, SubscriberActive or SubscriberUnsubscribed
+func (s Subscriber) Status() string {
+	switch {
+	case s.UnsubscribedAt != nil:
+		return SubscriberUnsubscribed
+	case s.ConfirmedAt != nil:
+		return SubscriberActive
+	default:
+		return SubscriberPending
+	}
+}
+
+// SubscribeRequest represents the request to follow the blog by email
+type SubscribeRequest struct {
+	Email string `json:"email"`
+}
+
+// SubscriptionTokenRequest carries the token of a confirmation or
+// unsubscribe link
+type SubscriptionTokenRequest struct {
+	Token string `json:"token"`
+}
+
+// NewsletterPost is a published post waiting for, or included in, a digest
+type NewsletterPost struct {
+	ID          string
+	Title       string
+	Slug        string
+	Excerpt     string
+	PublishedAt time.Time
+	QueuedAt    time.Time
+	SentAt      *time.Time
+}
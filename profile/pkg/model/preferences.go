@@ -0,0 +1,49 @@
+package model
+
+// Editor modes of the admin app
+const (
+	EditorMarkdown = "markdown"
+	EditorRichText = "rich-text"
+)
+
+// Themes of the admin app
+const (
+	ThemeLight  = "light"
+	ThemeDark   = "dark"
+	ThemeSystem = "system"
+)
+
+// Preferences are the settings of a profile that follow the author across
+// devices. Unset fields are left to the clients' defaults.
+type Preferences struct {
+	// Locale is a BCP 47 language tag such as en or pt-BR
+	Locale string `json:"locale,omitempty"`
+	// Timezone is an IANA time zone such as Europe/Paris
+	Timezone      string                   `json:"timezone,omitempty"`
+	Editor        *EditorPreferences       `json:"editor,omitempty"`
+	Notifications *NotificationPreferences `json:"notifications,omitempty"`
+}
+
+// EditorPreferences configure the post editor of the admin app
+type EditorPreferences struct {
+	Mode       string `json:"mode,omitempty"`
+	Theme      string `json:"theme,omitempty"`
+	FontSize   int    `json:"fontSize,omitempty"`
+	SpellCheck *bool  `json:"spellCheck,omitempty"`
+	Autosave   *bool  `json:"autosave,omitempty"`
+}
+
+// NotificationPreferences choose what the author is told about
+type NotificationPreferences struct {
+	// Email turns every notification email on or off
+	Email          *bool `json:"email,omitempty"`
+	NewDeviceLogin *bool `json:"newDeviceLogin,omitempty"`
+}
+
+// PreferencesUpdate changes some of the preferences of a profile. The fields
+// set in Set replace the stored ones; the fields named in Unset, by their
+// JSON path such as "locale" or "editor.fontSize", are cleared.
+type PreferencesUpdate struct {
+	Set   Preferences
+	Unset []string
+}
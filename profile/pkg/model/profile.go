@@ -2,6 +2,12 @@ package model
 
 import "time"
 
+// Roles a profile can have. Admins manage invitations.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // Profile represents a user profile
 type Profile struct {
 	ID        string    `json:"id"`
@@ -11,8 +17,16 @@ type Profile struct {
 	FirstName string    `json:"firstName"`
 	LastName  string    `json:"lastName"`
 	Bio       string    `json:"bio"`
+	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
+	// LockedAt is set while an admin has locked the account, which blocks logins
+	LockedAt *time.Time `json:"lockedAt,omitempty"`
+}
+
+// Locked reports whether the account is locked
+func (p Profile) Locked() bool {
+	return p.LockedAt != nil
 }
 
 // RegisterProfileRequest represents the request to register a new profile
@@ -23,6 +37,21 @@ type RegisterProfileRequest struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Bio       string `json:"bio"`
+	// InvitationCode is required unless registration is open or no profile exists yet
+	InvitationCode string `json:"invitationCode,omitempty"`
+}
+
+// CreateProfileRequest represents an admin creating a profile directly,
+// without an invitation
+type CreateProfileRequest struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Bio       string `json:"bio"`
+	// Role defaults to RoleUser
+	Role string `json:"role,omitempty"`
 }
 
 // LoginRequest represents the credentials needed for login
@@ -41,8 +70,28 @@ type LoginResponse struct {
 type TokenClaims struct {
 	UserID    string    `json:"userId"`
 	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	SessionID string    `json:"sessionId,omitempty"`
 	IssuedAt  time.Time `json:"issuedAt"`
 	ExpiresAt time.Time `json:"expiresAt"`
+	// Locale and Timezone are the preferences of the profile when the token
+	// was issued
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+	// Actor is the admin behind an impersonation token, nil otherwise
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies the admin who really makes the requests of an
+// impersonation token
+type Actor struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// Impersonated reports whether the claims belong to an impersonation token
+func (c *TokenClaims) Impersonated() bool {
+	return c != nil && c.Actor != nil
 }
 
 // TokenValidationRequest represents the request to validate a token
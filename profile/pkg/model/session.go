@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// Session is a login of a profile on a device. Tokens carry the session ID,
+// so revoking the session invalidates its token.
+type Session struct {
+	ID         string     `json:"id"`
+	ProfileID  string     `json:"profileId"`
+	UserAgent  string     `json:"userAgent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	// ImpersonatorID is the admin who started the session to impersonate
+	// the profile
+	ImpersonatorID string `json:"impersonatorId,omitempty"`
+	// Current marks the session of the token making the request
+	Current bool `json:"current"`
+}
+
+// Active reports whether the session can still be used at now
+func (s Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// ClientInfo describes the client making a request, as far as the transport
+// can tell
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// RevokeSessionsResponse represents the response to revoking the other
+// sessions of a profile
+type RevokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
+}
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+// AuthorStats counts the posts of a profile. The profile service learns
+// about posts from the post service's change stream, so the counts can lag
+// behind the post service by a few seconds.
+type AuthorStats struct {
+	ProfileID      string `json:"profileId"`
+	PublishedCount int    `json:"publishedCount"`
+	DraftCount     int    `json:"draftCount"`
+	// TotalViews adds up the views of every post, drafts included
+	TotalViews      int64      `json:"totalViews"`
+	LastPublishedAt *time.Time `json:"lastPublishedAt,omitempty"`
+}
+
+// AuthorPost is the last known state of a post, from which AuthorStats are
+// computed. Only posts are kept, not pages.
+type AuthorPost struct {
+	ID          string
+	ProfileID   string
+	IsPublished bool
+	ViewCount   int64
+	PublishedAt *time.Time
+	// Deleted posts are kept so a change replayed after the delete can't
+	// bring them back
+	Deleted bool
+	// Version orders the changes of a post. A state is only stored over one
+	// with the same or a lower version, which makes replays harmless.
+	Version int64
+}
@@ -0,0 +1,95 @@
+package model
+
+import "time"
+
+// Webhook events
+const (
+	EventProfileCreated = "profile.created"
+	// EventNewDeviceLogin is a login from a user agent none of the active
+	// sessions of the profile has
+	EventNewDeviceLogin = "profile.new_device_login"
+	EventProfileDeleted = "profile.deleted"
+)
+
+// WebhookEvents lists the events a webhook can subscribe to
+var WebhookEvents = []string{EventProfileCreated, EventNewDeviceLogin, EventProfileDeleted}
+
+// Webhook is a URL that receives the events it subscribed to. The secret
+// signs every delivery; it is only returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Subscribed reports whether the webhook receives event
+func (w Webhook) Subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateWebhookRequest represents the request to add a webhook
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed deliveries ran out of attempts
+	DeliveryFailed = "failed"
+)
+
+// WebhookDelivery is an event on its way to one webhook, and the log of the
+// attempts at delivering it
+type WebhookDelivery struct {
+	ID        string `json:"id"`
+	WebhookID string `json:"webhookId"`
+	Event     string `json:"event"`
+	// Payload is the JSON body, sent unchanged on every attempt
+	Payload  string `json:"-"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// ResponseStatus and LastError describe the last attempt. The status is
+	// zero when no response arrived.
+	ResponseStatus int        `json:"responseStatus,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	NextAttemptAt  time.Time  `json:"nextAttemptAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// WebhookEvent is the body of a delivery
+type WebhookEvent struct {
+	// ID identifies the event. Its deliveries to different webhooks share it.
+	ID        string         `json:"id"`
+	Type      string         `json:"type"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Profile   WebhookProfile `json:"profile"`
+	// Device is set for EventNewDeviceLogin
+	Device *WebhookDevice `json:"device,omitempty"`
+}
+
+// WebhookProfile is the profile an event is about. Emails are left out,
+// receivers such as chat channels don't need them.
+type WebhookProfile struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// WebhookDevice is the client of a login
+type WebhookDevice struct {
+	SessionID string `json:"sessionId"`
+	UserAgent string `json:"userAgent"`
+	IP        string `json:"ip"`
+}
@@ -0,0 +1,174 @@
+package posts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/segmentio/kafka-go"
+)
+
+// DefaultTopic is where Debezium publishes the changes of the posts table
+const DefaultTopic = "post-db.okblog.posts"
+
+// Backoff between two attempts at fetching or handling a message
+const (
+	minRetryBackoff = time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// ConsumerConfig configures a Consumer
+type ConsumerConfig struct {
+	Brokers []string
+	Topic   string
+	// GroupID is the consumer group. Offsets are committed for the group,
+	// so a restart resumes after the last handled change.
+	GroupID string
+}
+
+// reader is the part of kafka.Reader a Consumer uses
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Consumer reads the posts topic and hands every change to a Handler, one
+// at a time and in order. A message is committed once it was handled, so a
+// change is delivered at least once.
+type Consumer struct {
+	reader     reader
+	handler    Handler
+	logger     log.Logger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// NewConsumer creates a consumer of config.Topic. Run starts reading.
+func NewConsumer(config ConsumerConfig, handler Handler, logger log.Logger) (*Consumer, error) {
+	if len(config.Brokers) == 0 {
+		return nil, errors.New("at least one Kafka broker must be set")
+	}
+	if config.Topic == "" {
+		config.Topic = DefaultTopic
+	}
+	if config.GroupID == "" {
+		return nil, errors.New("consumer group must be set")
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  config.Brokers,
+		Topic:    config.Topic,
+		GroupID:  config.GroupID,
+		MinBytes: 1,
+		MaxBytes: 10e6, // 10MB
+		MaxWait:  time.Second,
+	})
+	return newConsumer(r, handler, log.With(logger, "topic", config.Topic)), nil
+}
+
+func newConsumer(r reader, handler Handler, logger log.Logger) *Consumer {
+	return &Consumer{
+		reader:     r,
+		handler:    handler,
+		logger:     logger,
+		minBackoff: minRetryBackoff,
+		maxBackoff: maxRetryBackoff,
+	}
+}
+
+// Run handles messages until ctx is canceled. A change the handler fails on
+// is retried with backoff rather than skipped, so nothing is lost while a
+// dependency is down. Messages that can't be decoded are logged and
+// committed, retrying would never fix them.
+func (c *Consumer) Run(ctx context.Context) error {
+	fetchBackoff := c.minBackoff
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Failed to fetch post change", "err", err)
+			if !c.sleep(ctx, &fetchBackoff) {
+				return nil
+			}
+			continue
+		}
+		fetchBackoff = c.minBackoff
+
+		if !c.handle(ctx, msg) {
+			return nil
+		}
+		if err := c.reader.CommitMessages(ctx, msg); err != nil && ctx.Err() == nil {
+			// The change is handled again after a restart, handlers
+			// are idempotent
+			level.Error(c.logger).Log("msg", "Failed to commit post change", "partition", msg.Partition, "offset", msg.Offset, "err", err)
+		}
+	}
+}
+
+// handle decodes msg and calls the handler until it succeeds. It returns
+// false when ctx was canceled first.
+func (c *Consumer) handle(ctx context.Context, msg kafka.Message) bool {
+	change, err := Decode(msg.Value)
+	if errors.Is(err, ErrTombstone) {
+		return true
+	}
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "Skipping undecodable post change", "partition", msg.Partition, "offset", msg.Offset, "err", err)
+		return true
+	}
+
+	backoff := c.minBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.handler.Handle(ctx, *change)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		level.Error(c.logger).Log("msg", "Failed to handle post change", "op", change.Op, "post", postID(change), "attempt", attempt, "err", err)
+		if !c.sleep(ctx, &backoff) {
+			return false
+		}
+	}
+}
+
+// sleep waits for backoff and doubles it up to maxBackoff. It returns false
+// when ctx was canceled first.
+func (c *Consumer) sleep(ctx context.Context, backoff *time.Duration) bool {
+	timer := time.NewTimer(*backoff)
+	defer timer.Stop()
+
+	*backoff *= 2
+	if *backoff > c.maxBackoff {
+		*backoff = c.maxBackoff
+	}
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close closes the connection to Kafka. Run must have returned.
+func (c *Consumer) Close() error {
+	if err := c.reader.Close(); err != nil {
+		return fmt.Errorf("close posts consumer: %w", err)
+	}
+	return nil
+}
+
+func postID(change *Change) string {
+	if change.After != nil {
+		return change.After.ID
+	}
+	return change.Before.ID
+}
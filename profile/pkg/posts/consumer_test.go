@@ -0,0 +1,160 @@
+package posts
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReader serves messages in order, then blocks until the context is
+// canceled
+type fakeReader struct {
+	mu        sync.Mutex
+	messages  []kafka.Message
+	fetchErrs []error
+	committed []int64
+	closed    bool
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.fetchErrs) > 0 {
+		err := r.fetchErrs[0]
+		r.fetchErrs = r.fetchErrs[1:]
+		r.mu.Unlock()
+		return kafka.Message{}, err
+	}
+	if len(r.messages) > 0 {
+		msg := r.messages[0]
+		r.messages = r.messages[1:]
+		r.mu.Unlock()
+		return msg, nil
+	}
+	r.mu.Unlock()
+
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range msgs {
+		r.committed = append(r.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func (r *fakeReader) commits() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64{}, r.committed...)
+}
+
+func newTestConsumer(r reader, handler Handler) *Consumer {
+	c := newConsumer(r, handler, log.NewNopLogger())
+	c.minBackoff = time.Millisecond
+	c.maxBackoff = 4 * time.Millisecond
+	return c
+}
+
+// runUntil runs c until done returns true
+func runUntil(t *testing.T, c *Consumer, done func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- c.Run(ctx) }()
+
+	require.Eventually(t, done, time.Second, time.Millisecond)
+	cancel()
+	assert.NoError(t, <-stopped)
+}
+
+func TestConsumer_Run(t *testing.T) {
+	r := &fakeReader{
+		fetchErrs: []error{errors.New("broker not available")},
+		messages: []kafka.Message{
+			{Offset: 1, Value: []byte(message)},
+			{Offset: 2, Value: nil},
+			{Offset: 3, Value: []byte(`{`)},
+			{Offset: 4, Value: []byte(`{"payload": {"op": "d", "before": {"id": "0f8fad5b-d9cb-469f-a165-70867728950e"}}}`)},
+		},
+	}
+
+	var mu sync.Mutex
+	var ops []string
+	c := newTestConsumer(r, HandlerFunc(func(_ context.Context, change Change) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ops = append(ops, change.Op)
+		return nil
+	}))
+
+	// Tombstones and undecodable messages are committed without reaching
+	// the handler
+	runUntil(t, c, func() bool { return len(r.commits()) == 4 })
+	assert.Equal(t, []int64{1, 2, 3, 4}, r.commits())
+	assert.Equal(t, []string{OpUpdate, OpDelete}, ops)
+
+	require.NoError(t, c.Close())
+	assert.True(t, r.closed)
+}
+
+func TestConsumer_RetriesHandler(t *testing.T) {
+	r := &fakeReader{messages: []kafka.Message{{Offset: 7, Value: []byte(message)}}}
+
+	var mu sync.Mutex
+	attempts := 0
+	c := newTestConsumer(r, HandlerFunc(func(context.Context, Change) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("database is down")
+		}
+		return nil
+	}))
+
+	runUntil(t, c, func() bool { return len(r.commits()) == 1 })
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []int64{7}, r.commits())
+}
+
+func TestConsumer_StopsWhileRetrying(t *testing.T) {
+	r := &fakeReader{messages: []kafka.Message{{Offset: 7, Value: []byte(message)}}}
+
+	var mu sync.Mutex
+	attempts := 0
+	c := newTestConsumer(r, HandlerFunc(func(context.Context, Change) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errors.New("database is down")
+	}))
+
+	runUntil(t, c, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts >= 3
+	})
+	assert.Empty(t, r.commits(), "a change that was never handled is not committed")
+}
+
+func TestNewConsumer_Validation(t *testing.T) {
+	_, err := NewConsumer(ConsumerConfig{GroupID: "profile-service"}, HandlerFunc(nil), log.NewNopLogger())
+	assert.Error(t, err)
+	_, err = NewConsumer(ConsumerConfig{Brokers: []string{"kafka:9092"}}, HandlerFunc(nil), log.NewNopLogger())
+	assert.Error(t, err)
+}
@@ -0,0 +1,250 @@
+// Package posts reads the changes of the post service's posts table, as
+// published by Debezium on Kafka, so the profile service can react to new
+// posts without calling the post service.
+package posts
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Debezium operations
+const (
+	OpCreate = "c"
+	OpUpdate = "u"
+	OpDelete = "d"
+	// OpRead is a row read by the initial snapshot of the table
+	OpRead = "r"
+)
+
+// Post types of the post service
+const (
+	TypePost = "POST"
+	TypePage = "PAGE"
+)
+
+// ErrTombstone is returned by Decode for the empty messages Debezium sends
+// after a delete so Kafka can compact the key away. They carry no change.
+var ErrTombstone = errors.New("tombstone message")
+
+// Post is a row of the posts table
+type Post struct {
+	ID          string
+	ProfileID   string
+	Type        string
+	Title       string
+	Slug        string
+	Excerpt     string
+	IsPublished bool
+	// PublishedAt is zero for posts that were never published
+	PublishedAt time.Time
+	ViewCount   int64
+}
+
+// Change is a single insert, update or delete of a post. Before is nil for
+// inserts and snapshot reads, After is nil for deletes.
+type Change struct {
+	Op     string
+	Before *Post
+	After  *Post
+	// Time is when Debezium processed the change
+	Time time.Time
+}
+
+// Published reports whether the change published a post: it is published
+// after the change and was not before. Snapshot reads don't count, they
+// replay posts that were published long ago.
+func (c Change) Published() bool {
+	if c.Op == OpRead || c.After == nil || !c.After.IsPublished {
+		return false
+	}
+	return c.Before == nil || !c.Before.IsPublished
+}
+
+// Handler processes the changes read by a Consumer. A change is handled
+// again when Handle fails, so it must be safe to repeat.
+type Handler interface {
+	Handle(ctx context.Context, change Change) error
+}
+
+// HandlerFunc adapts a function to Handler
+type HandlerFunc func(ctx context.Context, change Change) error
+
+// Handle implements Handler
+func (f HandlerFunc) Handle(ctx context.Context, change Change) error {
+	return f(ctx, change)
+}
+
+// Handlers combines handlers into one that calls them in order, so a single
+// Consumer can feed several features. It stops at the first error, and the
+// change is then handled again by every handler.
+func Handlers(handlers ...Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, change Change) error {
+		for _, h := range handlers {
+			if err := h.Handle(ctx, change); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// envelope is a Debezium message. The schema is left out when the connector
+// runs with schemas disabled, and the payload is then the message itself.
+type envelope struct {
+	Payload json.RawMessage `json:"payload"`
+}
+
+type payload struct {
+	Op     string `json:"op"`
+	Before *row   `json:"before"`
+	After  *row   `json:"after"`
+	TsMs   int64  `json:"ts_ms"`
+}
+
+// row is a post as the MySQL connector writes it. UUID columns are
+// BINARY(16) and arrive base64 encoded, DATETIME columns are microseconds
+// since the epoch and BOOLEAN columns are TINYINT(1), sent as numbers unless
+// the connector converts them.
+type row struct {
+	ID          json.RawMessage `json:"id"`
+	ProfileID   json.RawMessage `json:"profile_id"`
+	Type        string          `json:"type"`
+	Title       string          `json:"title"`
+	Slug        string          `json:"slug"`
+	Excerpt     *string         `json:"excerpt"`
+	IsPublished json.RawMessage `json:"is_published"`
+	PublishedAt *int64          `json:"published_at"`
+	ViewCount   int64           `json:"view_count"`
+}
+
+// Decode parses a message of the posts topic
+func Decode(value []byte) (*Change, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || bytes.Equal(value, []byte("null")) {
+		return nil, ErrTombstone
+	}
+
+	var env envelope
+	if err := json.Unmarshal(value, &env); err != nil {
+		return nil, fmt.Errorf("decode message: %w", err)
+	}
+	raw := env.Payload
+	if len(raw) == 0 {
+		raw = value
+	}
+
+	var p payload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("decode payload: %w", err)
+	}
+	switch p.Op {
+	case OpCreate, OpUpdate, OpDelete, OpRead:
+	default:
+		return nil, fmt.Errorf("unknown operation %q", p.Op)
+	}
+
+	change := &Change{Op: p.Op}
+	if p.TsMs > 0 {
+		change.Time = time.UnixMilli(p.TsMs).UTC()
+	}
+	var err error
+	if change.Before, err = p.Before.post(); err != nil {
+		return nil, fmt.Errorf("decode before: %w", err)
+	}
+	if change.After, err = p.After.post(); err != nil {
+		return nil, fmt.Errorf("decode after: %w", err)
+	}
+	if change.Before == nil && change.After == nil {
+		return nil, errors.New("change has no post")
+	}
+	return change, nil
+}
+
+func (r *row) post() (*Post, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	id, err := decodeUUID(r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("id: %w", err)
+	}
+	if id == "" {
+		return nil, errors.New("id: missing")
+	}
+	profileID, err := decodeUUID(r.ProfileID)
+	if err != nil {
+		return nil, fmt.Errorf("profile_id: %w", err)
+	}
+	published, err := decodeBool(r.IsPublished)
+	if err != nil {
+		return nil, fmt.Errorf("is_published: %w", err)
+	}
+
+	post := &Post{
+		ID:          id,
+		ProfileID:   profileID,
+		Type:        r.Type,
+		Title:       r.Title,
+		Slug:        r.Slug,
+		IsPublished: published,
+		ViewCount:   r.ViewCount,
+	}
+	if r.Excerpt != nil {
+		post.Excerpt = *r.Excerpt
+	}
+	if r.PublishedAt != nil {
+		post.PublishedAt = time.UnixMicro(*r.PublishedAt).UTC()
+	}
+	return post, nil
+}
+
+// decodeUUID accepts a UUID string or the base64 encoding of its 16 bytes.
+// A null or missing column is an empty string.
+func decodeUUID(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", err
+	}
+	if id, err := uuid.Parse(s); err == nil {
+		return id.String(), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid uuid %q", s)
+	}
+	id, err := uuid.FromBytes(b)
+	if err != nil {
+		return "", fmt.Errorf("invalid uuid %q", s)
+	}
+	return id.String(), nil
+}
+
+// decodeBool accepts true and false, or a number where anything but zero is
+// true
+func decodeBool(raw json.RawMessage) (bool, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return false, nil
+	}
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	n, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %s", raw)
+	}
+	return n != 0, nil
+}
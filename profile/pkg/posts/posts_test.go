@@ -0,0 +1,132 @@
+package posts
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// message is an update of the MySQL connector with schemas enabled; the
+// schema is shortened. The ids are the base64 BINARY(16) columns of
+// 0f8fad5b-d9cb-469f-a165-70867728950e and 7c9e6679-7425-40de-944b-e07fc1f90ae7.
+const message = `{
+	"schema": {"type": "struct", "name": "post-db.okblog.posts.Envelope"},
+	"payload": {
+		"before": {"id": "D4+tW9nLRp+hZXCGdyiVDg==", "profile_id": "fJ5meXQlQN6US+B/wfkK5w==", "type": "POST", "title": "Hello", "slug": "hello", "excerpt": null, "is_published": 0, "published_at": null, "view_count": 0},
+		"after": {"id": "D4+tW9nLRp+hZXCGdyiVDg==", "profile_id": "fJ5meXQlQN6US+B/wfkK5w==", "type": "POST", "title": "Hello", "slug": "hello", "excerpt": "First post", "is_published": 1, "published_at": 1718000000123456, "view_count": 3},
+		"source": {"db": "okblog", "table": "posts"},
+		"op": "u",
+		"ts_ms": 1718000001000
+	}
+}`
+
+func TestDecode(t *testing.T) {
+	change, err := Decode([]byte(message))
+	require.NoError(t, err)
+
+	assert.Equal(t, OpUpdate, change.Op)
+	assert.Equal(t, time.UnixMilli(1718000001000).UTC(), change.Time)
+	require.NotNil(t, change.Before)
+	assert.False(t, change.Before.IsPublished)
+	assert.True(t, change.Before.PublishedAt.IsZero())
+	assert.Empty(t, change.Before.Excerpt)
+
+	require.NotNil(t, change.After)
+	assert.Equal(t, &Post{
+		ID:          "0f8fad5b-d9cb-469f-a165-70867728950e",
+		ProfileID:   "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+		Type:        TypePost,
+		Title:       "Hello",
+		Slug:        "hello",
+		Excerpt:     "First post",
+		IsPublished: true,
+		PublishedAt: time.UnixMicro(1718000000123456).UTC(),
+		ViewCount:   3,
+	}, change.After)
+	assert.True(t, change.Published())
+}
+
+func TestDecode_WithoutSchema(t *testing.T) {
+	// Connectors with schemas disabled send the payload alone, and may
+	// convert UUIDs and booleans
+	change, err := Decode([]byte(`{"before": null, "after": {"id": "0f8fad5b-d9cb-469f-a165-70867728950e", "type": "PAGE", "is_published": true}, "op": "c"}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, OpCreate, change.Op)
+	assert.Nil(t, change.Before)
+	assert.Equal(t, "0f8fad5b-d9cb-469f-a165-70867728950e", change.After.ID)
+	assert.Equal(t, TypePage, change.After.Type)
+	assert.True(t, change.After.IsPublished)
+	assert.Empty(t, change.After.ProfileID)
+}
+
+func TestDecode_Errors(t *testing.T) {
+	_, err := Decode(nil)
+	assert.ErrorIs(t, err, ErrTombstone)
+	_, err = Decode([]byte("null"))
+	assert.ErrorIs(t, err, ErrTombstone)
+
+	for name, value := range map[string]string{
+		"not json":     `{`,
+		"unknown op":   `{"payload": {"op": "t", "after": {"id": "0f8fad5b-d9cb-469f-a165-70867728950e"}}}`,
+		"no post":      `{"payload": {"op": "d"}}`,
+		"missing id":   `{"payload": {"op": "c", "after": {"title": "Hello"}}}`,
+		"invalid id":   `{"payload": {"op": "c", "after": {"id": "not-a-uuid"}}}`,
+		"invalid bool": `{"payload": {"op": "c", "after": {"id": "0f8fad5b-d9cb-469f-a165-70867728950e", "is_published": "yes"}}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode([]byte(value))
+			assert.Error(t, err)
+			assert.NotErrorIs(t, err, ErrTombstone)
+		})
+	}
+}
+
+func TestChange_Published(t *testing.T) {
+	draft := &Post{ID: "post"}
+	published := &Post{ID: "post", IsPublished: true}
+
+	tests := []struct {
+		name   string
+		change Change
+		want   bool
+	}{
+		{"created published", Change{Op: OpCreate, After: published}, true},
+		{"created draft", Change{Op: OpCreate, After: draft}, false},
+		{"draft published", Change{Op: OpUpdate, Before: draft, After: published}, true},
+		{"published post edited", Change{Op: OpUpdate, Before: published, After: published}, false},
+		{"unpublished", Change{Op: OpUpdate, Before: published, After: draft}, false},
+		{"deleted", Change{Op: OpDelete, Before: published}, false},
+		{"snapshot", Change{Op: OpRead, After: published}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.change.Published())
+		})
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	var calls []string
+	record := func(name string, err error) Handler {
+		return HandlerFunc(func(ctx context.Context, change Change) error {
+			calls = append(calls, name)
+			return err
+		})
+	}
+	change := Change{Op: OpCreate, After: &Post{ID: "post"}}
+
+	require.NoError(t, Handlers(record("first", nil), record("second", nil)).Handle(context.Background(), change))
+	assert.Equal(t, []string{"first", "second"}, calls)
+
+	// The handlers after a failure are not called
+	calls = nil
+	failure := errors.New("database is down")
+	err := Handlers(record("first", failure), record("second", nil)).Handle(context.Background(), change)
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, []string{"first"}, calls)
+}
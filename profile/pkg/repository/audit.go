@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// auditEventColumns are selected by every audit event query, in
+// scanAuditEvent order
+const auditEventColumns = `id, action, profile_id, actor_id, target, request_id, ip, created_at`
+
+// scanAuditEvent reads a row selected with auditEventColumns
+func scanAuditEvent(row interface{ Scan(...interface{}) error }) (*model.AuditEvent, error) {
+	var event model.AuditEvent
+	err := row.Scan(
+		&event.ID,
+		&event.Action,
+		&event.ProfileID,
+		&event.ActorID,
+		&event.Target,
+		&event.RequestID,
+		&event.IP,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// CreateAuditEvent appends an entry to the audit trail
+func (r *PostgresRepository) CreateAuditEvent(ctx context.Context, event model.AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (id, action, profile_id, actor_id, target, request_id, ip, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateAuditEvent", "INSERT", "audit_events", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		event.ID,
+		event.Action,
+		event.ProfileID,
+		event.ActorID,
+		event.Target,
+		event.RequestID,
+		event.IP,
+		event.CreatedAt,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create audit event", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// ListAuditEvents returns the latest entries of the audit trail matching the
+// filter, newest first
+func (r *PostgresRepository) ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error) {
+	query := `
+		SELECT ` + auditEventColumns + `
+		FROM audit_events
+		WHERE ($1 = '' OR profile_id = $1) AND ($2 = '' OR actor_id = $2)
+		ORDER BY created_at DESC, id
+		LIMIT $3
+	`
+
+	ctx, span := r.startSpan(ctx, "ListAuditEvents", "SELECT", "audit_events", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, filter.ProfileID, filter.ActorID, filter.Limit)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list audit events", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []model.AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan audit event", "err", err)
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list audit events", "err", err)
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateAuditEvent(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	event := model.AuditEvent{
+		ID:        "event-id",
+		Action:    model.AuditImpersonationStarted,
+		ProfileID: "profile-id",
+		ActorID:   "admin-id",
+		Target:    "session-id",
+		RequestID: "request-id",
+		IP:        "192.0.2.1",
+		CreatedAt: now,
+	}
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO audit_events`)).
+		WithArgs("event-id", model.AuditImpersonationStarted, "profile-id", "admin-id", "session-id", "request-id", "192.0.2.1", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Call the method
+	err := repo.CreateAuditEvent(context.Background(), event)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListAuditEvents(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "action", "profile_id", "actor_id", "target", "request_id", "ip", "created_at"}).
+		AddRow("event-id", model.AuditSessionRevoked, "profile-id", "admin-id", "session-id", "request-id", "192.0.2.1", now)
+
+	// Set up expectations: empty filter fields match every entry
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE ($1 = '' OR profile_id = $1) AND ($2 = '' OR actor_id = $2)`)).
+		WithArgs("", "admin-id", 50).
+		WillReturnRows(rows)
+
+	// Call the method
+	events, err := repo.ListAuditEvents(context.Background(), model.AuditEventFilter{ActorID: "admin-id", Limit: 50})
+
+	// Assertions
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, model.AuditSessionRevoked, events[0].Action)
+	assert.Equal(t, "session-id", events[0].Target)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,211 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache drivers
+const (
+	CacheDriverNone   = "none"
+	CacheDriverMemory = "memory"
+	CacheDriverValkey = "valkey"
+)
+
+// Cache stores encoded repository results under string keys. Implementations
+// must be safe for concurrent use.
+//
+// Every key has a generation that Delete advances. A read-through fill takes
+// the generation before reading the database and stores with
+// SetIfGeneration, so a result read before a write can't be cached after the
+// write invalidated the key.
+type Cache interface {
+	// Get returns the value of key and whether it was found
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Generation returns the current generation of key
+	Generation(ctx context.Context, key string) (int64, error)
+	// SetIfGeneration stores value unless key was deleted since it had
+	// generation gen, and reports whether it did
+	SetIfGeneration(ctx context.Context, key string, value []byte, ttl time.Duration, gen int64) (bool, error)
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// lruEntry is a value of the in-process cache with its own deadline, so
+// found and not-found results can expire at different times
+type lruEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// lruGenerations is the number of generation counters of an LRUCache. Keys
+// share them by hash, so a delete may also turn away a fill of another key.
+const lruGenerations = 256
+
+// LRUCache is an in-process Cache that evicts the least recently used
+// entries beyond its size. Every replica has its own, so writes on one
+// replica don't invalidate the others before the entries expire.
+type LRUCache struct {
+	entries *lru.Cache[string, lruEntry]
+	now     func() time.Time
+
+	// mu makes comparing a generation and storing the entry atomic
+	mu          sync.Mutex
+	generations [lruGenerations]int64
+}
+
+// NewLRUCache creates an in-process cache of at most size entries
+func NewLRUCache(size int) (*LRUCache, error) {
+	entries, err := lru.New[string, lruEntry](size)
+	if err != nil {
+		return nil, err
+	}
+	return &LRUCache{entries: entries, now: time.Now}, nil
+}
+
+// Get implements Cache
+func (c *LRUCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	entry, ok := c.entries.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if !c.now().Before(entry.expiresAt) {
+		c.entries.Remove(key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Set implements Cache
+func (c *LRUCache) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	c.entries.Add(key, lruEntry{value: value, expiresAt: c.now().Add(ttl)})
+	return nil
+}
+
+// Generation implements Cache
+func (c *LRUCache) Generation(_ context.Context, key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *c.generation(key), nil
+}
+
+// SetIfGeneration implements Cache
+func (c *LRUCache) SetIfGeneration(_ context.Context, key string, value []byte, ttl time.Duration, gen int64) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *c.generation(key) != gen {
+		return false, nil
+	}
+	c.entries.Add(key, lruEntry{value: value, expiresAt: c.now().Add(ttl)})
+	return true, nil
+}
+
+// Delete implements Cache
+func (c *LRUCache) Delete(_ context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.entries.Remove(key)
+		*c.generation(key)++
+	}
+	return nil
+}
+
+// generation returns the counter key shares; c.mu must be held
+func (c *LRUCache) generation(key string) *int64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.generations[h.Sum32()%lruGenerations]
+}
+
+// valkeyGenerationTTL is how long Valkey keeps the generation of a key after
+// its last delete. It must outlast any read-through fill: a fill that started
+// before the generation expired could store a stale entry.
+const valkeyGenerationTTL = time.Hour
+
+// setIfGeneration stores ARGV[1] under KEYS[1] for ARGV[2] milliseconds if
+// the generation in KEYS[2], missing meaning 0, is still ARGV[3]
+var setIfGeneration = redis.NewScript(`
+if tonumber(redis.call("GET", KEYS[2]) or "0") ~= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// ValkeyCache is a Cache shared by every replica, kept in Valkey or Redis.
+// The generation of a key is kept next to it under "generation:" + key.
+type ValkeyCache struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewValkeyCache creates a cache that stores its keys in client, prefixed
+// with prefix
+func NewValkeyCache(client redis.UniversalClient, prefix string) *ValkeyCache {
+	return &ValkeyCache{client: client, prefix: prefix}
+}
+
+// Get implements Cache
+func (c *ValkeyCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set implements Cache
+func (c *ValkeyCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, c.prefix+key, value, ttl).Err()
+}
+
+// Generation implements Cache
+func (c *ValkeyCache) Generation(ctx context.Context, key string) (int64, error) {
+	gen, err := c.client.Get(ctx, c.generationKey(key)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return gen, err
+}
+
+// SetIfGeneration implements Cache
+func (c *ValkeyCache) SetIfGeneration(ctx context.Context, key string, value []byte, ttl time.Duration, gen int64) (bool, error) {
+	keys := []string{c.prefix + key, c.generationKey(key)}
+	stored, err := setIfGeneration.Run(ctx, c.client, keys, value, ttl.Milliseconds(), gen).Int()
+	return stored == 1, err
+}
+
+// Delete implements Cache
+func (c *ValkeyCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, c.prefix+key)
+			pipe.Incr(ctx, c.generationKey(key))
+			pipe.Expire(ctx, c.generationKey(key), valkeyGenerationTTL)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *ValkeyCache) generationKey(key string) string {
+	return c.prefix + "generation:" + key
+}
+
+// Ping checks the connection to Valkey, for readiness checks
+func (c *ValkeyCache) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
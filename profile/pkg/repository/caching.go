@@ -0,0 +1,313 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Cache defaults
+const (
+	DefaultCacheTTL         = 30 * time.Second
+	DefaultNegativeCacheTTL = 5 * time.Second
+)
+
+// Names of the cached lookups, used as the cache label of the counter
+const (
+	cacheProfiles = "profiles"
+	cacheSessions = "sessions"
+)
+
+// notFound is cached for lookups that found nothing. Encoded profiles and
+// sessions are never empty.
+var notFound = []byte{}
+
+// CachingRepository serves GetProfile and GetSession from a Cache and
+// forwards everything else to the wrapped repository. Writes through the
+// decorator invalidate the entries they affect, and a lookup that read the
+// database before such a write doesn't cache its result after it.
+//
+// Cached profiles carry no password hash, so credentials never reach the
+// cache; lookups that need the hash (by username and email) are not cached.
+// A revoked session would stay valid until its entry expires on replicas that
+// don't share the cache, so caches per replica shouldn't hold sessions; see
+// WithoutSessionCache.
+type CachingRepository struct {
+	Repository
+	cache       Cache
+	logger      log.Logger
+	ttl         time.Duration
+	negativeTTL time.Duration
+	requests    metrics.Counter
+	sessions    bool
+}
+
+// CacheOption configures optional behaviour of the caching repository
+type CacheOption func(*CachingRepository)
+
+// WithCacheTTL sets how long found profiles and sessions are cached
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(r *CachingRepository) {
+		r.ttl = ttl
+	}
+}
+
+// WithNegativeCacheTTL sets how long lookups that found nothing are cached.
+// Zero disables negative caching.
+func WithNegativeCacheTTL(ttl time.Duration) CacheOption {
+	return func(r *CachingRepository) {
+		r.negativeTTL = ttl
+	}
+}
+
+// WithoutSessionCache reads sessions from the wrapped repository every
+// time, so a revocation is seen at once by every replica
+func WithoutSessionCache() CacheOption {
+	return func(r *CachingRepository) {
+		r.sessions = false
+	}
+}
+
+// WithCacheCounter counts cache lookups by cache and result (hit or miss)
+func WithCacheCounter(requests metrics.Counter) CacheOption {
+	return func(r *CachingRepository) {
+		r.requests = requests
+	}
+}
+
+// NewCachingRepository wraps next with a read-through cache
+func NewCachingRepository(next Repository, cache Cache, logger log.Logger, opts ...CacheOption) *CachingRepository {
+	r := &CachingRepository{
+		Repository:  next,
+		cache:       cache,
+		logger:      logger,
+		ttl:         DefaultCacheTTL,
+		negativeTTL: DefaultNegativeCacheTTL,
+		requests:    discard.NewCounter(),
+		sessions:    true,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func profileKey(id string) string {
+	return "profile:" + id
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+// lookup returns the cached value of key. Cache errors are logged and
+// treated as a miss, so the database still answers when the cache is down.
+func (r *CachingRepository) lookup(ctx context.Context, name, key string) ([]byte, bool) {
+	value, ok, err := r.cache.Get(ctx, key)
+	if err != nil {
+		level.Warn(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to read cache", "key", key, "err", err)
+	}
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	r.requests.With("cache", name, "result", result).Add(1)
+	return value, ok
+}
+
+// generation returns the generation of key before a fill reads the database.
+// When the cache can't tell, the fill isn't stored.
+func (r *CachingRepository) generation(ctx context.Context, key string) (int64, bool) {
+	gen, err := r.cache.Generation(ctx, key)
+	if err != nil {
+		level.Warn(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to read cache generation", "key", key, "err", err)
+		return 0, false
+	}
+	return gen, true
+}
+
+// store caches value under key, or the not-found marker when value is nil,
+// unless key was invalidated since it had generation gen
+func (r *CachingRepository) store(ctx context.Context, key string, gen int64, value interface{}) {
+	encoded, ttl := notFound, r.negativeTTL
+	if value != nil {
+		var err error
+		if encoded, err = json.Marshal(value); err != nil {
+			level.Warn(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to encode cache entry", "key", key, "err", err)
+			return
+		}
+		ttl = r.ttl
+	}
+	if ttl <= 0 {
+		return
+	}
+	if _, err := r.cache.SetIfGeneration(ctx, key, encoded, ttl, gen); err != nil {
+		level.Warn(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to write cache", "key", key, "err", err)
+	}
+}
+
+// invalidate drops keys from the cache. A failure leaves stale entries until
+// they expire, so it is logged as an error.
+func (r *CachingRepository) invalidate(ctx context.Context, keys ...string) {
+	if err := r.cache.Delete(ctx, keys...); err != nil {
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to invalidate cache", "keys", len(keys), "err", err)
+	}
+}
+
+// GetProfile returns the cached profile, without its password hash
+func (r *CachingRepository) GetProfile(ctx context.Context, id string) (*model.Profile, error) {
+	key := profileKey(id)
+	if value, ok := r.lookup(ctx, cacheProfiles, key); ok {
+		if len(value) == 0 {
+			return nil, errors.New("profile not found")
+		}
+		var profile model.Profile
+		if err := json.Unmarshal(value, &profile); err == nil {
+			return &profile, nil
+		}
+		r.invalidate(ctx, key)
+	}
+
+	gen, cacheable := r.generation(ctx, key)
+	profile, err := r.Repository.GetProfile(ctx, id)
+	if err != nil {
+		if err.Error() == "profile not found" && cacheable {
+			r.store(ctx, key, gen, nil)
+		}
+		return nil, err
+	}
+
+	// Answer the same way a hit would
+	profile.Password = ""
+	if cacheable {
+		r.store(ctx, key, gen, profile)
+	}
+	return profile, nil
+}
+
+// GetSession returns the cached session
+func (r *CachingRepository) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	if !r.sessions {
+		return r.Repository.GetSession(ctx, id)
+	}
+
+	key := sessionKey(id)
+	if value, ok := r.lookup(ctx, cacheSessions, key); ok {
+		if len(value) == 0 {
+			return nil, errors.New("session not found")
+		}
+		var session model.Session
+		if err := json.Unmarshal(value, &session); err == nil {
+			return &session, nil
+		}
+		r.invalidate(ctx, key)
+	}
+
+	gen, cacheable := r.generation(ctx, key)
+	session, err := r.Repository.GetSession(ctx, id)
+	if err != nil {
+		if err.Error() == "session not found" && cacheable {
+			r.store(ctx, key, gen, nil)
+		}
+		return nil, err
+	}
+
+	if cacheable {
+		r.store(ctx, key, gen, session)
+	}
+	return session, nil
+}
+
+// CreateProfile drops a cached not-found result for the new ID
+func (r *CachingRepository) CreateProfile(ctx context.Context, profile model.Profile) error {
+	defer r.invalidate(ctx, profileKey(profile.ID))
+	return r.Repository.CreateProfile(ctx, profile)
+}
+
+// CreateProfileWithInvitation drops a cached not-found result for the new ID
+func (r *CachingRepository) CreateProfileWithInvitation(ctx context.Context, profile model.Profile, invitationID string, now time.Time) error {
+	defer r.invalidate(ctx, profileKey(profile.ID))
+	return r.Repository.CreateProfileWithInvitation(ctx, profile, invitationID, now)
+}
+
+// UpdateProfile invalidates the cached profile
+func (r *CachingRepository) UpdateProfile(ctx context.Context, profile model.Profile) error {
+	defer r.invalidate(ctx, profileKey(profile.ID))
+	return r.Repository.UpdateProfile(ctx, profile)
+}
+
+// UpdatePassword invalidates the cached profile, whose updatedAt changes
+func (r *CachingRepository) UpdatePassword(ctx context.Context, id string, passwordHash string) error {
+	defer r.invalidate(ctx, profileKey(id))
+	return r.Repository.UpdatePassword(ctx, id, passwordHash)
+}
+
+// UpdateRole invalidates the cached profile
+func (r *CachingRepository) UpdateRole(ctx context.Context, id string, role string) error {
+	defer r.invalidate(ctx, profileKey(id))
+	return r.Repository.UpdateRole(ctx, id, role)
+}
+
+// SetLockedAt invalidates the cached profile
+func (r *CachingRepository) SetLockedAt(ctx context.Context, id string, lockedAt *time.Time) error {
+	defer r.invalidate(ctx, profileKey(id))
+	return r.Repository.SetLockedAt(ctx, id, lockedAt)
+}
+
+// DeleteProfile invalidates the cached profile and the sessions that are
+// deleted with it
+func (r *CachingRepository) DeleteProfile(ctx context.Context, id string) error {
+	keys := append(r.activeSessionKeys(ctx, id), profileKey(id))
+	defer r.invalidate(ctx, keys...)
+	return r.Repository.DeleteProfile(ctx, id)
+}
+
+// CreateSession drops a cached not-found result for the new ID
+func (r *CachingRepository) CreateSession(ctx context.Context, session model.Session) error {
+	defer r.invalidate(ctx, sessionKey(session.ID))
+	return r.Repository.CreateSession(ctx, session)
+}
+
+// TouchSession invalidates the cached session, whose lastSeenAt changes
+func (r *CachingRepository) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	defer r.invalidate(ctx, sessionKey(id))
+	return r.Repository.TouchSession(ctx, id, lastSeenAt)
+}
+
+// RevokeSession invalidates the cached session
+func (r *CachingRepository) RevokeSession(ctx context.Context, profileID, id string, now time.Time) error {
+	defer r.invalidate(ctx, sessionKey(id))
+	return r.Repository.RevokeSession(ctx, profileID, id, now)
+}
+
+// RevokeOtherSessions invalidates the sessions that were active before the
+// revocation
+func (r *CachingRepository) RevokeOtherSessions(ctx context.Context, profileID, keepID string, now time.Time) (int, error) {
+	keys := r.activeSessionKeys(ctx, profileID)
+	defer r.invalidate(ctx, keys...)
+	return r.Repository.RevokeOtherSessions(ctx, profileID, keepID, now)
+}
+
+// activeSessionKeys returns the cache keys of the active sessions of a
+// profile. If they can't be listed the sessions stay cached until they
+// expire.
+func (r *CachingRepository) activeSessionKeys(ctx context.Context, profileID string) []string {
+	sessions, err := r.Repository.ListActiveSessions(ctx, profileID, time.Now())
+	if err != nil {
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list sessions to invalidate", "profile", profileID, "err", err)
+		return nil
+	}
+	keys := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		keys = append(keys, sessionKey(session.ID))
+	}
+	return keys
+}
@@ -0,0 +1,367 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var profileRowColumns = []string{"id", "username", "email", "password", "first_name", "last_name", "bio", "role", "created_at", "updated_at", "locked_at"}
+
+// setupCachingRepository wraps the sqlmock repository with an in-process
+// cache, so every query that reaches the database must be expected
+func setupCachingRepository(t *testing.T, opts ...CacheOption) (*sql.DB, sqlmock.Sqlmock, *CachingRepository) {
+	db, mock, next := setupMockDB(t)
+	cache, err := NewLRUCache(16)
+	require.NoError(t, err)
+	return db, mock, NewCachingRepository(next, cache, log.NewNopLogger(), opts...)
+}
+
+func expectGetProfile(mock sqlmock.Sqlmock, id string) {
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM profiles`)).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows(profileRowColumns).
+			AddRow(id, "testuser", "test@example.com", "hash", "Test", "User", "Test bio", model.RoleUser, now, now, nil))
+}
+
+func TestCachingRepository_GetProfile(t *testing.T) {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cache_requests_total"}, []string{"cache", "result"})
+	db, mock, repo := setupCachingRepository(t, WithCacheCounter(kitprometheus.NewCounter(requests)))
+	defer db.Close()
+
+	ctx := context.Background()
+	expectGetProfile(mock, "profile-id")
+
+	first, err := repo.GetProfile(ctx, "profile-id")
+	require.NoError(t, err)
+	second, err := repo.GetProfile(ctx, "profile-id")
+	require.NoError(t, err)
+
+	// One query; the password hash is left out of both answers
+	assert.Equal(t, first.Username, second.Username)
+	assert.Equal(t, first.Role, second.Role)
+	assert.True(t, first.CreatedAt.Equal(second.CreatedAt))
+	assert.Empty(t, first.Password)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Callers own what they get
+	second.Bio = "changed"
+	third, err := repo.GetProfile(ctx, "profile-id")
+	require.NoError(t, err)
+	assert.Equal(t, "Test bio", third.Bio)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(requests.WithLabelValues("profiles", "miss")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(requests.WithLabelValues("profiles", "hit")))
+}
+
+func TestCachingRepository_NegativeCaching(t *testing.T) {
+	db, mock, repo := setupCachingRepository(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM profiles`)).WithArgs("new-id").WillReturnError(sql.ErrNoRows)
+
+	for i := 0; i < 2; i++ {
+		_, err := repo.GetProfile(ctx, "new-id")
+		assert.EqualError(t, err, "profile not found")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Creating the profile drops the not-found entry
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO profiles`)).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectGetProfile(mock, "new-id")
+
+	require.NoError(t, repo.CreateProfile(ctx, model.Profile{ID: "new-id", Username: "testuser"}))
+	profile, err := repo.GetProfile(ctx, "new-id")
+	require.NoError(t, err)
+	assert.Equal(t, "new-id", profile.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCachingRepository_NegativeCachingDisabled(t *testing.T) {
+	db, mock, repo := setupCachingRepository(t, WithNegativeCacheTTL(0))
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM profiles`)).WithArgs("missing").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM profiles`)).WithArgs("missing").WillReturnError(sql.ErrNoRows)
+
+	for i := 0; i < 2; i++ {
+		_, err := repo.GetProfile(context.Background(), "missing")
+		assert.EqualError(t, err, "profile not found")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCachingRepository_Invalidation(t *testing.T) {
+	testCases := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		write  func(repo *CachingRepository) error
+	}{
+		{
+			name: "UpdateProfile",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta(`UPDATE profiles`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			write: func(repo *CachingRepository) error {
+				return repo.UpdateProfile(context.Background(), model.Profile{ID: "profile-id", Bio: "new bio"})
+			},
+		},
+		{
+			name: "UpdatePassword",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta(`SET password = $1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			write: func(repo *CachingRepository) error {
+				return repo.UpdatePassword(context.Background(), "profile-id", "new-hash")
+			},
+		},
+		{
+			name: "UpdateRole",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta(`SET role = $1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			write: func(repo *CachingRepository) error {
+				return repo.UpdateRole(context.Background(), "profile-id", model.RoleAdmin)
+			},
+		},
+		{
+			name: "SetLockedAt",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta(`SET locked_at = $1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			write: func(repo *CachingRepository) error {
+				now := time.Now()
+				return repo.SetLockedAt(context.Background(), "profile-id", &now)
+			},
+		},
+		{
+			name: "DeleteProfile",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(`FROM sessions`)).WillReturnRows(sqlmock.NewRows(sessionRowColumns))
+				mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM profiles`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			write: func(repo *CachingRepository) error {
+				return repo.DeleteProfile(context.Background(), "profile-id")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, repo := setupCachingRepository(t)
+			defer db.Close()
+
+			expectGetProfile(mock, "profile-id")
+			_, err := repo.GetProfile(context.Background(), "profile-id")
+			require.NoError(t, err)
+
+			tc.expect(mock)
+			require.NoError(t, tc.write(repo))
+
+			// The next read goes back to the database
+			expectGetProfile(mock, "profile-id")
+			_, err = repo.GetProfile(context.Background(), "profile-id")
+			require.NoError(t, err)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCachingRepository_Sessions(t *testing.T) {
+	db, mock, repo := setupCachingRepository(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	sessionRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(sessionRowColumns).
+			AddRow("s1", "profile-id", "Mozilla/5.0", "192.0.2.1", now, now, now.Add(time.Hour), nil, "")
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM sessions WHERE id = $1`)).WithArgs("s1").WillReturnRows(sessionRows())
+	for i := 0; i < 2; i++ {
+		session, err := repo.GetSession(ctx, "s1")
+		require.NoError(t, err)
+		assert.True(t, session.Active(now))
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Revoking the other sessions invalidates the ones that were active
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE profile_id = $1 AND revoked_at IS NULL`)).WillReturnRows(sessionRows())
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE profile_id = $2 AND id <> $3`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	revoked, err := repo.RevokeOtherSessions(ctx, "profile-id", "current", now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM sessions WHERE id = $1`)).WithArgs("s1").WillReturnRows(sessionRows())
+	_, err = repo.GetSession(ctx, "s1")
+	require.NoError(t, err)
+
+	mock.ExpectExec(regexp.QuoteMeta(`SET revoked_at = $1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, repo.RevokeSession(ctx, "profile-id", "s1", now))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM sessions WHERE id = $1`)).WithArgs("s1").WillReturnRows(sessionRows())
+	_, err = repo.GetSession(ctx, "s1")
+	require.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCachingRepository_WithoutSessionCache(t *testing.T) {
+	db, mock, repo := setupCachingRepository(t, WithoutSessionCache())
+	defer db.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta(`FROM sessions WHERE id = $1`)).WithArgs("s1").
+			WillReturnRows(sqlmock.NewRows(sessionRowColumns).
+				AddRow("s1", "profile-id", "Mozilla/5.0", "192.0.2.1", now, now, now.Add(time.Hour), nil, ""))
+		_, err := repo.GetSession(ctx, "s1")
+		require.NoError(t, err)
+	}
+
+	// Profiles are still cached
+	expectGetProfile(mock, "profile-id")
+	for i := 0; i < 2; i++ {
+		_, err := repo.GetProfile(ctx, "profile-id")
+		require.NoError(t, err)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// slowRepository runs afterRead once a profile was read, like a write that
+// lands while the result is on its way to the cache
+type slowRepository struct {
+	Repository
+	afterRead func()
+}
+
+func (r *slowRepository) GetProfile(ctx context.Context, id string) (*model.Profile, error) {
+	profile, err := r.Repository.GetProfile(ctx, id)
+	if r.afterRead != nil {
+		r.afterRead()
+		r.afterRead = nil
+	}
+	return profile, err
+}
+
+func TestCachingRepository_FillRacesWrite(t *testing.T) {
+	ctx := context.Background()
+	next := &slowRepository{Repository: NewMemoryRepository()}
+	cache, err := NewLRUCache(16)
+	require.NoError(t, err)
+	repo := NewCachingRepository(next, cache, log.NewNopLogger())
+	require.NoError(t, repo.CreateProfile(ctx, model.Profile{ID: "profile-id", Username: "user", Email: "user@example.com", Role: model.RoleAdmin}))
+
+	next.afterRead = func() {
+		require.NoError(t, repo.UpdateRole(ctx, "profile-id", model.RoleUser))
+	}
+	profile, err := repo.GetProfile(ctx, "profile-id")
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, profile.Role, "the read happened before the write")
+
+	// The result read before the write isn't cached after it
+	profile, err = repo.GetProfile(ctx, "profile-id")
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleUser, profile.Role)
+}
+
+// brokenCache fails every call, like an unreachable Valkey
+type brokenCache struct{}
+
+func (brokenCache) Get(context.Context, string) ([]byte, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func (brokenCache) Set(context.Context, string, []byte, time.Duration) error {
+	return errors.New("connection refused")
+}
+
+func (brokenCache) Generation(context.Context, string) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func (brokenCache) SetIfGeneration(context.Context, string, []byte, time.Duration, int64) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func (brokenCache) Delete(context.Context, ...string) error {
+	return errors.New("connection refused")
+}
+
+func TestCachingRepository_CacheDown(t *testing.T) {
+	db, mock, next := setupMockDB(t)
+	defer db.Close()
+	repo := NewCachingRepository(next, brokenCache{}, log.NewNopLogger())
+
+	expectGetProfile(mock, "profile-id")
+	expectGetProfile(mock, "profile-id")
+
+	for i := 0; i < 2; i++ {
+		profile, err := repo.GetProfile(context.Background(), "profile-id")
+		require.NoError(t, err)
+		assert.Equal(t, "profile-id", profile.ID)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	cache, err := NewLRUCache(2)
+	require.NoError(t, err)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	require.NoError(t, cache.Set(ctx, "short", []byte("a"), time.Second))
+	require.NoError(t, cache.Set(ctx, "long", []byte("b"), time.Minute))
+
+	value, ok, err := cache.Get(ctx, "short")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a"), value)
+
+	// Entries expire on their own deadline
+	now = now.Add(2 * time.Second)
+	_, ok, _ = cache.Get(ctx, "short")
+	assert.False(t, ok)
+	_, ok, _ = cache.Get(ctx, "long")
+	assert.True(t, ok)
+
+	// The least recently used entry is evicted beyond the size
+	require.NoError(t, cache.Set(ctx, "c", []byte("c"), time.Minute))
+	require.NoError(t, cache.Set(ctx, "d", []byte("d"), time.Minute))
+	_, ok, _ = cache.Get(ctx, "long")
+	assert.False(t, ok)
+
+	require.NoError(t, cache.Delete(ctx, "c", "unknown"))
+	_, ok, _ = cache.Get(ctx, "c")
+	assert.False(t, ok)
+
+	// A delete turns away values read before it
+	gen, err := cache.Generation(ctx, "c")
+	require.NoError(t, err)
+	stored, err := cache.SetIfGeneration(ctx, "c", []byte("c"), time.Minute, gen)
+	require.NoError(t, err)
+	assert.True(t, stored)
+	require.NoError(t, cache.Delete(ctx, "c"))
+	stored, err = cache.SetIfGeneration(ctx, "c", []byte("stale"), time.Minute, gen)
+	require.NoError(t, err)
+	assert.False(t, stored)
+	_, ok, _ = cache.Get(ctx, "c")
+	assert.False(t, ok)
+}
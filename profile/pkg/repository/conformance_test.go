@@ -0,0 +1,1023 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/database"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postgresDSNEnv points the conformance suite at a PostgreSQL database. Its
+// tables are emptied by the tests.
+const postgresDSNEnv = "PROFILE_TEST_POSTGRES_DSN"
+
+// The conformance suite runs the same tests against every backend, so they
+// can't drift apart. Each test gets an empty repository.
+
+func TestConformance_Memory(t *testing.T) {
+	runConformance(t, func(t *testing.T) Repository {
+		return NewMemoryRepository()
+	})
+}
+
+func TestConformance_SQLite(t *testing.T) {
+	runConformance(t, func(t *testing.T) Repository {
+		db, err := database.NewSQLiteDB(filepath.Join(t.TempDir(), "profile.db"), log.NewNopLogger())
+		if err != nil && strings.Contains(err.Error(), "cgo") {
+			t.Skip("the sqlite3 driver needs cgo")
+		}
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return NewSQLiteRepository(db, log.NewNopLogger())
+	})
+}
+
+func TestConformance_Postgres(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("set %s to run against PostgreSQL", postgresDSNEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	applyMigrations(t, db)
+
+	runConformance(t, func(t *testing.T) Repository {
+		_, err := db.Exec(`TRUNCATE profiles, invitations, sessions, magic_links, subscribers, newsletter_posts, author_posts, webhooks, webhook_deliveries, audit_events CASCADE`)
+		require.NoError(t, err)
+		return NewPostgresRepository(db, log.NewNopLogger())
+	})
+}
+
+// applyMigrations runs the files in migrations/, which are idempotent
+func applyMigrations(t *testing.T, db *sql.DB) {
+	files, err := filepath.Glob("../../migrations/*.sql")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	sort.Strings(files)
+
+	for _, file := range files {
+		migration, err := os.ReadFile(file)
+		require.NoError(t, err)
+		_, err = db.Exec(string(migration))
+		require.NoError(t, err, file)
+	}
+}
+
+func runConformance(t *testing.T, newRepo func(t *testing.T) Repository) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo Repository)
+	}{
+		{"Profiles", testProfiles},
+		{"UniqueProfiles", testUniqueProfiles},
+		{"ProfileByEmail", testProfileByEmail},
+		{"RoleAndLock", testRoleAndLock},
+		{"DeleteProfileCascades", testDeleteProfileCascades},
+		{"Invitations", testInvitations},
+		{"CreateProfileWithInvitation", testCreateProfileWithInvitation},
+		{"Sessions", testSessions},
+		{"MagicLinks", testMagicLinks},
+		{"Subscribers", testSubscribers},
+		{"NewsletterPosts", testNewsletterPosts},
+		{"AuthorStats", testAuthorStats},
+		{"Webhooks", testWebhooks},
+		{"WebhookDeliveries", testWebhookDeliveries},
+		{"ImpersonationSessions", testImpersonationSessions},
+		{"AuditEvents", testAuditEvents},
+		{"Preferences", testPreferences},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t))
+		})
+	}
+}
+
+// testNow is rounded so every backend stores it exactly
+func testNow() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+func assertSameTime(t *testing.T, expected, actual time.Time) {
+	t.Helper()
+	assert.True(t, expected.Equal(actual), "expected %v, got %v", expected, actual)
+}
+
+func newTestProfile(username string, createdAt time.Time) model.Profile {
+	return model.Profile{
+		ID:        uuid.New().String(),
+		Username:  username,
+		Email:     username + "@example.com",
+		Password:  "hash-" + username,
+		FirstName: "First",
+		LastName:  "Last",
+		Bio:       "Bio of " + username,
+		Role:      model.RoleUser,
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+}
+
+func testProfiles(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	count, err := repo.CountProfiles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	profile := newTestProfile("alice", now)
+	profile.Role = model.RoleAdmin
+	require.NoError(t, repo.CreateProfile(ctx, profile))
+
+	got, err := repo.GetProfile(ctx, profile.ID)
+	require.NoError(t, err)
+	assert.Equal(t, profile.Username, got.Username)
+	assert.Equal(t, profile.Email, got.Email)
+	assert.Equal(t, profile.Password, got.Password)
+	assert.Equal(t, profile.Bio, got.Bio)
+	assert.Equal(t, model.RoleAdmin, got.Role)
+	assertSameTime(t, now, got.CreatedAt)
+
+	got, err = repo.GetProfileByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, profile.ID, got.ID)
+
+	// Callers can't change the stored profile through what they get
+	got.Bio = "changed"
+	got, err = repo.GetProfile(ctx, profile.ID)
+	require.NoError(t, err)
+	assert.Equal(t, profile.Bio, got.Bio)
+
+	profile.FirstName = "Alice"
+	profile.Bio = "Updated"
+	profile.Password = "ignored"
+	require.NoError(t, repo.UpdateProfile(ctx, profile))
+	got, err = repo.GetProfile(ctx, profile.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Alice", got.FirstName)
+	assert.Equal(t, "Updated", got.Bio)
+	assert.Equal(t, "hash-alice", got.Password, "UpdateProfile must not change the password")
+	assert.False(t, got.UpdatedAt.Before(now))
+
+	require.NoError(t, repo.UpdatePassword(ctx, profile.ID, "new-hash"))
+	got, err = repo.GetProfile(ctx, profile.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "new-hash", got.Password)
+
+	count, err = repo.CountProfiles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	require.NoError(t, repo.DeleteProfile(ctx, profile.ID))
+
+	_, err = repo.GetProfile(ctx, profile.ID)
+	assert.EqualError(t, err, "profile not found")
+	_, err = repo.GetProfileByUsername(ctx, "alice")
+	assert.EqualError(t, err, "profile not found")
+	assert.EqualError(t, repo.UpdateProfile(ctx, profile), "profile not found")
+	assert.EqualError(t, repo.UpdatePassword(ctx, profile.ID, "hash"), "profile not found")
+	assert.EqualError(t, repo.DeleteProfile(ctx, profile.ID), "profile not found")
+}
+
+func testUniqueProfiles(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	alice := newTestProfile("alice", testNow())
+	require.NoError(t, repo.CreateProfile(ctx, alice))
+
+	sameUsername := newTestProfile("alice", testNow())
+	sameUsername.Email = "other@example.com"
+	assert.Error(t, repo.CreateProfile(ctx, sameUsername))
+
+	sameEmail := newTestProfile("bob", testNow())
+	sameEmail.Email = alice.Email
+	assert.Error(t, repo.CreateProfile(ctx, sameEmail))
+
+	count, err := repo.CountProfiles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func testProfileByEmail(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	// Emails are unique as stored, but lookups ignore case
+	older := newTestProfile("older", now.Add(-time.Hour))
+	older.Email = "Shared@Example.com"
+	newer := newTestProfile("newer", now)
+	newer.Email = "shared@example.com"
+	require.NoError(t, repo.CreateProfile(ctx, newer))
+	require.NoError(t, repo.CreateProfile(ctx, older))
+
+	got, err := repo.GetProfileByEmail(ctx, "SHARED@example.COM")
+	require.NoError(t, err)
+	assert.Equal(t, older.ID, got.ID, "the oldest profile wins")
+
+	_, err = repo.GetProfileByEmail(ctx, "nobody@example.com")
+	assert.EqualError(t, err, "profile not found")
+}
+
+func testRoleAndLock(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	profile := newTestProfile("alice", testNow())
+	require.NoError(t, repo.CreateProfile(ctx, profile))
+
+	got, err := repo.GetProfile(ctx, profile.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got.LockedAt)
+
+	require.NoError(t, repo.UpdateRole(ctx, profile.ID, model.RoleAdmin))
+	lockedAt := testNow()
+	require.NoError(t, repo.SetLockedAt(ctx, profile.ID, &lockedAt))
+
+	got, err = repo.GetProfileByUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, got.Role)
+	require.NotNil(t, got.LockedAt)
+	assertSameTime(t, lockedAt, *got.LockedAt)
+	got, err = repo.GetProfileByEmail(ctx, profile.Email)
+	require.NoError(t, err)
+	assert.True(t, got.Locked())
+
+	require.NoError(t, repo.SetLockedAt(ctx, profile.ID, nil))
+	got, err = repo.GetProfile(ctx, profile.ID)
+	require.NoError(t, err)
+	assert.False(t, got.Locked())
+
+	assert.EqualError(t, repo.UpdateRole(ctx, "missing", model.RoleUser), "profile not found")
+	assert.EqualError(t, repo.SetLockedAt(ctx, "missing", nil), "profile not found")
+}
+
+func testDeleteProfileCascades(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	admin := newTestProfile("admin", now)
+	require.NoError(t, repo.CreateProfile(ctx, admin))
+
+	invitation := model.Invitation{
+		ID: uuid.New().String(), Email: "guest@example.com", Role: model.RoleUser, CodeHash: "code-hash",
+		CreatedBy: admin.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+	}
+	require.NoError(t, repo.CreateInvitation(ctx, invitation))
+	session := model.Session{ID: uuid.New().String(), ProfileID: admin.ID, CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, repo.CreateSession(ctx, session))
+	link := model.MagicLink{ID: uuid.New().String(), ProfileID: admin.ID, TokenHash: "token-hash", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, repo.CreateMagicLink(ctx, link, 1, now.Add(-time.Hour)))
+
+	require.NoError(t, repo.DeleteProfile(ctx, admin.ID))
+
+	_, err := repo.GetSession(ctx, session.ID)
+	assert.EqualError(t, err, "session not found")
+	_, err = repo.ConsumeMagicLink(ctx, "token-hash", now)
+	assert.EqualError(t, err, "magic link not found")
+
+	// Invitations outlive their creator
+	got, err := repo.GetInvitationByCodeHash(ctx, "code-hash")
+	require.NoError(t, err)
+	assert.Empty(t, got.CreatedBy)
+}
+
+func testInvitations(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	newInvitation := func(codeHash string, createdAt, expiresAt time.Time) model.Invitation {
+		return model.Invitation{
+			ID: uuid.New().String(), Email: codeHash + "@example.com", Role: model.RoleUser,
+			CodeHash: codeHash, CreatedAt: createdAt, ExpiresAt: expiresAt,
+		}
+	}
+	older := newInvitation("older", now.Add(-2*time.Minute), now.Add(time.Hour))
+	newer := newInvitation("newer", now.Add(-time.Minute), now.Add(time.Hour))
+	expired := newInvitation("expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	revoked := newInvitation("revoked", now, now.Add(time.Hour))
+	for _, invitation := range []model.Invitation{older, newer, expired, revoked} {
+		require.NoError(t, repo.CreateInvitation(ctx, invitation))
+	}
+
+	// Code hashes are unique, and creators must exist
+	assert.Error(t, repo.CreateInvitation(ctx, newInvitation("older", now, now.Add(time.Hour))))
+	unknownCreator := newInvitation("unknown-creator", now, now.Add(time.Hour))
+	unknownCreator.CreatedBy = uuid.New().String()
+	assert.Error(t, repo.CreateInvitation(ctx, unknownCreator))
+
+	got, err := repo.GetInvitationByCodeHash(ctx, "older")
+	require.NoError(t, err)
+	assert.Equal(t, older.ID, got.ID)
+	assert.Equal(t, older.Email, got.Email)
+	assertSameTime(t, older.ExpiresAt, got.ExpiresAt)
+	assert.Nil(t, got.UsedAt)
+	assert.Nil(t, got.RevokedAt)
+
+	_, err = repo.GetInvitationByCodeHash(ctx, "unknown")
+	assert.EqualError(t, err, "invitation not found")
+
+	require.NoError(t, repo.RevokeInvitation(ctx, revoked.ID, now))
+	assert.EqualError(t, repo.RevokeInvitation(ctx, revoked.ID, now), "invitation not found")
+	assert.EqualError(t, repo.RevokeInvitation(ctx, uuid.New().String(), now), "invitation not found")
+
+	got, err = repo.GetInvitationByCodeHash(ctx, "revoked")
+	require.NoError(t, err)
+	require.NotNil(t, got.RevokedAt)
+	assertSameTime(t, now, *got.RevokedAt)
+
+	pending, err := repo.ListPendingInvitations(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, newer.ID, pending[0].ID, "newest first")
+	assert.Equal(t, older.ID, pending[1].ID)
+}
+
+func testCreateProfileWithInvitation(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	taken := newTestProfile("taken", now)
+	require.NoError(t, repo.CreateProfile(ctx, taken))
+
+	invitation := model.Invitation{
+		ID: uuid.New().String(), Email: "guest@example.com", Role: model.RoleAdmin,
+		CodeHash: "code-hash", CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+	}
+	require.NoError(t, repo.CreateInvitation(ctx, invitation))
+
+	// A profile that can't be created doesn't use up the invitation
+	duplicate := newTestProfile("taken", now)
+	duplicate.Email = "guest@example.com"
+	assert.Error(t, repo.CreateProfileWithInvitation(ctx, duplicate, invitation.ID, now))
+	got, err := repo.GetInvitationByCodeHash(ctx, "code-hash")
+	require.NoError(t, err)
+	assert.Nil(t, got.UsedAt)
+
+	guest := newTestProfile("guest", now)
+	guest.Role = model.RoleAdmin
+	require.NoError(t, repo.CreateProfileWithInvitation(ctx, guest, invitation.ID, now))
+
+	got, err = repo.GetInvitationByCodeHash(ctx, "code-hash")
+	require.NoError(t, err)
+	require.NotNil(t, got.UsedAt)
+	assert.Equal(t, guest.ID, got.UsedBy)
+
+	profile, err := repo.GetProfile(ctx, guest.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, profile.Role)
+
+	// The invitation can't be used twice
+	other := newTestProfile("other", now)
+	assert.EqualError(t, repo.CreateProfileWithInvitation(ctx, other, invitation.ID, now), "invitation not found")
+	_, err = repo.GetProfile(ctx, other.ID)
+	assert.EqualError(t, err, "profile not found")
+
+	// Nor after it expired
+	expired := model.Invitation{
+		ID: uuid.New().String(), Email: "late@example.com", Role: model.RoleUser,
+		CodeHash: "expired", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour),
+	}
+	require.NoError(t, repo.CreateInvitation(ctx, expired))
+	assert.EqualError(t, repo.CreateProfileWithInvitation(ctx, other, expired.ID, now), "invitation not found")
+}
+
+func testSessions(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	alice := newTestProfile("alice", now)
+	bob := newTestProfile("bob", now)
+	require.NoError(t, repo.CreateProfile(ctx, alice))
+	require.NoError(t, repo.CreateProfile(ctx, bob))
+
+	newSession := func(profileID string, lastSeenAt, expiresAt time.Time) model.Session {
+		return model.Session{
+			ID: uuid.New().String(), ProfileID: profileID, UserAgent: "Mozilla/5.0", IP: "192.0.2.1",
+			CreatedAt: now.Add(-time.Hour), LastSeenAt: lastSeenAt, ExpiresAt: expiresAt,
+		}
+	}
+	current := newSession(alice.ID, now, now.Add(time.Hour))
+	laptop := newSession(alice.ID, now.Add(-time.Minute), now.Add(time.Hour))
+	phone := newSession(alice.ID, now.Add(-2*time.Minute), now.Add(time.Hour))
+	expired := newSession(alice.ID, now.Add(-time.Hour), now.Add(-time.Minute))
+	bobs := newSession(bob.ID, now, now.Add(time.Hour))
+	for _, session := range []model.Session{current, laptop, phone, expired, bobs} {
+		require.NoError(t, repo.CreateSession(ctx, session))
+	}
+
+	// Sessions belong to existing profiles
+	assert.Error(t, repo.CreateSession(ctx, newSession(uuid.New().String(), now, now.Add(time.Hour))))
+
+	got, err := repo.GetSession(ctx, laptop.ID)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, got.ProfileID)
+	assert.Equal(t, "Mozilla/5.0", got.UserAgent)
+	assert.Equal(t, "192.0.2.1", got.IP)
+	assertSameTime(t, laptop.LastSeenAt, got.LastSeenAt)
+	assert.Nil(t, got.RevokedAt)
+
+	_, err = repo.GetSession(ctx, uuid.New().String())
+	assert.EqualError(t, err, "session not found")
+
+	active, err := repo.ListActiveSessions(ctx, alice.ID, now)
+	require.NoError(t, err)
+	require.Len(t, active, 3)
+	assert.Equal(t, []string{current.ID, laptop.ID, phone.ID}, []string{active[0].ID, active[1].ID, active[2].ID}, "most recently seen first")
+
+	// Touching moves the phone to the top
+	require.NoError(t, repo.TouchSession(ctx, phone.ID, now.Add(time.Second)))
+	require.NoError(t, repo.TouchSession(ctx, uuid.New().String(), now))
+	active, err = repo.ListActiveSessions(ctx, alice.ID, now)
+	require.NoError(t, err)
+	assert.Equal(t, phone.ID, active[0].ID)
+
+	// Only the owner can revoke, and only once
+	assert.EqualError(t, repo.RevokeSession(ctx, bob.ID, laptop.ID, now), "session not found")
+	require.NoError(t, repo.RevokeSession(ctx, alice.ID, laptop.ID, now))
+	assert.EqualError(t, repo.RevokeSession(ctx, alice.ID, laptop.ID, now), "session not found")
+
+	got, err = repo.GetSession(ctx, laptop.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.RevokedAt)
+	assertSameTime(t, now, *got.RevokedAt)
+
+	// Only the phone is left to revoke: the laptop is revoked and the
+	// expired session doesn't count
+	revoked, err := repo.RevokeOtherSessions(ctx, alice.ID, current.ID, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, revoked)
+
+	active, err = repo.ListActiveSessions(ctx, alice.ID, now)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	assert.Equal(t, current.ID, active[0].ID)
+
+	active, err = repo.ListActiveSessions(ctx, bob.ID, now)
+	require.NoError(t, err)
+	assert.Len(t, active, 1, "other profiles keep their sessions")
+}
+
+func testMagicLinks(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	profile := newTestProfile("alice", now)
+	require.NoError(t, repo.CreateProfile(ctx, profile))
+	since := now.Add(-15 * time.Minute)
+
+	link := model.MagicLink{
+		ID: uuid.New().String(), ProfileID: profile.ID, TokenHash: "token-hash", FingerprintHash: "fingerprint-hash",
+		CreatedAt: now, ExpiresAt: now.Add(15 * time.Minute),
+	}
+	require.NoError(t, repo.CreateMagicLink(ctx, link, 10, since))
+
+	// Token hashes are unique, and links belong to existing profiles
+	duplicate := link
+	duplicate.ID = uuid.New().String()
+	assert.Error(t, repo.CreateMagicLink(ctx, duplicate, 10, since))
+	orphan := link
+	orphan.ID = uuid.New().String()
+	orphan.TokenHash = "orphan"
+	orphan.ProfileID = uuid.New().String()
+	assert.Error(t, repo.CreateMagicLink(ctx, orphan, 10, since))
+
+	usedAt := now.Add(time.Minute)
+	got, err := repo.ConsumeMagicLink(ctx, "token-hash", usedAt)
+	require.NoError(t, err)
+	assert.Equal(t, link.ID, got.ID)
+	assert.Equal(t, profile.ID, got.ProfileID)
+	assert.Equal(t, "fingerprint-hash", got.FingerprintHash)
+	assertSameTime(t, link.ExpiresAt, got.ExpiresAt)
+	require.NotNil(t, got.UsedAt)
+	assertSameTime(t, usedAt, *got.UsedAt)
+
+	_, err = repo.ConsumeMagicLink(ctx, "token-hash", usedAt)
+	assert.EqualError(t, err, "magic link not found", "links are single use")
+	_, err = repo.ConsumeMagicLink(ctx, "unknown", usedAt)
+	assert.EqualError(t, err, "magic link not found")
+
+	expiring := link
+	expiring.ID = uuid.New().String()
+	expiring.TokenHash = "expiring"
+	require.NoError(t, repo.CreateMagicLink(ctx, expiring, 10, since))
+	_, err = repo.ConsumeMagicLink(ctx, "expiring", expiring.ExpiresAt)
+	assert.EqualError(t, err, "magic link not found", "links expire")
+
+	// Used links count against the limit as well as pending ones, and
+	// only those created after since
+	limited := link
+	limited.ID = uuid.New().String()
+	limited.TokenHash = "limited"
+	assert.EqualError(t, repo.CreateMagicLink(ctx, limited, 2, since), "too many magic links")
+	require.NoError(t, repo.CreateMagicLink(ctx, limited, 2, now))
+
+	// Concurrent requests for a profile can't all pass the count
+	other := newTestProfile("bob", now)
+	require.NoError(t, repo.CreateProfile(ctx, other))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link := model.MagicLink{
+				ID: uuid.New().String(), ProfileID: other.ID, TokenHash: uuid.New().String(), FingerprintHash: "fingerprint-hash",
+				CreatedAt: now, ExpiresAt: now.Add(15 * time.Minute),
+			}
+			err := repo.CreateMagicLink(ctx, link, 3, since)
+			if err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+				return
+			}
+			assert.EqualError(t, err, "too many magic links")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, created)
+}
+
+func newTestSubscriber(email string, createdAt time.Time) model.Subscriber {
+	return model.Subscriber{
+		ID:               uuid.New().String(),
+		Email:            email,
+		ConfirmTokenHash: "confirm-" + email,
+		ConfirmExpiresAt: createdAt.Add(48 * time.Hour),
+		UnsubscribeToken: "unsubscribe-" + email,
+		CreatedAt:        createdAt,
+	}
+}
+
+func testSubscribers(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	alice := newTestSubscriber("alice@example.com", now)
+	require.NoError(t, repo.CreateSubscriber(ctx, alice))
+	bob := newTestSubscriber("bob@example.com", now.Add(time.Second))
+	require.NoError(t, repo.CreateSubscriber(ctx, bob))
+
+	// Emails and tokens are unique
+	duplicate := newTestSubscriber("alice@example.com", now)
+	assert.Error(t, repo.CreateSubscriber(ctx, duplicate))
+	duplicate = newTestSubscriber("carol@example.com", now)
+	duplicate.ConfirmTokenHash = alice.ConfirmTokenHash
+	assert.Error(t, repo.CreateSubscriber(ctx, duplicate))
+
+	got, err := repo.GetSubscriberByEmail(ctx, "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, got.ID)
+	assert.Equal(t, alice.UnsubscribeToken, got.UnsubscribeToken)
+	assertSameTime(t, alice.ConfirmExpiresAt, got.ConfirmExpiresAt)
+	assert.Equal(t, model.SubscriberPending, got.Status())
+	_, err = repo.GetSubscriberByEmail(ctx, "nobody@example.com")
+	assert.EqualError(t, err, "subscriber not found")
+
+	confirmedAt := now.Add(time.Minute)
+	got, err = repo.ConfirmSubscriber(ctx, alice.ConfirmTokenHash, confirmedAt)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID, got.ID)
+	require.NotNil(t, got.ConfirmedAt)
+	assertSameTime(t, confirmedAt, *got.ConfirmedAt)
+	_, err = repo.ConfirmSubscriber(ctx, alice.ConfirmTokenHash, confirmedAt)
+	assert.EqualError(t, err, "subscriber not found", "confirmation tokens are single use")
+	_, err = repo.ConfirmSubscriber(ctx, bob.ConfirmTokenHash, bob.ConfirmExpiresAt)
+	assert.EqualError(t, err, "subscriber not found", "confirmation tokens expire")
+
+	unsubscribedAt := now.Add(2 * time.Minute)
+	got, err = repo.Unsubscribe(ctx, alice.UnsubscribeToken, unsubscribedAt)
+	require.NoError(t, err)
+	assert.Equal(t, model.SubscriberUnsubscribed, got.Status())
+	got, err = repo.Unsubscribe(ctx, alice.UnsubscribeToken, unsubscribedAt.Add(time.Hour))
+	require.NoError(t, err, "unsubscribing twice is fine")
+	require.NotNil(t, got.UnsubscribedAt)
+	assertSameTime(t, unsubscribedAt, *got.UnsubscribedAt)
+	_, err = repo.Unsubscribe(ctx, "unknown", unsubscribedAt)
+	assert.EqualError(t, err, "subscriber not found")
+
+	// Subscribing again makes an unsubscribed reader pending with a new token
+	require.NoError(t, repo.RenewSubscription(ctx, alice.ID, "renewed", now.Add(time.Hour)))
+	got, err = repo.GetSubscriberByEmail(ctx, "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, model.SubscriberPending, got.Status())
+	assert.Equal(t, "renewed", got.ConfirmTokenHash)
+	assert.Equal(t, alice.UnsubscribeToken, got.UnsubscribeToken)
+	assert.EqualError(t, repo.RenewSubscription(ctx, uuid.New().String(), "other", now), "subscriber not found")
+
+	subscribers, err := repo.ListSubscribers(ctx)
+	require.NoError(t, err)
+	require.Len(t, subscribers, 2)
+	assert.Equal(t, alice.ID, subscribers[0].ID)
+	assert.Equal(t, bob.ID, subscribers[1].ID)
+}
+
+func testNewsletterPosts(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	newPost := func(slug string, publishedAt time.Time) model.NewsletterPost {
+		return model.NewsletterPost{
+			ID: uuid.New().String(), Title: "Title of " + slug, Slug: slug, Excerpt: "Excerpt",
+			PublishedAt: publishedAt, QueuedAt: now,
+		}
+	}
+	second := newPost("second", now.Add(-time.Hour))
+	first := newPost("first", now.Add(-2*time.Hour))
+	require.NoError(t, repo.QueueNewsletterPost(ctx, second))
+	require.NoError(t, repo.QueueNewsletterPost(ctx, first))
+
+	// Queueing a post again keeps the first version
+	renamed := first
+	renamed.Title = "Renamed"
+	require.NoError(t, repo.QueueNewsletterPost(ctx, renamed))
+
+	lease := now.Add(time.Hour)
+	posts, err := repo.ClaimNewsletterPosts(ctx, now, lease)
+	require.NoError(t, err)
+	require.Len(t, posts, 2)
+	assert.Equal(t, first.ID, posts[0].ID)
+	assert.Equal(t, "Title of first", posts[0].Title)
+	assert.Equal(t, "first", posts[0].Slug)
+	assertSameTime(t, first.PublishedAt, posts[0].PublishedAt)
+	assert.Nil(t, posts[0].SentAt)
+	assert.Equal(t, second.ID, posts[1].ID)
+
+	// Claimed posts are left to their digest until the lease expires
+	posts, err = repo.ClaimNewsletterPosts(ctx, now, lease)
+	require.NoError(t, err)
+	assert.Empty(t, posts)
+
+	require.NoError(t, repo.MarkNewsletterPostsSent(ctx, []string{first.ID}, now))
+	require.NoError(t, repo.ReleaseNewsletterPosts(ctx, []string{first.ID, second.ID}))
+	posts, err = repo.ClaimNewsletterPosts(ctx, now, lease)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+	assert.Equal(t, second.ID, posts[0].ID)
+
+	// Sent posts are not queued again
+	require.NoError(t, repo.QueueNewsletterPost(ctx, first))
+	require.NoError(t, repo.MarkNewsletterPostsSent(ctx, []string{second.ID, uuid.New().String()}, now))
+	posts, err = repo.ClaimNewsletterPosts(ctx, lease.Add(time.Minute), lease.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, posts)
+}
+
+func testAuthorStats(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+	profileID := uuid.New().String()
+
+	stats, err := repo.GetAuthorStats(ctx, profileID)
+	require.NoError(t, err)
+	assert.Equal(t, model.AuthorStats{ProfileID: profileID}, *stats)
+
+	earlier, later := now.Add(-time.Hour), now
+	first := model.AuthorPost{ID: uuid.New().String(), ProfileID: profileID, IsPublished: true, ViewCount: 10, PublishedAt: &earlier, Version: 1}
+	second := model.AuthorPost{ID: uuid.New().String(), ProfileID: profileID, IsPublished: true, ViewCount: 5, PublishedAt: &later, Version: 1}
+	draft := model.AuthorPost{ID: uuid.New().String(), ProfileID: profileID, ViewCount: 1, Version: 1}
+	other := model.AuthorPost{ID: uuid.New().String(), ProfileID: uuid.New().String(), IsPublished: true, ViewCount: 100, PublishedAt: &later, Version: 1}
+	for _, post := range []model.AuthorPost{first, second, draft, other} {
+		require.NoError(t, repo.SaveAuthorPost(ctx, post))
+	}
+
+	stats, err = repo.GetAuthorStats(ctx, profileID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.PublishedCount)
+	assert.Equal(t, 1, stats.DraftCount)
+	assert.Equal(t, int64(16), stats.TotalViews)
+	require.NotNil(t, stats.LastPublishedAt)
+	assertSameTime(t, later, *stats.LastPublishedAt)
+
+	// The latest post is deleted, then an older change of it is replayed
+	deleted := second
+	deleted.Deleted = true
+	deleted.Version = 3
+	require.NoError(t, repo.SaveAuthorPost(ctx, deleted))
+	replayed := second
+	replayed.ViewCount = 7
+	replayed.Version = 2
+	require.NoError(t, repo.SaveAuthorPost(ctx, replayed))
+
+	// A change with the same version is applied again
+	require.NoError(t, repo.SaveAuthorPost(ctx, first))
+
+	stats, err = repo.GetAuthorStats(ctx, profileID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.PublishedCount)
+	assert.Equal(t, 1, stats.DraftCount)
+	assert.Equal(t, int64(11), stats.TotalViews)
+	require.NotNil(t, stats.LastPublishedAt)
+	assertSameTime(t, earlier, *stats.LastPublishedAt)
+
+	// Unpublishing makes a draft
+	unpublished := first
+	unpublished.IsPublished = false
+	unpublished.Version = 2
+	require.NoError(t, repo.SaveAuthorPost(ctx, unpublished))
+	stats, err = repo.GetAuthorStats(ctx, profileID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.PublishedCount)
+	assert.Equal(t, 2, stats.DraftCount)
+	assert.Nil(t, stats.LastPublishedAt)
+}
+
+func newTestWebhook(createdBy string, createdAt time.Time) model.Webhook {
+	return model.Webhook{
+		ID:        uuid.New().String(),
+		URL:       "https://hooks.example.com/okblog",
+		Events:    []string{model.EventProfileCreated, model.EventProfileDeleted},
+		Secret:    "secret",
+		CreatedBy: createdBy,
+		CreatedAt: createdAt,
+	}
+}
+
+func testWebhooks(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	admin := newTestProfile("admin", now)
+	require.NoError(t, repo.CreateProfile(ctx, admin))
+
+	older := newTestWebhook(admin.ID, now.Add(-time.Minute))
+	newer := newTestWebhook("", now)
+	newer.Events = []string{model.EventNewDeviceLogin}
+	require.NoError(t, repo.CreateWebhook(ctx, newer))
+	require.NoError(t, repo.CreateWebhook(ctx, older))
+
+	// Creators must exist
+	assert.Error(t, repo.CreateWebhook(ctx, newTestWebhook(uuid.New().String(), now)))
+
+	got, err := repo.GetWebhook(ctx, older.ID)
+	require.NoError(t, err)
+	assert.Equal(t, older.URL, got.URL)
+	assert.Equal(t, older.Events, got.Events)
+	assert.Equal(t, older.Secret, got.Secret)
+	assert.Equal(t, admin.ID, got.CreatedBy)
+	assertSameTime(t, older.CreatedAt, got.CreatedAt)
+
+	_, err = repo.GetWebhook(ctx, uuid.New().String())
+	assert.EqualError(t, err, "webhook not found")
+
+	webhooks, err := repo.ListWebhooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 2)
+	assert.Equal(t, older.ID, webhooks[0].ID, "oldest first")
+	assert.Equal(t, newer.ID, webhooks[1].ID)
+	assert.Empty(t, webhooks[1].CreatedBy)
+
+	// Webhooks outlive their creator
+	require.NoError(t, repo.DeleteProfile(ctx, admin.ID))
+	got, err = repo.GetWebhook(ctx, older.ID)
+	require.NoError(t, err)
+	assert.Empty(t, got.CreatedBy)
+
+	require.NoError(t, repo.DeleteWebhook(ctx, older.ID))
+	assert.EqualError(t, repo.DeleteWebhook(ctx, older.ID), "webhook not found")
+	webhooks, err = repo.ListWebhooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+}
+
+func testWebhookDeliveries(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	webhook := newTestWebhook("", now)
+	require.NoError(t, repo.CreateWebhook(ctx, webhook))
+
+	newDelivery := func(createdAt, nextAttemptAt time.Time) model.WebhookDelivery {
+		return model.WebhookDelivery{
+			ID: uuid.New().String(), WebhookID: webhook.ID, Event: model.EventProfileCreated,
+			Payload: `{"type":"profile.created"}`, Status: model.DeliveryPending,
+			CreatedAt: createdAt, NextAttemptAt: nextAttemptAt,
+		}
+	}
+	first := newDelivery(now.Add(-2*time.Minute), now.Add(-2*time.Minute))
+	second := newDelivery(now.Add(-time.Minute), now.Add(-time.Minute))
+	later := newDelivery(now, now.Add(time.Hour))
+	for _, delivery := range []model.WebhookDelivery{first, second, later} {
+		require.NoError(t, repo.CreateWebhookDelivery(ctx, delivery))
+	}
+
+	// Deliveries belong to an existing webhook
+	orphan := newDelivery(now, now)
+	orphan.WebhookID = uuid.New().String()
+	assert.Error(t, repo.CreateWebhookDelivery(ctx, orphan))
+
+	// Claims take the due deliveries, oldest first, and lease them
+	lease := now.Add(5 * time.Minute)
+	claimed, err := repo.ClaimWebhookDeliveries(ctx, now, lease, 1)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, first.ID, claimed[0].ID)
+	assert.Equal(t, first.Payload, claimed[0].Payload)
+	assertSameTime(t, lease, claimed[0].NextAttemptAt)
+
+	claimed, err = repo.ClaimWebhookDeliveries(ctx, now, lease, 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1, "leased deliveries are not claimed again")
+	assert.Equal(t, second.ID, claimed[0].ID)
+
+	// The first delivery went through, the second is retried
+	deliveredAt := now
+	delivered := first
+	delivered.Status = model.DeliveryDelivered
+	delivered.Attempts = 1
+	delivered.ResponseStatus = 204
+	delivered.NextAttemptAt = now
+	delivered.DeliveredAt = &deliveredAt
+	require.NoError(t, repo.UpdateWebhookDelivery(ctx, delivered))
+	retried := second
+	retried.Attempts = 1
+	retried.ResponseStatus = 500
+	retried.LastError = "receiver answered 500 Internal Server Error"
+	retried.NextAttemptAt = now.Add(time.Minute)
+	require.NoError(t, repo.UpdateWebhookDelivery(ctx, retried))
+	assert.EqualError(t, repo.UpdateWebhookDelivery(ctx, orphan), "webhook delivery not found")
+
+	claimed, err = repo.ClaimWebhookDeliveries(ctx, now.Add(time.Minute), lease, 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1, "delivered deliveries are not claimed")
+	assert.Equal(t, second.ID, claimed[0].ID)
+	assert.Equal(t, 1, claimed[0].Attempts)
+
+	deliveries, err := repo.ListWebhookDeliveries(ctx, webhook.ID, 2)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, later.ID, deliveries[0].ID, "newest first")
+	assert.Equal(t, second.ID, deliveries[1].ID)
+	assert.Equal(t, 500, deliveries[1].ResponseStatus)
+	assert.Equal(t, retried.LastError, deliveries[1].LastError)
+
+	deliveries, err = repo.ListWebhookDeliveries(ctx, webhook.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 3)
+	assert.Equal(t, model.DeliveryDelivered, deliveries[2].Status)
+	require.NotNil(t, deliveries[2].DeliveredAt)
+	assertSameTime(t, deliveredAt, *deliveries[2].DeliveredAt)
+
+	// Deliveries go with their webhook
+	require.NoError(t, repo.DeleteWebhook(ctx, webhook.ID))
+	deliveries, err = repo.ListWebhookDeliveries(ctx, webhook.ID, 10)
+	require.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func testImpersonationSessions(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	admin := newTestProfile("admin", now)
+	alice := newTestProfile("alice", now)
+	require.NoError(t, repo.CreateProfile(ctx, admin))
+	require.NoError(t, repo.CreateProfile(ctx, alice))
+
+	newSession := func(impersonatorID string) model.Session {
+		return model.Session{
+			ID: uuid.New().String(), ProfileID: alice.ID, ImpersonatorID: impersonatorID,
+			CreatedAt: now, LastSeenAt: now, ExpiresAt: now.Add(time.Hour),
+		}
+	}
+	impersonation := newSession(admin.ID)
+	own := newSession("")
+	require.NoError(t, repo.CreateSession(ctx, impersonation))
+	require.NoError(t, repo.CreateSession(ctx, own))
+
+	// Impersonators must exist
+	assert.Error(t, repo.CreateSession(ctx, newSession(uuid.New().String())))
+
+	got, err := repo.GetSession(ctx, impersonation.ID)
+	require.NoError(t, err)
+	assert.Equal(t, admin.ID, got.ImpersonatorID)
+	got, err = repo.GetSession(ctx, own.ID)
+	require.NoError(t, err)
+	assert.Empty(t, got.ImpersonatorID)
+
+	// Deleting the admin ends the impersonation
+	require.NoError(t, repo.DeleteProfile(ctx, admin.ID))
+	_, err = repo.GetSession(ctx, impersonation.ID)
+	assert.EqualError(t, err, "session not found")
+	active, err := repo.ListActiveSessions(ctx, alice.ID, now)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	assert.Equal(t, own.ID, active[0].ID)
+}
+
+func testAuditEvents(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	newEvent := func(action, profileID, actorID string, createdAt time.Time) model.AuditEvent {
+		return model.AuditEvent{
+			ID: uuid.New().String(), Action: action, ProfileID: profileID, ActorID: actorID,
+			RequestID: "request-id", IP: "192.0.2.1", CreatedAt: createdAt,
+		}
+	}
+	// The audit trail doesn't reference profiles, it outlives them
+	admin, other, alice, bob := uuid.New().String(), uuid.New().String(), uuid.New().String(), uuid.New().String()
+	started := newEvent(model.AuditImpersonationStarted, alice, admin, now.Add(-time.Minute))
+	started.Target = uuid.New().String()
+	revoked := newEvent(model.AuditSessionRevoked, alice, admin, now)
+	bobs := newEvent(model.AuditImpersonationStarted, bob, other, now.Add(-time.Second))
+	for _, event := range []model.AuditEvent{started, revoked, bobs} {
+		require.NoError(t, repo.CreateAuditEvent(ctx, event))
+	}
+
+	events, err := repo.ListAuditEvents(ctx, model.AuditEventFilter{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, []string{revoked.ID, bobs.ID, started.ID}, []string{events[0].ID, events[1].ID, events[2].ID}, "newest first")
+	got := events[2]
+	assert.Equal(t, model.AuditImpersonationStarted, got.Action)
+	assert.Equal(t, alice, got.ProfileID)
+	assert.Equal(t, admin, got.ActorID)
+	assert.Equal(t, started.Target, got.Target)
+	assert.Equal(t, "request-id", got.RequestID)
+	assert.Equal(t, "192.0.2.1", got.IP)
+	assertSameTime(t, started.CreatedAt, got.CreatedAt)
+
+	events, err = repo.ListAuditEvents(ctx, model.AuditEventFilter{ProfileID: alice, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	events, err = repo.ListAuditEvents(ctx, model.AuditEventFilter{ActorID: other, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, bobs.ID, events[0].ID)
+
+	events, err = repo.ListAuditEvents(ctx, model.AuditEventFilter{ProfileID: alice, ActorID: other, Limit: 10})
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	events, err = repo.ListAuditEvents(ctx, model.AuditEventFilter{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, revoked.ID, events[0].ID)
+}
+
+func testPreferences(t *testing.T, repo Repository) {
+	ctx := context.Background()
+	now := testNow()
+
+	alice := newTestProfile("alice", now)
+	require.NoError(t, repo.CreateProfile(ctx, alice))
+
+	// New profiles start with an empty document
+	preferences, err := repo.GetPreferences(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{}, preferences)
+
+	spellCheck := false
+	updated := model.Preferences{
+		Locale:   "pt-BR",
+		Timezone: "America/Sao_Paulo",
+		Editor:   &model.EditorPreferences{Mode: model.EditorMarkdown, FontSize: 16, SpellCheck: &spellCheck},
+	}
+	preferences, err = repo.UpdatePreferences(ctx, alice.ID, func(preferences *model.Preferences) error {
+		assert.Equal(t, &model.Preferences{}, preferences)
+		*preferences = updated
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &updated, preferences)
+	preferences, err = repo.GetPreferences(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &updated, preferences)
+
+	// An error from update leaves the document alone
+	rejected := errors.New("rejected")
+	_, err = repo.UpdatePreferences(ctx, alice.ID, func(preferences *model.Preferences) error {
+		assert.Equal(t, &updated, preferences)
+		preferences.Locale = "en"
+		return rejected
+	})
+	assert.Equal(t, rejected, err)
+	preferences, err = repo.GetPreferences(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &updated, preferences)
+
+	// The public profile is unchanged
+	profile, err := repo.GetProfile(ctx, alice.ID)
+	require.NoError(t, err)
+	assert.True(t, profile.UpdatedAt.Equal(alice.UpdatedAt))
+
+	_, err = repo.GetPreferences(ctx, uuid.New().String())
+	assert.EqualError(t, err, "profile not found")
+	_, err = repo.UpdatePreferences(ctx, uuid.New().String(), func(*model.Preferences) error { return nil })
+	assert.EqualError(t, err, "profile not found")
+}
@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// invitationColumns are selected by every invitation query, in scanInvitation order
+const invitationColumns = `id, email, role, code_hash, COALESCE(created_by, ''), created_at, expires_at, used_at, COALESCE(used_by, ''), revoked_at`
+
+// scanInvitation reads a row selected with invitationColumns
+func scanInvitation(row interface{ Scan(...interface{}) error }) (*model.Invitation, error) {
+	var invitation model.Invitation
+	var usedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.Email,
+		&invitation.Role,
+		&invitation.CodeHash,
+		&invitation.CreatedBy,
+		&invitation.CreatedAt,
+		&invitation.ExpiresAt,
+		&usedAt,
+		&invitation.UsedBy,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		invitation.UsedAt = &usedAt.Time
+	}
+	if revokedAt.Valid {
+		invitation.RevokedAt = &revokedAt.Time
+	}
+	return &invitation, nil
+}
+
+// CreateInvitation stores a new invitation
+func (r *PostgresRepository) CreateInvitation(ctx context.Context, invitation model.Invitation) error {
+	query := `
+		INSERT INTO invitations (id, email, role, code_hash, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateInvitation", "INSERT", "invitations", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		invitation.ID,
+		invitation.Email,
+		invitation.Role,
+		invitation.CodeHash,
+		invitation.CreatedBy,
+		invitation.CreatedAt,
+		invitation.ExpiresAt,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create invitation", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetInvitationByCodeHash retrieves an invitation by the hash of its code,
+// whether or not it is still pending
+func (r *PostgresRepository) GetInvitationByCodeHash(ctx context.Context, codeHash string) (*model.Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations WHERE code_hash = $1`
+
+	ctx, span := r.startSpan(ctx, "GetInvitationByCodeHash", "SELECT", "invitations", query)
+	defer span.End()
+
+	invitation, err := scanInvitation(r.db.QueryRowContext(ctx, query, codeHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("invitation not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get invitation", "err", err)
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// ListPendingInvitations returns the invitations that are neither used,
+// revoked nor expired at now, newest first
+func (r *PostgresRepository) ListPendingInvitations(ctx context.Context, now time.Time) ([]model.Invitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE used_at IS NULL AND revoked_at IS NULL AND expires_at > $1
+		ORDER BY created_at DESC
+	`
+
+	ctx, span := r.startSpan(ctx, "ListPendingInvitations", "SELECT", "invitations", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, now)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list invitations", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []model.Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan invitation", "err", err)
+			return nil, err
+		}
+		invitations = append(invitations, *invitation)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list invitations", "err", err)
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// RevokeInvitation revokes a pending invitation. Used and already revoked
+// invitations are reported as not found.
+func (r *PostgresRepository) RevokeInvitation(ctx context.Context, id string, now time.Time) error {
+	query := `
+		UPDATE invitations
+		SET revoked_at = $1
+		WHERE id = $2 AND used_at IS NULL AND revoked_at IS NULL
+	`
+
+	ctx, span := r.startSpan(ctx, "RevokeInvitation", "UPDATE", "invitations", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, now, id)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to revoke invitation", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("invitation not found")
+	}
+
+	return nil
+}
+
+// CreateProfileWithInvitation redeems the invitation and creates the profile
+// in one transaction, so a code can't be used twice and isn't used up when
+// the profile can't be created
+func (r *PostgresRepository) CreateProfileWithInvitation(ctx context.Context, profile model.Profile, invitationID string, now time.Time) error {
+	query := `
+		UPDATE invitations
+		SET used_at = $1, used_by = $2
+		WHERE id = $3 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > $1
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateProfileWithInvitation", "UPDATE", "invitations", query)
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to begin transaction", "err", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, now, profile.ID, invitationID)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to redeem invitation", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("invitation not found")
+	}
+
+	if _, err := tx.ExecContext(ctx, insertProfileQuery, insertProfileArgs(profile)...); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create profile", "err", err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to commit transaction", "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var invitationRowColumns = []string{"id", "email", "role", "code_hash", "created_by", "created_at", "expires_at", "used_at", "used_by", "revoked_at"}
+
+func TestCreateInvitation(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	invitation := model.Invitation{
+		ID:        uuid.New().String(),
+		Email:     "new@example.com",
+		Role:      model.RoleUser,
+		CodeHash:  "hash",
+		CreatedBy: uuid.New().String(),
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`
+		INSERT INTO invitations (id, email, role, code_hash, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+	`)).WithArgs(
+		invitation.ID,
+		invitation.Email,
+		invitation.Role,
+		invitation.CodeHash,
+		invitation.CreatedBy,
+		invitation.CreatedAt,
+		invitation.ExpiresAt,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Call the method
+	err := repo.CreateInvitation(context.Background(), invitation)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetInvitationByCodeHash(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	id := uuid.New().String()
+	now := time.Now()
+	rows := sqlmock.NewRows(invitationRowColumns).
+		AddRow(id, "new@example.com", model.RoleAdmin, "hash", "", now, now.Add(time.Hour), now, "profile-id", nil)
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ` + invitationColumns + ` FROM invitations WHERE code_hash = $1`)).
+		WithArgs("hash").
+		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM invitations WHERE code_hash = $1`)).
+		WithArgs("unknown").
+		WillReturnError(sql.ErrNoRows)
+
+	// Call the method
+	invitation, err := repo.GetInvitationByCodeHash(context.Background(), "hash")
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, id, invitation.ID)
+	assert.Equal(t, model.RoleAdmin, invitation.Role)
+	assert.Empty(t, invitation.CreatedBy)
+	require.NotNil(t, invitation.UsedAt)
+	assert.Equal(t, "profile-id", invitation.UsedBy)
+	assert.Nil(t, invitation.RevokedAt)
+
+	_, err = repo.GetInvitationByCodeHash(context.Background(), "unknown")
+	assert.EqualError(t, err, "invitation not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListPendingInvitations(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows(invitationRowColumns).
+		AddRow("b", "b@example.com", model.RoleUser, "hash-b", "admin-id", now, now.Add(time.Hour), nil, "", nil).
+		AddRow("a", "a@example.com", model.RoleUser, "hash-a", "admin-id", now.Add(-time.Hour), now.Add(time.Hour), nil, "", nil)
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE used_at IS NULL AND revoked_at IS NULL AND expires_at > $1`)).
+		WithArgs(now).
+		WillReturnRows(rows)
+
+	// Call the method
+	invitations, err := repo.ListPendingInvitations(context.Background(), now)
+
+	// Assertions
+	require.NoError(t, err)
+	require.Len(t, invitations, 2)
+	assert.Equal(t, "b", invitations[0].ID)
+	assert.Equal(t, "a", invitations[1].ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeInvitation(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	query := regexp.QuoteMeta(`
+		UPDATE invitations
+		SET revoked_at = $1
+		WHERE id = $2 AND used_at IS NULL AND revoked_at IS NULL
+	`)
+
+	// Set up expectations
+	mock.ExpectExec(query).WithArgs(now, "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(now, "used").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Call the method
+	assert.NoError(t, repo.RevokeInvitation(context.Background(), "pending", now))
+	assert.EqualError(t, repo.RevokeInvitation(context.Background(), "used", now), "invitation not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateProfileWithInvitation(t *testing.T) {
+	now := time.Now()
+	profile := model.Profile{
+		ID:        uuid.New().String(),
+		Username:  "testuser",
+		Email:     "test@example.com",
+		Password:  "hash",
+		Role:      model.RoleAdmin,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	redeem := regexp.QuoteMeta(`
+		UPDATE invitations
+		SET used_at = $1, used_by = $2
+		WHERE id = $3 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > $1
+	`)
+	insert := regexp.QuoteMeta(`INSERT INTO profiles`)
+
+	t.Run("Redeemed", func(t *testing.T) {
+		db, mock, repo := setupMockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec(redeem).WithArgs(now, profile.ID, "invitation-id").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insert).WithArgs(
+			profile.ID, profile.Username, profile.Email, profile.Password, profile.FirstName,
+			profile.LastName, profile.Bio, profile.Role, profile.CreatedAt, profile.UpdatedAt,
+		).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		assert.NoError(t, repo.CreateProfileWithInvitation(context.Background(), profile, "invitation-id", now))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Already Used", func(t *testing.T) {
+		db, mock, repo := setupMockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec(redeem).WithArgs(now, profile.ID, "invitation-id").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		err := repo.CreateProfileWithInvitation(context.Background(), profile, "invitation-id", now)
+		assert.EqualError(t, err, "invitation not found")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Duplicate Username", func(t *testing.T) {
+		db, mock, repo := setupMockDB(t)
+		defer db.Close()
+
+		// The invitation stays pending when the profile can't be created
+		duplicate := errors.New(`duplicate key value violates unique constraint "profiles_username_key"`)
+		mock.ExpectBegin()
+		mock.ExpectExec(redeem).WithArgs(now, profile.ID, "invitation-id").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(insert).WillReturnError(duplicate)
+		mock.ExpectRollback()
+
+		err := repo.CreateProfileWithInvitation(context.Background(), profile, "invitation-id", now)
+		assert.Equal(t, duplicate, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// CreateMagicLink stores a new magic link if the profile has fewer than limit
+// links created after since. The profile row is locked until the link is
+// inserted, so concurrent requests can't all pass the count.
+func (r *PostgresRepository) CreateMagicLink(ctx context.Context, link model.MagicLink, limit int, since time.Time) error {
+	query := `
+		INSERT INTO magic_links (id, profile_id, token_hash, fingerprint_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateMagicLink", "INSERT", "magic_links", query)
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to begin transaction", "err", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var profileID string
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM profiles WHERE id = $1 FOR UPDATE`, link.ProfileID).Scan(&profileID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("magic link profile does not exist")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to lock profile", "err", err)
+		return err
+	}
+
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM magic_links WHERE profile_id = $1 AND created_at > $2`, link.ProfileID, since).Scan(&count)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to count magic links", "err", err)
+		return err
+	}
+	if count >= limit {
+		return errors.New("too many magic links")
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		query,
+		link.ID,
+		link.ProfileID,
+		link.TokenHash,
+		link.FingerprintHash,
+		link.CreatedAt,
+		link.ExpiresAt,
+	)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create magic link", "err", err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to commit transaction", "err", err)
+		return err
+	}
+	return nil
+}
+
+// ConsumeMagicLink marks a pending magic link as used in a single statement,
+// so concurrent redemptions of the same link can't both succeed
+func (r *PostgresRepository) ConsumeMagicLink(ctx context.Context, tokenHash string, now time.Time) (*model.MagicLink, error) {
+	query := `
+		UPDATE magic_links
+		SET used_at = $1
+		WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+		RETURNING id, profile_id, token_hash, fingerprint_hash, created_at, expires_at, used_at
+	`
+
+	ctx, span := r.startSpan(ctx, "ConsumeMagicLink", "UPDATE", "magic_links", query)
+	defer span.End()
+
+	var link model.MagicLink
+	var usedAt time.Time
+	err := r.db.QueryRowContext(ctx, query, now, tokenHash).Scan(
+		&link.ID,
+		&link.ProfileID,
+		&link.TokenHash,
+		&link.FingerprintHash,
+		&link.CreatedAt,
+		&link.ExpiresAt,
+		&usedAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("magic link not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to consume magic link", "err", err)
+		return nil, err
+	}
+	link.UsedAt = &usedAt
+
+	return &link, nil
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateMagicLink(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	link := model.MagicLink{
+		ID:              uuid.New().String(),
+		ProfileID:       uuid.New().String(),
+		TokenHash:       "token-hash",
+		FingerprintHash: "fingerprint-hash",
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(15 * time.Minute),
+	}
+
+	since := now.Add(-15 * time.Minute)
+
+	// Set up expectations
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM profiles WHERE id = $1 FOR UPDATE`)).
+		WithArgs(link.ProfileID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(link.ProfileID))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM magic_links WHERE profile_id = $1 AND created_at > $2`)).
+		WithArgs(link.ProfileID, since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectExec(regexp.QuoteMeta(`
+		INSERT INTO magic_links (id, profile_id, token_hash, fingerprint_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`)).WithArgs(
+		link.ID,
+		link.ProfileID,
+		link.TokenHash,
+		link.FingerprintHash,
+		link.CreatedAt,
+		link.ExpiresAt,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Call the method
+	err := repo.CreateMagicLink(context.Background(), link, 3, since)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateMagicLink_TooMany(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	since := time.Now().Add(-15 * time.Minute)
+
+	// Set up expectations
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id FROM profiles WHERE id = $1 FOR UPDATE`)).
+		WithArgs("profile-id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("profile-id"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM magic_links WHERE profile_id = $1 AND created_at > $2`)).
+		WithArgs("profile-id", since).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectRollback()
+
+	// Call the method
+	err := repo.CreateMagicLink(context.Background(), model.MagicLink{ProfileID: "profile-id"}, 3, since)
+
+	// Assertions
+	assert.EqualError(t, err, "too many magic links")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestConsumeMagicLink(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "profile_id", "token_hash", "fingerprint_hash", "created_at", "expires_at", "used_at"}).
+		AddRow("link-id", "profile-id", "token-hash", "fingerprint-hash", now.Add(-time.Minute), now.Add(time.Minute), now)
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		UPDATE magic_links
+		SET used_at = $1
+		WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+	`)).WithArgs(now, "token-hash").WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE magic_links`)).
+		WithArgs(now, "token-hash").
+		WillReturnError(sql.ErrNoRows)
+
+	// Call the method
+	link, err := repo.ConsumeMagicLink(context.Background(), "token-hash", now)
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, "profile-id", link.ProfileID)
+	assert.Equal(t, "fingerprint-hash", link.FingerprintHash)
+	require.NotNil(t, link.UsedAt)
+	assert.Equal(t, now, *link.UsedAt)
+
+	// The second redemption of the same link finds nothing pending
+	link, err = repo.ConsumeMagicLink(context.Background(), "token-hash", now)
+	assert.Nil(t, link)
+	assert.EqualError(t, err, "magic link not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
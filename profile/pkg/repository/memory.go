@@ -0,0 +1,979 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+)
+
+// MemoryRepository implements the Repository interface with maps. It keeps
+// the constraints of the PostgreSQL schema (unique usernames, emails and
+// hashes, foreign keys and their cascades) so code tested against it behaves
+// the same on PostgreSQL. Everything is lost when the process exits.
+type MemoryRepository struct {
+	mu          sync.RWMutex
+	profiles    map[string]model.Profile
+	invitations map[string]model.Invitation
+	sessions    map[string]model.Session
+	magicLinks  map[string]model.MagicLink
+	subscribers map[string]model.Subscriber
+	posts       map[string]model.NewsletterPost
+	// postClaims holds the end of the lease of claimed posts
+	postClaims  map[string]time.Time
+	authorPosts map[string]model.AuthorPost
+	webhooks    map[string]model.Webhook
+	deliveries  map[string]model.WebhookDelivery
+	audit       []model.AuditEvent
+	// preferences are stored encoded, like the JSONB column, so callers
+	// never share them
+	preferences map[string][]byte
+}
+
+// NewMemoryRepository creates an empty in-memory repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		profiles:    make(map[string]model.Profile),
+		invitations: make(map[string]model.Invitation),
+		sessions:    make(map[string]model.Session),
+		magicLinks:  make(map[string]model.MagicLink),
+		subscribers: make(map[string]model.Subscriber),
+		posts:       make(map[string]model.NewsletterPost),
+		postClaims:  make(map[string]time.Time),
+		authorPosts: make(map[string]model.AuthorPost),
+		webhooks:    make(map[string]model.Webhook),
+		deliveries:  make(map[string]model.WebhookDelivery),
+		preferences: make(map[string][]byte),
+	}
+}
+
+// timePtr returns a pointer to a copy of t, so stored records don't share
+// their optional times with the callers
+func timePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func copyProfile(profile model.Profile) model.Profile {
+	profile.LockedAt = timePtr(profile.LockedAt)
+	return profile
+}
+
+func copyInvitation(invitation model.Invitation) model.Invitation {
+	invitation.UsedAt = timePtr(invitation.UsedAt)
+	invitation.RevokedAt = timePtr(invitation.RevokedAt)
+	return invitation
+}
+
+func copySession(session model.Session) model.Session {
+	session.RevokedAt = timePtr(session.RevokedAt)
+	return session
+}
+
+func copyMagicLink(link model.MagicLink) model.MagicLink {
+	link.UsedAt = timePtr(link.UsedAt)
+	return link
+}
+
+func copySubscriber(subscriber model.Subscriber) model.Subscriber {
+	subscriber.ConfirmedAt = timePtr(subscriber.ConfirmedAt)
+	subscriber.UnsubscribedAt = timePtr(subscriber.UnsubscribedAt)
+	return subscriber
+}
+
+func copyNewsletterPost(post model.NewsletterPost) model.NewsletterPost {
+	post.SentAt = timePtr(post.SentAt)
+	return post
+}
+
+func copyAuthorPost(post model.AuthorPost) model.AuthorPost {
+	post.PublishedAt = timePtr(post.PublishedAt)
+	return post
+}
+
+func copyWebhook(webhook model.Webhook) model.Webhook {
+	webhook.Events = append([]string{}, webhook.Events...)
+	return webhook
+}
+
+func copyWebhookDelivery(delivery model.WebhookDelivery) model.WebhookDelivery {
+	delivery.DeliveredAt = timePtr(delivery.DeliveredAt)
+	return delivery
+}
+
+// insertProfile adds profile unless it breaks a unique constraint. The
+// caller holds the write lock.
+func (r *MemoryRepository) insertProfile(profile model.Profile) error {
+	if _, ok := r.profiles[profile.ID]; ok {
+		return errors.New("duplicate profile id")
+	}
+	for _, p := range r.profiles {
+		if p.Username == profile.Username {
+			return errors.New("duplicate username")
+		}
+		if p.Email == profile.Email {
+			return errors.New("duplicate email")
+		}
+	}
+	r.profiles[profile.ID] = copyProfile(profile)
+	return nil
+}
+
+// CreateProfile implements Repository
+func (r *MemoryRepository) CreateProfile(_ context.Context, profile model.Profile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.insertProfile(profile)
+}
+
+// GetProfile implements Repository
+func (r *MemoryRepository) GetProfile(_ context.Context, id string) (*model.Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	profile, ok := r.profiles[id]
+	if !ok {
+		return nil, errors.New("profile not found")
+	}
+	profile = copyProfile(profile)
+	return &profile, nil
+}
+
+// GetProfileByUsername implements Repository
+func (r *MemoryRepository) GetProfileByUsername(_ context.Context, username string) (*model.Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, profile := range r.profiles {
+		if profile.Username == username {
+			profile = copyProfile(profile)
+			return &profile, nil
+		}
+	}
+	return nil, errors.New("profile not found")
+}
+
+// GetProfileByEmail implements Repository
+func (r *MemoryRepository) GetProfileByEmail(_ context.Context, email string) (*model.Profile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var found *model.Profile
+	for _, profile := range r.profiles {
+		if strings.EqualFold(profile.Email, email) && (found == nil || profile.CreatedAt.Before(found.CreatedAt)) {
+			p := copyProfile(profile)
+			found = &p
+		}
+	}
+	if found == nil {
+		return nil, errors.New("profile not found")
+	}
+	return found, nil
+}
+
+// UpdateProfile implements Repository
+func (r *MemoryRepository) UpdateProfile(_ context.Context, profile model.Profile) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.profiles[profile.ID]
+	if !ok {
+		return errors.New("profile not found")
+	}
+	stored.FirstName = profile.FirstName
+	stored.LastName = profile.LastName
+	stored.Bio = profile.Bio
+	stored.UpdatedAt = time.Now()
+	r.profiles[profile.ID] = stored
+	return nil
+}
+
+// UpdatePassword implements Repository
+func (r *MemoryRepository) UpdatePassword(_ context.Context, id string, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.profiles[id]
+	if !ok {
+		return errors.New("profile not found")
+	}
+	stored.Password = passwordHash
+	stored.UpdatedAt = time.Now()
+	r.profiles[id] = stored
+	return nil
+}
+
+// UpdateRole implements Repository
+func (r *MemoryRepository) UpdateRole(_ context.Context, id string, role string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.profiles[id]
+	if !ok {
+		return errors.New("profile not found")
+	}
+	stored.Role = role
+	stored.UpdatedAt = time.Now()
+	r.profiles[id] = stored
+	return nil
+}
+
+// SetLockedAt implements Repository
+func (r *MemoryRepository) SetLockedAt(_ context.Context, id string, lockedAt *time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.profiles[id]
+	if !ok {
+		return errors.New("profile not found")
+	}
+	stored.LockedAt = timePtr(lockedAt)
+	stored.UpdatedAt = time.Now()
+	r.profiles[id] = stored
+	return nil
+}
+
+// GetPreferences implements Repository
+func (r *MemoryRepository) GetPreferences(_ context.Context, profileID string) (*model.Preferences, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.profiles[profileID]; !ok {
+		return nil, errors.New("profile not found")
+	}
+	var preferences model.Preferences
+	if document, ok := r.preferences[profileID]; ok {
+		if err := json.Unmarshal(document, &preferences); err != nil {
+			return nil, err
+		}
+	}
+	return &preferences, nil
+}
+
+// UpdatePreferences implements Repository
+func (r *MemoryRepository) UpdatePreferences(_ context.Context, profileID string, update func(*model.Preferences) error) (*model.Preferences, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.profiles[profileID]; !ok {
+		return nil, errors.New("profile not found")
+	}
+	var preferences model.Preferences
+	if document, ok := r.preferences[profileID]; ok {
+		if err := json.Unmarshal(document, &preferences); err != nil {
+			return nil, err
+		}
+	}
+	if err := update(&preferences); err != nil {
+		return nil, err
+	}
+
+	document, err := json.Marshal(preferences)
+	if err != nil {
+		return nil, err
+	}
+	r.preferences[profileID] = document
+	return &preferences, nil
+}
+
+// DeleteProfile implements Repository. Like the foreign keys of the schema,
+// it deletes the sessions and magic links of the profile and clears the
+// creator of its invitations.
+func (r *MemoryRepository) DeleteProfile(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.profiles[id]; !ok {
+		return errors.New("profile not found")
+	}
+	delete(r.profiles, id)
+	delete(r.preferences, id)
+
+	for sid, session := range r.sessions {
+		if session.ProfileID == id || session.ImpersonatorID == id {
+			delete(r.sessions, sid)
+		}
+	}
+	for lid, link := range r.magicLinks {
+		if link.ProfileID == id {
+			delete(r.magicLinks, lid)
+		}
+	}
+	for iid, invitation := range r.invitations {
+		if invitation.CreatedBy == id {
+			invitation.CreatedBy = ""
+			r.invitations[iid] = invitation
+		}
+	}
+	for wid, webhook := range r.webhooks {
+		if webhook.CreatedBy == id {
+			webhook.CreatedBy = ""
+			r.webhooks[wid] = webhook
+		}
+	}
+	return nil
+}
+
+// CountProfiles implements Repository
+func (r *MemoryRepository) CountProfiles(_ context.Context) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.profiles), nil
+}
+
+// CreateInvitation implements Repository
+func (r *MemoryRepository) CreateInvitation(_ context.Context, invitation model.Invitation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.invitations[invitation.ID]; ok {
+		return errors.New("duplicate invitation id")
+	}
+	for _, i := range r.invitations {
+		if i.CodeHash == invitation.CodeHash {
+			return errors.New("duplicate invitation code")
+		}
+	}
+	if invitation.CreatedBy != "" {
+		if _, ok := r.profiles[invitation.CreatedBy]; !ok {
+			return errors.New("invitation creator does not exist")
+		}
+	}
+
+	// Only the columns CreateInvitation inserts are kept
+	invitation.Code = ""
+	invitation.UsedAt = nil
+	invitation.UsedBy = ""
+	invitation.RevokedAt = nil
+	r.invitations[invitation.ID] = invitation
+	return nil
+}
+
+// GetInvitationByCodeHash implements Repository
+func (r *MemoryRepository) GetInvitationByCodeHash(_ context.Context, codeHash string) (*model.Invitation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, invitation := range r.invitations {
+		if invitation.CodeHash == codeHash {
+			invitation = copyInvitation(invitation)
+			return &invitation, nil
+		}
+	}
+	return nil, errors.New("invitation not found")
+}
+
+// ListPendingInvitations implements Repository
+func (r *MemoryRepository) ListPendingInvitations(_ context.Context, now time.Time) ([]model.Invitation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	invitations := []model.Invitation{}
+	for _, invitation := range r.invitations {
+		if invitation.Pending(now) {
+			invitations = append(invitations, copyInvitation(invitation))
+		}
+	}
+	sort.Slice(invitations, func(i, j int) bool {
+		return invitations[i].CreatedAt.After(invitations[j].CreatedAt)
+	})
+	return invitations, nil
+}
+
+// RevokeInvitation implements Repository
+func (r *MemoryRepository) RevokeInvitation(_ context.Context, id string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invitation, ok := r.invitations[id]
+	if !ok || invitation.UsedAt != nil || invitation.RevokedAt != nil {
+		return errors.New("invitation not found")
+	}
+	invitation.RevokedAt = &now
+	r.invitations[id] = invitation
+	return nil
+}
+
+// CreateProfileWithInvitation implements Repository
+func (r *MemoryRepository) CreateProfileWithInvitation(_ context.Context, profile model.Profile, invitationID string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	invitation, ok := r.invitations[invitationID]
+	if !ok || !invitation.Pending(now) {
+		return errors.New("invitation not found")
+	}
+	if err := r.insertProfile(profile); err != nil {
+		return err
+	}
+	invitation.UsedAt = &now
+	invitation.UsedBy = profile.ID
+	r.invitations[invitationID] = invitation
+	return nil
+}
+
+// CreateSession implements Repository
+func (r *MemoryRepository) CreateSession(_ context.Context, session model.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[session.ID]; ok {
+		return errors.New("duplicate session id")
+	}
+	if _, ok := r.profiles[session.ProfileID]; !ok {
+		return errors.New("session profile does not exist")
+	}
+	if _, ok := r.profiles[session.ImpersonatorID]; session.ImpersonatorID != "" && !ok {
+		return errors.New("session impersonator does not exist")
+	}
+	session.RevokedAt = nil
+	session.Current = false
+	r.sessions[session.ID] = session
+	return nil
+}
+
+// GetSession implements Repository
+func (r *MemoryRepository) GetSession(_ context.Context, id string) (*model.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, errors.New("session not found")
+	}
+	session = copySession(session)
+	return &session, nil
+}
+
+// ListActiveSessions implements Repository
+func (r *MemoryRepository) ListActiveSessions(_ context.Context, profileID string, now time.Time) ([]model.Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sessions := []model.Session{}
+	for _, session := range r.sessions {
+		if session.ProfileID == profileID && session.Active(now) {
+			sessions = append(sessions, copySession(session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// TouchSession implements Repository
+func (r *MemoryRepository) TouchSession(_ context.Context, id string, lastSeenAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[id]; ok {
+		session.LastSeenAt = lastSeenAt
+		r.sessions[id] = session
+	}
+	return nil
+}
+
+// RevokeSession implements Repository
+func (r *MemoryRepository) RevokeSession(_ context.Context, profileID, id string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok || session.ProfileID != profileID || session.RevokedAt != nil {
+		return errors.New("session not found")
+	}
+	session.RevokedAt = &now
+	r.sessions[id] = session
+	return nil
+}
+
+// RevokeOtherSessions implements Repository
+func (r *MemoryRepository) RevokeOtherSessions(_ context.Context, profileID, keepID string, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	revoked := 0
+	for id, session := range r.sessions {
+		if session.ProfileID == profileID && id != keepID && session.Active(now) {
+			revokedAt := now
+			session.RevokedAt = &revokedAt
+			r.sessions[id] = session
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+// CreateMagicLink implements Repository
+func (r *MemoryRepository) CreateMagicLink(_ context.Context, link model.MagicLink, limit int, since time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.magicLinks[link.ID]; ok {
+		return errors.New("duplicate magic link id")
+	}
+	for _, l := range r.magicLinks {
+		if l.TokenHash == link.TokenHash {
+			return errors.New("duplicate magic link token")
+		}
+	}
+	if _, ok := r.profiles[link.ProfileID]; !ok {
+		return errors.New("magic link profile does not exist")
+	}
+	count := 0
+	for _, l := range r.magicLinks {
+		if l.ProfileID == link.ProfileID && l.CreatedAt.After(since) {
+			count++
+		}
+	}
+	if count >= limit {
+		return errors.New("too many magic links")
+	}
+	link.UsedAt = nil
+	r.magicLinks[link.ID] = link
+	return nil
+}
+
+// ConsumeMagicLink implements Repository
+func (r *MemoryRepository) ConsumeMagicLink(_ context.Context, tokenHash string, now time.Time) (*model.MagicLink, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, link := range r.magicLinks {
+		if link.TokenHash != tokenHash {
+			continue
+		}
+		if link.UsedAt != nil || !now.Before(link.ExpiresAt) {
+			break
+		}
+		link.UsedAt = &now
+		r.magicLinks[id] = link
+		link = copyMagicLink(link)
+		return &link, nil
+	}
+	return nil, errors.New("magic link not found")
+}
+
+// CreateSubscriber implements Repository
+func (r *MemoryRepository) CreateSubscriber(_ context.Context, subscriber model.Subscriber) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.subscribers[subscriber.ID]; ok {
+		return errors.New("duplicate subscriber id")
+	}
+	for _, s := range r.subscribers {
+		switch {
+		case s.Email == subscriber.Email:
+			return errors.New("duplicate subscriber email")
+		case s.ConfirmTokenHash == subscriber.ConfirmTokenHash:
+			return errors.New("duplicate subscriber confirmation token")
+		case s.UnsubscribeToken == subscriber.UnsubscribeToken:
+			return errors.New("duplicate subscriber unsubscribe token")
+		}
+	}
+	subscriber.ConfirmedAt = nil
+	subscriber.UnsubscribedAt = nil
+	r.subscribers[subscriber.ID] = subscriber
+	return nil
+}
+
+// GetSubscriberByEmail implements Repository
+func (r *MemoryRepository) GetSubscriberByEmail(_ context.Context, email string) (*model.Subscriber, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, subscriber := range r.subscribers {
+		if subscriber.Email == email {
+			subscriber = copySubscriber(subscriber)
+			return &subscriber, nil
+		}
+	}
+	return nil, errors.New("subscriber not found")
+}
+
+// RenewSubscription implements Repository
+func (r *MemoryRepository) RenewSubscription(_ context.Context, id, confirmTokenHash string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscriber, ok := r.subscribers[id]
+	if !ok {
+		return errors.New("subscriber not found")
+	}
+	for otherID, s := range r.subscribers {
+		if otherID != id && s.ConfirmTokenHash == confirmTokenHash {
+			return errors.New("duplicate subscriber confirmation token")
+		}
+	}
+	subscriber.ConfirmTokenHash = confirmTokenHash
+	subscriber.ConfirmExpiresAt = expiresAt
+	subscriber.ConfirmedAt = nil
+	subscriber.UnsubscribedAt = nil
+	r.subscribers[id] = subscriber
+	return nil
+}
+
+// ConfirmSubscriber implements Repository
+func (r *MemoryRepository) ConfirmSubscriber(_ context.Context, confirmTokenHash string, now time.Time) (*model.Subscriber, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, subscriber := range r.subscribers {
+		if subscriber.ConfirmTokenHash != confirmTokenHash {
+			continue
+		}
+		if subscriber.ConfirmedAt != nil || subscriber.UnsubscribedAt != nil || !now.Before(subscriber.ConfirmExpiresAt) {
+			break
+		}
+		subscriber.ConfirmedAt = &now
+		r.subscribers[id] = subscriber
+		subscriber = copySubscriber(subscriber)
+		return &subscriber, nil
+	}
+	return nil, errors.New("subscriber not found")
+}
+
+// Unsubscribe implements Repository
+func (r *MemoryRepository) Unsubscribe(_ context.Context, unsubscribeToken string, now time.Time) (*model.Subscriber, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, subscriber := range r.subscribers {
+		if subscriber.UnsubscribeToken != unsubscribeToken {
+			continue
+		}
+		if subscriber.UnsubscribedAt == nil {
+			subscriber.UnsubscribedAt = &now
+			r.subscribers[id] = subscriber
+		}
+		subscriber = copySubscriber(subscriber)
+		return &subscriber, nil
+	}
+	return nil, errors.New("subscriber not found")
+}
+
+// ListSubscribers implements Repository
+func (r *MemoryRepository) ListSubscribers(_ context.Context) ([]model.Subscriber, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	subscribers := make([]model.Subscriber, 0, len(r.subscribers))
+	for _, subscriber := range r.subscribers {
+		subscribers = append(subscribers, copySubscriber(subscriber))
+	}
+	sort.Slice(subscribers, func(i, j int) bool {
+		if !subscribers[i].CreatedAt.Equal(subscribers[j].CreatedAt) {
+			return subscribers[i].CreatedAt.Before(subscribers[j].CreatedAt)
+		}
+		return subscribers[i].ID < subscribers[j].ID
+	})
+	return subscribers, nil
+}
+
+// QueueNewsletterPost implements Repository
+func (r *MemoryRepository) QueueNewsletterPost(_ context.Context, post model.NewsletterPost) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.posts[post.ID]; ok {
+		return nil
+	}
+	post.SentAt = nil
+	r.posts[post.ID] = post
+	return nil
+}
+
+// ClaimNewsletterPosts implements Repository
+func (r *MemoryRepository) ClaimNewsletterPosts(_ context.Context, now, leaseUntil time.Time) ([]model.NewsletterPost, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	posts := []model.NewsletterPost{}
+	for id, post := range r.posts {
+		if post.SentAt != nil {
+			continue
+		}
+		if claimedUntil, ok := r.postClaims[id]; ok && claimedUntil.After(now) {
+			continue
+		}
+		r.postClaims[id] = leaseUntil
+		posts = append(posts, copyNewsletterPost(post))
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].PublishedAt.Equal(posts[j].PublishedAt) {
+			return posts[i].PublishedAt.Before(posts[j].PublishedAt)
+		}
+		return posts[i].ID < posts[j].ID
+	})
+	return posts, nil
+}
+
+// ReleaseNewsletterPosts implements Repository
+func (r *MemoryRepository) ReleaseNewsletterPosts(_ context.Context, ids []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range ids {
+		if post, ok := r.posts[id]; ok && post.SentAt == nil {
+			delete(r.postClaims, id)
+		}
+	}
+	return nil
+}
+
+// MarkNewsletterPostsSent implements Repository
+func (r *MemoryRepository) MarkNewsletterPostsSent(_ context.Context, ids []string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, id := range ids {
+		if post, ok := r.posts[id]; ok && post.SentAt == nil {
+			sentAt := now
+			post.SentAt = &sentAt
+			r.posts[id] = post
+		}
+	}
+	return nil
+}
+
+// SaveAuthorPost implements Repository
+func (r *MemoryRepository) SaveAuthorPost(_ context.Context, post model.AuthorPost) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stored, ok := r.authorPosts[post.ID]; ok && stored.Version > post.Version {
+		return nil
+	}
+	r.authorPosts[post.ID] = copyAuthorPost(post)
+	return nil
+}
+
+// GetAuthorStats implements Repository
+func (r *MemoryRepository) GetAuthorStats(_ context.Context, profileID string) (*model.AuthorStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := model.AuthorStats{ProfileID: profileID}
+	for _, post := range r.authorPosts {
+		if post.ProfileID != profileID || post.Deleted {
+			continue
+		}
+		stats.TotalViews += post.ViewCount
+		if !post.IsPublished {
+			stats.DraftCount++
+			continue
+		}
+		stats.PublishedCount++
+		if post.PublishedAt != nil && (stats.LastPublishedAt == nil || post.PublishedAt.After(*stats.LastPublishedAt)) {
+			stats.LastPublishedAt = timePtr(post.PublishedAt)
+		}
+	}
+	return &stats, nil
+}
+
+// CreateWebhook implements Repository
+func (r *MemoryRepository) CreateWebhook(_ context.Context, webhook model.Webhook) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.webhooks[webhook.ID]; ok {
+		return errors.New("duplicate webhook id")
+	}
+	if webhook.CreatedBy != "" {
+		if _, ok := r.profiles[webhook.CreatedBy]; !ok {
+			return errors.New("webhook creator does not exist")
+		}
+	}
+	r.webhooks[webhook.ID] = copyWebhook(webhook)
+	return nil
+}
+
+// GetWebhook implements Repository
+func (r *MemoryRepository) GetWebhook(_ context.Context, id string) (*model.Webhook, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	webhook, ok := r.webhooks[id]
+	if !ok {
+		return nil, errors.New("webhook not found")
+	}
+	webhook = copyWebhook(webhook)
+	return &webhook, nil
+}
+
+// ListWebhooks implements Repository
+func (r *MemoryRepository) ListWebhooks(_ context.Context) ([]model.Webhook, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	webhooks := make([]model.Webhook, 0, len(r.webhooks))
+	for _, webhook := range r.webhooks {
+		webhooks = append(webhooks, copyWebhook(webhook))
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		if !webhooks[i].CreatedAt.Equal(webhooks[j].CreatedAt) {
+			return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt)
+		}
+		return webhooks[i].ID < webhooks[j].ID
+	})
+	return webhooks, nil
+}
+
+// DeleteWebhook implements Repository
+func (r *MemoryRepository) DeleteWebhook(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.webhooks[id]; !ok {
+		return errors.New("webhook not found")
+	}
+	delete(r.webhooks, id)
+
+	for did, delivery := range r.deliveries {
+		if delivery.WebhookID == id {
+			delete(r.deliveries, did)
+		}
+	}
+	return nil
+}
+
+// CreateWebhookDelivery implements Repository
+func (r *MemoryRepository) CreateWebhookDelivery(_ context.Context, delivery model.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.deliveries[delivery.ID]; ok {
+		return errors.New("duplicate webhook delivery id")
+	}
+	if _, ok := r.webhooks[delivery.WebhookID]; !ok {
+		return errors.New("webhook does not exist")
+	}
+
+	// Only the columns CreateWebhookDelivery inserts are kept
+	delivery.Attempts = 0
+	delivery.ResponseStatus = 0
+	delivery.LastError = ""
+	delivery.DeliveredAt = nil
+	r.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+// ClaimWebhookDeliveries implements Repository
+func (r *MemoryRepository) ClaimWebhookDeliveries(_ context.Context, now, leaseUntil time.Time, limit int) ([]model.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	due := []model.WebhookDelivery{}
+	for _, delivery := range r.deliveries {
+		if delivery.Status == model.DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]model.WebhookDelivery, 0, len(due))
+	for _, delivery := range due {
+		delivery.NextAttemptAt = leaseUntil
+		r.deliveries[delivery.ID] = delivery
+		claimed = append(claimed, copyWebhookDelivery(delivery))
+	}
+	return claimed, nil
+}
+
+// UpdateWebhookDelivery implements Repository
+func (r *MemoryRepository) UpdateWebhookDelivery(_ context.Context, delivery model.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.deliveries[delivery.ID]
+	if !ok {
+		return errors.New("webhook delivery not found")
+	}
+	stored.Status = delivery.Status
+	stored.Attempts = delivery.Attempts
+	stored.ResponseStatus = delivery.ResponseStatus
+	stored.LastError = delivery.LastError
+	stored.NextAttemptAt = delivery.NextAttemptAt
+	stored.DeliveredAt = timePtr(delivery.DeliveredAt)
+	r.deliveries[delivery.ID] = stored
+	return nil
+}
+
+// ListWebhookDeliveries implements Repository
+func (r *MemoryRepository) ListWebhookDeliveries(_ context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	deliveries := []model.WebhookDelivery{}
+	for _, delivery := range r.deliveries {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, copyWebhookDelivery(delivery))
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+		}
+		return deliveries[i].ID < deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// CreateAuditEvent implements Repository
+func (r *MemoryRepository) CreateAuditEvent(_ context.Context, event model.AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, stored := range r.audit {
+		if stored.ID == event.ID {
+			return errors.New("duplicate audit event id")
+		}
+	}
+	r.audit = append(r.audit, event)
+	return nil
+}
+
+// ListAuditEvents implements Repository
+func (r *MemoryRepository) ListAuditEvents(_ context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := []model.AuditEvent{}
+	for _, event := range r.audit {
+		if filter.ProfileID != "" && event.ProfileID != filter.ProfileID {
+			continue
+		}
+		if filter.ActorID != "" && event.ActorID != filter.ActorID {
+			continue
+		}
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.After(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
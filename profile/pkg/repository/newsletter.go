@@ -0,0 +1,347 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+	"github.com/lib/pq"
+)
+
+// subscriberColumns are selected by every subscriber query, in scanSubscriber order
+const subscriberColumns = `id, email, confirm_token_hash, confirm_expires_at, unsubscribe_token, created_at, confirmed_at, unsubscribed_at`
+
+// scanSubscriber reads a row selected with subscriberColumns
+func scanSubscriber(row interface{ Scan(...interface{}) error }) (*model.Subscriber, error) {
+	var subscriber model.Subscriber
+	var confirmedAt, unsubscribedAt sql.NullTime
+	err := row.Scan(
+		&subscriber.ID,
+		&subscriber.Email,
+		&subscriber.ConfirmTokenHash,
+		&subscriber.ConfirmExpiresAt,
+		&subscriber.UnsubscribeToken,
+		&subscriber.CreatedAt,
+		&confirmedAt,
+		&unsubscribedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if confirmedAt.Valid {
+		subscriber.ConfirmedAt = &confirmedAt.Time
+	}
+	if unsubscribedAt.Valid {
+		subscriber.UnsubscribedAt = &unsubscribedAt.Time
+	}
+	return &subscriber, nil
+}
+
+// newsletterPostColumns are selected by every newsletter post query, in
+// scanNewsletterPost order
+const newsletterPostColumns = `id, title, slug, excerpt, published_at, queued_at, sent_at`
+
+// scanNewsletterPost reads a row selected with newsletterPostColumns
+func scanNewsletterPost(row interface{ Scan(...interface{}) error }) (*model.NewsletterPost, error) {
+	var post model.NewsletterPost
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&post.ID,
+		&post.Title,
+		&post.Slug,
+		&post.Excerpt,
+		&post.PublishedAt,
+		&post.QueuedAt,
+		&sentAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if sentAt.Valid {
+		post.SentAt = &sentAt.Time
+	}
+	return &post, nil
+}
+
+// CreateSubscriber stores a new, pending subscriber
+func (r *PostgresRepository) CreateSubscriber(ctx context.Context, subscriber model.Subscriber) error {
+	query := `
+		INSERT INTO subscribers (id, email, confirm_token_hash, confirm_expires_at, unsubscribe_token, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateSubscriber", "INSERT", "subscribers", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		subscriber.ID,
+		subscriber.Email,
+		subscriber.ConfirmTokenHash,
+		subscriber.ConfirmExpiresAt,
+		subscriber.UnsubscribeToken,
+		subscriber.CreatedAt,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create subscriber", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetSubscriberByEmail retrieves a subscriber by email, whatever its status
+func (r *PostgresRepository) GetSubscriberByEmail(ctx context.Context, email string) (*model.Subscriber, error) {
+	query := `SELECT ` + subscriberColumns + ` FROM subscribers WHERE email = $1`
+
+	ctx, span := r.startSpan(ctx, "GetSubscriberByEmail", "SELECT", "subscribers", query)
+	defer span.End()
+
+	subscriber, err := scanSubscriber(r.db.QueryRowContext(ctx, query, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("subscriber not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get subscriber", "err", err)
+		return nil, err
+	}
+
+	return subscriber, nil
+}
+
+// RenewSubscription sets a new confirmation token and clears the
+// confirmation and unsubscription of a subscriber
+func (r *PostgresRepository) RenewSubscription(ctx context.Context, id, confirmTokenHash string, expiresAt time.Time) error {
+	query := `
+		UPDATE subscribers
+		SET confirm_token_hash = $1, confirm_expires_at = $2, confirmed_at = NULL, unsubscribed_at = NULL
+		WHERE id = $3
+	`
+
+	ctx, span := r.startSpan(ctx, "RenewSubscription", "UPDATE", "subscribers", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, confirmTokenHash, expiresAt, id)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to renew subscription", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("subscriber not found")
+	}
+
+	return nil
+}
+
+// ConfirmSubscriber confirms a pending subscriber in a single statement, so
+// the token can't be used once it has expired
+func (r *PostgresRepository) ConfirmSubscriber(ctx context.Context, confirmTokenHash string, now time.Time) (*model.Subscriber, error) {
+	query := `
+		UPDATE subscribers
+		SET confirmed_at = $1
+		WHERE confirm_token_hash = $2 AND confirmed_at IS NULL AND unsubscribed_at IS NULL AND confirm_expires_at > $1
+		RETURNING ` + subscriberColumns
+
+	ctx, span := r.startSpan(ctx, "ConfirmSubscriber", "UPDATE", "subscribers", query)
+	defer span.End()
+
+	subscriber, err := scanSubscriber(r.db.QueryRowContext(ctx, query, now, confirmTokenHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("subscriber not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to confirm subscriber", "err", err)
+		return nil, err
+	}
+
+	return subscriber, nil
+}
+
+// Unsubscribe records when the subscriber with the token unsubscribed
+func (r *PostgresRepository) Unsubscribe(ctx context.Context, unsubscribeToken string, now time.Time) (*model.Subscriber, error) {
+	query := `
+		UPDATE subscribers
+		SET unsubscribed_at = COALESCE(unsubscribed_at, $1)
+		WHERE unsubscribe_token = $2
+		RETURNING ` + subscriberColumns
+
+	ctx, span := r.startSpan(ctx, "Unsubscribe", "UPDATE", "subscribers", query)
+	defer span.End()
+
+	subscriber, err := scanSubscriber(r.db.QueryRowContext(ctx, query, now, unsubscribeToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("subscriber not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to unsubscribe", "err", err)
+		return nil, err
+	}
+
+	return subscriber, nil
+}
+
+// ListSubscribers returns every subscriber, oldest first
+func (r *PostgresRepository) ListSubscribers(ctx context.Context) ([]model.Subscriber, error) {
+	query := `SELECT ` + subscriberColumns + ` FROM subscribers ORDER BY created_at, id`
+
+	ctx, span := r.startSpan(ctx, "ListSubscribers", "SELECT", "subscribers", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list subscribers", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscribers := []model.Subscriber{}
+	for rows.Next() {
+		subscriber, err := scanSubscriber(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan subscriber", "err", err)
+			return nil, err
+		}
+		subscribers = append(subscribers, *subscriber)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list subscribers", "err", err)
+		return nil, err
+	}
+
+	return subscribers, nil
+}
+
+// QueueNewsletterPost stores a post for the next digest. The post service
+// can publish the same post more than once, it is only queued the first time.
+func (r *PostgresRepository) QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error {
+	query := `
+		INSERT INTO newsletter_posts (id, title, slug, excerpt, published_at, queued_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO NOTHING
+	`
+
+	ctx, span := r.startSpan(ctx, "QueueNewsletterPost", "INSERT", "newsletter_posts", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		post.ID,
+		post.Title,
+		post.Slug,
+		post.Excerpt,
+		post.PublishedAt,
+		post.QueuedAt,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to queue newsletter post", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// ClaimNewsletterPosts leases the unsent posts, in the order they were
+// published. SKIP LOCKED lets replicas claim at the same time without
+// waiting for each other.
+func (r *PostgresRepository) ClaimNewsletterPosts(ctx context.Context, now, leaseUntil time.Time) ([]model.NewsletterPost, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE newsletter_posts
+			SET claimed_until = $1
+			WHERE id IN (
+				SELECT id FROM newsletter_posts
+				WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until <= $2)
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING ` + newsletterPostColumns + `
+		)
+		SELECT ` + newsletterPostColumns + ` FROM claimed
+		ORDER BY published_at, id
+	`
+
+	ctx, span := r.startSpan(ctx, "ClaimNewsletterPosts", "UPDATE", "newsletter_posts", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, leaseUntil, now)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to claim newsletter posts", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []model.NewsletterPost{}
+	for rows.Next() {
+		post, err := scanNewsletterPost(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan newsletter post", "err", err)
+			return nil, err
+		}
+		posts = append(posts, *post)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to claim newsletter posts", "err", err)
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+// ReleaseNewsletterPosts ends the lease of posts that were not sent
+func (r *PostgresRepository) ReleaseNewsletterPosts(ctx context.Context, ids []string) error {
+	query := `UPDATE newsletter_posts SET claimed_until = NULL WHERE id = ANY($1) AND sent_at IS NULL`
+
+	ctx, span := r.startSpan(ctx, "ReleaseNewsletterPosts", "UPDATE", "newsletter_posts", query)
+	defer span.End()
+
+	if _, err := r.db.ExecContext(ctx, query, pq.Array(ids)); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to release newsletter posts", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// MarkNewsletterPostsSent records that the posts went out in a digest
+func (r *PostgresRepository) MarkNewsletterPostsSent(ctx context.Context, ids []string, now time.Time) error {
+	query := `UPDATE newsletter_posts SET sent_at = $1 WHERE id = ANY($2) AND sent_at IS NULL`
+
+	ctx, span := r.startSpan(ctx, "MarkNewsletterPostsSent", "UPDATE", "newsletter_posts", query)
+	defer span.End()
+
+	if _, err := r.db.ExecContext(ctx, query, now, pq.Array(ids)); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to mark newsletter posts as sent", "err", err)
+		return err
+	}
+
+	return nil
+}
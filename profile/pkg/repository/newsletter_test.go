@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var subscriberColumnNames = []string{"id", "email", "confirm_token_hash", "confirm_expires_at", "unsubscribe_token", "created_at", "confirmed_at", "unsubscribed_at"}
+
+func TestConfirmSubscriber(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows(subscriberColumnNames).
+		AddRow("subscriber-id", "reader@example.com", "token-hash", now.Add(time.Hour), "unsubscribe-token", now.Add(-time.Hour), now, nil)
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		UPDATE subscribers
+		SET confirmed_at = $1
+		WHERE confirm_token_hash = $2 AND confirmed_at IS NULL AND unsubscribed_at IS NULL AND confirm_expires_at > $1
+	`)).WithArgs(now, "token-hash").WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE subscribers`)).
+		WithArgs(now, "token-hash").
+		WillReturnError(sql.ErrNoRows)
+
+	// Call the method
+	subscriber, err := repo.ConfirmSubscriber(context.Background(), "token-hash", now)
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, "reader@example.com", subscriber.Email)
+	assert.Equal(t, model.SubscriberActive, subscriber.Status())
+	assert.Nil(t, subscriber.UnsubscribedAt)
+
+	// The token can't confirm twice
+	subscriber, err = repo.ConfirmSubscriber(context.Background(), "token-hash", now)
+	assert.Nil(t, subscriber)
+	assert.EqualError(t, err, "subscriber not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUnsubscribe(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows(subscriberColumnNames).
+		AddRow("subscriber-id", "reader@example.com", "token-hash", now, "unsubscribe-token", now.Add(-time.Hour), now.Add(-time.Minute), now)
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`
+		UPDATE subscribers
+		SET unsubscribed_at = COALESCE(unsubscribed_at, $1)
+		WHERE unsubscribe_token = $2
+	`)).WithArgs(now, "unsubscribe-token").WillReturnRows(rows)
+
+	// Call the method
+	subscriber, err := repo.Unsubscribe(context.Background(), "unsubscribe-token", now)
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, model.SubscriberUnsubscribed, subscriber.Status())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRenewSubscription_NotFound(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	expiresAt := time.Now().Add(48 * time.Hour)
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE subscribers`)).
+		WithArgs("token-hash", expiresAt, "subscriber-id").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Call the method
+	err := repo.RenewSubscription(context.Background(), "subscriber-id", "token-hash", expiresAt)
+
+	// Assertions
+	assert.EqualError(t, err, "subscriber not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMarkNewsletterPostsSent(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	ids := []string{"post-1", "post-2"}
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE newsletter_posts SET sent_at = $1 WHERE id = ANY($2) AND sent_at IS NULL`)).
+		WithArgs(now, pq.Array(ids)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// Call the method
+	err := repo.MarkNewsletterPostsSent(context.Background(), ids, now)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReleaseNewsletterPosts(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	ids := []string{"post-1", "post-2"}
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE newsletter_posts SET claimed_until = NULL WHERE id = ANY($1) AND sent_at IS NULL`)).
+		WithArgs(pq.Array(ids)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	// Call the method
+	err := repo.ReleaseNewsletterPosts(context.Background(), ids)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
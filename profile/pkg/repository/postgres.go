@@ -4,11 +4,26 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/tracing"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Storage drivers. SQLite and memory are meant for local development and
+// tests.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverMemory   = "memory"
 )
 
 // Repository defines the interface for profile storage operations
@@ -16,35 +31,164 @@ type Repository interface {
 	CreateProfile(ctx context.Context, profile model.Profile) error
 	GetProfile(ctx context.Context, id string) (*model.Profile, error)
 	GetProfileByUsername(ctx context.Context, username string) (*model.Profile, error)
+	GetProfileByEmail(ctx context.Context, email string) (*model.Profile, error)
 	UpdateProfile(ctx context.Context, profile model.Profile) error
+	UpdatePassword(ctx context.Context, id string, passwordHash string) error
+	UpdateRole(ctx context.Context, id string, role string) error
+	// SetLockedAt locks the profile at lockedAt, or unlocks it when nil
+	SetLockedAt(ctx context.Context, id string, lockedAt *time.Time) error
 	DeleteProfile(ctx context.Context, id string) error
 	CountProfiles(ctx context.Context) (int, error)
+	// GetPreferences and UpdatePreferences read and change the preferences
+	// document of a profile. It is empty until first updated. UpdatePreferences
+	// passes the stored document to update and saves what it leaves, with no
+	// other update in between; an error from update leaves it unchanged.
+	GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error)
+	UpdatePreferences(ctx context.Context, profileID string, update func(*model.Preferences) error) (*model.Preferences, error)
+
+	CreateInvitation(ctx context.Context, invitation model.Invitation) error
+	GetInvitationByCodeHash(ctx context.Context, codeHash string) (*model.Invitation, error)
+	ListPendingInvitations(ctx context.Context, now time.Time) ([]model.Invitation, error)
+	RevokeInvitation(ctx context.Context, id string, now time.Time) error
+	// CreateProfileWithInvitation creates the profile and marks the invitation
+	// as used in one transaction. It fails if the invitation is no longer pending.
+	CreateProfileWithInvitation(ctx context.Context, profile model.Profile, invitationID string, now time.Time) error
+
+	CreateSession(ctx context.Context, session model.Session) error
+	GetSession(ctx context.Context, id string) (*model.Session, error)
+	ListActiveSessions(ctx context.Context, profileID string, now time.Time) ([]model.Session, error)
+	TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error
+	RevokeSession(ctx context.Context, profileID, id string, now time.Time) error
+	// RevokeOtherSessions revokes the active sessions of the profile except
+	// keepID and returns how many were revoked
+	RevokeOtherSessions(ctx context.Context, profileID, keepID string, now time.Time) (int, error)
+
+	// CreateMagicLink stores the link unless the profile already has limit
+	// links created after since, used or not, and fails with "too many
+	// magic links" then. Concurrent calls for a profile are counted one
+	// after the other.
+	CreateMagicLink(ctx context.Context, link model.MagicLink, limit int, since time.Time) error
+	// ConsumeMagicLink marks the pending link with the token hash as used and
+	// returns it. Used, expired and unknown links are not found.
+	ConsumeMagicLink(ctx context.Context, tokenHash string, now time.Time) (*model.MagicLink, error)
+
+	CreateSubscriber(ctx context.Context, subscriber model.Subscriber) error
+	GetSubscriberByEmail(ctx context.Context, email string) (*model.Subscriber, error)
+	// RenewSubscription replaces the confirmation token of a subscriber and
+	// makes it pending again, whether it was pending or unsubscribed
+	RenewSubscription(ctx context.Context, id, confirmTokenHash string, expiresAt time.Time) error
+	// ConfirmSubscriber confirms the pending subscriber with the token hash
+	// and returns it. Confirmed, unsubscribed, expired and unknown tokens are
+	// not found.
+	ConfirmSubscriber(ctx context.Context, confirmTokenHash string, now time.Time) (*model.Subscriber, error)
+	// Unsubscribe unsubscribes the subscriber with the token and returns it.
+	// Unsubscribing twice keeps the first time.
+	Unsubscribe(ctx context.Context, unsubscribeToken string, now time.Time) (*model.Subscriber, error)
+	ListSubscribers(ctx context.Context) ([]model.Subscriber, error)
+
+	// QueueNewsletterPost stores a post for the next digest. Posts that were
+	// already queued are left as they are.
+	QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error
+	// ClaimNewsletterPosts leases the unsent posts that no other digest
+	// holds, oldest first. ReleaseNewsletterPosts gives them back unsent.
+	ClaimNewsletterPosts(ctx context.Context, now, leaseUntil time.Time) ([]model.NewsletterPost, error)
+	ReleaseNewsletterPosts(ctx context.Context, ids []string) error
+	MarkNewsletterPostsSent(ctx context.Context, ids []string, now time.Time) error
+
+	// SaveAuthorPost stores the state of a post unless a state with a higher
+	// version is already stored
+	SaveAuthorPost(ctx context.Context, post model.AuthorPost) error
+	// GetAuthorStats counts the posts of a profile. A profile without posts
+	// gets zero counts, not an error.
+	GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error)
+
+	CreateWebhook(ctx context.Context, webhook model.Webhook) error
+	GetWebhook(ctx context.Context, id string) (*model.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]model.Webhook, error)
+	// DeleteWebhook deletes a webhook and its deliveries
+	DeleteWebhook(ctx context.Context, id string) error
+	CreateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error
+	// ClaimWebhookDeliveries returns up to limit pending deliveries due at
+	// now and moves their next attempt to leaseUntil, so other replicas
+	// leave them alone while they are sent
+	ClaimWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]model.WebhookDelivery, error)
+	// UpdateWebhookDelivery records the outcome of an attempt
+	UpdateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error
+	// ListWebhookDeliveries returns the latest deliveries of a webhook,
+	// newest first
+	ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error)
+
+	CreateAuditEvent(ctx context.Context, event model.AuditEvent) error
+	// ListAuditEvents returns up to filter.Limit entries of the audit trail,
+	// newest first
+	ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error)
 }
 
 // PostgresRepository implements the Repository interface using PostgreSQL
 type PostgresRepository struct {
 	db     *sql.DB
 	logger log.Logger
+	tracer trace.Tracer
+}
+
+// Option configures optional behaviour of the PostgreSQL repository
+type Option func(*PostgresRepository)
+
+// WithTracerProvider sets the provider of the query spans. The global
+// provider is used by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(r *PostgresRepository) {
+		r.tracer = tp.Tracer(tracing.InstrumentationName)
+	}
 }
 
 // NewPostgresRepository creates a new PostgreSQL repository
-func NewPostgresRepository(db *sql.DB, logger log.Logger) Repository {
-	return &PostgresRepository{
+func NewPostgresRepository(db *sql.DB, logger log.Logger, opts ...Option) Repository {
+	r := &PostgresRepository{
 		db:     db,
 		logger: logger,
+		tracer: otel.Tracer(tracing.InstrumentationName),
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
-// CreateProfile creates a new profile in the database
-func (r *PostgresRepository) CreateProfile(ctx context.Context, profile model.Profile) error {
-	query := `
-		INSERT INTO profiles (id, username, email, password, first_name, last_name, bio, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+// startSpan starts a client span for a query on table
+func (r *PostgresRepository) startSpan(ctx context.Context, method, operation, table, query string) (context.Context, trace.Span) {
+	return startQuerySpan(ctx, r.tracer, "postgresql", method, operation, table, query)
+}
+
+// startQuerySpan starts a client span for a query of a SQL repository
+func startQuerySpan(ctx context.Context, tracer trace.Tracer, system, method, operation, table, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, operation+" "+table,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", system),
+			attribute.String("db.operation", operation),
+			attribute.String("db.sql.table", table),
+			attribute.String("db.statement", strings.Join(strings.Fields(query), " ")),
+			attribute.String("code.function", method),
+		),
+	)
+}
+
+// recordError marks the span of a failed query
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// insertProfileQuery is shared by CreateProfile and CreateProfileWithInvitation
+const insertProfileQuery = `
+		INSERT INTO profiles (id, username, email, password, first_name, last_name, bio, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
 
-	_, err := r.db.ExecContext(
-		ctx,
-		query,
+// insertProfileArgs returns the arguments of insertProfileQuery
+func insertProfileArgs(profile model.Profile) []interface{} {
+	return []interface{}{
 		profile.ID,
 		profile.Username,
 		profile.Email,
@@ -52,12 +196,21 @@ func (r *PostgresRepository) CreateProfile(ctx context.Context, profile model.Pr
 		profile.FirstName,
 		profile.LastName,
 		profile.Bio,
+		profile.Role,
 		profile.CreatedAt,
 		profile.UpdatedAt,
-	)
+	}
+}
+
+// CreateProfile creates a new profile in the database
+func (r *PostgresRepository) CreateProfile(ctx context.Context, profile model.Profile) error {
+	ctx, span := r.startSpan(ctx, "CreateProfile", "INSERT", "profiles", insertProfileQuery)
+	defer span.End()
 
+	_, err := r.db.ExecContext(ctx, insertProfileQuery, insertProfileArgs(profile)...)
 	if err != nil {
-		level.Error(r.logger).Log("msg", "Failed to create profile", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create profile", "err", err)
 		return err
 	}
 
@@ -67,12 +220,16 @@ func (r *PostgresRepository) CreateProfile(ctx context.Context, profile model.Pr
 // GetProfile retrieves a profile from the database by ID
 func (r *PostgresRepository) GetProfile(ctx context.Context, id string) (*model.Profile, error) {
 	query := `
-		SELECT id, username, email, password, first_name, last_name, bio, created_at, updated_at
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
 		FROM profiles
 		WHERE id = $1
 	`
 
+	ctx, span := r.startSpan(ctx, "GetProfile", "SELECT", "profiles", query)
+	defer span.End()
+
 	var profile model.Profile
+	var lockedAt sql.NullTime
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&profile.ID,
 		&profile.Username,
@@ -81,17 +238,23 @@ func (r *PostgresRepository) GetProfile(ctx context.Context, id string) (*model.
 		&profile.FirstName,
 		&profile.LastName,
 		&profile.Bio,
+		&profile.Role,
 		&profile.CreatedAt,
 		&profile.UpdatedAt,
+		&lockedAt,
 	)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.New("profile not found")
 		}
-		level.Error(r.logger).Log("msg", "Failed to get profile", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get profile", "err", err)
 		return nil, err
 	}
+	if lockedAt.Valid {
+		profile.LockedAt = &lockedAt.Time
+	}
 
 	return &profile, nil
 }
@@ -99,12 +262,16 @@ func (r *PostgresRepository) GetProfile(ctx context.Context, id string) (*model.
 // GetProfileByUsername retrieves a profile from the database by username
 func (r *PostgresRepository) GetProfileByUsername(ctx context.Context, username string) (*model.Profile, error) {
 	query := `
-		SELECT id, username, email, password, first_name, last_name, bio, created_at, updated_at
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
 		FROM profiles
 		WHERE username = $1
 	`
 
+	ctx, span := r.startSpan(ctx, "GetProfileByUsername", "SELECT", "profiles", query)
+	defer span.End()
+
 	var profile model.Profile
+	var lockedAt sql.NullTime
 	err := r.db.QueryRowContext(ctx, query, username).Scan(
 		&profile.ID,
 		&profile.Username,
@@ -113,17 +280,67 @@ func (r *PostgresRepository) GetProfileByUsername(ctx context.Context, username
 		&profile.FirstName,
 		&profile.LastName,
 		&profile.Bio,
+		&profile.Role,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+		&lockedAt,
+	)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("profile not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get profile by username", "err", err)
+		return nil, err
+	}
+	if lockedAt.Valid {
+		profile.LockedAt = &lockedAt.Time
+	}
+
+	return &profile, nil
+}
+
+// GetProfileByEmail retrieves a profile from the database by email, ignoring case
+func (r *PostgresRepository) GetProfileByEmail(ctx context.Context, email string) (*model.Profile, error) {
+	query := `
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
+		FROM profiles
+		WHERE LOWER(email) = LOWER($1)
+		ORDER BY created_at
+		LIMIT 1
+	`
+
+	ctx, span := r.startSpan(ctx, "GetProfileByEmail", "SELECT", "profiles", query)
+	defer span.End()
+
+	var profile model.Profile
+	var lockedAt sql.NullTime
+	err := r.db.QueryRowContext(ctx, query, email).Scan(
+		&profile.ID,
+		&profile.Username,
+		&profile.Email,
+		&profile.Password,
+		&profile.FirstName,
+		&profile.LastName,
+		&profile.Bio,
+		&profile.Role,
 		&profile.CreatedAt,
 		&profile.UpdatedAt,
+		&lockedAt,
 	)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.New("profile not found")
 		}
-		level.Error(r.logger).Log("msg", "Failed to get profile by username", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get profile by email", "err", err)
 		return nil, err
 	}
+	if lockedAt.Valid {
+		profile.LockedAt = &lockedAt.Time
+	}
 
 	return &profile, nil
 }
@@ -136,6 +353,9 @@ func (r *PostgresRepository) UpdateProfile(ctx context.Context, profile model.Pr
 		WHERE id = $5
 	`
 
+	ctx, span := r.startSpan(ctx, "UpdateProfile", "UPDATE", "profiles", query)
+	defer span.End()
+
 	result, err := r.db.ExecContext(
 		ctx,
 		query,
@@ -147,13 +367,94 @@ func (r *PostgresRepository) UpdateProfile(ctx context.Context, profile model.Pr
 	)
 
 	if err != nil {
-		level.Error(r.logger).Log("msg", "Failed to update profile", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to update profile", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("profile not found")
+	}
+
+	return nil
+}
+
+// UpdatePassword replaces the stored password hash of a profile
+func (r *PostgresRepository) UpdatePassword(ctx context.Context, id string, passwordHash string) error {
+	query := `
+		UPDATE profiles
+		SET password = $1, updated_at = $2
+		WHERE id = $3
+	`
+
+	ctx, span := r.startSpan(ctx, "UpdatePassword", "UPDATE", "profiles", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, passwordHash, time.Now(), id)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to update password", "err", err)
 		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		level.Error(r.logger).Log("msg", "Failed to get rows affected", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("profile not found")
+	}
+
+	return nil
+}
+
+// UpdateRole changes the role of a profile
+func (r *PostgresRepository) UpdateRole(ctx context.Context, id string, role string) error {
+	query := `
+		UPDATE profiles
+		SET role = $1, updated_at = $2
+		WHERE id = $3
+	`
+	return r.updateProfileColumn(ctx, "UpdateRole", query, role, id)
+}
+
+// SetLockedAt locks or unlocks a profile
+func (r *PostgresRepository) SetLockedAt(ctx context.Context, id string, lockedAt *time.Time) error {
+	query := `
+		UPDATE profiles
+		SET locked_at = $1, updated_at = $2
+		WHERE id = $3
+	`
+	return r.updateProfileColumn(ctx, "SetLockedAt", query, lockedAt, id)
+}
+
+// updateProfileColumn runs an update of one column of a profile that also
+// sets updated_at
+func (r *PostgresRepository) updateProfileColumn(ctx context.Context, method, query string, value interface{}, id string) error {
+	ctx, span := r.startSpan(ctx, method, "UPDATE", "profiles", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, value, time.Now(), id)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to run "+method, "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
 		return err
 	}
 
@@ -168,15 +469,20 @@ func (r *PostgresRepository) UpdateProfile(ctx context.Context, profile model.Pr
 func (r *PostgresRepository) DeleteProfile(ctx context.Context, id string) error {
 	query := `DELETE FROM profiles WHERE id = $1`
 
+	ctx, span := r.startSpan(ctx, "DeleteProfile", "DELETE", "profiles", query)
+	defer span.End()
+
 	result, err := r.db.ExecContext(ctx, query, id)
 	if err != nil {
-		level.Error(r.logger).Log("msg", "Failed to delete profile", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to delete profile", "err", err)
 		return err
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		level.Error(r.logger).Log("msg", "Failed to get rows affected", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
 		return err
 	}
 
@@ -191,10 +497,14 @@ func (r *PostgresRepository) DeleteProfile(ctx context.Context, id string) error
 func (r *PostgresRepository) CountProfiles(ctx context.Context) (int, error) {
 	query := `SELECT COUNT(*) FROM profiles`
 
+	ctx, span := r.startSpan(ctx, "CountProfiles", "SELECT", "profiles", query)
+	defer span.End()
+
 	var count int
 	err := r.db.QueryRowContext(ctx, query).Scan(&count)
 	if err != nil {
-		level.Error(r.logger).Log("msg", "Failed to count profiles", "err", err)
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to count profiles", "err", err)
 		return 0, err
 	}
 
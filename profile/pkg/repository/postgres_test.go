@@ -13,6 +13,11 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func setupMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock, Repository) {
@@ -39,14 +44,15 @@ func TestCreateProfile(t *testing.T) {
 		FirstName: "Test",
 		LastName:  "User",
 		Bio:       "Test bio",
+		Role:      model.RoleUser,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
 
 	// Set up expectations
 	mock.ExpectExec(regexp.QuoteMeta(`
-		INSERT INTO profiles (id, username, email, password, first_name, last_name, bio, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO profiles (id, username, email, password, first_name, last_name, bio, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`)).WithArgs(
 		profile.ID,
 		profile.Username,
@@ -55,6 +61,7 @@ func TestCreateProfile(t *testing.T) {
 		profile.FirstName,
 		profile.LastName,
 		profile.Bio,
+		profile.Role,
 		profile.CreatedAt,
 		profile.UpdatedAt,
 	).WillReturnResult(sqlmock.NewResult(1, 1))
@@ -76,12 +83,12 @@ func TestGetProfile(t *testing.T) {
 	now := time.Now()
 	hashedPassword := "$2a$10$hPkIwyYJBsmvKnXN9LBrNeoWsGnY6MQiEjgZXQvtdnVtPKQwvzBSG" // Bcrypt hash example
 
-	rows := sqlmock.NewRows([]string{"id", "username", "email", "password", "first_name", "last_name", "bio", "created_at", "updated_at"}).
-		AddRow(id, "testuser", "test@example.com", hashedPassword, "Test", "User", "Test bio", now, now)
+	rows := sqlmock.NewRows([]string{"id", "username", "email", "password", "first_name", "last_name", "bio", "role", "created_at", "updated_at", "locked_at"}).
+		AddRow(id, "testuser", "test@example.com", hashedPassword, "Test", "User", "Test bio", model.RoleAdmin, now, now, nil)
 
 	// Set up expectations
 	mock.ExpectQuery(regexp.QuoteMeta(`
-		SELECT id, username, email, password, first_name, last_name, bio, created_at, updated_at
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
 		FROM profiles
 		WHERE id = $1
 	`)).WithArgs(id).WillReturnRows(rows)
@@ -99,6 +106,7 @@ func TestGetProfile(t *testing.T) {
 	assert.Equal(t, "Test", profile.FirstName)
 	assert.Equal(t, "User", profile.LastName)
 	assert.Equal(t, "Test bio", profile.Bio)
+	assert.Equal(t, model.RoleAdmin, profile.Role)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
@@ -111,7 +119,7 @@ func TestGetProfile_NotFound(t *testing.T) {
 
 	// Set up expectations
 	mock.ExpectQuery(regexp.QuoteMeta(`
-		SELECT id, username, email, password, first_name, last_name, bio, created_at, updated_at
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
 		FROM profiles
 		WHERE id = $1
 	`)).WithArgs(id).WillReturnError(sql.ErrNoRows)
@@ -136,12 +144,12 @@ func TestGetProfileByUsername(t *testing.T) {
 	now := time.Now()
 	hashedPassword := "$2a$10$hPkIwyYJBsmvKnXN9LBrNeoWsGnY6MQiEjgZXQvtdnVtPKQwvzBSG" // Bcrypt hash example
 
-	rows := sqlmock.NewRows([]string{"id", "username", "email", "password", "first_name", "last_name", "bio", "created_at", "updated_at"}).
-		AddRow(id, username, "test@example.com", hashedPassword, "Test", "User", "Test bio", now, now)
+	rows := sqlmock.NewRows([]string{"id", "username", "email", "password", "first_name", "last_name", "bio", "role", "created_at", "updated_at", "locked_at"}).
+		AddRow(id, username, "test@example.com", hashedPassword, "Test", "User", "Test bio", model.RoleAdmin, now, now, nil)
 
 	// Set up expectations
 	mock.ExpectQuery(regexp.QuoteMeta(`
-		SELECT id, username, email, password, first_name, last_name, bio, created_at, updated_at
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
 		FROM profiles
 		WHERE username = $1
 	`)).WithArgs(username).WillReturnRows(rows)
@@ -159,6 +167,7 @@ func TestGetProfileByUsername(t *testing.T) {
 	assert.Equal(t, "Test", profile.FirstName)
 	assert.Equal(t, "User", profile.LastName)
 	assert.Equal(t, "Test bio", profile.Bio)
+	assert.Equal(t, model.RoleAdmin, profile.Role)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
@@ -171,7 +180,7 @@ func TestGetProfileByUsername_NotFound(t *testing.T) {
 
 	// Set up expectations
 	mock.ExpectQuery(regexp.QuoteMeta(`
-		SELECT id, username, email, password, first_name, last_name, bio, created_at, updated_at
+		SELECT id, username, email, password, first_name, last_name, bio, role, created_at, updated_at, locked_at
 		FROM profiles
 		WHERE username = $1
 	`)).WithArgs(username).WillReturnError(sql.ErrNoRows)
@@ -186,6 +195,38 @@ func TestGetProfileByUsername_NotFound(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestGetProfileByEmail(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	id := uuid.New().String()
+	now := time.Now()
+
+	rows := sqlmock.NewRows([]string{"id", "username", "email", "password", "first_name", "last_name", "bio", "role", "created_at", "updated_at", "locked_at"}).
+		AddRow(id, "testuser", "Test@Example.com", "hash", "Test", "User", "Test bio", model.RoleUser, now, now, nil)
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE LOWER(email) = LOWER($1)`)).
+		WithArgs("test@example.com").
+		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE LOWER(email) = LOWER($1)`)).
+		WithArgs("nobody@example.com").
+		WillReturnError(sql.ErrNoRows)
+
+	// Call the method
+	profile, err := repo.GetProfileByEmail(ctx, "test@example.com")
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, id, profile.ID)
+	assert.Equal(t, "Test@Example.com", profile.Email)
+
+	_, err = repo.GetProfileByEmail(ctx, "nobody@example.com")
+	assert.EqualError(t, err, "profile not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestUpdateProfile(t *testing.T) {
 	db, mock, repo := setupMockDB(t)
 	defer db.Close()
@@ -255,6 +296,56 @@ func TestUpdateProfile_NotFound(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestUpdatePassword(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	id := uuid.New().String()
+	hash := "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`
+		UPDATE profiles
+		SET password = $1, updated_at = $2
+		WHERE id = $3
+	`)).WithArgs(
+		hash,
+		sqlmock.AnyArg(), // For updated_at which is set in the function
+		id,
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Call the method
+	err := repo.UpdatePassword(ctx, id, hash)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdatePassword_NotFound(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	ctx := context.Background()
+	id := uuid.New().String()
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`
+		UPDATE profiles
+		SET password = $1, updated_at = $2
+		WHERE id = $3
+	`)).WithArgs("hash", sqlmock.AnyArg(), id).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Call the method
+	err := repo.UpdatePassword(ctx, id, "hash")
+
+	// Assertions
+	assert.Error(t, err)
+	assert.Equal(t, "profile not found", err.Error())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestDeleteProfile(t *testing.T) {
 	db, mock, repo := setupMockDB(t)
 	defer db.Close()
@@ -295,3 +386,41 @@ func TestDeleteProfile_NotFound(t *testing.T) {
 	assert.Equal(t, "profile not found", err.Error())
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestQuerySpans(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	repo := NewPostgresRepository(db, log.NewNopLogger(), WithTracerProvider(tp))
+
+	// Set up expectations
+	id := uuid.New().String()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM profiles WHERE id = $1`)).
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM profiles`)).
+		WillReturnError(sql.ErrConnDone)
+
+	// Call the repository
+	ctx := context.Background()
+	assert.NoError(t, repo.DeleteProfile(ctx, id))
+	_, err = repo.CountProfiles(ctx)
+	assert.Error(t, err)
+
+	// Assertions
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "DELETE profiles", spans[0].Name())
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind())
+	assert.Contains(t, spans[0].Attributes(), attribute.String("db.statement", "DELETE FROM profiles WHERE id = $1"))
+	assert.Contains(t, spans[0].Attributes(), attribute.String("code.function", "DeleteProfile"))
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	assert.Equal(t, "SELECT profiles", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
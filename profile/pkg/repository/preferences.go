@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// GetPreferences retrieves the preferences document of a profile
+func (r *PostgresRepository) GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error) {
+	query := `SELECT preferences FROM profiles WHERE id = $1`
+
+	ctx, span := r.startSpan(ctx, "GetPreferences", "SELECT", "profiles", query)
+	defer span.End()
+
+	var document []byte
+	if err := r.db.QueryRowContext(ctx, query, profileID).Scan(&document); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("profile not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get preferences", "err", err)
+		return nil, err
+	}
+
+	var preferences model.Preferences
+	if err := json.Unmarshal(document, &preferences); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to decode preferences", "err", err)
+		return nil, err
+	}
+	return &preferences, nil
+}
+
+// UpdatePreferences changes the preferences document of a profile. The row
+// is locked until the new document is written, so concurrent updates don't
+// overwrite each other. It doesn't change updated_at, which is about the
+// public profile.
+func (r *PostgresRepository) UpdatePreferences(ctx context.Context, profileID string, update func(*model.Preferences) error) (*model.Preferences, error) {
+	query := `SELECT preferences FROM profiles WHERE id = $1 FOR UPDATE`
+
+	ctx, span := r.startSpan(ctx, "UpdatePreferences", "UPDATE", "profiles", query)
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to begin transaction", "err", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var document []byte
+	if err := tx.QueryRowContext(ctx, query, profileID).Scan(&document); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("profile not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get preferences", "err", err)
+		return nil, err
+	}
+
+	var preferences model.Preferences
+	if err := json.Unmarshal(document, &preferences); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to decode preferences", "err", err)
+		return nil, err
+	}
+	if err := update(&preferences); err != nil {
+		return nil, err
+	}
+
+	document, err = json.Marshal(preferences)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE profiles SET preferences = $1 WHERE id = $2`, string(document), profileID); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to update preferences", "err", err)
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to commit transaction", "err", err)
+		return nil, err
+	}
+	return &preferences, nil
+}
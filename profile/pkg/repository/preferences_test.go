@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPreferences(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT preferences FROM profiles WHERE id = $1`)).
+		WithArgs("profile-id").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow([]byte(`{"locale": "fr", "editor": {"mode": "markdown"}}`)))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT preferences FROM profiles WHERE id = $1`)).
+		WithArgs("missing-id").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}))
+
+	// Call the method
+	preferences, err := repo.GetPreferences(context.Background(), "profile-id")
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{Locale: "fr", Editor: &model.EditorPreferences{Mode: model.EditorMarkdown}}, preferences)
+
+	_, err = repo.GetPreferences(context.Background(), "missing-id")
+	assert.EqualError(t, err, "profile not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdatePreferences(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	// Set up expectations
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT preferences FROM profiles WHERE id = $1 FOR UPDATE`)).
+		WithArgs("profile-id").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow([]byte(`{"locale": "fr"}`)))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE profiles SET preferences = $1 WHERE id = $2`)).
+		WithArgs(`{"locale":"fr","timezone":"Europe/Paris"}`, "profile-id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// Call the method
+	preferences, err := repo.UpdatePreferences(context.Background(), "profile-id", func(preferences *model.Preferences) error {
+		preferences.Timezone = "Europe/Paris"
+		return nil
+	})
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{Locale: "fr", Timezone: "Europe/Paris"}, preferences)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdatePreferences_Rejected(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	// Set up expectations
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT preferences FROM profiles WHERE id = $1 FOR UPDATE`)).
+		WithArgs("profile-id").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}).AddRow([]byte(`{}`)))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT preferences FROM profiles WHERE id = $1 FOR UPDATE`)).
+		WithArgs("missing-id").
+		WillReturnRows(sqlmock.NewRows([]string{"preferences"}))
+	mock.ExpectRollback()
+
+	// Call the method
+	rejected := errors.New("rejected")
+	_, err := repo.UpdatePreferences(context.Background(), "profile-id", func(*model.Preferences) error { return rejected })
+
+	// Assertions
+	assert.Equal(t, rejected, err)
+	_, err = repo.UpdatePreferences(context.Background(), "missing-id", func(*model.Preferences) error { return nil })
+	assert.EqualError(t, err, "profile not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
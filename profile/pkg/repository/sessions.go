@@ -0,0 +1,208 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// sessionColumns are selected by every session query, in scanSession order
+const sessionColumns = `id, profile_id, user_agent, ip, created_at, last_seen_at, expires_at, revoked_at, COALESCE(impersonator_id, '')`
+
+// scanSession reads a row selected with sessionColumns
+func scanSession(row interface{ Scan(...interface{}) error }) (*model.Session, error) {
+	var session model.Session
+	var revokedAt sql.NullTime
+	err := row.Scan(
+		&session.ID,
+		&session.ProfileID,
+		&session.UserAgent,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastSeenAt,
+		&session.ExpiresAt,
+		&revokedAt,
+		&session.ImpersonatorID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		session.RevokedAt = &revokedAt.Time
+	}
+	return &session, nil
+}
+
+// CreateSession stores the session of a new login
+func (r *PostgresRepository) CreateSession(ctx context.Context, session model.Session) error {
+	query := `
+		INSERT INTO sessions (id, profile_id, user_agent, ip, created_at, last_seen_at, expires_at, impersonator_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateSession", "INSERT", "sessions", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		session.ID,
+		session.ProfileID,
+		session.UserAgent,
+		session.IP,
+		session.CreatedAt,
+		session.LastSeenAt,
+		session.ExpiresAt,
+		session.ImpersonatorID,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create session", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetSession retrieves a session by ID, whether or not it is still active
+func (r *PostgresRepository) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`
+
+	ctx, span := r.startSpan(ctx, "GetSession", "SELECT", "sessions", query)
+	defer span.End()
+
+	session, err := scanSession(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("session not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get session", "err", err)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ListActiveSessions returns the sessions of a profile that are neither
+// revoked nor expired at now, most recently seen first
+func (r *PostgresRepository) ListActiveSessions(ctx context.Context, profileID string, now time.Time) ([]model.Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions
+		WHERE profile_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_seen_at DESC
+	`
+
+	ctx, span := r.startSpan(ctx, "ListActiveSessions", "SELECT", "sessions", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, profileID, now)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list sessions", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan session", "err", err)
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list sessions", "err", err)
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records that the session was used at lastSeenAt
+func (r *PostgresRepository) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	query := `UPDATE sessions SET last_seen_at = $1 WHERE id = $2`
+
+	ctx, span := r.startSpan(ctx, "TouchSession", "UPDATE", "sessions", query)
+	defer span.End()
+
+	if _, err := r.db.ExecContext(ctx, query, lastSeenAt, id); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to touch session", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// RevokeSession revokes an active session of a profile. Sessions of other
+// profiles and sessions that are already revoked are reported as not found.
+func (r *PostgresRepository) RevokeSession(ctx context.Context, profileID, id string, now time.Time) error {
+	query := `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE id = $2 AND profile_id = $3 AND revoked_at IS NULL
+	`
+
+	ctx, span := r.startSpan(ctx, "RevokeSession", "UPDATE", "sessions", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, now, id, profileID)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to revoke session", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("session not found")
+	}
+
+	return nil
+}
+
+// RevokeOtherSessions revokes every active session of a profile but keepID
+func (r *PostgresRepository) RevokeOtherSessions(ctx context.Context, profileID, keepID string, now time.Time) (int, error) {
+	query := `
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE profile_id = $2 AND id <> $3 AND revoked_at IS NULL AND expires_at > $1
+	`
+
+	ctx, span := r.startSpan(ctx, "RevokeOtherSessions", "UPDATE", "sessions", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, now, profileID, keepID)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to revoke sessions", "err", err)
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return 0, err
+	}
+
+	return int(rowsAffected), nil
+}
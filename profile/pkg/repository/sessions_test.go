@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var sessionRowColumns = []string{"id", "profile_id", "user_agent", "ip", "created_at", "last_seen_at", "expires_at", "revoked_at", "impersonator_id"}
+
+func TestCreateSession(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	session := model.Session{
+		ID:         uuid.New().String(),
+		ProfileID:  uuid.New().String(),
+		UserAgent:  "Mozilla/5.0",
+		IP:         "192.0.2.1",
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`
+		INSERT INTO sessions (id, profile_id, user_agent, ip, created_at, last_seen_at, expires_at, impersonator_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))
+	`)).WithArgs(
+		session.ID,
+		session.ProfileID,
+		session.UserAgent,
+		session.IP,
+		session.CreatedAt,
+		session.LastSeenAt,
+		session.ExpiresAt,
+		session.ImpersonatorID,
+	).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Call the method
+	err := repo.CreateSession(context.Background(), session)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetSession(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows(sessionRowColumns).
+		AddRow("s", "profile-id", "Mozilla/5.0", "192.0.2.1", now, now, now.Add(time.Hour), now, "")
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT ` + sessionColumns + ` FROM sessions WHERE id = $1`)).
+		WithArgs("s").
+		WillReturnRows(rows)
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM sessions WHERE id = $1`)).
+		WithArgs("unknown").
+		WillReturnError(sql.ErrNoRows)
+
+	// Call the method
+	session, err := repo.GetSession(context.Background(), "s")
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, "profile-id", session.ProfileID)
+	assert.Equal(t, "Mozilla/5.0", session.UserAgent)
+	require.NotNil(t, session.RevokedAt)
+
+	_, err = repo.GetSession(context.Background(), "unknown")
+	assert.EqualError(t, err, "session not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListActiveSessions(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	rows := sqlmock.NewRows(sessionRowColumns).
+		AddRow("laptop", "profile-id", "Firefox", "192.0.2.1", now, now, now.Add(time.Hour), nil, "admin-id").
+		AddRow("phone", "profile-id", "Safari", "192.0.2.2", now, now.Add(-time.Hour), now.Add(time.Hour), nil, "")
+
+	// Set up expectations
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE profile_id = $1 AND revoked_at IS NULL AND expires_at > $2`)).
+		WithArgs("profile-id", now).
+		WillReturnRows(rows)
+
+	// Call the method
+	sessions, err := repo.ListActiveSessions(context.Background(), "profile-id", now)
+
+	// Assertions
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "laptop", sessions[0].ID)
+	assert.Equal(t, "admin-id", sessions[0].ImpersonatorID)
+	assert.Nil(t, sessions[1].RevokedAt)
+	assert.Empty(t, sessions[1].ImpersonatorID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTouchSession(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE sessions SET last_seen_at = $1 WHERE id = $2`)).
+		WithArgs(now, "s").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Call the method
+	assert.NoError(t, repo.TouchSession(context.Background(), "s", now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeSession(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	query := regexp.QuoteMeta(`
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE id = $2 AND profile_id = $3 AND revoked_at IS NULL
+	`)
+
+	// Set up expectations
+	mock.ExpectExec(query).WithArgs(now, "phone", "profile-id").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs(now, "phone", "other-id").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Call the method
+	assert.NoError(t, repo.RevokeSession(context.Background(), "profile-id", "phone", now))
+	assert.EqualError(t, repo.RevokeSession(context.Background(), "other-id", "phone", now), "session not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+
+	// Set up expectations
+	mock.ExpectExec(regexp.QuoteMeta(`
+		UPDATE sessions
+		SET revoked_at = $1
+		WHERE profile_id = $2 AND id <> $3 AND revoked_at IS NULL AND expires_at > $1
+	`)).WithArgs(now, "profile-id", "current").WillReturnResult(sqlmock.NewResult(0, 3))
+
+	// Call the method
+	revoked, err := repo.RevokeOtherSessions(context.Background(), "profile-id", "current", now)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.Equal(t, 3, revoked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,1113 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/tracing"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// profileColumns are selected by the SQLite profile queries, in scanProfile order
+const profileColumns = `id, username, email, password, COALESCE(first_name, ''), COALESCE(last_name, ''), COALESCE(bio, ''), role, created_at, updated_at, locked_at`
+
+// scanProfile reads a row selected with profileColumns
+func scanProfile(row interface{ Scan(...interface{}) error }) (*model.Profile, error) {
+	var profile model.Profile
+	var lockedAt sql.NullTime
+	err := row.Scan(
+		&profile.ID,
+		&profile.Username,
+		&profile.Email,
+		&profile.Password,
+		&profile.FirstName,
+		&profile.LastName,
+		&profile.Bio,
+		&profile.Role,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+		&lockedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if lockedAt.Valid {
+		profile.LockedAt = &lockedAt.Time
+	}
+	return &profile, nil
+}
+
+// SQLiteRepository implements the Repository interface using SQLite, for
+// local development without a PostgreSQL server. The schema is created by
+// database.NewSQLiteDB.
+//
+// SQLite stores times as text, so every time is written in UTC to keep
+// comparisons in queries correct.
+type SQLiteRepository struct {
+	db     *sql.DB
+	logger log.Logger
+	tracer trace.Tracer
+}
+
+// NewSQLiteRepository creates a new SQLite repository
+func NewSQLiteRepository(db *sql.DB, logger log.Logger) *SQLiteRepository {
+	return &SQLiteRepository{
+		db:     db,
+		logger: logger,
+		tracer: otel.Tracer(tracing.InstrumentationName),
+	}
+}
+
+func (r *SQLiteRepository) startSpan(ctx context.Context, method, operation, table, query string) (context.Context, trace.Span) {
+	return startQuerySpan(ctx, r.tracer, "sqlite", method, operation, table, query)
+}
+
+// fail records err on the span and logs it with msg
+func (r *SQLiteRepository) fail(ctx context.Context, span trace.Span, msg string, err error) error {
+	recordError(span, err)
+	level.Error(requestid.Logger(ctx, r.logger)).Log("msg", msg, "err", err)
+	return err
+}
+
+// exec runs a statement and returns the number of affected rows
+func (r *SQLiteRepository) exec(ctx context.Context, method, operation, table, query string, args ...interface{}) (int64, error) {
+	ctx, span := r.startSpan(ctx, method, operation, table, query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, r.fail(ctx, span, "Failed to run "+method, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, r.fail(ctx, span, "Failed to get rows affected", err)
+	}
+	return rowsAffected, nil
+}
+
+func utc(t time.Time) time.Time {
+	return t.UTC()
+}
+
+const sqliteInsertProfileQuery = `
+		INSERT INTO profiles (id, username, email, password, first_name, last_name, bio, role, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+func sqliteInsertProfileArgs(profile model.Profile) []interface{} {
+	args := insertProfileArgs(profile)
+	args[8] = utc(profile.CreatedAt)
+	args[9] = utc(profile.UpdatedAt)
+	return args
+}
+
+// CreateProfile implements Repository
+func (r *SQLiteRepository) CreateProfile(ctx context.Context, profile model.Profile) error {
+	_, err := r.exec(ctx, "CreateProfile", "INSERT", "profiles", sqliteInsertProfileQuery, sqliteInsertProfileArgs(profile)...)
+	return err
+}
+
+// getProfile runs a profile query that selects at most one row
+func (r *SQLiteRepository) getProfile(ctx context.Context, method, query string, arg interface{}) (*model.Profile, error) {
+	ctx, span := r.startSpan(ctx, method, "SELECT", "profiles", query)
+	defer span.End()
+
+	profile, err := scanProfile(r.db.QueryRowContext(ctx, query, arg))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("profile not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get profile", err)
+	}
+	return profile, nil
+}
+
+// GetProfile implements Repository
+func (r *SQLiteRepository) GetProfile(ctx context.Context, id string) (*model.Profile, error) {
+	return r.getProfile(ctx, "GetProfile", `SELECT `+profileColumns+` FROM profiles WHERE id = ?`, id)
+}
+
+// GetProfileByUsername implements Repository
+func (r *SQLiteRepository) GetProfileByUsername(ctx context.Context, username string) (*model.Profile, error) {
+	return r.getProfile(ctx, "GetProfileByUsername", `SELECT `+profileColumns+` FROM profiles WHERE username = ?`, username)
+}
+
+// GetProfileByEmail implements Repository
+func (r *SQLiteRepository) GetProfileByEmail(ctx context.Context, email string) (*model.Profile, error) {
+	return r.getProfile(ctx, "GetProfileByEmail",
+		`SELECT `+profileColumns+` FROM profiles WHERE LOWER(email) = LOWER(?) ORDER BY created_at LIMIT 1`, email)
+}
+
+// UpdateProfile implements Repository
+func (r *SQLiteRepository) UpdateProfile(ctx context.Context, profile model.Profile) error {
+	query := `UPDATE profiles SET first_name = ?, last_name = ?, bio = ?, updated_at = ? WHERE id = ?`
+	n, err := r.exec(ctx, "UpdateProfile", "UPDATE", "profiles", query,
+		profile.FirstName, profile.LastName, profile.Bio, utc(time.Now()), profile.ID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("profile not found")
+	}
+	return nil
+}
+
+// UpdatePassword implements Repository
+func (r *SQLiteRepository) UpdatePassword(ctx context.Context, id string, passwordHash string) error {
+	query := `UPDATE profiles SET password = ?, updated_at = ? WHERE id = ?`
+	n, err := r.exec(ctx, "UpdatePassword", "UPDATE", "profiles", query, passwordHash, utc(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("profile not found")
+	}
+	return nil
+}
+
+// UpdateRole implements Repository
+func (r *SQLiteRepository) UpdateRole(ctx context.Context, id string, role string) error {
+	query := `UPDATE profiles SET role = ?, updated_at = ? WHERE id = ?`
+	n, err := r.exec(ctx, "UpdateRole", "UPDATE", "profiles", query, role, utc(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("profile not found")
+	}
+	return nil
+}
+
+// SetLockedAt implements Repository
+func (r *SQLiteRepository) SetLockedAt(ctx context.Context, id string, lockedAt *time.Time) error {
+	var value interface{}
+	if lockedAt != nil {
+		value = utc(*lockedAt)
+	}
+	query := `UPDATE profiles SET locked_at = ?, updated_at = ? WHERE id = ?`
+	n, err := r.exec(ctx, "SetLockedAt", "UPDATE", "profiles", query, value, utc(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("profile not found")
+	}
+	return nil
+}
+
+// GetPreferences implements Repository
+func (r *SQLiteRepository) GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error) {
+	query := `SELECT preferences FROM profiles WHERE id = ?`
+
+	ctx, span := r.startSpan(ctx, "GetPreferences", "SELECT", "profiles", query)
+	defer span.End()
+
+	var document string
+	if err := r.db.QueryRowContext(ctx, query, profileID).Scan(&document); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("profile not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get preferences", err)
+	}
+
+	var preferences model.Preferences
+	if err := json.Unmarshal([]byte(document), &preferences); err != nil {
+		return nil, r.fail(ctx, span, "Failed to decode preferences", err)
+	}
+	return &preferences, nil
+}
+
+// UpdatePreferences implements Repository. The database has a single
+// connection, so nothing else writes between the read and the update.
+func (r *SQLiteRepository) UpdatePreferences(ctx context.Context, profileID string, update func(*model.Preferences) error) (*model.Preferences, error) {
+	query := `SELECT preferences FROM profiles WHERE id = ?`
+
+	ctx, span := r.startSpan(ctx, "UpdatePreferences", "UPDATE", "profiles", query)
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	var document string
+	if err := tx.QueryRowContext(ctx, query, profileID).Scan(&document); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("profile not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get preferences", err)
+	}
+
+	var preferences model.Preferences
+	if err := json.Unmarshal([]byte(document), &preferences); err != nil {
+		return nil, r.fail(ctx, span, "Failed to decode preferences", err)
+	}
+	if err := update(&preferences); err != nil {
+		return nil, err
+	}
+
+	updated, err := json.Marshal(preferences)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE profiles SET preferences = ? WHERE id = ?`, string(updated), profileID); err != nil {
+		return nil, r.fail(ctx, span, "Failed to update preferences", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to commit transaction", err)
+	}
+	return &preferences, nil
+}
+
+// DeleteProfile implements Repository
+func (r *SQLiteRepository) DeleteProfile(ctx context.Context, id string) error {
+	n, err := r.exec(ctx, "DeleteProfile", "DELETE", "profiles", `DELETE FROM profiles WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("profile not found")
+	}
+	return nil
+}
+
+// CountProfiles implements Repository
+func (r *SQLiteRepository) CountProfiles(ctx context.Context) (int, error) {
+	query := `SELECT COUNT(*) FROM profiles`
+
+	ctx, span := r.startSpan(ctx, "CountProfiles", "SELECT", "profiles", query)
+	defer span.End()
+
+	var count int
+	if err := r.db.QueryRowContext(ctx, query).Scan(&count); err != nil {
+		return 0, r.fail(ctx, span, "Failed to count profiles", err)
+	}
+	return count, nil
+}
+
+// CreateInvitation implements Repository
+func (r *SQLiteRepository) CreateInvitation(ctx context.Context, invitation model.Invitation) error {
+	query := `
+		INSERT INTO invitations (id, email, role, code_hash, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?, ?)
+	`
+	_, err := r.exec(ctx, "CreateInvitation", "INSERT", "invitations", query,
+		invitation.ID,
+		invitation.Email,
+		invitation.Role,
+		invitation.CodeHash,
+		invitation.CreatedBy,
+		utc(invitation.CreatedAt),
+		utc(invitation.ExpiresAt),
+	)
+	return err
+}
+
+// GetInvitationByCodeHash implements Repository
+func (r *SQLiteRepository) GetInvitationByCodeHash(ctx context.Context, codeHash string) (*model.Invitation, error) {
+	query := `SELECT ` + invitationColumns + ` FROM invitations WHERE code_hash = ?`
+
+	ctx, span := r.startSpan(ctx, "GetInvitationByCodeHash", "SELECT", "invitations", query)
+	defer span.End()
+
+	invitation, err := scanInvitation(r.db.QueryRowContext(ctx, query, codeHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("invitation not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get invitation", err)
+	}
+	return invitation, nil
+}
+
+// ListPendingInvitations implements Repository
+func (r *SQLiteRepository) ListPendingInvitations(ctx context.Context, now time.Time) ([]model.Invitation, error) {
+	query := `
+		SELECT ` + invitationColumns + `
+		FROM invitations
+		WHERE used_at IS NULL AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC
+	`
+
+	ctx, span := r.startSpan(ctx, "ListPendingInvitations", "SELECT", "invitations", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, utc(now))
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to list invitations", err)
+	}
+	defer rows.Close()
+
+	invitations := []model.Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan invitation", err)
+		}
+		invitations = append(invitations, *invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to list invitations", err)
+	}
+	return invitations, nil
+}
+
+// RevokeInvitation implements Repository
+func (r *SQLiteRepository) RevokeInvitation(ctx context.Context, id string, now time.Time) error {
+	query := `UPDATE invitations SET revoked_at = ? WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL`
+	n, err := r.exec(ctx, "RevokeInvitation", "UPDATE", "invitations", query, utc(now), id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("invitation not found")
+	}
+	return nil
+}
+
+// CreateProfileWithInvitation implements Repository
+func (r *SQLiteRepository) CreateProfileWithInvitation(ctx context.Context, profile model.Profile, invitationID string, now time.Time) error {
+	query := `
+		UPDATE invitations
+		SET used_at = ?, used_by = ?
+		WHERE id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateProfileWithInvitation", "UPDATE", "invitations", query)
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return r.fail(ctx, span, "Failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, utc(now), profile.ID, invitationID, utc(now))
+	if err != nil {
+		return r.fail(ctx, span, "Failed to redeem invitation", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return r.fail(ctx, span, "Failed to get rows affected", err)
+	}
+	if rowsAffected == 0 {
+		return errors.New("invitation not found")
+	}
+
+	if _, err := tx.ExecContext(ctx, sqliteInsertProfileQuery, sqliteInsertProfileArgs(profile)...); err != nil {
+		return r.fail(ctx, span, "Failed to create profile", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return r.fail(ctx, span, "Failed to commit transaction", err)
+	}
+	return nil
+}
+
+// CreateSession implements Repository
+func (r *SQLiteRepository) CreateSession(ctx context.Context, session model.Session) error {
+	query := `
+		INSERT INTO sessions (id, profile_id, user_agent, ip, created_at, last_seen_at, expires_at, impersonator_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))
+	`
+	_, err := r.exec(ctx, "CreateSession", "INSERT", "sessions", query,
+		session.ID,
+		session.ProfileID,
+		session.UserAgent,
+		session.IP,
+		utc(session.CreatedAt),
+		utc(session.LastSeenAt),
+		utc(session.ExpiresAt),
+		session.ImpersonatorID,
+	)
+	return err
+}
+
+// GetSession implements Repository
+func (r *SQLiteRepository) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE id = ?`
+
+	ctx, span := r.startSpan(ctx, "GetSession", "SELECT", "sessions", query)
+	defer span.End()
+
+	session, err := scanSession(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("session not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get session", err)
+	}
+	return session, nil
+}
+
+// ListActiveSessions implements Repository
+func (r *SQLiteRepository) ListActiveSessions(ctx context.Context, profileID string, now time.Time) ([]model.Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions
+		WHERE profile_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_seen_at DESC
+	`
+
+	ctx, span := r.startSpan(ctx, "ListActiveSessions", "SELECT", "sessions", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, profileID, utc(now))
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to list sessions", err)
+	}
+	defer rows.Close()
+
+	sessions := []model.Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan session", err)
+		}
+		sessions = append(sessions, *session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to list sessions", err)
+	}
+	return sessions, nil
+}
+
+// TouchSession implements Repository
+func (r *SQLiteRepository) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	_, err := r.exec(ctx, "TouchSession", "UPDATE", "sessions", `UPDATE sessions SET last_seen_at = ? WHERE id = ?`, utc(lastSeenAt), id)
+	return err
+}
+
+// RevokeSession implements Repository
+func (r *SQLiteRepository) RevokeSession(ctx context.Context, profileID, id string, now time.Time) error {
+	query := `UPDATE sessions SET revoked_at = ? WHERE id = ? AND profile_id = ? AND revoked_at IS NULL`
+	n, err := r.exec(ctx, "RevokeSession", "UPDATE", "sessions", query, utc(now), id, profileID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// RevokeOtherSessions implements Repository
+func (r *SQLiteRepository) RevokeOtherSessions(ctx context.Context, profileID, keepID string, now time.Time) (int, error) {
+	query := `
+		UPDATE sessions
+		SET revoked_at = ?
+		WHERE profile_id = ? AND id <> ? AND revoked_at IS NULL AND expires_at > ?
+	`
+	n, err := r.exec(ctx, "RevokeOtherSessions", "UPDATE", "sessions", query, utc(now), profileID, keepID, utc(now))
+	return int(n), err
+}
+
+// CreateMagicLink implements Repository. The database has a single
+// connection, so no other link is created between the count and the insert.
+func (r *SQLiteRepository) CreateMagicLink(ctx context.Context, link model.MagicLink, limit int, since time.Time) error {
+	query := `
+		INSERT INTO magic_links (id, profile_id, token_hash, fingerprint_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateMagicLink", "INSERT", "magic_links", query)
+	defer span.End()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return r.fail(ctx, span, "Failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM magic_links WHERE profile_id = ? AND created_at > ?`, link.ProfileID, utc(since)).Scan(&count)
+	if err != nil {
+		return r.fail(ctx, span, "Failed to count magic links", err)
+	}
+	if count >= limit {
+		return errors.New("too many magic links")
+	}
+
+	_, err = tx.ExecContext(ctx, query,
+		link.ID,
+		link.ProfileID,
+		link.TokenHash,
+		link.FingerprintHash,
+		utc(link.CreatedAt),
+		utc(link.ExpiresAt),
+	)
+	if err != nil {
+		return r.fail(ctx, span, "Failed to create magic link", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return r.fail(ctx, span, "Failed to commit transaction", err)
+	}
+	return nil
+}
+
+// ConsumeMagicLink implements Repository. The update is a single statement,
+// like on PostgreSQL, so a link can't be consumed twice.
+func (r *SQLiteRepository) ConsumeMagicLink(ctx context.Context, tokenHash string, now time.Time) (*model.MagicLink, error) {
+	query := `
+		UPDATE magic_links
+		SET used_at = ?
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING id, profile_id, token_hash, fingerprint_hash, created_at, expires_at, used_at
+	`
+
+	ctx, span := r.startSpan(ctx, "ConsumeMagicLink", "UPDATE", "magic_links", query)
+	defer span.End()
+
+	var link model.MagicLink
+	var usedAt time.Time
+	err := r.db.QueryRowContext(ctx, query, utc(now), tokenHash, utc(now)).Scan(
+		&link.ID,
+		&link.ProfileID,
+		&link.TokenHash,
+		&link.FingerprintHash,
+		&link.CreatedAt,
+		&link.ExpiresAt,
+		&usedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("magic link not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to consume magic link", err)
+	}
+	link.UsedAt = &usedAt
+
+	return &link, nil
+}
+
+// CreateSubscriber implements Repository
+func (r *SQLiteRepository) CreateSubscriber(ctx context.Context, subscriber model.Subscriber) error {
+	query := `
+		INSERT INTO subscribers (id, email, confirm_token_hash, confirm_expires_at, unsubscribe_token, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err := r.exec(ctx, "CreateSubscriber", "INSERT", "subscribers", query,
+		subscriber.ID,
+		subscriber.Email,
+		subscriber.ConfirmTokenHash,
+		utc(subscriber.ConfirmExpiresAt),
+		subscriber.UnsubscribeToken,
+		utc(subscriber.CreatedAt),
+	)
+	return err
+}
+
+// GetSubscriberByEmail implements Repository
+func (r *SQLiteRepository) GetSubscriberByEmail(ctx context.Context, email string) (*model.Subscriber, error) {
+	query := `SELECT ` + subscriberColumns + ` FROM subscribers WHERE email = ?`
+
+	ctx, span := r.startSpan(ctx, "GetSubscriberByEmail", "SELECT", "subscribers", query)
+	defer span.End()
+
+	subscriber, err := scanSubscriber(r.db.QueryRowContext(ctx, query, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("subscriber not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get subscriber", err)
+	}
+	return subscriber, nil
+}
+
+// RenewSubscription implements Repository
+func (r *SQLiteRepository) RenewSubscription(ctx context.Context, id, confirmTokenHash string, expiresAt time.Time) error {
+	query := `
+		UPDATE subscribers
+		SET confirm_token_hash = ?, confirm_expires_at = ?, confirmed_at = NULL, unsubscribed_at = NULL
+		WHERE id = ?
+	`
+	n, err := r.exec(ctx, "RenewSubscription", "UPDATE", "subscribers", query, confirmTokenHash, utc(expiresAt), id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("subscriber not found")
+	}
+	return nil
+}
+
+// ConfirmSubscriber implements Repository
+func (r *SQLiteRepository) ConfirmSubscriber(ctx context.Context, confirmTokenHash string, now time.Time) (*model.Subscriber, error) {
+	query := `
+		UPDATE subscribers
+		SET confirmed_at = ?
+		WHERE confirm_token_hash = ? AND confirmed_at IS NULL AND unsubscribed_at IS NULL AND confirm_expires_at > ?
+		RETURNING ` + subscriberColumns
+
+	ctx, span := r.startSpan(ctx, "ConfirmSubscriber", "UPDATE", "subscribers", query)
+	defer span.End()
+
+	subscriber, err := scanSubscriber(r.db.QueryRowContext(ctx, query, utc(now), confirmTokenHash, utc(now)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("subscriber not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to confirm subscriber", err)
+	}
+	return subscriber, nil
+}
+
+// Unsubscribe implements Repository
+func (r *SQLiteRepository) Unsubscribe(ctx context.Context, unsubscribeToken string, now time.Time) (*model.Subscriber, error) {
+	query := `
+		UPDATE subscribers
+		SET unsubscribed_at = COALESCE(unsubscribed_at, ?)
+		WHERE unsubscribe_token = ?
+		RETURNING ` + subscriberColumns
+
+	ctx, span := r.startSpan(ctx, "Unsubscribe", "UPDATE", "subscribers", query)
+	defer span.End()
+
+	subscriber, err := scanSubscriber(r.db.QueryRowContext(ctx, query, utc(now), unsubscribeToken))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("subscriber not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to unsubscribe", err)
+	}
+	return subscriber, nil
+}
+
+// ListSubscribers implements Repository
+func (r *SQLiteRepository) ListSubscribers(ctx context.Context) ([]model.Subscriber, error) {
+	query := `SELECT ` + subscriberColumns + ` FROM subscribers ORDER BY created_at, id`
+
+	ctx, span := r.startSpan(ctx, "ListSubscribers", "SELECT", "subscribers", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to list subscribers", err)
+	}
+	defer rows.Close()
+
+	subscribers := []model.Subscriber{}
+	for rows.Next() {
+		subscriber, err := scanSubscriber(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan subscriber", err)
+		}
+		subscribers = append(subscribers, *subscriber)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to list subscribers", err)
+	}
+	return subscribers, nil
+}
+
+// QueueNewsletterPost implements Repository
+func (r *SQLiteRepository) QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error {
+	query := `
+		INSERT INTO newsletter_posts (id, title, slug, excerpt, published_at, queued_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING
+	`
+	_, err := r.exec(ctx, "QueueNewsletterPost", "INSERT", "newsletter_posts", query,
+		post.ID,
+		post.Title,
+		post.Slug,
+		post.Excerpt,
+		utc(post.PublishedAt),
+		utc(post.QueuedAt),
+	)
+	return err
+}
+
+// ClaimNewsletterPosts implements Repository. SQLite serializes writers, so
+// the statement alone keeps two claims from taking the same rows.
+func (r *SQLiteRepository) ClaimNewsletterPosts(ctx context.Context, now, leaseUntil time.Time) ([]model.NewsletterPost, error) {
+	query := `
+		UPDATE newsletter_posts
+		SET claimed_until = ?
+		WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until <= ?)
+		RETURNING ` + newsletterPostColumns
+
+	ctx, span := r.startSpan(ctx, "ClaimNewsletterPosts", "UPDATE", "newsletter_posts", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, utc(leaseUntil), utc(now))
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to claim newsletter posts", err)
+	}
+	defer rows.Close()
+
+	posts := []model.NewsletterPost{}
+	for rows.Next() {
+		post, err := scanNewsletterPost(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan newsletter post", err)
+		}
+		posts = append(posts, *post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to claim newsletter posts", err)
+	}
+
+	// RETURNING has no ORDER BY
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].PublishedAt.Equal(posts[j].PublishedAt) {
+			return posts[i].PublishedAt.Before(posts[j].PublishedAt)
+		}
+		return posts[i].ID < posts[j].ID
+	})
+	return posts, nil
+}
+
+// ReleaseNewsletterPosts implements Repository
+func (r *SQLiteRepository) ReleaseNewsletterPosts(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := `UPDATE newsletter_posts SET claimed_until = NULL WHERE id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `) AND sent_at IS NULL`
+	_, err := r.exec(ctx, "ReleaseNewsletterPosts", "UPDATE", "newsletter_posts", query, args...)
+	return err
+}
+
+// MarkNewsletterPostsSent implements Repository. SQLite has no arrays, so
+// the ids are expanded into an IN list.
+func (r *SQLiteRepository) MarkNewsletterPostsSent(ctx context.Context, ids []string, now time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{utc(now)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := `UPDATE newsletter_posts SET sent_at = ? WHERE id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `) AND sent_at IS NULL`
+	_, err := r.exec(ctx, "MarkNewsletterPostsSent", "UPDATE", "newsletter_posts", query, args...)
+	return err
+}
+
+// SaveAuthorPost implements Repository
+func (r *SQLiteRepository) SaveAuthorPost(ctx context.Context, post model.AuthorPost) error {
+	var publishedAt interface{}
+	if post.PublishedAt != nil {
+		publishedAt = utc(*post.PublishedAt)
+	}
+	query := `
+		INSERT INTO author_posts (id, profile_id, is_published, view_count, published_at, deleted, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			profile_id = excluded.profile_id,
+			is_published = excluded.is_published,
+			view_count = excluded.view_count,
+			published_at = excluded.published_at,
+			deleted = excluded.deleted,
+			version = excluded.version
+		WHERE author_posts.version <= excluded.version
+	`
+	_, err := r.exec(ctx, "SaveAuthorPost", "INSERT", "author_posts", query,
+		post.ID,
+		post.ProfileID,
+		post.IsPublished,
+		post.ViewCount,
+		publishedAt,
+		post.Deleted,
+		post.Version,
+	)
+	return err
+}
+
+// GetAuthorStats implements Repository. The driver only parses columns it
+// knows the type of, which an aggregate has not, so the last publication is
+// selected as a row of its own.
+func (r *SQLiteRepository) GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error) {
+	query := `
+		SELECT
+			COALESCE(SUM(CASE WHEN is_published THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN is_published THEN 0 ELSE 1 END), 0),
+			COALESCE(SUM(view_count), 0)
+		FROM author_posts
+		WHERE profile_id = ? AND NOT deleted
+	`
+
+	ctx, span := r.startSpan(ctx, "GetAuthorStats", "SELECT", "author_posts", query)
+	defer span.End()
+
+	stats := model.AuthorStats{ProfileID: profileID}
+	err := r.db.QueryRowContext(ctx, query, profileID).Scan(&stats.PublishedCount, &stats.DraftCount, &stats.TotalViews)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to get author stats", err)
+	}
+
+	query = `
+		SELECT published_at
+		FROM author_posts
+		WHERE profile_id = ? AND NOT deleted AND is_published AND published_at IS NOT NULL
+		ORDER BY published_at DESC
+		LIMIT 1
+	`
+	var lastPublishedAt time.Time
+	err = r.db.QueryRowContext(ctx, query, profileID).Scan(&lastPublishedAt)
+	switch {
+	case err == nil:
+		stats.LastPublishedAt = &lastPublishedAt
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, r.fail(ctx, span, "Failed to get last published post", err)
+	}
+	return &stats, nil
+}
+
+// CreateWebhook implements Repository
+func (r *SQLiteRepository) CreateWebhook(ctx context.Context, webhook model.Webhook) error {
+	query := `
+		INSERT INTO webhooks (id, url, events, secret, created_by, created_at)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), ?)
+	`
+	_, err := r.exec(ctx, "CreateWebhook", "INSERT", "webhooks", query,
+		webhook.ID,
+		webhook.URL,
+		strings.Join(webhook.Events, ","),
+		webhook.Secret,
+		webhook.CreatedBy,
+		utc(webhook.CreatedAt),
+	)
+	return err
+}
+
+// GetWebhook implements Repository
+func (r *SQLiteRepository) GetWebhook(ctx context.Context, id string) (*model.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+
+	ctx, span := r.startSpan(ctx, "GetWebhook", "SELECT", "webhooks", query)
+	defer span.End()
+
+	webhook, err := scanWebhook(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("webhook not found")
+		}
+		return nil, r.fail(ctx, span, "Failed to get webhook", err)
+	}
+	return webhook, nil
+}
+
+// ListWebhooks implements Repository
+func (r *SQLiteRepository) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks ORDER BY created_at, id`
+
+	ctx, span := r.startSpan(ctx, "ListWebhooks", "SELECT", "webhooks", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to list webhooks", err)
+	}
+	defer rows.Close()
+
+	webhooks := []model.Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan webhook", err)
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to list webhooks", err)
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook implements Repository
+func (r *SQLiteRepository) DeleteWebhook(ctx context.Context, id string) error {
+	n, err := r.exec(ctx, "DeleteWebhook", "DELETE", "webhooks", `DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("webhook not found")
+	}
+	return nil
+}
+
+// CreateWebhookDelivery implements Repository
+func (r *SQLiteRepository) CreateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, created_at, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := r.exec(ctx, "CreateWebhookDelivery", "INSERT", "webhook_deliveries", query,
+		delivery.ID,
+		delivery.WebhookID,
+		delivery.Event,
+		delivery.Payload,
+		delivery.Status,
+		utc(delivery.CreatedAt),
+		utc(delivery.NextAttemptAt),
+	)
+	return err
+}
+
+// ClaimWebhookDeliveries implements Repository. SQLite serializes writers,
+// so the statement alone keeps two claims from taking the same rows.
+func (r *SQLiteRepository) ClaimWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]model.WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+		)
+		RETURNING ` + webhookDeliveryColumns
+
+	ctx, span := r.startSpan(ctx, "ClaimWebhookDeliveries", "UPDATE", "webhook_deliveries", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, utc(leaseUntil), utc(now), limit)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to claim webhook deliveries", err)
+	}
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan webhook delivery", err)
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to claim webhook deliveries", err)
+	}
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery implements Repository
+func (r *SQLiteRepository) UpdateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	var deliveredAt interface{}
+	if delivery.DeliveredAt != nil {
+		deliveredAt = utc(*delivery.DeliveredAt)
+	}
+	query := `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ?, delivered_at = ?
+		WHERE id = ?
+	`
+	n, err := r.exec(ctx, "UpdateWebhookDelivery", "UPDATE", "webhook_deliveries", query,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.LastError,
+		utc(delivery.NextAttemptAt),
+		deliveredAt,
+		delivery.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("webhook delivery not found")
+	}
+	return nil
+}
+
+// ListWebhookDeliveries implements Repository
+func (r *SQLiteRepository) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY created_at DESC, id
+		LIMIT ?
+	`
+
+	ctx, span := r.startSpan(ctx, "ListWebhookDeliveries", "SELECT", "webhook_deliveries", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to list webhook deliveries", err)
+	}
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan webhook delivery", err)
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to list webhook deliveries", err)
+	}
+	return deliveries, nil
+}
+
+// CreateAuditEvent implements Repository
+func (r *SQLiteRepository) CreateAuditEvent(ctx context.Context, event model.AuditEvent) error {
+	query := `
+		INSERT INTO audit_events (id, action, profile_id, actor_id, target, request_id, ip, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := r.exec(ctx, "CreateAuditEvent", "INSERT", "audit_events", query,
+		event.ID,
+		event.Action,
+		event.ProfileID,
+		event.ActorID,
+		event.Target,
+		event.RequestID,
+		event.IP,
+		utc(event.CreatedAt),
+	)
+	return err
+}
+
+// ListAuditEvents implements Repository
+func (r *SQLiteRepository) ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error) {
+	query := `
+		SELECT ` + auditEventColumns + `
+		FROM audit_events
+		WHERE (? = '' OR profile_id = ?) AND (? = '' OR actor_id = ?)
+		ORDER BY created_at DESC, id
+		LIMIT ?
+	`
+
+	ctx, span := r.startSpan(ctx, "ListAuditEvents", "SELECT", "audit_events", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, filter.ProfileID, filter.ProfileID, filter.ActorID, filter.ActorID, filter.Limit)
+	if err != nil {
+		return nil, r.fail(ctx, span, "Failed to list audit events", err)
+	}
+	defer rows.Close()
+
+	events := []model.AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, r.fail(ctx, span, "Failed to scan audit event", err)
+		}
+		events = append(events, *event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, r.fail(ctx, span, "Failed to list audit events", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// SaveAuthorPost stores the state of a post. The conditional update makes
+// an older change a no-op, so the stream can be replayed.
+func (r *PostgresRepository) SaveAuthorPost(ctx context.Context, post model.AuthorPost) error {
+	query := `
+		INSERT INTO author_posts (id, profile_id, is_published, view_count, published_at, deleted, version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			profile_id = EXCLUDED.profile_id,
+			is_published = EXCLUDED.is_published,
+			view_count = EXCLUDED.view_count,
+			published_at = EXCLUDED.published_at,
+			deleted = EXCLUDED.deleted,
+			version = EXCLUDED.version
+		WHERE author_posts.version <= EXCLUDED.version
+	`
+
+	ctx, span := r.startSpan(ctx, "SaveAuthorPost", "INSERT", "author_posts", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		post.ID,
+		post.ProfileID,
+		post.IsPublished,
+		post.ViewCount,
+		post.PublishedAt,
+		post.Deleted,
+		post.Version,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to save author post", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetAuthorStats counts the posts of a profile
+func (r *PostgresRepository) GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error) {
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE is_published),
+			COUNT(*) FILTER (WHERE NOT is_published),
+			COALESCE(SUM(view_count), 0),
+			MAX(published_at) FILTER (WHERE is_published)
+		FROM author_posts
+		WHERE profile_id = $1 AND NOT deleted
+	`
+
+	ctx, span := r.startSpan(ctx, "GetAuthorStats", "SELECT", "author_posts", query)
+	defer span.End()
+
+	stats := model.AuthorStats{ProfileID: profileID}
+	var lastPublishedAt sql.NullTime
+	err := r.db.QueryRowContext(ctx, query, profileID).Scan(
+		&stats.PublishedCount,
+		&stats.DraftCount,
+		&stats.TotalViews,
+		&lastPublishedAt,
+	)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get author stats", "err", err)
+		return nil, err
+	}
+	if lastPublishedAt.Valid {
+		stats.LastPublishedAt = &lastPublishedAt.Time
+	}
+
+	return &stats, nil
+}
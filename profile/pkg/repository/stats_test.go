@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveAuthorPost(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	publishedAt := time.Now()
+	post := model.AuthorPost{ID: "post-id", ProfileID: "profile-id", IsPublished: true, ViewCount: 3, PublishedAt: &publishedAt, Version: 42}
+
+	// Set up expectations: the update only applies over an older version
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE author_posts.version <= EXCLUDED.version`)).
+		WithArgs("post-id", "profile-id", true, int64(3), publishedAt, false, int64(42)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Call the method
+	err := repo.SaveAuthorPost(context.Background(), post)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetAuthorStats(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	lastPublishedAt := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM author_posts`)).
+		WithArgs("profile-id").
+		WillReturnRows(sqlmock.NewRows([]string{"published", "drafts", "views", "last_published_at"}).AddRow(2, 1, 16, lastPublishedAt))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM author_posts`)).
+		WithArgs("no-posts").
+		WillReturnRows(sqlmock.NewRows([]string{"published", "drafts", "views", "last_published_at"}).AddRow(0, 0, 0, nil))
+
+	// Call the method
+	stats, err := repo.GetAuthorStats(context.Background(), "profile-id")
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, model.AuthorStats{
+		ProfileID:       "profile-id",
+		PublishedCount:  2,
+		DraftCount:      1,
+		TotalViews:      16,
+		LastPublishedAt: &lastPublishedAt,
+	}, *stats)
+
+	stats, err = repo.GetAuthorStats(context.Background(), "no-posts")
+	require.NoError(t, err)
+	assert.Equal(t, model.AuthorStats{ProfileID: "no-posts"}, *stats)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
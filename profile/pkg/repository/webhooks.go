@@ -0,0 +1,343 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// webhookColumns are selected by every webhook query, in scanWebhook order
+const webhookColumns = `id, url, events, secret, COALESCE(created_by, ''), created_at`
+
+// scanWebhook reads a row selected with webhookColumns
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*model.Webhook, error) {
+	var webhook model.Webhook
+	var events string
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.URL,
+		&events,
+		&webhook.Secret,
+		&webhook.CreatedBy,
+		&webhook.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	webhook.Events = splitEvents(events)
+	return &webhook, nil
+}
+
+// splitEvents parses the events column
+func splitEvents(events string) []string {
+	if events == "" {
+		return []string{}
+	}
+	return strings.Split(events, ",")
+}
+
+// webhookDeliveryColumns are selected by every delivery query, in
+// scanWebhookDelivery order
+const webhookDeliveryColumns = `id, webhook_id, event, payload, status, attempts, response_status, last_error, created_at, next_attempt_at, delivered_at`
+
+// scanWebhookDelivery reads a row selected with webhookDeliveryColumns
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (*model.WebhookDelivery, error) {
+	var delivery model.WebhookDelivery
+	var deliveredAt sql.NullTime
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.CreatedAt,
+		&delivery.NextAttemptAt,
+		&deliveredAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deliveredAt.Valid {
+		delivery.DeliveredAt = &deliveredAt.Time
+	}
+	return &delivery, nil
+}
+
+// CreateWebhook stores a new webhook
+func (r *PostgresRepository) CreateWebhook(ctx context.Context, webhook model.Webhook) error {
+	query := `
+		INSERT INTO webhooks (id, url, events, secret, created_by, created_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateWebhook", "INSERT", "webhooks", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		webhook.ID,
+		webhook.URL,
+		strings.Join(webhook.Events, ","),
+		webhook.Secret,
+		webhook.CreatedBy,
+		webhook.CreatedAt,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create webhook", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetWebhook retrieves a webhook by ID
+func (r *PostgresRepository) GetWebhook(ctx context.Context, id string) (*model.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = $1`
+
+	ctx, span := r.startSpan(ctx, "GetWebhook", "SELECT", "webhooks", query)
+	defer span.End()
+
+	webhook, err := scanWebhook(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("webhook not found")
+		}
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get webhook", "err", err)
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+// ListWebhooks returns every webhook, oldest first
+func (r *PostgresRepository) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks ORDER BY created_at, id`
+
+	ctx, span := r.startSpan(ctx, "ListWebhooks", "SELECT", "webhooks", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list webhooks", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []model.Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan webhook", "err", err)
+			return nil, err
+		}
+		webhooks = append(webhooks, *webhook)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list webhooks", "err", err)
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook; its deliveries go with it
+func (r *PostgresRepository) DeleteWebhook(ctx context.Context, id string) error {
+	query := `DELETE FROM webhooks WHERE id = $1`
+
+	ctx, span := r.startSpan(ctx, "DeleteWebhook", "DELETE", "webhooks", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(ctx, query, id)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to delete webhook", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("webhook not found")
+	}
+
+	return nil
+}
+
+// CreateWebhookDelivery stores a delivery to attempt
+func (r *PostgresRepository) CreateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (id, webhook_id, event, payload, status, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	ctx, span := r.startSpan(ctx, "CreateWebhookDelivery", "INSERT", "webhook_deliveries", query)
+	defer span.End()
+
+	_, err := r.db.ExecContext(
+		ctx,
+		query,
+		delivery.ID,
+		delivery.WebhookID,
+		delivery.Event,
+		delivery.Payload,
+		delivery.Status,
+		delivery.CreatedAt,
+		delivery.NextAttemptAt,
+	)
+
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to create webhook delivery", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries leases due deliveries. SKIP LOCKED lets replicas
+// claim at the same time without waiting for each other.
+func (r *PostgresRepository) ClaimWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]model.WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= $2
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + webhookDeliveryColumns
+
+	ctx, span := r.startSpan(ctx, "ClaimWebhookDeliveries", "UPDATE", "webhook_deliveries", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, leaseUntil, now, limit)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to claim webhook deliveries", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan webhook delivery", "err", err)
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to claim webhook deliveries", "err", err)
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt
+func (r *PostgresRepository) UpdateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, response_status = $3, last_error = $4, next_attempt_at = $5, delivered_at = $6
+		WHERE id = $7
+	`
+
+	ctx, span := r.startSpan(ctx, "UpdateWebhookDelivery", "UPDATE", "webhook_deliveries", query)
+	defer span.End()
+
+	result, err := r.db.ExecContext(
+		ctx,
+		query,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.LastError,
+		delivery.NextAttemptAt,
+		delivery.DeliveredAt,
+		delivery.ID,
+	)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to update webhook delivery", "err", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to get rows affected", "err", err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return errors.New("webhook delivery not found")
+	}
+
+	return nil
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a webhook
+func (r *PostgresRepository) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC, id
+		LIMIT $2
+	`
+
+	ctx, span := r.startSpan(ctx, "ListWebhookDeliveries", "SELECT", "webhook_deliveries", query)
+	defer span.End()
+
+	rows, err := r.db.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list webhook deliveries", "err", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []model.WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			recordError(span, err)
+			level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to scan webhook delivery", "err", err)
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	if err := rows.Err(); err != nil {
+		recordError(span, err)
+		level.Error(requestid.Logger(ctx, r.logger)).Log("msg", "Failed to list webhook deliveries", "err", err)
+		return nil, err
+	}
+
+	return deliveries, nil
+}
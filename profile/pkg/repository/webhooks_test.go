@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	webhook := model.Webhook{
+		ID:        "webhook-id",
+		URL:       "https://hooks.example.com/okblog",
+		Events:    []string{model.EventProfileCreated, model.EventProfileDeleted},
+		Secret:    "secret",
+		CreatedAt: now,
+	}
+
+	// Set up expectations: events are stored as a list, and a webhook
+	// without creator stores NULL
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO webhooks`)).
+		WithArgs("webhook-id", webhook.URL, "profile.created,profile.deleted", "secret", "", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Call the method
+	err := repo.CreateWebhook(context.Background(), webhook)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetWebhook_NotFound(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM webhooks WHERE id = $1`)).
+		WithArgs("unknown").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	// Call the method
+	webhook, err := repo.GetWebhook(context.Background(), "unknown")
+
+	// Assertions
+	assert.Nil(t, webhook)
+	assert.EqualError(t, err, "webhook not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimWebhookDeliveries(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	lease := now.Add(5 * time.Minute)
+	columns := []string{"id", "webhook_id", "event", "payload", "status", "attempts", "response_status", "last_error", "created_at", "next_attempt_at", "delivered_at"}
+
+	// Set up expectations: rows locked by another replica are skipped
+	mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE SKIP LOCKED`)).
+		WithArgs(lease, now, 10).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("delivery-id", "webhook-id", model.EventProfileCreated, `{}`, model.DeliveryPending, 2, 500, "receiver answered 500", now, lease, nil))
+
+	// Call the method
+	deliveries, err := repo.ClaimWebhookDeliveries(context.Background(), now, lease, 10)
+
+	// Assertions
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, "delivery-id", deliveries[0].ID)
+	assert.Equal(t, 2, deliveries[0].Attempts)
+	assert.Equal(t, 500, deliveries[0].ResponseStatus)
+	assert.Nil(t, deliveries[0].DeliveredAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateWebhookDelivery_NotFound(t *testing.T) {
+	db, mock, repo := setupMockDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	delivery := model.WebhookDelivery{ID: "unknown", Status: model.DeliveryFailed, Attempts: 8, LastError: "timeout", NextAttemptAt: now}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE webhook_deliveries`)).
+		WithArgs(model.DeliveryFailed, 8, 0, "timeout", now, nil, "unknown").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// Call the method
+	err := repo.UpdateWebhookDelivery(context.Background(), delivery)
+
+	// Assertions
+	assert.EqualError(t, err, "webhook delivery not found")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
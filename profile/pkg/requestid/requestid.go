@@ -0,0 +1,56 @@
+package requestid
+
+import (
+	"context"
+
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+)
+
+// Header is the HTTP header (and lowercased, the gRPC metadata key) that
+// carries the request ID
+const Header = "X-Request-ID"
+
+// maxLength bounds request IDs accepted from clients
+const maxLength = 128
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by ctx, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// New generates a request ID
+func New() string {
+	return uuid.New().String()
+}
+
+// Sanitize returns id if it is safe to log and echo back to the client,
+// otherwise it generates a new one
+func Sanitize(id string) string {
+	if id == "" || len(id) > maxLength {
+		return New()
+	}
+	for _, r := range id {
+		isAlnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !isAlnum && r != '-' && r != '_' && r != '.' && r != ':' {
+			return New()
+		}
+	}
+	return id
+}
+
+// Logger returns logger with the request ID of ctx attached to every line
+func Logger(ctx context.Context, logger log.Logger) log.Logger {
+	if id := FromContext(ctx); id != "" {
+		return log.With(logger, "request_id", id)
+	}
+	return logger
+}
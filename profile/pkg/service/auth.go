@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+)
+
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("not allowed for this account")
+)
+
+type claimsContextKey struct{}
+
+// NewContextWithClaims returns a context carrying the claims of the
+// authenticated caller. Transports set it after validating the caller's token.
+func NewContextWithClaims(ctx context.Context, claims *model.TokenClaims) context.Context {
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the authenticated caller, or nil
+func ClaimsFromContext(ctx context.Context) *model.TokenClaims {
+	claims, _ := ctx.Value(claimsContextKey{}).(*model.TokenClaims)
+	return claims
+}
+
+// requireAdmin returns the claims of the caller if it is an admin
+func requireAdmin(ctx context.Context) (*model.TokenClaims, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, ErrUnauthenticated
+	}
+	if claims.Role != model.RoleAdmin {
+		return nil, ErrForbidden
+	}
+	return claims, nil
+}
+
+// requireProfileAccess returns the claims of the caller if it is the profile
+// with the given ID or an admin
+func requireProfileAccess(ctx context.Context, profileID string) (*model.TokenClaims, error) {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil, ErrUnauthenticated
+	}
+	if claims.UserID != profileID && claims.Role != model.RoleAdmin {
+		return nil, ErrForbidden
+	}
+	return claims, nil
+}
+
+type clientContextKey struct{}
+
+// NewContextWithClient returns a context carrying what the transport knows
+// about the client. Login records it on the new session.
+func NewContextWithClient(ctx context.Context, client model.ClientInfo) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// ClientFromContext returns the client info set by NewContextWithClient
+func ClientFromContext(ctx context.Context) model.ClientInfo {
+	client, _ := ctx.Value(clientContextKey{}).(model.ClientInfo)
+	return client
+}
@@ -0,0 +1,305 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Supported password hashing algorithms
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var (
+	ErrUnknownHashFormat = errors.New("unknown password hash format")
+	ErrMalformedHash     = errors.New("malformed password hash")
+)
+
+// PasswordHasher hashes and verifies passwords. Encoded hashes are
+// self-describing, so a hasher can tell whether a stored hash was made with
+// older settings and should be replaced.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of a password
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether the encoded hash was made with a different
+	// algorithm or weaker parameters than the hasher currently uses
+	NeedsRehash(encoded string) bool
+	// MaxPasswordBytes is the length of the longest password Hash takes, in
+	// bytes, or 0 if it takes any
+	MaxPasswordBytes() int
+}
+
+// hashVerifier verifies one encoded hash format
+type hashVerifier interface {
+	Matches(encoded string) bool
+	Verify(password, encoded string) (bool, error)
+}
+
+// Argon2idParams are the tunable argon2id parameters
+type Argon2idParams struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Bounds of the argon2id parameters. A stored hash decides how much memory
+// and time verifying it takes, so hashes outside them are rejected rather
+// than computed.
+const (
+	maxArgon2idMemory     = 1024 * 1024 // 1 GiB
+	maxArgon2idIterations = 32
+	minArgon2idSaltLength = 8
+	minArgon2idKeyLength  = 16
+)
+
+// validate checks the parameters against the bounds. argon2 needs at least
+// 8 KiB of memory per lane.
+func (p Argon2idParams) validate() error {
+	switch {
+	case p.Iterations < 1 || p.Iterations > maxArgon2idIterations:
+		return fmt.Errorf("argon2id iterations must be between 1 and %d", maxArgon2idIterations)
+	case p.Parallelism < 1:
+		return errors.New("argon2id parallelism must be positive")
+	case p.Memory < 8*uint32(p.Parallelism) || p.Memory > maxArgon2idMemory:
+		return fmt.Errorf("argon2id memory must be between 8 KiB per lane and %d KiB", maxArgon2idMemory)
+	case p.SaltLength < minArgon2idSaltLength:
+		return fmt.Errorf("argon2id salts must be at least %d bytes", minArgon2idSaltLength)
+	case p.KeyLength < minArgon2idKeyLength:
+		return fmt.Errorf("argon2id keys must be at least %d bytes", minArgon2idKeyLength)
+	}
+	return nil
+}
+
+// DefaultArgon2idParams follow the OWASP recommendation for argon2id
+func DefaultArgon2idParams() Argon2idParams {
+	return Argon2idParams{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// Argon2idHasher hashes passwords with argon2id and encodes them in the PHC
+// string format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type Argon2idHasher struct {
+	Params Argon2idParams
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.Params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Params.Iterations, h.Params.Memory, h.Params.Parallelism, h.Params.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Params.Memory, h.Params.Iterations, h.Params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) MaxPasswordBytes() int {
+	return 0
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Params.Memory ||
+		params.Iterations != h.Params.Iterations ||
+		params.Parallelism != h.Params.Parallelism ||
+		params.KeyLength != h.Params.KeyLength ||
+		uint32(len(salt)) != h.Params.SaltLength
+}
+
+// decodeArgon2id parses a PHC encoded argon2id hash
+func decodeArgon2id(encoded string) (Argon2idParams, []byte, []byte, error) {
+	var params Argon2idParams
+
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrMalformedHash, version)
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	if err := params.validate(); err != nil {
+		return params, nil, nil, fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+	return params, salt, key, nil
+}
+
+// maxBcryptPasswordBytes is the most bcrypt hashes, longer passwords fail
+// with bcrypt.ErrPasswordTooLong
+const maxBcryptPasswordBytes = 72
+
+// BcryptHasher hashes passwords with bcrypt at a fixed cost
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (h BcryptHasher) MaxPasswordBytes() int {
+	return maxBcryptPasswordBytes
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	if !h.Matches(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// HasherConfig selects the algorithm new hashes are made with and its parameters
+type HasherConfig struct {
+	Algorithm  string
+	Argon2id   Argon2idParams
+	BcryptCost int
+}
+
+// DefaultHasherConfig hashes with argon2id
+func DefaultHasherConfig() HasherConfig {
+	return HasherConfig{
+		Algorithm:  AlgorithmArgon2id,
+		Argon2id:   DefaultArgon2idParams(),
+		BcryptCost: bcrypt.DefaultCost,
+	}
+}
+
+// multiHasher hashes with the preferred algorithm and verifies any supported format
+type multiHasher struct {
+	preferred PasswordHasher
+	verifiers []hashVerifier
+}
+
+// NewPasswordHasher creates a hasher that hashes with the configured
+// algorithm and can verify hashes from every supported algorithm, including
+// the legacy WordPress formats of migrated accounts
+func NewPasswordHasher(config HasherConfig) (PasswordHasher, error) {
+	argon := Argon2idHasher{Params: config.Argon2id}
+	bcryptHasher := BcryptHasher{Cost: config.BcryptCost}
+
+	var preferred PasswordHasher
+	switch config.Algorithm {
+	case AlgorithmArgon2id:
+		// Hashes made with parameters out of bounds couldn't be verified
+		if err := config.Argon2id.validate(); err != nil {
+			return nil, err
+		}
+		preferred = argon
+	case AlgorithmBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		preferred = bcryptHasher
+	default:
+		return nil, fmt.Errorf("unsupported password hashing algorithm %q", config.Algorithm)
+	}
+
+	return &multiHasher{
+		preferred: preferred,
+		verifiers: []hashVerifier{argon, bcryptHasher, PhpassVerifier{}, WordPressBcryptVerifier{}},
+	}, nil
+}
+
+func (h *multiHasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+func (h *multiHasher) Verify(password, encoded string) (bool, error) {
+	for _, v := range h.verifiers {
+		if v.Matches(encoded) {
+			return v.Verify(password, encoded)
+		}
+	}
+	return false, ErrUnknownHashFormat
+}
+
+func (h *multiHasher) MaxPasswordBytes() int {
+	return h.preferred.MaxPasswordBytes()
+}
+
+func (h *multiHasher) NeedsRehash(encoded string) bool {
+	return h.preferred.NeedsRehash(encoded)
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/google/uuid"
+)
+
+// DefaultImpersonationTTL is how long an impersonation token is valid
+const DefaultImpersonationTTL = 15 * time.Minute
+
+// Entries returned by ListAuditEvents
+const (
+	DefaultAuditEventLimit = 100
+	maxAuditEventLimit     = 1000
+)
+
+// WithImpersonationTTL sets how long impersonation tokens are valid
+func WithImpersonationTTL(ttl time.Duration) Option {
+	return func(s *profileService) {
+		s.impersonationTTL = ttl
+	}
+}
+
+func (s *profileService) Impersonate(ctx context.Context, profileID string) (*model.ImpersonationResponse, error) {
+	caller, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// An admin impersonating another admin gets an admin token, which must
+	// not start an impersonation of its own: the trail would lose the admin
+	// who is really acting
+	if caller.Impersonated() {
+		return nil, ErrForbidden
+	}
+	if caller.UserID == profileID {
+		return nil, &ValidationError{Fields: map[string]string{"id": "is your own profile"}}
+	}
+
+	profile, err := s.repo.GetProfile(ctx, profileID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return nil, ErrProfileNotFound
+		}
+		return nil, err
+	}
+	if profile.Locked() {
+		return nil, ErrAccountLocked
+	}
+
+	// The token gets a session of its own, so it shows up in the sessions of
+	// the profile and can be revoked like any other
+	now := time.Now()
+	session := model.Session{
+		ID:             uuid.New().String(),
+		ProfileID:      profile.ID,
+		UserAgent:      clientUserAgent(ctx),
+		IP:             ClientFromContext(ctx).IP,
+		CreatedAt:      now,
+		LastSeenAt:     now,
+		ExpiresAt:      now.Add(s.impersonationTTL),
+		ImpersonatorID: caller.UserID,
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to create session")
+		return nil, err
+	}
+
+	// No token without its entry in the audit trail
+	err = s.recordAudit(ctx, model.AuditEvent{
+		Action:    model.AuditImpersonationStarted,
+		ProfileID: profile.ID,
+		ActorID:   caller.UserID,
+		Target:    session.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	actor := &model.Actor{UserID: caller.UserID, Username: caller.Username}
+	token, err := s.generateJWTToken(profile, session.ID, actor, s.tokenPreferences(ctx, profile.ID), now, session.ExpiresAt)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to generate JWT token")
+		return nil, ErrTokenGenerationFailed
+	}
+
+	profile.Password = ""
+	return &model.ImpersonationResponse{
+		Profile:   profile,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// checkActor makes sure the admin behind an impersonation token can still
+// impersonate: the token dies with the admin's account, role or lock
+func (s *profileService) checkActor(ctx context.Context, actor *model.Actor) error {
+	profile, err := s.repo.GetProfile(ctx, actor.UserID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return ErrInvalidToken
+		}
+		return err
+	}
+	if profile.Role != model.RoleAdmin || profile.Locked() {
+		requestid.Logger(ctx, s.logger).Log("msg", "Rejected impersonation token of former admin", "impersonator", actor.UserID)
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (s *profileService) ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultAuditEventLimit
+	}
+	if filter.Limit > maxAuditEventLimit {
+		filter.Limit = maxAuditEventLimit
+	}
+	return s.repo.ListAuditEvents(ctx, filter)
+}
+
+// auditImpersonation records a change made with an impersonation token in
+// the audit trail. Changes the profile makes itself are not recorded. The
+// change is already stored, so a failure is only logged.
+func (s *profileService) auditImpersonation(ctx context.Context, action, target string) {
+	claims := ClaimsFromContext(ctx)
+	if !claims.Impersonated() {
+		return
+	}
+	s.recordAudit(ctx, model.AuditEvent{
+		Action:    action,
+		ProfileID: claims.UserID,
+		ActorID:   claims.Actor.UserID,
+		Target:    target,
+	})
+}
+
+// recordAudit stores an entry of the audit trail for the request of ctx
+func (s *profileService) recordAudit(ctx context.Context, event model.AuditEvent) error {
+	event.ID = uuid.New().String()
+	event.RequestID = requestid.FromContext(ctx)
+	event.IP = ClientFromContext(ctx).IP
+	event.CreatedAt = time.Now()
+
+	logger := requestid.Logger(ctx, s.logger)
+	if err := s.repo.CreateAuditEvent(ctx, event); err != nil {
+		logger.Log("err", err, "msg", "Failed to record audit event", "action", event.Action, "profile", event.ProfileID, "impersonator", event.ActorID)
+		return err
+	}
+	logger.Log("msg", "Recorded audit event", "action", event.Action, "profile", event.ProfileID, "impersonator", event.ActorID, "target", event.Target)
+	return nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/go-kit/kit/metrics"
+)
+
+// Login results counted by InstrumentingMiddleware
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+	LoginError   = "error"
+)
+
+// InstrumentingMiddleware counts login attempts by result. A failure is a
+// wrong username or password or a locked account; an error is anything else
+// going wrong.
+func InstrumentingMiddleware(logins metrics.Counter) Middleware {
+	return func(next Service) Service {
+		return &instrumentingMiddleware{
+			Service: next,
+			logins:  logins,
+		}
+	}
+}
+
+type instrumentingMiddleware struct {
+	Service
+	logins metrics.Counter
+}
+
+func (mw *instrumentingMiddleware) Login(ctx context.Context, req model.LoginRequest) (*model.LoginResponse, error) {
+	resp, err := mw.Service.Login(ctx, req)
+
+	result := LoginSuccess
+	if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrInvalidInput) || errors.Is(err, ErrAccountLocked) {
+		result = LoginFailure
+	} else if err != nil {
+		result = LoginError
+	}
+	mw.logins.With("result", result).Add(1)
+
+	return resp, err
+}
+
+// InstrumentHasher records how long hashing and verifying passwords take, by
+// operation and hash algorithm
+func InstrumentHasher(next PasswordHasher, duration metrics.Histogram) PasswordHasher {
+	return &instrumentedHasher{next: next, duration: duration}
+}
+
+type instrumentedHasher struct {
+	next     PasswordHasher
+	duration metrics.Histogram
+}
+
+func (h *instrumentedHasher) Hash(password string) (encoded string, err error) {
+	defer func(begin time.Time) {
+		h.duration.With("operation", "hash", "algorithm", hashAlgorithm(encoded)).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return h.next.Hash(password)
+}
+
+func (h *instrumentedHasher) Verify(password, encoded string) (bool, error) {
+	defer func(begin time.Time) {
+		h.duration.With("operation", "verify", "algorithm", hashAlgorithm(encoded)).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return h.next.Verify(password, encoded)
+}
+
+func (h *instrumentedHasher) NeedsRehash(encoded string) bool {
+	return h.next.NeedsRehash(encoded)
+}
+
+func (h *instrumentedHasher) MaxPasswordBytes() int {
+	return h.next.MaxPasswordBytes()
+}
+
+// hashAlgorithm names the algorithm of an encoded hash for metric labels
+func hashAlgorithm(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return AlgorithmArgon2id
+	case strings.HasPrefix(encoded, "$wp$"):
+		return "wordpress-bcrypt"
+	case strings.HasPrefix(encoded, "$2"):
+		return AlgorithmBcrypt
+	case strings.HasPrefix(encoded, "$P$"), strings.HasPrefix(encoded, "$H$"):
+		return "phpass"
+	default:
+		return "unknown"
+	}
+}
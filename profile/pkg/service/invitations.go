@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidInvitation  = errors.New("invitation code is invalid, expired or already used")
+	ErrInvitationNotFound = errors.New("invitation not found")
+)
+
+// DefaultInvitationTTL is how long an invitation stays valid unless the
+// request sets an expiry
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+// invitationCodeBytes is the entropy of an invitation code
+const invitationCodeBytes = 18
+
+// roles are the roles an invitation can grant
+var roles = map[string]bool{
+	model.RoleUser:  true,
+	model.RoleAdmin: true,
+}
+
+// newInvitationCode returns a random code and the hash that is stored
+func newInvitationCode() (string, string, error) {
+	b := make([]byte, invitationCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+	return code, hashInvitationCode(code), nil
+}
+
+// hashInvitationCode returns the hex SHA-256 of a code. Codes are random, so
+// a fast hash is enough.
+func hashInvitationCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *profileService) CreateInvitation(ctx context.Context, req model.CreateInvitationRequest) (*model.Invitation, error) {
+	caller, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if req.Role == "" {
+		req.Role = model.RoleUser
+	}
+	verr := &ValidationError{}
+	if msg := checkEmail(strings.TrimSpace(req.Email)); msg != "" {
+		verr.add("email", msg)
+	}
+	if !roles[req.Role] {
+		verr.add("role", "must be user or admin")
+	}
+	expiresAt := now.Add(s.invitationTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+		if !expiresAt.After(now) {
+			verr.add("expiresAt", "must be in the future")
+		}
+	}
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+
+	code, codeHash, err := newInvitationCode()
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to generate invitation code")
+		return nil, err
+	}
+
+	invitation := model.Invitation{
+		ID:        uuid.New().String(),
+		Email:     strings.TrimSpace(req.Email),
+		Role:      req.Role,
+		CodeHash:  codeHash,
+		CreatedBy: caller.UserID,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.repo.CreateInvitation(ctx, invitation); err != nil {
+		return nil, err
+	}
+	s.auditImpersonation(ctx, model.AuditInvitationCreated, invitation.ID)
+
+	// The code is only ever shown here
+	invitation.Code = code
+	return &invitation, nil
+}
+
+func (s *profileService) ListInvitations(ctx context.Context) ([]model.Invitation, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.ListPendingInvitations(ctx, time.Now())
+}
+
+func (s *profileService) RevokeInvitation(ctx context.Context, id string) error {
+	if _, err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	err := s.repo.RevokeInvitation(ctx, id, time.Now())
+	if err != nil {
+		if err.Error() == "invitation not found" {
+			return ErrInvitationNotFound
+		}
+		return err
+	}
+	s.auditImpersonation(ctx, model.AuditInvitationRevoked, id)
+	return nil
+}
+
+// pendingInvitation looks up the invitation for a registration. The code
+// must be pending and issued for the email being registered.
+func (s *profileService) pendingInvitation(ctx context.Context, code, email string) (*model.Invitation, error) {
+	invitation, err := s.repo.GetInvitationByCodeHash(ctx, hashInvitationCode(code))
+	if err != nil {
+		if err.Error() == "invitation not found" {
+			return nil, ErrInvalidInvitation
+		}
+		return nil, err
+	}
+
+	if !invitation.Pending(time.Now()) || !strings.EqualFold(invitation.Email, email) {
+		requestid.Logger(ctx, s.logger).Log("msg", "Rejected invitation", "invitation", invitation.ID)
+		return nil, ErrInvalidInvitation
+	}
+	return invitation, nil
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
 	"github.com/go-kit/log"
 )
 
@@ -26,9 +27,19 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
+// callLogger returns the logger for a call. Calls made with an impersonation
+// token are marked with the admin behind it.
+func (mw *loggingMiddleware) callLogger(ctx context.Context) log.Logger {
+	logger := requestid.Logger(ctx, mw.logger)
+	if claims := ClaimsFromContext(ctx); claims.Impersonated() {
+		logger = log.With(logger, "impersonator", claims.Actor.UserID)
+	}
+	return logger
+}
+
 func (mw *loggingMiddleware) RegisterProfile(ctx context.Context, req model.RegisterProfileRequest) (profile *model.Profile, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.callLogger(ctx).Log(
 			"method", "RegisterProfile",
 			"username", req.Username,
 			"email", req.Email,
@@ -42,7 +53,7 @@ func (mw *loggingMiddleware) RegisterProfile(ctx context.Context, req model.Regi
 
 func (mw *loggingMiddleware) Login(ctx context.Context, req model.LoginRequest) (loginResponse *model.LoginResponse, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.callLogger(ctx).Log(
 			"method", "Login",
 			"username", req.Username,
 			"took", time.Since(begin),
@@ -55,7 +66,11 @@ func (mw *loggingMiddleware) Login(ctx context.Context, req model.LoginRequest)
 
 func (mw *loggingMiddleware) ValidateToken(ctx context.Context, token string) (claims *model.TokenClaims, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		logger := mw.callLogger(ctx)
+		if claims.Impersonated() {
+			logger = log.With(logger, "user", claims.UserID, "impersonator", claims.Actor.UserID)
+		}
+		logger.Log(
 			"method", "ValidateToken",
 			"took", time.Since(begin),
 			"err", err,
@@ -67,7 +82,7 @@ func (mw *loggingMiddleware) ValidateToken(ctx context.Context, token string) (c
 
 func (mw *loggingMiddleware) GetProfile(ctx context.Context, id string) (profile *model.Profile, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.callLogger(ctx).Log(
 			"method", "GetProfile",
 			"id", id,
 			"took", time.Since(begin),
@@ -80,7 +95,7 @@ func (mw *loggingMiddleware) GetProfile(ctx context.Context, id string) (profile
 
 func (mw *loggingMiddleware) UpdateProfile(ctx context.Context, id string, req model.UpdateProfileRequest) (profile *model.Profile, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.callLogger(ctx).Log(
 			"method", "UpdateProfile",
 			"id", id,
 			"took", time.Since(begin),
@@ -93,7 +108,7 @@ func (mw *loggingMiddleware) UpdateProfile(ctx context.Context, id string, req m
 
 func (mw *loggingMiddleware) DeleteProfile(ctx context.Context, id string) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.callLogger(ctx).Log(
 			"method", "DeleteProfile",
 			"id", id,
 			"took", time.Since(begin),
@@ -103,3 +118,414 @@ func (mw *loggingMiddleware) DeleteProfile(ctx context.Context, id string) (err
 
 	return mw.next.DeleteProfile(ctx, id)
 }
+
+func (mw *loggingMiddleware) CreateInvitation(ctx context.Context, req model.CreateInvitationRequest) (invitation *model.Invitation, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "CreateInvitation",
+			"email", req.Email,
+			"role", req.Role,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.CreateInvitation(ctx, req)
+}
+
+func (mw *loggingMiddleware) ListInvitations(ctx context.Context) (invitations []model.Invitation, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ListInvitations",
+			"count", len(invitations),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ListInvitations(ctx)
+}
+
+func (mw *loggingMiddleware) RevokeInvitation(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "RevokeInvitation",
+			"id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.RevokeInvitation(ctx, id)
+}
+
+func (mw *loggingMiddleware) ListSessions(ctx context.Context, profileID string) (sessions []model.Session, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ListSessions",
+			"id", profileID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ListSessions(ctx, profileID)
+}
+
+func (mw *loggingMiddleware) RevokeSession(ctx context.Context, profileID, sessionID string) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "RevokeSession",
+			"id", profileID,
+			"session", sessionID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.RevokeSession(ctx, profileID, sessionID)
+}
+
+func (mw *loggingMiddleware) RevokeOtherSessions(ctx context.Context, profileID string) (revoked int, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "RevokeOtherSessions",
+			"id", profileID,
+			"revoked", revoked,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.RevokeOtherSessions(ctx, profileID)
+}
+
+func (mw *loggingMiddleware) GetPreferences(ctx context.Context, profileID string) (preferences *model.Preferences, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "GetPreferences",
+			"id", profileID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.GetPreferences(ctx, profileID)
+}
+
+func (mw *loggingMiddleware) UpdatePreferences(ctx context.Context, profileID string, req model.PreferencesUpdate) (preferences *model.Preferences, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "UpdatePreferences",
+			"id", profileID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.UpdatePreferences(ctx, profileID, req)
+}
+
+func (mw *loggingMiddleware) CreateProfile(ctx context.Context, req model.CreateProfileRequest) (profile *model.Profile, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "CreateProfile",
+			"username", req.Username,
+			"email", req.Email,
+			"role", req.Role,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.CreateProfile(ctx, req)
+}
+
+func (mw *loggingMiddleware) ResetPassword(ctx context.Context, id, password string) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ResetPassword",
+			"id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ResetPassword(ctx, id, password)
+}
+
+func (mw *loggingMiddleware) SetRole(ctx context.Context, id, role string) (profile *model.Profile, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "SetRole",
+			"id", id,
+			"role", role,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.SetRole(ctx, id, role)
+}
+
+func (mw *loggingMiddleware) LockProfile(ctx context.Context, id string) (profile *model.Profile, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "LockProfile",
+			"id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.LockProfile(ctx, id)
+}
+
+func (mw *loggingMiddleware) UnlockProfile(ctx context.Context, id string) (profile *model.Profile, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "UnlockProfile",
+			"id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.UnlockProfile(ctx, id)
+}
+
+func (mw *loggingMiddleware) Impersonate(ctx context.Context, profileID string) (resp *model.ImpersonationResponse, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "Impersonate",
+			"id", profileID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.Impersonate(ctx, profileID)
+}
+
+func (mw *loggingMiddleware) ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) (events []model.AuditEvent, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ListAuditEvents",
+			"profile", filter.ProfileID,
+			"actor", filter.ActorID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ListAuditEvents(ctx, filter)
+}
+
+func (mw *loggingMiddleware) RequestMagicLink(ctx context.Context, req model.MagicLinkRequest) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "RequestMagicLink",
+			"email", req.Email,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.RequestMagicLink(ctx, req)
+}
+
+func (mw *loggingMiddleware) RedeemMagicLink(ctx context.Context, req model.RedeemMagicLinkRequest) (loginResponse *model.LoginResponse, err error) {
+	defer func(begin time.Time) {
+		var id string
+		if loginResponse != nil && loginResponse.Profile != nil {
+			id = loginResponse.Profile.ID
+		}
+		mw.callLogger(ctx).Log(
+			"method", "RedeemMagicLink",
+			"id", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.RedeemMagicLink(ctx, req)
+}
+
+func (mw *loggingMiddleware) Subscribe(ctx context.Context, req model.SubscribeRequest) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "Subscribe",
+			"email", req.Email,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.Subscribe(ctx, req)
+}
+
+func (mw *loggingMiddleware) ConfirmSubscription(ctx context.Context, req model.SubscriptionTokenRequest) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ConfirmSubscription",
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ConfirmSubscription(ctx, req)
+}
+
+func (mw *loggingMiddleware) Unsubscribe(ctx context.Context, req model.SubscriptionTokenRequest) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "Unsubscribe",
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.Unsubscribe(ctx, req)
+}
+
+func (mw *loggingMiddleware) ListSubscribers(ctx context.Context) (subscribers []model.Subscriber, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ListSubscribers",
+			"count", len(subscribers),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ListSubscribers(ctx)
+}
+
+func (mw *loggingMiddleware) QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "QueueNewsletterPost",
+			"post", post.ID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.QueueNewsletterPost(ctx, post)
+}
+
+func (mw *loggingMiddleware) SendNewsletterDigest(ctx context.Context) (sent int, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "SendNewsletterDigest",
+			"sent", sent,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.SendNewsletterDigest(ctx)
+}
+
+func (mw *loggingMiddleware) RecordAuthorPost(ctx context.Context, post model.AuthorPost) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "RecordAuthorPost",
+			"post", post.ID,
+			"profile", post.ProfileID,
+			"version", post.Version,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.RecordAuthorPost(ctx, post)
+}
+
+func (mw *loggingMiddleware) GetAuthorStats(ctx context.Context, profileID string) (stats *model.AuthorStats, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "GetAuthorStats",
+			"profile", profileID,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.GetAuthorStats(ctx, profileID)
+}
+
+func (mw *loggingMiddleware) CreateWebhook(ctx context.Context, req model.CreateWebhookRequest) (webhook *model.Webhook, err error) {
+	defer func(begin time.Time) {
+		id := ""
+		if webhook != nil {
+			id = webhook.ID
+		}
+		mw.callLogger(ctx).Log(
+			"method", "CreateWebhook",
+			"webhook", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.CreateWebhook(ctx, req)
+}
+
+func (mw *loggingMiddleware) ListWebhooks(ctx context.Context) (webhooks []model.Webhook, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ListWebhooks",
+			"count", len(webhooks),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ListWebhooks(ctx)
+}
+
+func (mw *loggingMiddleware) DeleteWebhook(ctx context.Context, id string) (err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "DeleteWebhook",
+			"webhook", id,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.DeleteWebhook(ctx, id)
+}
+
+func (mw *loggingMiddleware) ListWebhookDeliveries(ctx context.Context, webhookID string) (deliveries []model.WebhookDelivery, err error) {
+	defer func(begin time.Time) {
+		mw.callLogger(ctx).Log(
+			"method", "ListWebhookDeliveries",
+			"webhook", webhookID,
+			"count", len(deliveries),
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.ListWebhookDeliveries(ctx, webhookID)
+}
+
+// DeliverWebhooks runs every few seconds, the runs that found nothing to
+// send are not logged
+func (mw *loggingMiddleware) DeliverWebhooks(ctx context.Context) (delivered int, err error) {
+	defer func(begin time.Time) {
+		if delivered == 0 && err == nil {
+			return
+		}
+		mw.callLogger(ctx).Log(
+			"method", "DeliverWebhooks",
+			"delivered", delivered,
+			"took", time.Since(begin),
+			"err", err,
+		)
+	}(time.Now())
+
+	return mw.next.DeliverWebhooks(ctx)
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/mailer"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidMagicLink   = errors.New("login link is invalid, expired or already used")
+	ErrMagicLinksDisabled = errors.New("magic link login is disabled")
+)
+
+// DefaultMagicLinkTTL is how long a magic link can be redeemed
+const DefaultMagicLinkTTL = 15 * time.Minute
+
+// magicLinkTokenBytes is the entropy of a magic link token
+const magicLinkTokenBytes = 32
+
+// An address gets at most maxMagicLinksPerWindow links per magicLinkWindow,
+// further requests are dropped so the endpoint can't flood an inbox
+const (
+	maxMagicLinksPerWindow = 3
+	magicLinkWindow        = 15 * time.Minute
+)
+
+// magicLinkSendTimeout bounds creating and sending a magic link in the
+// background
+const magicLinkSendTimeout = time.Minute
+
+// maxPendingMagicLinks is how many magic links are created and sent in the
+// background at once. Requests beyond it are dropped, so a flood of them
+// can't pile up goroutines and mail server connections.
+const maxPendingMagicLinks = 32
+
+// hashMagicLinkToken returns the hex SHA-256 of a token
+func hashMagicLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprintHash binds a magic link to the client: its user agent and the
+// optional secret it keeps until it redeems the link
+func fingerprintHash(ctx context.Context, fingerprint string) string {
+	sum := sha256.Sum256([]byte(ClientFromContext(ctx).UserAgent + "\x00" + fingerprint))
+	return hex.EncodeToString(sum[:])
+}
+
+// buildMagicLink returns the link to the login page carrying the token
+func (s *profileService) buildMagicLink(token string) (string, error) {
+	return withToken(s.magicLinkURL, token)
+}
+
+// RequestMagicLink only checks the request: the link is created and sent in
+// the background, so neither the answer nor how long it takes tells whether
+// the address has an account. Failures from then on are only logged.
+func (s *profileService) RequestMagicLink(ctx context.Context, req model.MagicLinkRequest) error {
+	if s.mailer == nil || s.magicLinkURL == "" {
+		return ErrMagicLinksDisabled
+	}
+
+	email := strings.TrimSpace(req.Email)
+	if msg := checkEmail(email); msg != "" {
+		verr := &ValidationError{}
+		verr.add("email", msg)
+		return verr
+	}
+
+	select {
+	case s.magicLinkSlots <- struct{}{}:
+	default:
+		requestid.Logger(ctx, s.logger).Log("msg", "Too many magic links pending, dropped the request")
+		return nil
+	}
+
+	// The request context ends with the response, its values are still
+	// wanted for the fingerprint and the logs
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), magicLinkSendTimeout)
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		defer func() { <-s.magicLinkSlots }()
+		defer cancel()
+		if err := s.sendMagicLink(ctx, email, req.Fingerprint); err != nil {
+			requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to send magic link")
+		}
+	}()
+	return nil
+}
+
+// sendMagicLink creates a magic link for the profile with the email address
+// and mails it, unless the address has no profile or already got
+// maxMagicLinksPerWindow links in the last magicLinkWindow
+func (s *profileService) sendMagicLink(ctx context.Context, email, fingerprint string) error {
+	profile, err := s.repo.GetProfileByEmail(ctx, email)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			requestid.Logger(ctx, s.logger).Log("msg", "Magic link requested for unknown email")
+			return nil
+		}
+		return err
+	}
+
+	b := make([]byte, magicLinkTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	link := model.MagicLink{
+		ID:              uuid.New().String(),
+		ProfileID:       profile.ID,
+		TokenHash:       hashMagicLinkToken(token),
+		FingerprintHash: fingerprintHash(ctx, fingerprint),
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(s.magicLinkTTL),
+	}
+	if err := s.repo.CreateMagicLink(ctx, link, maxMagicLinksPerWindow, now.Add(-magicLinkWindow)); err != nil {
+		if err.Error() == "too many magic links" {
+			requestid.Logger(ctx, s.logger).Log("msg", "Too many magic links requested", "id", profile.ID)
+			return nil
+		}
+		return err
+	}
+
+	linkURL, err := s.buildMagicLink(token)
+	if err != nil {
+		return err
+	}
+	msg := mailer.Message{
+		To:      profile.Email,
+		Subject: "Your okblog login link",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link in the same browser to log in:\n\n%s\n\nIt can be used once and expires in %s. If you didn't ask for it, ignore this email.\n",
+			profile.Username, linkURL, s.magicLinkTTL),
+	}
+	return s.mailer.Send(ctx, msg)
+}
+
+func (s *profileService) RedeemMagicLink(ctx context.Context, req model.RedeemMagicLinkRequest) (*model.LoginResponse, error) {
+	if strings.TrimSpace(req.Token) == "" {
+		return nil, ErrInvalidMagicLink
+	}
+
+	// The link is used up even when the fingerprint doesn't match, so a
+	// leaked link can't be retried from another client
+	link, err := s.repo.ConsumeMagicLink(ctx, hashMagicLinkToken(req.Token), time.Now())
+	if err != nil {
+		if err.Error() == "magic link not found" {
+			return nil, ErrInvalidMagicLink
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(link.FingerprintHash), []byte(fingerprintHash(ctx, req.Fingerprint))) != 1 {
+		requestid.Logger(ctx, s.logger).Log("msg", "Magic link redeemed from another client", "link", link.ID)
+		return nil, ErrInvalidMagicLink
+	}
+
+	profile, err := s.repo.GetProfile(ctx, link.ProfileID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return nil, ErrInvalidMagicLink
+		}
+		return nil, err
+	}
+	return s.startSession(ctx, profile)
+}
@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/mailer"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/posts"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNewsletterDisabled       = errors.New("newsletter is disabled")
+	ErrInvalidSubscriptionToken = errors.New("subscription link is invalid, expired or already used")
+)
+
+// DefaultSubscriptionConfirmTTL is how long a subscription can be confirmed
+const DefaultSubscriptionConfirmTTL = 48 * time.Hour
+
+// subscriptionResendInterval is how long a pending subscriber waits before
+// subscribing again sends a new confirmation, so the endpoint can't be used
+// to flood an inbox
+const subscriptionResendInterval = time.Hour
+
+// subscriptionTokenBytes is the entropy of confirmation and unsubscribe tokens
+const subscriptionTokenBytes = 32
+
+// newsletterDigestLease is how long a digest holds the posts it sends, so
+// the replicas don't all send them. It must be longer than sending to every
+// subscriber takes. The posts of a digest interrupted midway go out again
+// once it expired.
+const newsletterDigestLease = 6 * time.Hour
+
+// NewsletterConfig configures the newsletter, see WithNewsletter
+type NewsletterConfig struct {
+	// ConfirmURL and UnsubscribeURL are the pages of the web app that post
+	// the token of the link back to the API
+	ConfirmURL     string
+	UnsubscribeURL string
+	// SiteURL is the public URL of the blog, posts are linked below it
+	SiteURL    string
+	ConfirmTTL time.Duration
+}
+
+// WithNewsletter enables newsletter subscriptions. Confirmation links and
+// digests are sent with m.
+func WithNewsletter(m mailer.Mailer, config NewsletterConfig) Option {
+	return func(s *profileService) {
+		if config.ConfirmTTL <= 0 {
+			config.ConfirmTTL = DefaultSubscriptionConfirmTTL
+		}
+		s.newsletterMailer = m
+		s.newsletter = config
+	}
+}
+
+// newSubscriptionToken returns a random token for a subscription link
+func newSubscriptionToken() (string, error) {
+	b := make([]byte, subscriptionTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSubscriptionToken returns the hex SHA-256 of a confirmation token
+func hashSubscriptionToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *profileService) newsletterEnabled() bool {
+	return s.newsletterMailer != nil && s.newsletter.ConfirmURL != ""
+}
+
+// postURL returns the address of a post on the blog
+func (s *profileService) postURL(slug string) string {
+	return strings.TrimRight(s.newsletter.SiteURL, "/") + "/" + url.PathEscape(slug)
+}
+
+func (s *profileService) Subscribe(ctx context.Context, req model.SubscribeRequest) error {
+	if !s.newsletterEnabled() {
+		return ErrNewsletterDisabled
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if msg := checkEmail(email); msg != "" {
+		verr := &ValidationError{}
+		verr.add("email", msg)
+		return verr
+	}
+
+	token, err := newSubscriptionToken()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expiresAt := now.Add(s.newsletter.ConfirmTTL)
+
+	// Every address gets the same answer, so the endpoint can't be used to
+	// find out who subscribed. Subscribing again sends a new link, which
+	// also brings back readers who unsubscribed, unless the last one is
+	// recent.
+	subscriber, err := s.repo.GetSubscriberByEmail(ctx, email)
+	switch {
+	case err != nil && err.Error() == "subscriber not found":
+		unsubscribeToken, err := newSubscriptionToken()
+		if err != nil {
+			return err
+		}
+		err = s.repo.CreateSubscriber(ctx, model.Subscriber{
+			ID:               uuid.New().String(),
+			Email:            email,
+			ConfirmTokenHash: hashSubscriptionToken(token),
+			ConfirmExpiresAt: expiresAt,
+			UnsubscribeToken: unsubscribeToken,
+			CreatedAt:        now,
+		})
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case subscriber.Status() == model.SubscriberActive:
+		requestid.Logger(ctx, s.logger).Log("msg", "Subscription requested for an active subscriber")
+		return nil
+	case subscriber.Status() == model.SubscriberPending && subscriber.ConfirmExpiresAt.After(expiresAt.Add(-subscriptionResendInterval)):
+		// The link was sent ConfirmTTL before it expires
+		requestid.Logger(ctx, s.logger).Log("msg", "Subscription requested again too soon", "subscriber", subscriber.ID)
+		return nil
+	default:
+		if err := s.repo.RenewSubscription(ctx, subscriber.ID, hashSubscriptionToken(token), expiresAt); err != nil {
+			return err
+		}
+	}
+
+	confirmURL, err := withToken(s.newsletter.ConfirmURL, token)
+	if err != nil {
+		return err
+	}
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Confirm your okblog subscription",
+		Body: fmt.Sprintf("Hi,\n\nOpen this link to receive new okblog posts by email:\n\n%s\n\nIt expires in %s. If you didn't subscribe, ignore this email and you won't hear from us again.\n",
+			confirmURL, s.newsletter.ConfirmTTL),
+	}
+	// A failure is only logged, as it would tell an address that already
+	// subscribed apart
+	if err := s.newsletterMailer.Send(ctx, msg); err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to send subscription confirmation")
+	}
+	return nil
+}
+
+func (s *profileService) ConfirmSubscription(ctx context.Context, req model.SubscriptionTokenRequest) error {
+	if strings.TrimSpace(req.Token) == "" {
+		return ErrInvalidSubscriptionToken
+	}
+
+	subscriber, err := s.repo.ConfirmSubscriber(ctx, hashSubscriptionToken(req.Token), time.Now())
+	if err != nil {
+		if err.Error() == "subscriber not found" {
+			return ErrInvalidSubscriptionToken
+		}
+		return err
+	}
+	requestid.Logger(ctx, s.logger).Log("msg", "Subscription confirmed", "subscriber", subscriber.ID)
+	return nil
+}
+
+func (s *profileService) Unsubscribe(ctx context.Context, req model.SubscriptionTokenRequest) error {
+	token := strings.TrimSpace(req.Token)
+	if token == "" {
+		return ErrInvalidSubscriptionToken
+	}
+
+	subscriber, err := s.repo.Unsubscribe(ctx, token, time.Now())
+	if err != nil {
+		if err.Error() == "subscriber not found" {
+			return ErrInvalidSubscriptionToken
+		}
+		return err
+	}
+	requestid.Logger(ctx, s.logger).Log("msg", "Unsubscribed", "subscriber", subscriber.ID)
+	return nil
+}
+
+func (s *profileService) ListSubscribers(ctx context.Context) ([]model.Subscriber, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.ListSubscribers(ctx)
+}
+
+func (s *profileService) QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error {
+	if post.QueuedAt.IsZero() {
+		post.QueuedAt = time.Now()
+	}
+	if post.PublishedAt.IsZero() {
+		post.PublishedAt = post.QueuedAt
+	}
+	return s.repo.QueueNewsletterPost(ctx, post)
+}
+
+func (s *profileService) SendNewsletterDigest(ctx context.Context) (int, error) {
+	if !s.newsletterEnabled() {
+		return 0, ErrNewsletterDisabled
+	}
+
+	now := time.Now()
+	queued, err := s.repo.ClaimNewsletterPosts(ctx, now, now.Add(newsletterDigestLease))
+	if err != nil || len(queued) == 0 {
+		return 0, err
+	}
+	ids := make([]string, len(queued))
+	for i, post := range queued {
+		ids[i] = post.ID
+	}
+
+	logger := requestid.Logger(ctx, s.logger)
+	// Posts that went out to nobody are left for the next digest
+	release := func() {
+		if err := s.repo.ReleaseNewsletterPosts(ctx, ids); err != nil {
+			logger.Log("err", err, "msg", "Failed to release newsletter posts")
+		}
+	}
+
+	subscribers, err := s.repo.ListSubscribers(ctx)
+	if err != nil {
+		release()
+		return 0, err
+	}
+
+	subject := fmt.Sprintf("%d new posts on okblog", len(queued))
+	if len(queued) == 1 {
+		subject = "New on okblog: " + queued[0].Title
+	}
+	var body strings.Builder
+	body.WriteString("Hi,\n\nHere is what was published on okblog since the last email:\n")
+	for _, post := range queued {
+		body.WriteString("\n" + post.Title + "\n")
+		if post.Excerpt != "" {
+			body.WriteString(post.Excerpt + "\n")
+		}
+		body.WriteString(s.postURL(post.Slug) + "\n")
+	}
+
+	sent, failed := 0, 0
+	var lastErr error
+	for _, subscriber := range subscribers {
+		if subscriber.Status() != model.SubscriberActive {
+			continue
+		}
+		unsubscribeURL, err := withToken(s.newsletter.UnsubscribeURL, subscriber.UnsubscribeToken)
+		if err != nil {
+			if sent == 0 {
+				release()
+			}
+			return sent, err
+		}
+		msg := mailer.Message{
+			To:      subscriber.Email,
+			Subject: subject,
+			Body:    body.String() + "\nYou get this email because you subscribed to okblog. To stop, open:\n" + unsubscribeURL + "\n",
+		}
+		if err := s.newsletterMailer.Send(ctx, msg); err != nil {
+			logger.Log("err", err, "msg", "Failed to send newsletter digest", "subscriber", subscriber.ID)
+			failed++
+			lastErr = err
+			continue
+		}
+		sent++
+	}
+
+	// When no email went out the mailer is probably down, keep the posts
+	// for the next digest. Partial failures are not retried, the readers
+	// who got it would get the same posts again.
+	if sent == 0 && failed > 0 {
+		release()
+		return 0, fmt.Errorf("send newsletter digest: %w", lastErr)
+	}
+	if err := s.repo.MarkNewsletterPostsSent(ctx, ids, time.Now()); err != nil {
+		return sent, err
+	}
+	logger.Log("msg", "Newsletter digest sent", "posts", len(queued), "sent", sent, "failed", failed)
+	return sent, nil
+}
+
+// NewsletterPostHandler queues the posts published on the posts topic for
+// the next digest. Pages and snapshot reads are ignored.
+func NewsletterPostHandler(svc Service) posts.Handler {
+	return posts.HandlerFunc(func(ctx context.Context, change posts.Change) error {
+		if !change.Published() || change.After.Type != posts.TypePost {
+			return nil
+		}
+		post := change.After
+		return svc.QueueNewsletterPost(ctx, model.NewsletterPost{
+			ID:          post.ID,
+			Title:       post.Title,
+			Slug:        post.Slug,
+			Excerpt:     post.Excerpt,
+			PublishedAt: post.PublishedAt,
+		})
+	})
+}
+
+// subscriberCSVHeader is the first row written by WriteSubscribersCSV
+var subscriberCSVHeader = []string{"id", "email", "status", "created_at", "confirmed_at", "unsubscribed_at"}
+
+// WriteSubscribersCSV writes subscribers as CSV with a header row. Times are
+// RFC 3339 in UTC and empty when unset.
+func WriteSubscribersCSV(w io.Writer, subscribers []model.Subscriber) error {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(subscriberCSVHeader); err != nil {
+		return err
+	}
+	for _, subscriber := range subscribers {
+		err := cw.Write([]string{
+			subscriber.ID,
+			csvCell(subscriber.Email),
+			subscriber.Status(),
+			formatTime(&subscriber.CreatedAt),
+			formatTime(subscriber.ConfirmedAt),
+			formatTime(subscriber.UnsubscribedAt),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell quotes values spreadsheets would run as a formula. Emails are
+// typed by readers, and the export is opened by admins.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// withToken returns rawURL with the token query parameter set
+func withToken(rawURL, token string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	// The runtime image has no zoneinfo, so timezones are checked against
+	// the copy in the binary
+	_ "time/tzdata"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// preferencesSchemaJSON is the JSON Schema every stored preferences document
+// is valid against
+//
+//go:embed preferences_schema.json
+var preferencesSchemaJSON []byte
+
+var preferencesSchema = compilePreferencesSchema()
+
+func compilePreferencesSchema() *jsonschema.Schema {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(preferencesSchemaJSON))
+	if err != nil {
+		panic("preferences schema: " + err.Error())
+	}
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	const url = "urn:okblog:profile:preferences"
+	if err := c.AddResource(url, doc); err != nil {
+		panic("preferences schema: " + err.Error())
+	}
+	return c.MustCompile(url)
+}
+
+func (s *profileService) GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error) {
+	if _, err := requireProfileAccess(ctx, profileID); err != nil {
+		return nil, err
+	}
+
+	preferences, err := s.repo.GetPreferences(ctx, profileID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return nil, ErrProfileNotFound
+		}
+		return nil, err
+	}
+	return preferences, nil
+}
+
+// UpdatePreferences merges the fields set in req into the stored preferences
+// and clears the ones it unsets. Other fields keep their value.
+func (s *profileService) UpdatePreferences(ctx context.Context, profileID string, req model.PreferencesUpdate) (*model.Preferences, error) {
+	if _, err := requireProfileAccess(ctx, profileID); err != nil {
+		return nil, err
+	}
+
+	preferences, err := s.repo.UpdatePreferences(ctx, profileID, func(preferences *model.Preferences) error {
+		mergePreferences(preferences, req.Set)
+		if err := unsetPreferences(preferences, req.Unset); err != nil {
+			return err
+		}
+		return validatePreferences(*preferences)
+	})
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return nil, ErrProfileNotFound
+		}
+		return nil, err
+	}
+	s.auditImpersonation(ctx, model.AuditPreferencesUpdated, profileID)
+	return preferences, nil
+}
+
+// mergePreferences copies the fields set in update onto preferences
+func mergePreferences(preferences *model.Preferences, update model.Preferences) {
+	if update.Locale != "" {
+		preferences.Locale = update.Locale
+	}
+	if update.Timezone != "" {
+		preferences.Timezone = update.Timezone
+	}
+
+	if e := update.Editor; e != nil {
+		if preferences.Editor == nil {
+			preferences.Editor = &model.EditorPreferences{}
+		}
+		if e.Mode != "" {
+			preferences.Editor.Mode = e.Mode
+		}
+		if e.Theme != "" {
+			preferences.Editor.Theme = e.Theme
+		}
+		if e.FontSize != 0 {
+			preferences.Editor.FontSize = e.FontSize
+		}
+		if e.SpellCheck != nil {
+			preferences.Editor.SpellCheck = e.SpellCheck
+		}
+		if e.Autosave != nil {
+			preferences.Editor.Autosave = e.Autosave
+		}
+	}
+
+	if n := update.Notifications; n != nil {
+		if preferences.Notifications == nil {
+			preferences.Notifications = &model.NotificationPreferences{}
+		}
+		if n.Email != nil {
+			preferences.Notifications.Email = n.Email
+		}
+		if n.NewDeviceLogin != nil {
+			preferences.Notifications.NewDeviceLogin = n.NewDeviceLogin
+		}
+	}
+}
+
+// unsetPreferences clears the fields at paths. Nested documents left empty
+// are removed.
+func unsetPreferences(preferences *model.Preferences, paths []string) error {
+	verr := &ValidationError{}
+	for _, path := range paths {
+		editor, notifications := preferences.Editor, preferences.Notifications
+		if editor == nil {
+			editor = &model.EditorPreferences{}
+		}
+		if notifications == nil {
+			notifications = &model.NotificationPreferences{}
+		}
+
+		switch path {
+		case "locale":
+			preferences.Locale = ""
+		case "timezone":
+			preferences.Timezone = ""
+		case "editor":
+			preferences.Editor = nil
+		case "editor.mode":
+			editor.Mode = ""
+		case "editor.theme":
+			editor.Theme = ""
+		case "editor.fontSize":
+			editor.FontSize = 0
+		case "editor.spellCheck":
+			editor.SpellCheck = nil
+		case "editor.autosave":
+			editor.Autosave = nil
+		case "notifications":
+			preferences.Notifications = nil
+		case "notifications.email":
+			notifications.Email = nil
+		case "notifications.newDeviceLogin":
+			notifications.NewDeviceLogin = nil
+		default:
+			verr.add(path, "is not a preference")
+		}
+	}
+
+	if e := preferences.Editor; e != nil && *e == (model.EditorPreferences{}) {
+		preferences.Editor = nil
+	}
+	if n := preferences.Notifications; n != nil && *n == (model.NotificationPreferences{}) {
+		preferences.Notifications = nil
+	}
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validatePreferences checks preferences against the schema and the
+// timezone against the IANA database
+func validatePreferences(preferences model.Preferences) error {
+	doc, err := json.Marshal(preferences)
+	if err != nil {
+		return err
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(doc))
+	if err != nil {
+		return err
+	}
+
+	verr := &ValidationError{}
+	err = preferencesSchema.Validate(instance)
+	var schemaErr *jsonschema.ValidationError
+	if errors.As(err, &schemaErr) {
+		addSchemaErrors(verr, schemaErr, message.NewPrinter(language.English))
+	} else if err != nil {
+		return err
+	}
+
+	// "Local" is the zone of whichever server reads it
+	if tz := preferences.Timezone; tz != "" && verr.Fields["timezone"] == "" {
+		if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+			verr.add("timezone", "is not a known time zone")
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// addSchemaErrors reports the leaves of a schema validation error under the
+// path of the value they are about
+func addSchemaErrors(verr *ValidationError, err *jsonschema.ValidationError, p *message.Printer) {
+	if len(err.Causes) == 0 {
+		field := strings.Join(err.InstanceLocation, ".")
+		if field == "" {
+			field = "preferences"
+		}
+		verr.add(field, err.ErrorKind.LocalizedString(p))
+		return
+	}
+	for _, cause := range err.Causes {
+		addSchemaErrors(verr, cause, p)
+	}
+}
+
+// tokenPreferences returns the preferences to put in the tokens of a
+// profile. A failure is only logged: the preferences are a convenience for
+// downstream services and not worth failing a login over.
+func (s *profileService) tokenPreferences(ctx context.Context, profileID string) *model.Preferences {
+	preferences, err := s.repo.GetPreferences(ctx, profileID)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to load preferences for token", "id", profileID)
+		return nil
+	}
+	return preferences
+}
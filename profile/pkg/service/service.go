@@ -3,20 +3,23 @@ package service
 import (
 	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ganis/okblog/profile/pkg/mailer"
 	"github.com/ganis/okblog/profile/pkg/model"
 	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/webhook"
 	"github.com/go-kit/log"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -26,21 +29,9 @@ var (
 	ErrHashingFailed         = errors.New("password hashing failed")
 	ErrTokenGenerationFailed = errors.New("failed to generate token")
 	ErrInvalidToken          = errors.New("invalid token")
+	ErrRegistrationDisabled  = errors.New("registration is disabled")
 )
 
-// JWT signing key - loaded from environment variable or default value
-var jwtSigningKey = getJWTSigningKey()
-
-// getJWTSigningKey loads the JWT signing key from environment variable or uses default
-func getJWTSigningKey() []byte {
-	key := os.Getenv("JWT_SIGNING_KEY")
-	if key == "" {
-		// Default value if environment variable is not set
-		return []byte("my_secret_key")
-	}
-	return []byte(key)
-}
-
 // JWT token expiration time
 const jwtExpirationTime = 14 * 24 * time.Hour
 
@@ -48,61 +39,253 @@ const jwtExpirationTime = 14 * 24 * time.Hour
 type JWTClaims struct {
 	UserID    string    `json:"userId"`
 	Username  string    `json:"username"`
+	Role      string    `json:"role,omitempty"`
+	SessionID string    `json:"sid,omitempty"`
 	IssuedAt  time.Time `json:"issuedAt"`
 	ExpiresAt time.Time `json:"expiresAt"`
+	// Locale and Timezone are the preferences of the profile when the token
+	// was issued. The names follow the OpenID Connect standard claims.
+	Locale   string `json:"locale,omitempty"`
+	Timezone string `json:"zoneinfo,omitempty"`
+	// Actor is set on impersonation tokens, after the act claim of RFC 8693
+	Actor *model.Actor `json:"act,omitempty"`
 }
 
 // Service defines the interface for profile operations
 type Service interface {
 	RegisterProfile(ctx context.Context, req model.RegisterProfileRequest) (*model.Profile, error)
 	Login(ctx context.Context, req model.LoginRequest) (*model.LoginResponse, error)
+	// RequestMagicLink emails a one-time login link if a profile has the
+	// email, in the background. Unknown emails, throttled requests and
+	// failures to send are not reported.
+	RequestMagicLink(ctx context.Context, req model.MagicLinkRequest) error
+	RedeemMagicLink(ctx context.Context, req model.RedeemMagicLinkRequest) (*model.LoginResponse, error)
 	ValidateToken(ctx context.Context, token string) (*model.TokenClaims, error)
 	GetProfile(ctx context.Context, id string) (*model.Profile, error)
 	UpdateProfile(ctx context.Context, id string, req model.UpdateProfileRequest) (*model.Profile, error)
 	DeleteProfile(ctx context.Context, id string) error
+
+	// Invitation management requires an admin caller, see NewContextWithClaims
+	CreateInvitation(ctx context.Context, req model.CreateInvitationRequest) (*model.Invitation, error)
+	ListInvitations(ctx context.Context) ([]model.Invitation, error)
+	RevokeInvitation(ctx context.Context, id string) error
+
+	// Session management requires the profile itself or an admin as caller
+	ListSessions(ctx context.Context, profileID string) ([]model.Session, error)
+	RevokeSession(ctx context.Context, profileID, sessionID string) error
+	// RevokeOtherSessions revokes every session of the profile except the
+	// caller's and returns how many were revoked
+	RevokeOtherSessions(ctx context.Context, profileID string) (int, error)
+
+	// Preferences require the profile itself or an admin as caller.
+	// UpdatePreferences only changes the fields set or unset in the request
+	// and validates the result against the preferences JSON Schema.
+	GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error)
+	UpdatePreferences(ctx context.Context, profileID string, req model.PreferencesUpdate) (*model.Preferences, error)
+
+	// Account administration requires an admin caller. Resetting the
+	// password and locking revoke every session of the profile.
+	CreateProfile(ctx context.Context, req model.CreateProfileRequest) (*model.Profile, error)
+	ResetPassword(ctx context.Context, id, password string) error
+	SetRole(ctx context.Context, id, role string) (*model.Profile, error)
+	LockProfile(ctx context.Context, id string) (*model.Profile, error)
+	UnlockProfile(ctx context.Context, id string) (*model.Profile, error)
+	// Impersonate returns a short-lived token of the profile for the admin
+	// caller. Its claims name the admin as actor, and the changes made with
+	// it are recorded in the audit trail.
+	Impersonate(ctx context.Context, profileID string) (*model.ImpersonationResponse, error)
+	// ListAuditEvents requires an admin caller
+	ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error)
+
+	// Subscribe emails a link confirming the subscription of a reader to
+	// the newsletter. Addresses that already subscribed are not reported.
+	Subscribe(ctx context.Context, req model.SubscribeRequest) error
+	ConfirmSubscription(ctx context.Context, req model.SubscriptionTokenRequest) error
+	Unsubscribe(ctx context.Context, req model.SubscriptionTokenRequest) error
+	// ListSubscribers requires an admin caller
+	ListSubscribers(ctx context.Context) ([]model.Subscriber, error)
+	// QueueNewsletterPost and SendNewsletterDigest are run by the server,
+	// not the transports: published posts are queued as they arrive and
+	// sent to active subscribers in a digest. SendNewsletterDigest returns
+	// how many emails were sent.
+	QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error
+	SendNewsletterDigest(ctx context.Context) (int, error)
+
+	// RecordAuthorPost is run by the server for every change on the posts
+	// topic. GetAuthorStats counts the posts of a profile from the recorded
+	// states.
+	RecordAuthorPost(ctx context.Context, post model.AuthorPost) error
+	GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error)
+
+	// Webhook management requires an admin caller. The secret of a webhook
+	// is only returned by CreateWebhook.
+	CreateWebhook(ctx context.Context, req model.CreateWebhookRequest) (*model.Webhook, error)
+	ListWebhooks(ctx context.Context) ([]model.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	ListWebhookDeliveries(ctx context.Context, webhookID string) ([]model.WebhookDelivery, error)
+	// DeliverWebhooks is run by the server: it sends the deliveries that
+	// are due and returns how many the receivers accepted
+	DeliverWebhooks(ctx context.Context) (int, error)
 }
 
 // profileService implements the Service interface
 type profileService struct {
-	repo           repository.Repository
-	logger         log.Logger
-	onlyOneProfile bool
+	repo             repository.Repository
+	logger           log.Logger
+	openRegistration bool
+	invitationTTL    time.Duration
+	passwordPolicy   PasswordPolicy
+	hasher           PasswordHasher
+	signingKey       []byte
+	// previousSigningKeys still verify tokens signed before a key rotation
+	previousSigningKeys [][]byte
+
+	sessionTouchInterval time.Duration
+	impersonationTTL     time.Duration
+	// sessionlessTokens accepts tokens issued before sessions existed
+	sessionlessTokens bool
+
+	mailer       mailer.Mailer
+	magicLinkURL string
+	magicLinkTTL time.Duration
+	// magicLinkSlots holds a value per magic link being sent in the
+	// background, up to maxPendingMagicLinks
+	magicLinkSlots chan struct{}
+	// background tracks the magic links still being sent after their
+	// request was answered, for tests to wait on
+	background sync.WaitGroup
+
+	newsletterMailer mailer.Mailer
+	newsletter       NewsletterConfig
+
+	webhookSender webhook.Sender
+	webhooks      WebhookConfig
+}
+
+// Option configures optional behaviour of the profile service
+type Option func(*profileService)
+
+// WithPasswordPolicy sets the policy new passwords are checked against
+func WithPasswordPolicy(policy PasswordPolicy) Option {
+	return func(s *profileService) {
+		s.passwordPolicy = policy
+	}
+}
+
+// WithPasswordHasher sets the hasher used to store and verify passwords
+func WithPasswordHasher(hasher PasswordHasher) Option {
+	return func(s *profileService) {
+		s.hasher = hasher
+	}
+}
+
+// WithOpenRegistration lets anyone register without an invitation code
+func WithOpenRegistration(open bool) Option {
+	return func(s *profileService) {
+		s.openRegistration = open
+	}
+}
+
+// WithInvitationTTL sets how long new invitations stay valid by default
+func WithInvitationTTL(ttl time.Duration) Option {
+	return func(s *profileService) {
+		s.invitationTTL = ttl
+	}
+}
+
+// WithSessionTouchInterval sets how often ValidateToken records the last use
+// of a session
+func WithSessionTouchInterval(d time.Duration) Option {
+	return func(s *profileService) {
+		s.sessionTouchInterval = d
+	}
+}
+
+// WithSessionlessTokens sets whether ValidateToken accepts tokens issued
+// before sessions existed. Turn it off once they have all expired.
+func WithSessionlessTokens(allowed bool) Option {
+	return func(s *profileService) {
+		s.sessionlessTokens = allowed
+	}
+}
+
+// WithMagicLinks enables magic link login. Links point to url with the token
+// in the token query parameter and are sent with m.
+func WithMagicLinks(m mailer.Mailer, url string, ttl time.Duration) Option {
+	return func(s *profileService) {
+		s.mailer = m
+		s.magicLinkURL = url
+		s.magicLinkTTL = ttl
+		s.magicLinkSlots = make(chan struct{}, maxPendingMagicLinks)
+	}
+}
+
+// WithJWTSigningKey sets the HMAC key tokens are signed with. Without it a
+// random key is generated, so tokens don't survive a restart.
+func WithJWTSigningKey(key []byte) Option {
+	return func(s *profileService) {
+		s.signingKey = key
+	}
 }
 
-// NewService creates a new instance of the profile service
-func NewService(repo repository.Repository, logger log.Logger, onlyOneProfile bool) Service {
-	return &profileService{
+// WithPreviousJWTSigningKeys sets keys that signed tokens before the current
+// one. Their tokens stay valid until they expire, so rotating the key doesn't
+// log everyone out.
+func WithPreviousJWTSigningKeys(keys ...[]byte) Option {
+	return func(s *profileService) {
+		s.previousSigningKeys = keys
+	}
+}
+
+// NewService creates a new instance of the profile service. Registration
+// needs an invitation unless WithOpenRegistration is set; the first profile
+// can always register and becomes an admin.
+func NewService(repo repository.Repository, logger log.Logger, opts ...Option) Service {
+	s := &profileService{
 		repo:           repo,
 		logger:         logger,
-		onlyOneProfile: onlyOneProfile,
+		invitationTTL:  DefaultInvitationTTL,
+		passwordPolicy: DefaultPasswordPolicy(),
+
+		sessionTouchInterval: DefaultSessionTouchInterval,
+		impersonationTTL:     DefaultImpersonationTTL,
+		sessionlessTokens:    true,
+		magicLinkTTL:         DefaultMagicLinkTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	if s.hasher == nil {
+		// The default configuration is always valid
+		s.hasher, _ = NewPasswordHasher(DefaultHasherConfig())
+	}
+	// bcrypt can't hash longer passwords, so they are rejected as invalid
+	// rather than failing to hash
+	s.passwordPolicy.MaxBytes = s.hasher.MaxPasswordBytes()
+	if len(s.signingKey) == 0 {
+		s.signingKey = make([]byte, 32)
+		if _, err := rand.Read(s.signingKey); err != nil {
+			panic(fmt.Sprintf("generate jwt signing key: %v", err))
+		}
+	}
+	return s
 }
 
 func (s *profileService) RegisterProfile(ctx context.Context, req model.RegisterProfileRequest) (*model.Profile, error) {
-	if req.Username == "" || req.Email == "" || req.Password == "" {
-		return nil, ErrInvalidInput
+	if err := validateRegistration(req, s.passwordPolicy); err != nil {
+		return nil, err
 	}
 
-	// Check if we only allow one profile
-	if s.onlyOneProfile {
-		// Count existing profiles
-		count, err := s.repo.CountProfiles(ctx)
-		if err != nil {
-			s.logger.Log("err", err, "msg", "Failed to count profiles")
-			return nil, err
-		}
-
-		// If profiles already exist, prevent registration
-		if count > 0 {
-			s.logger.Log("msg", "Registration blocked due to ONLY_ONE_PROFILE configuration")
-			return nil, errors.New("registration is disabled")
-		}
+	// The role comes from the invitation, or from being the first profile
+	role, invitation, err := s.registrationRole(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
-	// Hash the password with bcrypt
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	// Hash the password with the configured hasher
+	hashedPassword, err := s.hasher.Hash(req.Password)
 	if err != nil {
-		s.logger.Log("err", err, "msg", "Failed to hash password")
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to hash password")
 		return nil, ErrHashingFailed
 	}
 
@@ -111,19 +294,29 @@ func (s *profileService) RegisterProfile(ctx context.Context, req model.Register
 		ID:        uuid.New().String(),
 		Username:  req.Username,
 		Email:     req.Email,
-		Password:  string(hashedPassword), // Store the hashed password
+		Password:  hashedPassword, // Store the hashed password
 		FirstName: req.FirstName,
 		LastName:  req.LastName,
 		Bio:       req.Bio,
+		Role:      role,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
 
-	// Save to the repository
-	err = s.repo.CreateProfile(ctx, profile)
+	// Save to the repository, using up the invitation in the same transaction
+	if invitation != nil {
+		err = s.repo.CreateProfileWithInvitation(ctx, profile, invitation.ID, now)
+		if err != nil && err.Error() == "invitation not found" {
+			// Used or revoked since it was checked
+			return nil, ErrInvalidInvitation
+		}
+	} else {
+		err = s.repo.CreateProfile(ctx, profile)
+	}
 	if err != nil {
 		return nil, err
 	}
+	s.emitWebhookEvent(ctx, model.EventProfileCreated, &profile)
 
 	// Don't return the password in the response
 	profile.Password = ""
@@ -131,6 +324,34 @@ func (s *profileService) RegisterProfile(ctx context.Context, req model.Register
 	return &profile, nil
 }
 
+// registrationRole decides whether a registration may proceed and with which
+// role. An invitation is returned when the registration redeems one.
+func (s *profileService) registrationRole(ctx context.Context, req model.RegisterProfileRequest) (string, *model.Invitation, error) {
+	if code := strings.TrimSpace(req.InvitationCode); code != "" {
+		invitation, err := s.pendingInvitation(ctx, code, req.Email)
+		if err != nil {
+			return "", nil, err
+		}
+		return invitation.Role, invitation, nil
+	}
+
+	count, err := s.repo.CountProfiles(ctx)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to count profiles")
+		return "", nil, err
+	}
+	if count == 0 {
+		requestid.Logger(ctx, s.logger).Log("msg", "Registering the first profile as admin", "username", req.Username)
+		return model.RoleAdmin, nil, nil
+	}
+
+	if !s.openRegistration {
+		requestid.Logger(ctx, s.logger).Log("msg", "Registration blocked, no invitation code", "username", req.Username)
+		return "", nil, ErrRegistrationDisabled
+	}
+	return model.RoleUser, nil, nil
+}
+
 func (s *profileService) Login(ctx context.Context, req model.LoginRequest) (*model.LoginResponse, error) {
 	if req.Username == "" || req.Password == "" {
 		return nil, ErrInvalidInput
@@ -146,16 +367,53 @@ func (s *profileService) Login(ctx context.Context, req model.LoginRequest) (*mo
 	}
 
 	// Compare the provided password with the stored hash
-	err = bcrypt.CompareHashAndPassword([]byte(profile.Password), []byte(req.Password))
+	match, err := s.hasher.Verify(req.Password, profile.Password)
 	if err != nil {
-		s.logger.Log("err", err, "msg", "Password comparison failed")
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Password comparison failed")
 		return nil, ErrInvalidCredentials
 	}
+	if !match {
+		requestid.Logger(ctx, s.logger).Log("msg", "Password comparison failed", "username", req.Username)
+		return nil, ErrInvalidCredentials
+	}
+
+	// Upgrade hashes made with an older algorithm or weaker parameters
+	if s.hasher.NeedsRehash(profile.Password) {
+		s.rehashPassword(ctx, profile.ID, req.Password)
+	}
+
+	return s.startSession(ctx, profile)
+}
+
+// startSession creates a session for an authenticated profile and returns
+// the login response with its token. Locked accounts get ErrAccountLocked.
+func (s *profileService) startSession(ctx context.Context, profile *model.Profile) (*model.LoginResponse, error) {
+	// Checked once the credentials are known to be right, so the lock isn't
+	// revealed to someone guessing passwords
+	if profile.Locked() {
+		requestid.Logger(ctx, s.logger).Log("msg", "Rejected login of locked account", "id", profile.ID)
+		return nil, ErrAccountLocked
+	}
+
+	// Every login is a session the user can see and revoke
+	now := time.Now()
+	newDeviceWebhooks := s.newDeviceLoginWebhooks(ctx, profile.ID, now)
+	session, err := s.createSession(ctx, profile.ID, now, now.Add(jwtExpirationTime))
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to create session")
+		return nil, err
+	}
+	s.enqueueWebhookEvent(ctx, newDeviceWebhooks, model.WebhookEvent{
+		Type:    model.EventNewDeviceLogin,
+		Profile: webhookProfile(profile),
+		Device:  &model.WebhookDevice{SessionID: session.ID, UserAgent: session.UserAgent, IP: session.IP},
+	})
 
 	// Generate JWT token
-	token, err := s.generateJWTToken(profile)
+	preferences := s.tokenPreferences(ctx, profile.ID)
+	token, err := s.generateJWTToken(profile, session.ID, nil, preferences, now, session.ExpiresAt)
 	if err != nil {
-		s.logger.Log("err", err, "msg", "Failed to generate JWT token")
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to generate JWT token")
 		return nil, ErrTokenGenerationFailed
 	}
 
@@ -171,8 +429,25 @@ func (s *profileService) Login(ctx context.Context, req model.LoginRequest) (*mo
 	return response, nil
 }
 
-// generateJWTToken creates a new JWT token for the user
-func (s *profileService) generateJWTToken(profile *model.Profile) (string, error) {
+// rehashPassword stores a fresh hash of a password that was just verified.
+// Failures are only logged since the login itself already succeeded.
+func (s *profileService) rehashPassword(ctx context.Context, id, password string) {
+	hashedPassword, err := s.hasher.Hash(password)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to rehash password", "id", id)
+		return
+	}
+	if err := s.repo.UpdatePassword(ctx, id, hashedPassword); err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to save rehashed password", "id", id)
+		return
+	}
+	requestid.Logger(ctx, s.logger).Log("msg", "Rehashed password", "id", id)
+}
+
+// generateJWTToken creates a new JWT token for the user and session. actor
+// is the admin behind an impersonation token, nil otherwise. preferences may
+// be nil.
+func (s *profileService) generateJWTToken(profile *model.Profile, sessionID string, actor *model.Actor, preferences *model.Preferences, issuedAt, expiresAt time.Time) (string, error) {
 	// Create JWT header (algorithm & token type)
 	header := map[string]string{
 		"alg": "HS256",
@@ -187,14 +462,18 @@ func (s *profileService) generateJWTToken(profile *model.Profile) (string, error
 	headerBase64 := base64.RawURLEncoding.EncodeToString(headerJSON)
 
 	// Create JWT payload (claims)
-	now := time.Now()
-	expiresAt := now.Add(jwtExpirationTime)
-
 	claims := JWTClaims{
 		UserID:    profile.ID,
 		Username:  profile.Username,
-		IssuedAt:  now,
+		Role:      profile.Role,
+		SessionID: sessionID,
+		IssuedAt:  issuedAt,
 		ExpiresAt: expiresAt,
+		Actor:     actor,
+	}
+	if preferences != nil {
+		claims.Locale = preferences.Locale
+		claims.Timezone = preferences.Timezone
 	}
 
 	// Convert payload to JSON and encode to base64
@@ -206,10 +485,7 @@ func (s *profileService) generateJWTToken(profile *model.Profile) (string, error
 
 	// Create the signature
 	signatureInput := fmt.Sprintf("%s.%s", headerBase64, payloadBase64)
-	h := hmac.New(sha256.New, jwtSigningKey)
-	h.Write([]byte(signatureInput))
-	signature := h.Sum(nil)
-	signatureBase64 := base64.RawURLEncoding.EncodeToString(signature)
+	signatureBase64 := base64.RawURLEncoding.EncodeToString(jwtSignature(s.signingKey, signatureInput))
 
 	// Combine all parts to create the complete JWT token
 	token := fmt.Sprintf("%s.%s.%s", headerBase64, payloadBase64, signatureBase64)
@@ -217,6 +493,13 @@ func (s *profileService) generateJWTToken(profile *model.Profile) (string, error
 	return token, nil
 }
 
+// jwtSignature returns the HS256 signature of the header and payload
+func jwtSignature(key []byte, signatureInput string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(signatureInput))
+	return h.Sum(nil)
+}
+
 // ValidateJWTToken validates a JWT token and returns the claims if valid
 func (s *profileService) ValidateJWTToken(tokenString string) (*JWTClaims, error) {
 	// Split the token into its parts
@@ -227,14 +510,17 @@ func (s *profileService) ValidateJWTToken(tokenString string) (*JWTClaims, error
 
 	headerBase64, payloadBase64, signatureBase64 := parts[0], parts[1], parts[2]
 
-	// Verify the signature
+	// Verify the signature with the current key, then with the keys it replaced
 	signatureInput := fmt.Sprintf("%s.%s", headerBase64, payloadBase64)
-	h := hmac.New(sha256.New, jwtSigningKey)
-	h.Write([]byte(signatureInput))
-	expectedSignature := h.Sum(nil)
-	expectedSignatureBase64 := base64.RawURLEncoding.EncodeToString(expectedSignature)
-
-	if signatureBase64 != expectedSignatureBase64 {
+	signature, err := base64.RawURLEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+	valid := hmac.Equal(signature, jwtSignature(s.signingKey, signatureInput))
+	for _, key := range s.previousSigningKeys {
+		valid = valid || hmac.Equal(signature, jwtSignature(key, signatureInput))
+	}
+	if !valid {
 		return nil, errors.New("invalid token signature")
 	}
 
@@ -266,16 +552,47 @@ func (s *profileService) ValidateToken(ctx context.Context, token string) (*mode
 	// Validate the token
 	claims, err := s.ValidateJWTToken(token)
 	if err != nil {
-		s.logger.Log("err", err, "msg", "Token validation failed")
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Token validation failed")
 		return nil, ErrInvalidToken
 	}
 
+	// Tokens issued before sessions existed have none to check, so their
+	// profile is checked instead. Every impersonation token has one.
+	impersonatorID := ""
+	if claims.Actor != nil {
+		if claims.SessionID == "" {
+			return nil, ErrInvalidToken
+		}
+		impersonatorID = claims.Actor.UserID
+	}
+	if claims.SessionID != "" {
+		if err := s.checkSession(ctx, claims.SessionID, claims.UserID, impersonatorID); err != nil {
+			return nil, err
+		}
+	} else if err := s.checkSessionlessToken(ctx, claims); err != nil {
+		return nil, err
+	}
+	if claims.Actor != nil {
+		if err := s.checkActor(ctx, claims.Actor); err != nil {
+			return nil, err
+		}
+	}
+
 	// Convert internal claims to the model claims
 	tokenClaims := &model.TokenClaims{
 		UserID:    claims.UserID,
 		Username:  claims.Username,
+		Role:      claims.Role,
+		SessionID: claims.SessionID,
 		IssuedAt:  claims.IssuedAt,
 		ExpiresAt: claims.ExpiresAt,
+		Locale:    claims.Locale,
+		Timezone:  claims.Timezone,
+		Actor:     claims.Actor,
+	}
+	// Tokens issued before roles existed belong to regular users
+	if tokenClaims.Role == "" {
+		tokenClaims.Role = model.RoleUser
 	}
 
 	return tokenClaims, nil
@@ -297,6 +614,10 @@ func (s *profileService) GetProfile(ctx context.Context, id string) (*model.Prof
 }
 
 func (s *profileService) UpdateProfile(ctx context.Context, id string, req model.UpdateProfileRequest) (*model.Profile, error) {
+	if _, err := requireProfileAccess(ctx, id); err != nil {
+		return nil, err
+	}
+
 	// First fetch the profile
 	profile, err := s.repo.GetProfile(ctx, id)
 	if err != nil {
@@ -324,6 +645,7 @@ func (s *profileService) UpdateProfile(ctx context.Context, id string, req model
 	if err != nil {
 		return nil, err
 	}
+	s.auditImpersonation(ctx, model.AuditProfileUpdated, id)
 
 	// Don't return the password in the response
 	profile.Password = ""
@@ -332,6 +654,23 @@ func (s *profileService) UpdateProfile(ctx context.Context, id string, req model
 }
 
 func (s *profileService) DeleteProfile(ctx context.Context, id string) error {
+	if _, err := requireProfileAccess(ctx, id); err != nil {
+		return err
+	}
+
+	// The event describes the profile, which has to be read before it is gone
+	webhooks := s.subscribedWebhooks(ctx, model.EventProfileDeleted)
+	var profile *model.Profile
+	if len(webhooks) > 0 {
+		var err error
+		if profile, err = s.repo.GetProfile(ctx, id); err != nil {
+			if err.Error() == "profile not found" {
+				return ErrProfileNotFound
+			}
+			return err
+		}
+	}
+
 	err := s.repo.DeleteProfile(ctx, id)
 	if err != nil {
 		if err.Error() == "profile not found" {
@@ -339,5 +678,9 @@ func (s *profileService) DeleteProfile(ctx context.Context, id string) error {
 		}
 		return err
 	}
+	s.auditImpersonation(ctx, model.AuditProfileDeleted, id)
+	if profile != nil {
+		s.enqueueWebhookEvent(ctx, webhooks, model.WebhookEvent{Type: model.EventProfileDeleted, Profile: webhookProfile(profile)})
+	}
 	return nil
 }
@@ -2,16 +2,34 @@ package service
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ganis/okblog/profile/pkg/mailer"
 	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/posts"
+	"github.com/ganis/okblog/profile/pkg/repository"
+	"github.com/ganis/okblog/profile/pkg/webhook"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/go-kit/log"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -46,6 +64,21 @@ func (m *MockRepository) UpdateProfile(ctx context.Context, profile model.Profil
 	return args.Error(0)
 }
 
+func (m *MockRepository) UpdatePassword(ctx context.Context, id string, passwordHash string) error {
+	args := m.Called(ctx, id, passwordHash)
+	return args.Error(0)
+}
+
+func (m *MockRepository) UpdateRole(ctx context.Context, id string, role string) error {
+	args := m.Called(ctx, id, role)
+	return args.Error(0)
+}
+
+func (m *MockRepository) SetLockedAt(ctx context.Context, id string, lockedAt *time.Time) error {
+	args := m.Called(ctx, id, lockedAt)
+	return args.Error(0)
+}
+
 func (m *MockRepository) DeleteProfile(ctx context.Context, id string) error {
 	args := m.Called(ctx, id)
 	return args.Error(0)
@@ -56,13 +89,263 @@ func (m *MockRepository) CountProfiles(ctx context.Context) (int, error) {
 	return args.Int(0), args.Error(1)
 }
 
+func (m *MockRepository) GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error) {
+	args := m.Called(ctx, profileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Preferences), args.Error(1)
+}
+
+func (m *MockRepository) UpdatePreferences(ctx context.Context, profileID string, update func(*model.Preferences) error) (*model.Preferences, error) {
+	args := m.Called(ctx, profileID, update)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Preferences), args.Error(1)
+}
+
+func (m *MockRepository) CreateInvitation(ctx context.Context, invitation model.Invitation) error {
+	args := m.Called(ctx, invitation)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetInvitationByCodeHash(ctx context.Context, codeHash string) (*model.Invitation, error) {
+	args := m.Called(ctx, codeHash)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Invitation), args.Error(1)
+}
+
+func (m *MockRepository) ListPendingInvitations(ctx context.Context, now time.Time) ([]model.Invitation, error) {
+	args := m.Called(ctx, now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Invitation), args.Error(1)
+}
+
+func (m *MockRepository) RevokeInvitation(ctx context.Context, id string, now time.Time) error {
+	args := m.Called(ctx, id, now)
+	return args.Error(0)
+}
+
+func (m *MockRepository) CreateSession(ctx context.Context, session model.Session) error {
+	args := m.Called(ctx, session)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	args := m.Called(ctx, id)
+	if fn, ok := args.Get(0).(func(context.Context, string) *model.Session); ok {
+		return fn(ctx, id), args.Error(1)
+	}
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Session), args.Error(1)
+}
+
+func (m *MockRepository) ListActiveSessions(ctx context.Context, profileID string, now time.Time) ([]model.Session, error) {
+	args := m.Called(ctx, profileID, now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Session), args.Error(1)
+}
+
+func (m *MockRepository) TouchSession(ctx context.Context, id string, lastSeenAt time.Time) error {
+	args := m.Called(ctx, id, lastSeenAt)
+	return args.Error(0)
+}
+
+func (m *MockRepository) RevokeSession(ctx context.Context, profileID, id string, now time.Time) error {
+	args := m.Called(ctx, profileID, id, now)
+	return args.Error(0)
+}
+
+func (m *MockRepository) RevokeOtherSessions(ctx context.Context, profileID, keepID string, now time.Time) (int, error) {
+	args := m.Called(ctx, profileID, keepID, now)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockRepository) GetProfileByEmail(ctx context.Context, email string) (*model.Profile, error) {
+	args := m.Called(ctx, email)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockRepository) CreateMagicLink(ctx context.Context, link model.MagicLink, limit int, since time.Time) error {
+	args := m.Called(ctx, link, limit, since)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ConsumeMagicLink(ctx context.Context, tokenHash string, now time.Time) (*model.MagicLink, error) {
+	args := m.Called(ctx, tokenHash, now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.MagicLink), args.Error(1)
+}
+
+func (m *MockRepository) CreateSubscriber(ctx context.Context, subscriber model.Subscriber) error {
+	args := m.Called(ctx, subscriber)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetSubscriberByEmail(ctx context.Context, email string) (*model.Subscriber, error) {
+	args := m.Called(ctx, email)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Subscriber), args.Error(1)
+}
+
+func (m *MockRepository) RenewSubscription(ctx context.Context, id, confirmTokenHash string, expiresAt time.Time) error {
+	args := m.Called(ctx, id, confirmTokenHash, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ConfirmSubscriber(ctx context.Context, confirmTokenHash string, now time.Time) (*model.Subscriber, error) {
+	args := m.Called(ctx, confirmTokenHash, now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Subscriber), args.Error(1)
+}
+
+func (m *MockRepository) Unsubscribe(ctx context.Context, unsubscribeToken string, now time.Time) (*model.Subscriber, error) {
+	args := m.Called(ctx, unsubscribeToken, now)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Subscriber), args.Error(1)
+}
+
+func (m *MockRepository) ListSubscribers(ctx context.Context) ([]model.Subscriber, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Subscriber), args.Error(1)
+}
+
+func (m *MockRepository) QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error {
+	args := m.Called(ctx, post)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ClaimNewsletterPosts(ctx context.Context, now, leaseUntil time.Time) ([]model.NewsletterPost, error) {
+	args := m.Called(ctx, now, leaseUntil)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.NewsletterPost), args.Error(1)
+}
+
+func (m *MockRepository) ReleaseNewsletterPosts(ctx context.Context, ids []string) error {
+	args := m.Called(ctx, ids)
+	return args.Error(0)
+}
+
+func (m *MockRepository) MarkNewsletterPostsSent(ctx context.Context, ids []string, now time.Time) error {
+	args := m.Called(ctx, ids, now)
+	return args.Error(0)
+}
+
+func (m *MockRepository) SaveAuthorPost(ctx context.Context, post model.AuthorPost) error {
+	args := m.Called(ctx, post)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error) {
+	args := m.Called(ctx, profileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.AuthorStats), args.Error(1)
+}
+
+func (m *MockRepository) CreateWebhook(ctx context.Context, webhook model.Webhook) error {
+	args := m.Called(ctx, webhook)
+	return args.Error(0)
+}
+
+func (m *MockRepository) GetWebhook(ctx context.Context, id string) (*model.Webhook, error) {
+	args := m.Called(ctx, id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Webhook), args.Error(1)
+}
+
+func (m *MockRepository) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Webhook), args.Error(1)
+}
+
+func (m *MockRepository) DeleteWebhook(ctx context.Context, id string) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockRepository) CreateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	args := m.Called(ctx, delivery)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ClaimWebhookDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]model.WebhookDelivery, error) {
+	args := m.Called(ctx, now, leaseUntil, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.WebhookDelivery), args.Error(1)
+}
+
+func (m *MockRepository) UpdateWebhookDelivery(ctx context.Context, delivery model.WebhookDelivery) error {
+	args := m.Called(ctx, delivery)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]model.WebhookDelivery, error) {
+	args := m.Called(ctx, webhookID, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.WebhookDelivery), args.Error(1)
+}
+
+func (m *MockRepository) CreateAuditEvent(ctx context.Context, event model.AuditEvent) error {
+	args := m.Called(ctx, event)
+	return args.Error(0)
+}
+
+func (m *MockRepository) ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error) {
+	args := m.Called(ctx, filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.AuditEvent), args.Error(1)
+}
+
+func (m *MockRepository) CreateProfileWithInvitation(ctx context.Context, profile model.Profile, invitationID string, now time.Time) error {
+	args := m.Called(ctx, profile, invitationID, now)
+	return args.Error(0)
+}
+
 func TestRegisterProfile(t *testing.T) {
 	// Create a mock repository
 	mockRepo := new(MockRepository)
 	// Create a noop logger
 	logger := log.NewNopLogger()
-	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	// Create a service that lets anyone register
+	svc := NewService(mockRepo, logger, WithOpenRegistration(true))
 
 	// Setup test data
 	req := model.RegisterProfileRequest{
@@ -75,6 +358,7 @@ func TestRegisterProfile(t *testing.T) {
 	}
 
 	// Setup expectations - we can't check exact password match since it's hashed
+	mockRepo.On("CountProfiles", mock.Anything).Return(1, nil)
 	mockRepo.On("CreateProfile", mock.Anything, mock.MatchedBy(func(p model.Profile) bool {
 		return p.Username == req.Username &&
 			p.Email == req.Email &&
@@ -82,7 +366,8 @@ func TestRegisterProfile(t *testing.T) {
 			len(p.Password) > 0 && // Ensure password is not empty
 			p.FirstName == req.FirstName &&
 			p.LastName == req.LastName &&
-			p.Bio == req.Bio
+			p.Bio == req.Bio &&
+			p.Role == model.RoleUser
 	})).Return(nil)
 
 	// Call the method
@@ -106,7 +391,7 @@ func TestRegisterProfile_InvalidInput(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Test cases for invalid input
 	testCases := []struct {
@@ -152,10 +437,109 @@ func TestRegisterProfile_InvalidInput(t *testing.T) {
 
 			// Assertions
 			assert.Error(t, err)
-			assert.Equal(t, ErrInvalidInput, err)
+			assert.ErrorIs(t, err, ErrInvalidInput)
+			assert.Nil(t, profile)
+		})
+	}
+}
+
+func TestRegisterProfile_FieldValidation(t *testing.T) {
+	// Create a mock repository
+	mockRepo := new(MockRepository)
+	// Create a noop logger
+	logger := log.NewNopLogger()
+	// Create a service with a policy that knows one breached password
+	policy := DefaultPasswordPolicy()
+	policy.Breached = map[string]bool{"correcthorse1": true}
+	svc := NewService(mockRepo, logger, WithPasswordPolicy(policy))
+
+	valid := model.RegisterProfileRequest{
+		Username: "testuser",
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+
+	// Test cases for invalid fields
+	testCases := []struct {
+		name   string
+		modify func(req *model.RegisterProfileRequest)
+		field  string
+	}{
+		{"Username Too Short", func(req *model.RegisterProfileRequest) { req.Username = "ab" }, "username"},
+		{"Username Bad Charset", func(req *model.RegisterProfileRequest) { req.Username = "test user" }, "username"},
+		{"Username Leading Symbol", func(req *model.RegisterProfileRequest) { req.Username = "_testuser" }, "username"},
+		{"Username Reserved", func(req *model.RegisterProfileRequest) { req.Username = "Admin" }, "username"},
+		{"Email Without At", func(req *model.RegisterProfileRequest) { req.Email = "test.example.com" }, "email"},
+		{"Email With Display Name", func(req *model.RegisterProfileRequest) { req.Email = "Test <test@example.com>" }, "email"},
+		{"Email Without Domain Dot", func(req *model.RegisterProfileRequest) { req.Email = "test@localhost" }, "email"},
+		{"Password Too Short", func(req *model.RegisterProfileRequest) { req.Password = "abc12" }, "password"},
+		{"Password Breached", func(req *model.RegisterProfileRequest) { req.Password = "CorrectHorse1" }, "password"},
+		{"Password Too Weak", func(req *model.RegisterProfileRequest) { req.Password = "abcdefgh" }, "password"},
+		{"First Name Too Long", func(req *model.RegisterProfileRequest) { req.FirstName = strings.Repeat("a", 256) }, "firstName"},
+		{"Last Name Too Long", func(req *model.RegisterProfileRequest) { req.LastName = strings.Repeat("a", 256) }, "lastName"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := valid
+			tc.modify(&req)
+
+			// Call the method
+			profile, err := svc.RegisterProfile(context.Background(), req)
+
+			// Assertions
 			assert.Nil(t, profile)
+			assert.ErrorIs(t, err, ErrInvalidInput)
+
+			var verr *ValidationError
+			assert.ErrorAs(t, err, &verr)
+			assert.Len(t, verr.Fields, 1)
+			assert.Contains(t, verr.Fields, tc.field)
+		})
+	}
+
+	// Every invalid field is reported at once
+	_, err := svc.RegisterProfile(context.Background(), model.RegisterProfileRequest{Username: "api", Email: "nope"})
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+	assert.Len(t, verr.Fields, 3)
+
+	mockRepo.AssertNotCalled(t, "CreateProfile", mock.Anything, mock.Anything)
+}
+
+func TestRegisterProfile_BcryptPasswordLength(t *testing.T) {
+	mockRepo := new(MockRepository)
+	config := testHasherConfig()
+	config.Algorithm = AlgorithmBcrypt
+	config.BcryptCost = bcrypt.MinCost
+	hasher, err := NewPasswordHasher(config)
+	require.NoError(t, err)
+	svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(hasher))
+
+	// bcrypt only hashes 72 bytes, so longer passwords are invalid input
+	// rather than a failure to hash
+	for _, password := range []string{
+		"Correct-Horse-9" + strings.Repeat("a", 60),
+		"Correct-Horse-9" + strings.Repeat("é", 30),
+	} {
+		_, err = svc.RegisterProfile(context.Background(), model.RegisterProfileRequest{
+			Username: "testuser",
+			Email:    "test@example.com",
+			Password: password,
 		})
+		var verr *ValidationError
+		require.ErrorAs(t, err, &verr)
+		assert.Equal(t, "must be at most 72 bytes, fewer characters outside of ASCII", verr.Fields["password"])
 	}
+	mockRepo.AssertNotCalled(t, "CreateProfile", mock.Anything, mock.Anything)
+}
+
+func TestPasswordScore(t *testing.T) {
+	assert.Equal(t, 0, PasswordScore("abc"))
+	assert.Equal(t, 1, PasswordScore("abcdefgh"))
+	assert.Equal(t, 2, PasswordScore("password123"))
+	assert.Equal(t, 3, PasswordScore("Password123"))
+	assert.Equal(t, 4, PasswordScore("Correct-Horse-9"))
 }
 
 func TestLogin(t *testing.T) {
@@ -164,7 +548,7 @@ func TestLogin(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Setup test data
 	username := "testuser"
@@ -194,6 +578,12 @@ func TestLogin(t *testing.T) {
 
 	// Setup expectations
 	mockRepo.On("GetProfileByUsername", mock.Anything, username).Return(profileData, nil)
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+	// The bcrypt hash is upgraded to argon2id after a successful login
+	mockRepo.On("UpdatePassword", mock.Anything, id, mock.MatchedBy(func(hash string) bool {
+		return strings.HasPrefix(hash, "$argon2id$")
+	})).Return(nil)
 
 	// Call the method
 	loginResponse, err := svc.Login(context.Background(), loginReq)
@@ -222,7 +612,7 @@ func TestLogin_InvalidCredentials(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Setup test data
 	username := "testuser"
@@ -264,81 +654,313 @@ func TestLogin_InvalidCredentials(t *testing.T) {
 	mockRepo.AssertExpectations(t)
 }
 
-func TestGetProfile(t *testing.T) {
+func TestLogin_CurrentHashIsNotRehashed(t *testing.T) {
 	// Create a mock repository
 	mockRepo := new(MockRepository)
 	// Create a noop logger
 	logger := log.NewNopLogger()
-	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	// Create a service that hashes with cheap argon2id parameters
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	assert.NoError(t, err)
+	svc := NewService(mockRepo, logger, WithPasswordHasher(hasher))
+
+	hashedPassword, err := hasher.Hash("password123")
+	assert.NoError(t, err)
 
-	// Create a test profile
-	id := uuid.New().String()
 	profileData := &model.Profile{
-		ID:        id,
-		Username:  "testuser",
-		Email:     "test@example.com",
-		FirstName: "Test",
-		LastName:  "User",
-		Bio:       "This is a test user",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:       uuid.New().String(),
+		Username: "testuser",
+		Password: hashedPassword,
 	}
-
-	// Setup expectations
-	mockRepo.On("GetProfile", mock.Anything, id).Return(profileData, nil)
+	mockRepo.On("GetProfileByUsername", mock.Anything, "testuser").Return(profileData, nil)
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
 
 	// Call the method
-	profile, err := svc.GetProfile(context.Background(), id)
+	loginResponse, err := svc.Login(context.Background(), model.LoginRequest{Username: "testuser", Password: "password123"})
 
 	// Assertions
 	assert.NoError(t, err)
-	assert.Equal(t, profileData, profile)
+	assert.NotEmpty(t, loginResponse.Token)
+	mockRepo.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything, mock.Anything)
 	mockRepo.AssertExpectations(t)
 }
 
-func TestGetProfile_NotFound(t *testing.T) {
+func TestLogin_RehashFailureDoesNotFailLogin(t *testing.T) {
 	// Create a mock repository
 	mockRepo := new(MockRepository)
 	// Create a noop logger
 	logger := log.NewNopLogger()
-	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	// Create a service that prefers bcrypt at a higher cost than the stored hash
+	config := testHasherConfig()
+	config.Algorithm = AlgorithmBcrypt
+	config.BcryptCost = bcrypt.MinCost + 1
+	hasher, err := NewPasswordHasher(config)
+	assert.NoError(t, err)
+	svc := NewService(mockRepo, logger, WithPasswordHasher(hasher))
 
-	// Setup expectations
-	id := "non-existent-id"
-	mockRepo.On("GetProfile", mock.Anything, id).Return(nil, errors.New("profile not found"))
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	id := uuid.New().String()
+	profileData := &model.Profile{ID: id, Username: "testuser", Password: string(hashedPassword)}
+	mockRepo.On("GetProfileByUsername", mock.Anything, "testuser").Return(profileData, nil)
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+	mockRepo.On("UpdatePassword", mock.Anything, id, mock.MatchedBy(func(hash string) bool {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err == nil && cost == bcrypt.MinCost+1
+	})).Return(errors.New("database is down"))
 
 	// Call the method
-	profile, err := svc.GetProfile(context.Background(), id)
+	loginResponse, err := svc.Login(context.Background(), model.LoginRequest{Username: "testuser", Password: "password123"})
 
 	// Assertions
-	assert.Error(t, err)
-	assert.Equal(t, ErrProfileNotFound, err)
-	assert.Nil(t, profile)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loginResponse.Token)
 	mockRepo.AssertExpectations(t)
 }
 
-func TestUpdateProfile(t *testing.T) {
-	// Create a mock repository
-	mockRepo := new(MockRepository)
-	// Create a noop logger
-	logger := log.NewNopLogger()
-	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+func TestPasswordHasher(t *testing.T) {
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	assert.NoError(t, err)
 
-	// Create a test profile
-	id := uuid.New().String()
-	profileData := &model.Profile{
-		ID:        id,
-		Username:  "testuser",
-		Email:     "test@example.com",
-		FirstName: "Test",
-		LastName:  "User",
-		Bio:       "Original bio",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
+	// Hashes are self-describing PHC strings
+	hash, err := hasher.Hash("password123")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	match, err := hasher.Verify("password123", hash)
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	match, err = hasher.Verify("wrongpassword", hash)
+	assert.NoError(t, err)
+	assert.False(t, match)
+	assert.False(t, hasher.NeedsRehash(hash))
+
+	// Changing a parameter makes existing hashes outdated
+	stronger := testHasherConfig()
+	stronger.Argon2id.Iterations = 2
+	strongerHasher, err := NewPasswordHasher(stronger)
+	assert.NoError(t, err)
+	assert.True(t, strongerHasher.NeedsRehash(hash))
+
+	// bcrypt hashes are still verified but need a rehash
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	match, err = hasher.Verify("password123", string(bcryptHash))
+	assert.NoError(t, err)
+	assert.True(t, match)
+	assert.True(t, hasher.NeedsRehash(string(bcryptHash)))
+
+	// Unknown formats are rejected
+	_, err = hasher.Verify("password123", "plaintext")
+	assert.ErrorIs(t, err, ErrUnknownHashFormat)
+	_, err = hasher.Verify("password123", "$argon2id$v=19$garbage")
+	assert.ErrorIs(t, err, ErrMalformedHash)
+
+	// Parameters out of bounds are rejected before any work is done
+	salt := base64.RawStdEncoding.EncodeToString(make([]byte, 16))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=1000000,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=4,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=16$" + salt + "$" + key,
+		"$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=-1,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=1$$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(make([]byte, 4)) + "$" + key,
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=1024,t=1,p=1$" + salt + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 8)),
+	} {
+		_, err = hasher.Verify("password123", encoded)
+		assert.ErrorIs(t, err, ErrMalformedHash, encoded)
+		assert.True(t, hasher.NeedsRehash(encoded), encoded)
+	}
+
+	// Only bcrypt limits the length of passwords
+	assert.Zero(t, hasher.MaxPasswordBytes())
+	bcryptConfig := testHasherConfig()
+	bcryptConfig.Algorithm = AlgorithmBcrypt
+	bcryptHasher, err := NewPasswordHasher(bcryptConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, 72, bcryptHasher.MaxPasswordBytes())
+
+	// Invalid configurations are rejected
+	_, err = NewPasswordHasher(HasherConfig{Algorithm: "md5"})
+	assert.Error(t, err)
+	_, err = NewPasswordHasher(HasherConfig{Algorithm: AlgorithmBcrypt, BcryptCost: 99})
+	assert.Error(t, err)
+	tooMuchMemory := testHasherConfig()
+	tooMuchMemory.Argon2id.Memory = 4 * 1024 * 1024
+	_, err = NewPasswordHasher(tooMuchMemory)
+	assert.Error(t, err)
+}
+
+func TestPasswordHasher_WordPress(t *testing.T) {
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	assert.NoError(t, err)
+
+	// Portable phpass hashes used before WordPress 6.8
+	for _, tc := range []struct {
+		password string
+		hash     string
+	}{
+		{"password123", "$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0"},
+		{"correct horse", "$H$9saltsaltoOYGA0TbwROeAx3OxiKY5/"},
+	} {
+		match, err := hasher.Verify(tc.password, tc.hash)
+		assert.NoError(t, err)
+		assert.True(t, match, tc.hash)
+
+		match, err = hasher.Verify("wrongpassword", tc.hash)
+		assert.NoError(t, err)
+		assert.False(t, match, tc.hash)
+		assert.True(t, hasher.NeedsRehash(tc.hash))
+	}
+
+	// WordPress 6.8 $wp$ hashes: bcrypt over base64(HMAC-SHA384(password))
+	mac := hmac.New(sha512.New384, []byte("wp-sha384"))
+	mac.Write([]byte("password123"))
+	prehashed := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte(prehashed), bcrypt.MinCost)
+	assert.NoError(t, err)
+	wpHash := "$wp" + string(bcryptHash)
+
+	match, err := hasher.Verify("password123", wpHash)
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	match, err = hasher.Verify("password124", wpHash)
+	assert.NoError(t, err)
+	assert.False(t, match)
+	assert.True(t, hasher.NeedsRehash(wpHash))
+}
+
+func TestLogin_UpgradesWordPressHash(t *testing.T) {
+	// Create a mock repository
+	mockRepo := new(MockRepository)
+	// Create a noop logger
+	logger := log.NewNopLogger()
+	// Create a service that hashes with cheap argon2id parameters
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	assert.NoError(t, err)
+	svc := NewService(mockRepo, logger, WithPasswordHasher(hasher))
+
+	id := uuid.New().String()
+	profileData := &model.Profile{ID: id, Username: "ganis", Password: "$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0"}
+	mockRepo.On("GetProfileByUsername", mock.Anything, "ganis").Return(profileData, nil)
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+	mockRepo.On("UpdatePassword", mock.Anything, id, mock.MatchedBy(func(hash string) bool {
+		match, err := hasher.Verify("password123", hash)
+		return err == nil && match && strings.HasPrefix(hash, "$argon2id$")
+	})).Return(nil)
+
+	// Call the method
+	loginResponse, err := svc.Login(context.Background(), model.LoginRequest{Username: "ganis", Password: "password123"})
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loginResponse.Token)
+	mockRepo.AssertExpectations(t)
+}
+
+// testHasherConfig returns argon2id parameters that keep tests fast
+func testHasherConfig() HasherConfig {
+	config := DefaultHasherConfig()
+	config.Argon2id = Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	return config
+}
+
+// testHasher returns a fast hasher for tests that register profiles
+func testHasher(t *testing.T) PasswordHasher {
+	t.Helper()
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hasher
+}
+
+func TestGetProfile(t *testing.T) {
+	// Create a mock repository
+	mockRepo := new(MockRepository)
+	// Create a noop logger
+	logger := log.NewNopLogger()
+	// Create a service with the mock repository
+	svc := NewService(mockRepo, logger)
+
+	// Create a test profile
+	id := uuid.New().String()
+	profileData := &model.Profile{
+		ID:        id,
+		Username:  "testuser",
+		Email:     "test@example.com",
+		FirstName: "Test",
+		LastName:  "User",
+		Bio:       "This is a test user",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// Setup expectations
+	mockRepo.On("GetProfile", mock.Anything, id).Return(profileData, nil)
+
+	// Call the method
+	profile, err := svc.GetProfile(context.Background(), id)
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.Equal(t, profileData, profile)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGetProfile_NotFound(t *testing.T) {
+	// Create a mock repository
+	mockRepo := new(MockRepository)
+	// Create a noop logger
+	logger := log.NewNopLogger()
+	// Create a service with the mock repository
+	svc := NewService(mockRepo, logger)
+
+	// Setup expectations
+	id := "non-existent-id"
+	mockRepo.On("GetProfile", mock.Anything, id).Return(nil, errors.New("profile not found"))
+
+	// Call the method
+	profile, err := svc.GetProfile(context.Background(), id)
+
+	// Assertions
+	assert.Error(t, err)
+	assert.Equal(t, ErrProfileNotFound, err)
+	assert.Nil(t, profile)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestUpdateProfile(t *testing.T) {
+	// Create a mock repository
+	mockRepo := new(MockRepository)
+	// Create a noop logger
+	logger := log.NewNopLogger()
+	// Create a service with the mock repository
+	svc := NewService(mockRepo, logger)
+
+	// Create a test profile
+	id := uuid.New().String()
+	profileData := &model.Profile{
+		ID:        id,
+		Username:  "testuser",
+		Email:     "test@example.com",
+		FirstName: "Test",
+		LastName:  "User",
+		Bio:       "Original bio",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
 
 	// Create update request
 	updateReq := model.UpdateProfileRequest{
@@ -357,7 +979,8 @@ func TestUpdateProfile(t *testing.T) {
 	})).Return(nil)
 
 	// Call the method
-	updatedProfile, err := svc.UpdateProfile(context.Background(), id, updateReq)
+	owner := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: id, Role: model.RoleUser})
+	updatedProfile, err := svc.UpdateProfile(owner, id, updateReq)
 
 	// Assertions
 	assert.NoError(t, err)
@@ -374,7 +997,7 @@ func TestUpdateProfile_NotFound(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Setup expectations
 	id := "non-existent-id"
@@ -386,7 +1009,8 @@ func TestUpdateProfile_NotFound(t *testing.T) {
 	mockRepo.On("GetProfile", mock.Anything, id).Return(nil, errors.New("profile not found"))
 
 	// Call the method
-	profile, err := svc.UpdateProfile(context.Background(), id, updateReq)
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	profile, err := svc.UpdateProfile(admin, id, updateReq)
 
 	// Assertions
 	assert.Error(t, err)
@@ -401,14 +1025,15 @@ func TestDeleteProfile(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Setup expectations
 	id := uuid.New().String()
 	mockRepo.On("DeleteProfile", mock.Anything, id).Return(nil)
 
 	// Call the method
-	err := svc.DeleteProfile(context.Background(), id)
+	owner := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: id, Role: model.RoleUser})
+	err := svc.DeleteProfile(owner, id)
 
 	// Assertions
 	assert.NoError(t, err)
@@ -421,14 +1046,15 @@ func TestDeleteProfile_NotFound(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Setup expectations
 	id := "non-existent-id"
 	mockRepo.On("DeleteProfile", mock.Anything, id).Return(errors.New("profile not found"))
 
 	// Call the method
-	err := svc.DeleteProfile(context.Background(), id)
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	err := svc.DeleteProfile(admin, id)
 
 	// Assertions
 	assert.Error(t, err)
@@ -436,13 +1062,29 @@ func TestDeleteProfile_NotFound(t *testing.T) {
 	mockRepo.AssertExpectations(t)
 }
 
+func TestUpdateProfile_OtherProfile(t *testing.T) {
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger())
+
+	// Profiles only change their own profile, and nothing is read or written
+	other := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "other-id", Role: model.RoleUser})
+	_, err := svc.UpdateProfile(other, "profile-id", model.UpdateProfileRequest{Bio: "Hacked"})
+	assert.Equal(t, ErrForbidden, err)
+	assert.Equal(t, ErrForbidden, svc.DeleteProfile(other, "profile-id"))
+
+	_, err = svc.UpdateProfile(context.Background(), "profile-id", model.UpdateProfileRequest{Bio: "Hacked"})
+	assert.Equal(t, ErrUnauthenticated, err)
+	assert.Equal(t, ErrUnauthenticated, svc.DeleteProfile(context.Background(), "profile-id"))
+	mockRepo.AssertExpectations(t)
+}
+
 func TestValidateToken(t *testing.T) {
 	// Create a mock repository
 	mockRepo := new(MockRepository)
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Setup test data
 	username := "testuser"
@@ -472,9 +1114,24 @@ func TestValidateToken(t *testing.T) {
 
 	// Setup expectations
 	mockRepo.On("GetProfileByUsername", mock.Anything, username).Return(profileData, nil)
+	// The bcrypt hash is upgraded to argon2id after a successful login
+	mockRepo.On("UpdatePassword", mock.Anything, id, mock.MatchedBy(func(hash string) bool {
+		return strings.HasPrefix(hash, "$argon2id$")
+	})).Return(nil)
+
+	// The token is bound to the session created at login
+	var session model.Session
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.MatchedBy(func(s model.Session) bool {
+		return s.ProfileID == id && s.UserAgent == "test-agent" && s.IP == "192.0.2.1"
+	})).Run(func(args mock.Arguments) { session = args.Get(1).(model.Session) }).Return(nil)
+	mockRepo.On("GetSession", mock.Anything, mock.Anything).Return(func(_ context.Context, _ string) *model.Session {
+		return &session
+	}, nil)
 
 	// Login to get a token
-	loginResponse, err := svc.Login(context.Background(), loginReq)
+	ctx := NewContextWithClient(context.Background(), model.ClientInfo{UserAgent: "test-agent", IP: "192.0.2.1"})
+	loginResponse, err := svc.Login(ctx, loginReq)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, loginResponse.Token)
 
@@ -489,6 +1146,7 @@ func TestValidateToken(t *testing.T) {
 	assert.NotNil(t, claims)
 	assert.Equal(t, id, claims.UserID)
 	assert.Equal(t, username, claims.Username)
+	assert.Equal(t, session.ID, claims.SessionID)
 	// Expiration time should be in the future
 	assert.True(t, claims.ExpiresAt.After(time.Now()))
 
@@ -501,7 +1159,7 @@ func TestValidateToken_Invalid(t *testing.T) {
 	// Create a noop logger
 	logger := log.NewNopLogger()
 	// Create a service with the mock repository
-	svc := NewService(mockRepo, logger, false)
+	svc := NewService(mockRepo, logger)
 
 	// Test with an invalid token
 	invalidToken := "invalid.token.format"
@@ -521,13 +1179,13 @@ func TestValidateToken_Invalid(t *testing.T) {
 	assert.Nil(t, claims)
 }
 
-func TestRegisterProfile_OnlyOneProfile(t *testing.T) {
+func TestRegisterProfile_FirstProfileIsAdmin(t *testing.T) {
 	// Create a mock repository
 	mockRepo := new(MockRepository)
 	// Create a noop logger
 	logger := log.NewNopLogger()
-	// Create a service with onlyOneProfile set to true
-	svc := NewService(mockRepo, logger, true)
+	// Create a service that needs invitations
+	svc := NewService(mockRepo, logger)
 
 	// Setup test data
 	req := model.RegisterProfileRequest{
@@ -542,13 +1200,7 @@ func TestRegisterProfile_OnlyOneProfile(t *testing.T) {
 	// Test case 1: No existing profiles
 	mockRepo.On("CountProfiles", mock.Anything).Return(0, nil).Once()
 	mockRepo.On("CreateProfile", mock.Anything, mock.MatchedBy(func(p model.Profile) bool {
-		return p.Username == req.Username &&
-			p.Email == req.Email &&
-			p.Password != req.Password && // Password should be hashed, not plaintext
-			len(p.Password) > 0 && // Ensure password is not empty
-			p.FirstName == req.FirstName &&
-			p.LastName == req.LastName &&
-			p.Bio == req.Bio
+		return p.Username == req.Username && p.Role == model.RoleAdmin
 	})).Return(nil).Once()
 
 	// Call the method when no profiles exist
@@ -557,18 +1209,1448 @@ func TestRegisterProfile_OnlyOneProfile(t *testing.T) {
 	// Assertions for first call
 	assert.NoError(t, err)
 	assert.NotNil(t, profile)
-	assert.Equal(t, req.Username, profile.Username)
+	assert.Equal(t, model.RoleAdmin, profile.Role)
 
-	// Test case 2: Existing profile should prevent registration
+	// Test case 2: Without an invitation nobody else can register
 	mockRepo.On("CountProfiles", mock.Anything).Return(1, nil).Once()
 
 	// Call the method when a profile already exists
 	profile2, err2 := svc.RegisterProfile(context.Background(), req)
 
 	// Assertions for second call
-	assert.Error(t, err2)
 	assert.Nil(t, profile2)
-	assert.Equal(t, "registration is disabled", err2.Error())
+	assert.Equal(t, ErrRegistrationDisabled, err2)
 
 	mockRepo.AssertExpectations(t)
 }
+
+func TestRegisterProfile_Invitation(t *testing.T) {
+	req := model.RegisterProfileRequest{
+		Username:       "testuser",
+		Email:          "Test@Example.com",
+		Password:       "password123",
+		InvitationCode: " the-code ",
+	}
+	pending := func() *model.Invitation {
+		return &model.Invitation{
+			ID:        "invitation-id",
+			Email:     "test@example.com",
+			Role:      model.RoleAdmin,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+	}
+	used := time.Now().Add(-time.Minute)
+
+	testCases := []struct {
+		name       string
+		invitation *model.Invitation
+		lookupErr  error
+		redeemErr  error
+		err        error
+	}{
+		{name: "Pending", invitation: pending()},
+		{name: "Unknown Code", lookupErr: errors.New("invitation not found"), err: ErrInvalidInvitation},
+		{name: "Expired", invitation: func() *model.Invitation {
+			inv := pending()
+			inv.ExpiresAt = time.Now().Add(-time.Second)
+			return inv
+		}(), err: ErrInvalidInvitation},
+		{name: "Used", invitation: func() *model.Invitation {
+			inv := pending()
+			inv.UsedAt = &used
+			return inv
+		}(), err: ErrInvalidInvitation},
+		{name: "Revoked", invitation: func() *model.Invitation {
+			inv := pending()
+			inv.RevokedAt = &used
+			return inv
+		}(), err: ErrInvalidInvitation},
+		{name: "Other Email", invitation: func() *model.Invitation {
+			inv := pending()
+			inv.Email = "someone@example.com"
+			return inv
+		}(), err: ErrInvalidInvitation},
+		{name: "Used Concurrently", invitation: pending(), redeemErr: errors.New("invitation not found"), err: ErrInvalidInvitation},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockRepo := new(MockRepository)
+			svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+			mockRepo.On("GetInvitationByCodeHash", mock.Anything, hashInvitationCode("the-code")).
+				Return(tc.invitation, tc.lookupErr)
+			if tc.invitation != nil && tc.invitation.Pending(time.Now()) && tc.invitation.Email == "test@example.com" {
+				mockRepo.On("CreateProfileWithInvitation", mock.Anything, mock.MatchedBy(func(p model.Profile) bool {
+					return p.Username == req.Username && p.Role == model.RoleAdmin
+				}), "invitation-id", mock.Anything).Return(tc.redeemErr)
+			}
+
+			profile, err := svc.RegisterProfile(context.Background(), req)
+
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				assert.Nil(t, profile)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, model.RoleAdmin, profile.Role)
+			}
+			mockRepo.AssertExpectations(t)
+			mockRepo.AssertNotCalled(t, "CountProfiles", mock.Anything)
+			mockRepo.AssertNotCalled(t, "CreateProfile", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestCreateInvitation(t *testing.T) {
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	user := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "user-id", Role: model.RoleUser})
+
+	t.Run("Admin", func(t *testing.T) {
+		mockRepo := new(MockRepository)
+		svc := NewService(mockRepo, log.NewNopLogger(), WithInvitationTTL(time.Hour))
+
+		var stored model.Invitation
+		mockRepo.On("CreateInvitation", mock.Anything, mock.Anything).
+			Run(func(args mock.Arguments) { stored = args.Get(1).(model.Invitation) }).
+			Return(nil)
+
+		invitation, err := svc.CreateInvitation(admin, model.CreateInvitationRequest{Email: "new@example.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, model.RoleUser, invitation.Role)
+		assert.Equal(t, "admin-id", invitation.CreatedBy)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), invitation.ExpiresAt, time.Minute)
+
+		// Only the hash of the code is stored
+		assert.NotEmpty(t, invitation.Code)
+		assert.Empty(t, stored.Code)
+		assert.Equal(t, hashInvitationCode(invitation.Code), stored.CodeHash)
+	})
+
+	t.Run("Not Admin", func(t *testing.T) {
+		mockRepo := new(MockRepository)
+		svc := NewService(mockRepo, log.NewNopLogger())
+
+		_, err := svc.CreateInvitation(user, model.CreateInvitationRequest{Email: "new@example.com"})
+		assert.Equal(t, ErrForbidden, err)
+
+		_, err = svc.CreateInvitation(context.Background(), model.CreateInvitationRequest{Email: "new@example.com"})
+		assert.Equal(t, ErrUnauthenticated, err)
+		mockRepo.AssertNotCalled(t, "CreateInvitation", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		svc := NewService(new(MockRepository), log.NewNopLogger())
+		past := time.Now().Add(-time.Hour)
+
+		_, err := svc.CreateInvitation(admin, model.CreateInvitationRequest{Email: "nope", Role: "owner", ExpiresAt: &past})
+		var verr *ValidationError
+		assert.ErrorAs(t, err, &verr)
+		assert.Len(t, verr.Fields, 3)
+	})
+}
+
+func TestRevokeInvitation(t *testing.T) {
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger())
+
+	mockRepo.On("RevokeInvitation", mock.Anything, "pending", mock.Anything).Return(nil)
+	mockRepo.On("RevokeInvitation", mock.Anything, "used", mock.Anything).Return(errors.New("invitation not found"))
+
+	assert.NoError(t, svc.RevokeInvitation(admin, "pending"))
+	assert.Equal(t, ErrInvitationNotFound, svc.RevokeInvitation(admin, "used"))
+	assert.Equal(t, ErrUnauthenticated, svc.RevokeInvitation(context.Background(), "pending"))
+	mockRepo.AssertExpectations(t)
+}
+
+func TestValidateToken_Role(t *testing.T) {
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(testHasher(t))).(*profileService)
+	mockRepo.On("GetProfile", mock.Anything, "admin-id").Return(&model.Profile{ID: "admin-id", Role: model.RoleAdmin}, nil)
+	mockRepo.On("GetProfile", mock.Anything, "old-id").Return(&model.Profile{ID: "old-id", Role: model.RoleUser}, nil)
+
+	token, err := svc.generateJWTToken(&model.Profile{ID: "admin-id", Username: "admin-user", Role: model.RoleAdmin}, "", nil, nil, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	claims, err := svc.ValidateToken(context.Background(), token)
+	assert.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, claims.Role)
+
+	// Tokens from before roles existed are regular users
+	token, err = svc.generateJWTToken(&model.Profile{ID: "old-id", Username: "old-user"}, "", nil, nil, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	claims, err = svc.ValidateToken(context.Background(), token)
+	assert.NoError(t, err)
+	assert.Equal(t, model.RoleUser, claims.Role)
+}
+
+func TestValidateToken_WithoutSession(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		profile *model.Profile
+		err     error
+		opts    []Option
+		wantErr error
+	}{
+		{name: "unchanged profile", profile: &model.Profile{ID: "id", Role: model.RoleAdmin}},
+		{name: "locked since", profile: &model.Profile{ID: "id", Role: model.RoleAdmin, LockedAt: &now}, wantErr: ErrInvalidToken},
+		{name: "demoted since", profile: &model.Profile{ID: "id", Role: model.RoleUser}, wantErr: ErrInvalidToken},
+		{name: "deleted since", err: errors.New("profile not found"), wantErr: ErrInvalidToken},
+		{name: "no longer accepted", opts: []Option{WithSessionlessTokens(false)}, wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := new(MockRepository)
+			svc := NewService(mockRepo, log.NewNopLogger(), tt.opts...).(*profileService)
+			if tt.profile != nil || tt.err != nil {
+				mockRepo.On("GetProfile", mock.Anything, "id").Return(tt.profile, tt.err)
+			}
+
+			token, err := svc.generateJWTToken(&model.Profile{ID: "id", Username: "admin-user", Role: model.RoleAdmin}, "", nil, nil, now, now.Add(time.Hour))
+			require.NoError(t, err)
+			_, err = svc.ValidateToken(context.Background(), token)
+			assert.Equal(t, tt.wantErr, err)
+			mockRepo.AssertExpectations(t)
+		})
+	}
+}
+
+func TestInstrumentingMiddleware_CountsLogins(t *testing.T) {
+	// Create a mock repository
+	mockRepo := new(MockRepository)
+	logins := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "logins_total"}, []string{"result"})
+
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	assert.NoError(t, err)
+	hashed, err := hasher.Hash("password123")
+	assert.NoError(t, err)
+
+	svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(hasher))
+	svc = InstrumentingMiddleware(kitprometheus.NewCounter(logins))(svc)
+
+	// Setup mock expectations
+	profile := &model.Profile{ID: uuid.New().String(), Username: "testuser", Password: hashed}
+	mockRepo.On("GetProfileByUsername", mock.Anything, "testuser").Return(profile, nil)
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+	mockRepo.On("GetProfileByUsername", mock.Anything, "broken").Return(nil, errors.New("connection refused"))
+
+	// Call the service
+	_, err = svc.Login(context.Background(), model.LoginRequest{Username: "testuser", Password: "password123"})
+	assert.NoError(t, err)
+	_, err = svc.Login(context.Background(), model.LoginRequest{Username: "testuser", Password: "wrongpassword"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = svc.Login(context.Background(), model.LoginRequest{Username: "broken", Password: "password123"})
+	assert.Error(t, err)
+
+	// Assertions
+	assert.Equal(t, 1.0, testutil.ToFloat64(logins.WithLabelValues(LoginSuccess)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(logins.WithLabelValues(LoginFailure)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(logins.WithLabelValues(LoginError)))
+}
+
+func TestInstrumentHasher(t *testing.T) {
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "hash_duration_seconds"}, []string{"operation", "algorithm"})
+
+	hasher, err := NewPasswordHasher(testHasherConfig())
+	assert.NoError(t, err)
+	hasher = InstrumentHasher(hasher, kitprometheus.NewHistogram(duration))
+
+	hashed, err := hasher.Hash("password123")
+	assert.NoError(t, err)
+	ok, err := hasher.Verify("password123", hashed)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, err = hasher.Verify("password123", "$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0")
+	assert.NoError(t, err)
+
+	// One series each for argon2id hash, argon2id verify and phpass verify
+	assert.Equal(t, 3, testutil.CollectAndCount(duration))
+}
+
+func TestValidateToken_Session(t *testing.T) {
+	profile := &model.Profile{ID: "profile-id", Username: "testuser", Role: model.RoleUser}
+	now := time.Now()
+	revoked := now.Add(-time.Minute)
+
+	testCases := []struct {
+		name    string
+		session *model.Session
+		err     error
+		touched bool
+	}{
+		{name: "Active", session: &model.Session{ID: "s", ProfileID: "profile-id", LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}},
+		{name: "Seen Long Ago", session: &model.Session{ID: "s", ProfileID: "profile-id", LastSeenAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)}, touched: true},
+		{name: "Revoked", session: &model.Session{ID: "s", ProfileID: "profile-id", LastSeenAt: now, ExpiresAt: now.Add(time.Hour), RevokedAt: &revoked}, err: ErrInvalidToken},
+		{name: "Other Profile", session: &model.Session{ID: "s", ProfileID: "other-id", LastSeenAt: now, ExpiresAt: now.Add(time.Hour)}, err: ErrInvalidToken},
+		{name: "Deleted", err: ErrInvalidToken},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockRepo := new(MockRepository)
+			svc := NewService(mockRepo, log.NewNopLogger()).(*profileService)
+
+			if tc.session != nil {
+				mockRepo.On("GetSession", mock.Anything, "s").Return(tc.session, nil)
+			} else {
+				mockRepo.On("GetSession", mock.Anything, "s").Return(nil, errors.New("session not found"))
+			}
+			// A failure to record the last use doesn't reject the token
+			mockRepo.On("TouchSession", mock.Anything, "s", mock.Anything).Return(errors.New("database is down"))
+
+			token, err := svc.generateJWTToken(profile, "s", nil, nil, now, now.Add(time.Hour))
+			assert.NoError(t, err)
+			claims, err := svc.ValidateToken(context.Background(), token)
+
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				assert.Nil(t, claims)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "s", claims.SessionID)
+			}
+			if tc.touched {
+				mockRepo.AssertCalled(t, "TouchSession", mock.Anything, "s", mock.Anything)
+			} else {
+				mockRepo.AssertNotCalled(t, "TouchSession", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	owner := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "profile-id", Role: model.RoleUser, SessionID: "current"})
+	stranger := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "other-id", Role: model.RoleUser})
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin, SessionID: "admin-session"})
+
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger())
+	mockRepo.On("ListActiveSessions", mock.Anything, "profile-id", mock.Anything).
+		Return([]model.Session{{ID: "current"}, {ID: "phone"}}, nil).Twice()
+
+	sessions, err := svc.ListSessions(owner, "profile-id")
+	assert.NoError(t, err)
+	assert.True(t, sessions[0].Current)
+	assert.False(t, sessions[1].Current)
+
+	_, err = svc.ListSessions(admin, "profile-id")
+	assert.NoError(t, err)
+
+	_, err = svc.ListSessions(stranger, "profile-id")
+	assert.Equal(t, ErrForbidden, err)
+	_, err = svc.ListSessions(context.Background(), "profile-id")
+	assert.Equal(t, ErrUnauthenticated, err)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestRevokeSessions(t *testing.T) {
+	owner := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "profile-id", Role: model.RoleUser, SessionID: "current"})
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin, SessionID: "admin-session"})
+
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger())
+	mockRepo.On("RevokeSession", mock.Anything, "profile-id", "phone", mock.Anything).Return(nil)
+	mockRepo.On("RevokeSession", mock.Anything, "profile-id", "gone", mock.Anything).Return(errors.New("session not found"))
+	mockRepo.On("RevokeOtherSessions", mock.Anything, "profile-id", "current", mock.Anything).Return(2, nil)
+	mockRepo.On("RevokeOtherSessions", mock.Anything, "profile-id", "", mock.Anything).Return(3, nil)
+
+	assert.NoError(t, svc.RevokeSession(owner, "profile-id", "phone"))
+	assert.Equal(t, ErrSessionNotFound, svc.RevokeSession(owner, "profile-id", "gone"))
+
+	// The owner keeps the session making the request
+	revoked, err := svc.RevokeOtherSessions(owner, "profile-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, revoked)
+
+	// An admin has no session on the profile to keep
+	revoked, err = svc.RevokeOtherSessions(admin, "profile-id")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, revoked)
+	mockRepo.AssertExpectations(t)
+}
+
+// memoryOutbox records the messages sent by the service
+type memoryOutbox struct {
+	messages []mailer.Message
+	// err fails every send when set
+	err error
+}
+
+func (o *memoryOutbox) Send(_ context.Context, msg mailer.Message) error {
+	if o.err != nil {
+		return o.err
+	}
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+func TestMagicLink(t *testing.T) {
+	mockRepo := new(MockRepository)
+	outbox := &memoryOutbox{}
+	svc := NewService(mockRepo, log.NewNopLogger(), WithMagicLinks(outbox, "https://okblog.example/login/magic?from=email", time.Minute)).(*profileService)
+
+	browser := NewContextWithClient(context.Background(), model.ClientInfo{UserAgent: "Firefox"})
+	profile := &model.Profile{ID: "profile-id", Username: "guest", Email: "guest@example.com", Role: model.RoleUser}
+
+	var link model.MagicLink
+	mockRepo.On("GetProfileByEmail", mock.Anything, "guest@example.com").Return(profile, nil)
+	mockRepo.On("GetProfileByEmail", mock.Anything, "nobody@example.com").Return(nil, errors.New("profile not found"))
+	mockRepo.On("CreateMagicLink", mock.Anything, mock.Anything, maxMagicLinksPerWindow, mock.Anything).
+		Run(func(args mock.Arguments) { link = args.Get(1).(model.MagicLink) }).
+		Return(nil)
+
+	// Unknown addresses look the same to the caller but get no email
+	assert.NoError(t, svc.RequestMagicLink(browser, model.MagicLinkRequest{Email: "nobody@example.com"}))
+	svc.background.Wait()
+	assert.Empty(t, outbox.messages)
+
+	assert.NoError(t, svc.RequestMagicLink(browser, model.MagicLinkRequest{Email: "guest@example.com", Fingerprint: "tab-secret"}))
+	svc.background.Wait()
+	require.Len(t, outbox.messages, 1)
+	assert.Equal(t, "guest@example.com", outbox.messages[0].To)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), link.ExpiresAt, time.Second)
+
+	// The email carries the token, the database only its hash
+	match := regexp.MustCompile(`https://okblog\.example/login/magic\?from=email&token=([A-Za-z0-9_-]+)`).FindStringSubmatch(outbox.messages[0].Body)
+	require.Len(t, match, 2)
+	token := match[1]
+	assert.Equal(t, hashMagicLinkToken(token), link.TokenHash)
+	assert.NotContains(t, link.TokenHash, token)
+
+	consumed := link
+	mockRepo.On("ConsumeMagicLink", mock.Anything, link.TokenHash, mock.Anything).Return(&consumed, nil).Once()
+	mockRepo.On("GetProfile", mock.Anything, "profile-id").Return(profile, nil)
+	mockRepo.On("GetPreferences", mock.Anything, mock.Anything).Return(&model.Preferences{}, nil)
+	mockRepo.On("CreateSession", mock.Anything, mock.Anything).Return(nil)
+
+	resp, err := svc.RedeemMagicLink(browser, model.RedeemMagicLinkRequest{Token: token, Fingerprint: "tab-secret"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.Token)
+	assert.Equal(t, "profile-id", resp.Profile.ID)
+
+	// A second use finds nothing to consume
+	mockRepo.On("ConsumeMagicLink", mock.Anything, link.TokenHash, mock.Anything).Return(nil, errors.New("magic link not found")).Once()
+	_, err = svc.RedeemMagicLink(browser, model.RedeemMagicLinkRequest{Token: token, Fingerprint: "tab-secret"})
+	assert.Equal(t, ErrInvalidMagicLink, err)
+}
+
+func TestRequestMagicLink_Background(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	outbox := &memoryOutbox{}
+	svc := NewService(repo, log.NewNopLogger(), WithMagicLinks(outbox, "https://okblog.example/login", time.Minute)).(*profileService)
+
+	now := time.Now()
+	guest := model.Profile{ID: uuid.New().String(), Username: "guest", Email: "guest@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), guest))
+
+	// The request is answered before the link is sent, and outlives the
+	// request context
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, svc.RequestMagicLink(ctx, model.MagicLinkRequest{Email: "guest@example.com"}))
+	cancel()
+	svc.background.Wait()
+	assert.Len(t, outbox.messages, 1)
+
+	// An address only gets so many links at a time
+	for i := 0; i < maxMagicLinksPerWindow; i++ {
+		require.NoError(t, svc.RequestMagicLink(context.Background(), model.MagicLinkRequest{Email: "guest@example.com"}))
+		svc.background.Wait()
+	}
+	assert.Len(t, outbox.messages, maxMagicLinksPerWindow)
+
+	// Requests beyond those already being sent are dropped
+	other := model.Profile{ID: uuid.New().String(), Username: "other", Email: "other@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), other))
+	for i := 0; i < maxPendingMagicLinks; i++ {
+		svc.magicLinkSlots <- struct{}{}
+	}
+	require.NoError(t, svc.RequestMagicLink(context.Background(), model.MagicLinkRequest{Email: "other@example.com"}))
+	svc.background.Wait()
+	assert.Len(t, outbox.messages, maxMagicLinksPerWindow)
+	for i := 0; i < maxPendingMagicLinks; i++ {
+		<-svc.magicLinkSlots
+	}
+
+	// Mailer failures aren't reported either
+	outbox.err = errors.New("connection refused")
+	assert.NoError(t, svc.RequestMagicLink(context.Background(), model.MagicLinkRequest{Email: "other@example.com"}))
+	svc.background.Wait()
+}
+
+func TestRedeemMagicLink_Fingerprint(t *testing.T) {
+	browser := NewContextWithClient(context.Background(), model.ClientInfo{UserAgent: "Firefox"})
+	link := &model.MagicLink{ID: "link-id", ProfileID: "profile-id", FingerprintHash: fingerprintHash(browser, "tab-secret")}
+
+	testCases := []struct {
+		name        string
+		ctx         context.Context
+		fingerprint string
+	}{
+		{"Other Browser", NewContextWithClient(context.Background(), model.ClientInfo{UserAgent: "curl"}), "tab-secret"},
+		{"Other Secret", browser, "guess"},
+		{"No Client", context.Background(), "tab-secret"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockRepo := new(MockRepository)
+			svc := NewService(mockRepo, log.NewNopLogger(), WithMagicLinks(&memoryOutbox{}, "https://okblog.example/login", time.Minute))
+			mockRepo.On("ConsumeMagicLink", mock.Anything, hashMagicLinkToken("token"), mock.Anything).Return(link, nil)
+
+			resp, err := svc.RedeemMagicLink(tc.ctx, model.RedeemMagicLinkRequest{Token: "token", Fingerprint: tc.fingerprint})
+			assert.Equal(t, ErrInvalidMagicLink, err)
+			assert.Nil(t, resp)
+			mockRepo.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRequestMagicLink_Disabled(t *testing.T) {
+	svc := NewService(new(MockRepository), log.NewNopLogger())
+	assert.Equal(t, ErrMagicLinksDisabled, svc.RequestMagicLink(context.Background(), model.MagicLinkRequest{Email: "guest@example.com"}))
+
+	svc = NewService(new(MockRepository), log.NewNopLogger(), WithMagicLinks(&memoryOutbox{}, "https://okblog.example/login", time.Minute))
+	var verr *ValidationError
+	assert.ErrorAs(t, svc.RequestMagicLink(context.Background(), model.MagicLinkRequest{Email: "not-an-email"}), &verr)
+}
+
+func TestCreateProfile(t *testing.T) {
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	user := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "user-id", Role: model.RoleUser})
+	req := model.CreateProfileRequest{Username: "newadmin", Email: "new@example.com", Password: "correct horse battery staple", Role: model.RoleAdmin}
+
+	t.Run("Admin", func(t *testing.T) {
+		mockRepo := new(MockRepository)
+		svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+		var stored model.Profile
+		mockRepo.On("CreateProfile", mock.Anything, mock.Anything).
+			Run(func(args mock.Arguments) { stored = args.Get(1).(model.Profile) }).
+			Return(nil)
+
+		// Registration rules don't apply: no invitation and no count of profiles
+		profile, err := svc.CreateProfile(admin, req)
+		assert.NoError(t, err)
+		assert.Equal(t, model.RoleAdmin, profile.Role)
+		assert.Empty(t, profile.Password)
+		assert.True(t, strings.HasPrefix(stored.Password, "$argon2id$"))
+		mockRepo.AssertNotCalled(t, "CountProfiles", mock.Anything)
+	})
+
+	t.Run("Not Admin", func(t *testing.T) {
+		mockRepo := new(MockRepository)
+		svc := NewService(mockRepo, log.NewNopLogger())
+
+		_, err := svc.CreateProfile(user, req)
+		assert.Equal(t, ErrForbidden, err)
+		mockRepo.AssertNotCalled(t, "CreateProfile", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		svc := NewService(new(MockRepository), log.NewNopLogger())
+
+		_, err := svc.CreateProfile(admin, model.CreateProfileRequest{Username: "admin", Email: "nope", Password: "short", Role: "owner"})
+		var verr *ValidationError
+		assert.ErrorAs(t, err, &verr)
+		assert.Len(t, verr.Fields, 4)
+	})
+}
+
+func TestResetPassword(t *testing.T) {
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+	mockRepo.On("UpdatePassword", mock.Anything, "profile-id", mock.AnythingOfType("string")).Return(nil)
+	mockRepo.On("UpdatePassword", mock.Anything, "missing", mock.AnythingOfType("string")).Return(errors.New("profile not found"))
+	mockRepo.On("RevokeOtherSessions", mock.Anything, "profile-id", "", mock.Anything).Return(2, nil)
+
+	assert.NoError(t, svc.ResetPassword(admin, "profile-id", "correct horse battery staple"))
+	assert.Equal(t, ErrProfileNotFound, svc.ResetPassword(admin, "missing", "correct horse battery staple"))
+	assert.ErrorIs(t, svc.ResetPassword(admin, "profile-id", "short"), ErrInvalidInput)
+	assert.Equal(t, ErrUnauthenticated, svc.ResetPassword(context.Background(), "profile-id", "correct horse battery staple"))
+	mockRepo.AssertExpectations(t)
+	mockRepo.AssertNumberOfCalls(t, "RevokeOtherSessions", 1)
+}
+
+func TestSetRole(t *testing.T) {
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger())
+
+	mockRepo.On("UpdateRole", mock.Anything, "profile-id", model.RoleAdmin).Return(nil)
+	mockRepo.On("RevokeOtherSessions", mock.Anything, "profile-id", "", mock.Anything).Return(1, nil)
+	mockRepo.On("GetProfile", mock.Anything, "profile-id").Return(&model.Profile{ID: "profile-id", Role: model.RoleAdmin, Password: "hash"}, nil)
+
+	profile, err := svc.SetRole(admin, "profile-id", model.RoleAdmin)
+	assert.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, profile.Role)
+	assert.Empty(t, profile.Password)
+
+	_, err = svc.SetRole(admin, "profile-id", "owner")
+	assert.ErrorIs(t, err, ErrInvalidInput)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestSetRole_RevokesTokens(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t))).(*profileService)
+
+	now := time.Now()
+	admin := model.Profile{ID: uuid.New().String(), Username: "admin", Email: "admin@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	other := model.Profile{ID: uuid.New().String(), Username: "other", Email: "other@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), admin))
+	require.NoError(t, repo.CreateProfile(context.Background(), other))
+
+	resp, err := svc.startSession(context.Background(), &admin)
+	require.NoError(t, err)
+	claims, err := svc.ValidateToken(context.Background(), resp.Token)
+	require.NoError(t, err)
+	assert.Equal(t, model.RoleAdmin, claims.Role)
+
+	// The demoted admin's token stops working at once, not when it expires
+	otherCtx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: other.ID, Role: model.RoleAdmin})
+	_, err = svc.SetRole(otherCtx, admin.ID, model.RoleUser)
+	require.NoError(t, err)
+	_, err = svc.ValidateToken(context.Background(), resp.Token)
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestLockProfile(t *testing.T) {
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	lockedAt := time.Now()
+
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger())
+	mockRepo.On("SetLockedAt", mock.Anything, "profile-id", mock.MatchedBy(func(t *time.Time) bool { return t != nil })).Return(nil)
+	mockRepo.On("SetLockedAt", mock.Anything, "profile-id", (*time.Time)(nil)).Return(nil)
+	mockRepo.On("RevokeOtherSessions", mock.Anything, "profile-id", "", mock.Anything).Return(1, nil)
+	mockRepo.On("GetProfile", mock.Anything, "profile-id").Return(&model.Profile{ID: "profile-id", LockedAt: &lockedAt}, nil).Once()
+	mockRepo.On("GetProfile", mock.Anything, "profile-id").Return(&model.Profile{ID: "profile-id"}, nil).Once()
+
+	// Locking logs the profile out everywhere
+	profile, err := svc.LockProfile(admin, "profile-id")
+	assert.NoError(t, err)
+	assert.True(t, profile.Locked())
+
+	profile, err = svc.UnlockProfile(admin, "profile-id")
+	assert.NoError(t, err)
+	assert.False(t, profile.Locked())
+	mockRepo.AssertExpectations(t)
+	mockRepo.AssertNumberOfCalls(t, "RevokeOtherSessions", 1)
+
+	_, err = svc.LockProfile(context.Background(), "profile-id")
+	assert.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLogin_LockedAccount(t *testing.T) {
+	hasher := testHasher(t)
+	hash, err := hasher.Hash("password123")
+	require.NoError(t, err)
+	lockedAt := time.Now()
+
+	mockRepo := new(MockRepository)
+	svc := NewService(mockRepo, log.NewNopLogger(), WithPasswordHasher(hasher))
+	mockRepo.On("GetProfileByUsername", mock.Anything, "locked").
+		Return(&model.Profile{ID: "profile-id", Username: "locked", Password: hash, LockedAt: &lockedAt}, nil)
+
+	// The lock is only reported with the right password
+	_, err = svc.Login(context.Background(), model.LoginRequest{Username: "locked", Password: "wrong"})
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = svc.Login(context.Background(), model.LoginRequest{Username: "locked", Password: "password123"})
+	assert.Equal(t, ErrAccountLocked, err)
+	mockRepo.AssertNotCalled(t, "CreateSession", mock.Anything, mock.Anything)
+}
+
+func TestValidateJWTToken_PreviousSigningKeys(t *testing.T) {
+	oldKey, newKey := []byte("old-key-old-key-old-key-old-key!"), []byte("new-key-new-key-new-key-new-key!")
+	now := time.Now()
+
+	old := NewService(new(MockRepository), log.NewNopLogger(), WithJWTSigningKey(oldKey)).(*profileService)
+	token, err := old.generateJWTToken(&model.Profile{ID: "profile-id", Username: "alice"}, "", nil, nil, now, now.Add(time.Hour))
+	require.NoError(t, err)
+
+	// After a rotation the old key still verifies, but no longer signs
+	rotated := NewService(new(MockRepository), log.NewNopLogger(),
+		WithJWTSigningKey(newKey), WithPreviousJWTSigningKeys(oldKey)).(*profileService)
+	claims, err := rotated.ValidateJWTToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "profile-id", claims.UserID)
+
+	fresh, err := rotated.generateJWTToken(&model.Profile{ID: "profile-id"}, "", nil, nil, now, now.Add(time.Hour))
+	require.NoError(t, err)
+	_, err = old.ValidateJWTToken(fresh)
+	assert.Error(t, err)
+
+	// Once the old key is dropped its tokens are rejected
+	dropped := NewService(new(MockRepository), log.NewNopLogger(), WithJWTSigningKey(newKey)).(*profileService)
+	_, err = dropped.ValidateJWTToken(token)
+	assert.EqualError(t, err, "invalid token signature")
+}
+
+func newNewsletterService(outbox *memoryOutbox) (Service, *repository.MemoryRepository) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithNewsletter(outbox, NewsletterConfig{
+		ConfirmURL:     "https://okblog.example/newsletter/confirm",
+		UnsubscribeURL: "https://okblog.example/newsletter/unsubscribe",
+		SiteURL:        "https://okblog.example/",
+	}))
+	return svc, repo
+}
+
+// linkToken returns the token of the link to page in an email body
+func linkToken(t *testing.T, body, page string) string {
+	t.Helper()
+	match := regexp.MustCompile(regexp.QuoteMeta("https://okblog.example/"+page) + `\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(body)
+	require.Len(t, match, 2, body)
+	return match[1]
+}
+
+func TestNewsletterSubscription(t *testing.T) {
+	ctx := context.Background()
+	outbox := &memoryOutbox{}
+	svc, repo := newNewsletterService(outbox)
+
+	require.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: " Reader@Example.com "}))
+	require.Len(t, outbox.messages, 1)
+	assert.Equal(t, "reader@example.com", outbox.messages[0].To)
+	token := linkToken(t, outbox.messages[0].Body, "newsletter/confirm")
+
+	// Only the hash of the confirmation token is stored
+	subscriber, err := repo.GetSubscriberByEmail(ctx, "reader@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, model.SubscriberPending, subscriber.Status())
+	assert.Equal(t, hashSubscriptionToken(token), subscriber.ConfirmTokenHash)
+	assert.WithinDuration(t, time.Now().Add(DefaultSubscriptionConfirmTTL), subscriber.ConfirmExpiresAt, time.Second)
+
+	require.NoError(t, svc.ConfirmSubscription(ctx, model.SubscriptionTokenRequest{Token: token}))
+	assert.Equal(t, ErrInvalidSubscriptionToken, svc.ConfirmSubscription(ctx, model.SubscriptionTokenRequest{Token: token}))
+	assert.Equal(t, ErrInvalidSubscriptionToken, svc.ConfirmSubscription(ctx, model.SubscriptionTokenRequest{}))
+
+	// Subscribing again while active sends nothing
+	require.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: "reader@example.com"}))
+	assert.Len(t, outbox.messages, 1)
+
+	require.NoError(t, svc.Unsubscribe(ctx, model.SubscriptionTokenRequest{Token: subscriber.UnsubscribeToken}))
+	require.NoError(t, svc.Unsubscribe(ctx, model.SubscriptionTokenRequest{Token: subscriber.UnsubscribeToken}))
+	assert.Equal(t, ErrInvalidSubscriptionToken, svc.Unsubscribe(ctx, model.SubscriptionTokenRequest{Token: "unknown"}))
+
+	// Coming back takes a new confirmation
+	require.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: "reader@example.com"}))
+	require.Len(t, outbox.messages, 2)
+	assert.Equal(t, ErrInvalidSubscriptionToken, svc.ConfirmSubscription(ctx, model.SubscriptionTokenRequest{Token: token}))
+	renewed := linkToken(t, outbox.messages[1].Body, "newsletter/confirm")
+	require.NoError(t, svc.ConfirmSubscription(ctx, model.SubscriptionTokenRequest{Token: renewed}))
+
+	admin := NewContextWithClaims(ctx, &model.TokenClaims{UserID: "admin-id", Role: model.RoleAdmin})
+	subscribers, err := svc.ListSubscribers(admin)
+	require.NoError(t, err)
+	require.Len(t, subscribers, 1)
+	assert.Equal(t, model.SubscriberActive, subscribers[0].Status())
+	_, err = svc.ListSubscribers(NewContextWithClaims(ctx, &model.TokenClaims{UserID: "user-id", Role: model.RoleUser}))
+	assert.Equal(t, ErrForbidden, err)
+}
+
+func TestSubscribe_Resend(t *testing.T) {
+	ctx := context.Background()
+	outbox := &memoryOutbox{}
+	svc, repo := newNewsletterService(outbox)
+
+	require.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: "reader@example.com"}))
+	require.Len(t, outbox.messages, 1)
+
+	// A pending confirmation isn't sent again while it is recent
+	require.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: "reader@example.com"}))
+	assert.Len(t, outbox.messages, 1)
+
+	subscriber, err := repo.GetSubscriberByEmail(ctx, "reader@example.com")
+	require.NoError(t, err)
+	sentAt := time.Now().Add(-subscriptionResendInterval - time.Minute)
+	require.NoError(t, repo.RenewSubscription(ctx, subscriber.ID, subscriber.ConfirmTokenHash, sentAt.Add(DefaultSubscriptionConfirmTTL)))
+	require.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: "reader@example.com"}))
+	assert.Len(t, outbox.messages, 2)
+
+	// Nor are mailer failures reported
+	outbox.err = errors.New("connection refused")
+	assert.NoError(t, svc.Subscribe(ctx, model.SubscribeRequest{Email: "other@example.com"}))
+}
+
+func TestSubscribe_Disabled(t *testing.T) {
+	svc := NewService(new(MockRepository), log.NewNopLogger())
+	assert.Equal(t, ErrNewsletterDisabled, svc.Subscribe(context.Background(), model.SubscribeRequest{Email: "reader@example.com"}))
+	_, err := svc.SendNewsletterDigest(context.Background())
+	assert.Equal(t, ErrNewsletterDisabled, err)
+
+	svc, _ = newNewsletterService(&memoryOutbox{})
+	var verr *ValidationError
+	assert.ErrorAs(t, svc.Subscribe(context.Background(), model.SubscribeRequest{Email: "not-an-email"}), &verr)
+}
+
+func TestSendNewsletterDigest(t *testing.T) {
+	ctx := context.Background()
+	outbox := &memoryOutbox{}
+	svc, repo := newNewsletterService(outbox)
+
+	now := time.Now()
+	for _, email := range []string{"active@example.com", "pending@example.com"} {
+		require.NoError(t, repo.CreateSubscriber(ctx, model.Subscriber{
+			ID: uuid.New().String(), Email: email, ConfirmTokenHash: "hash-" + email, ConfirmExpiresAt: now.Add(time.Hour),
+			UnsubscribeToken: "unsubscribe-" + strings.Split(email, "@")[0], CreatedAt: now,
+		}))
+	}
+	_, err := repo.ConfirmSubscriber(ctx, "hash-active@example.com", now)
+	require.NoError(t, err)
+
+	// Nothing published, nothing sent
+	sent, err := svc.SendNewsletterDigest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+
+	handler := NewsletterPostHandler(svc)
+	published := &posts.Post{ID: "post-1", Type: posts.TypePost, Title: "Hello", Slug: "hello world", Excerpt: "First post", IsPublished: true, PublishedAt: now}
+	require.NoError(t, handler.Handle(ctx, posts.Change{Op: posts.OpCreate, After: published}))
+	page := &posts.Post{ID: "page-1", Type: posts.TypePage, Title: "About", Slug: "about", IsPublished: true}
+	require.NoError(t, handler.Handle(ctx, posts.Change{Op: posts.OpCreate, After: page}))
+	draft := &posts.Post{ID: "post-2", Type: posts.TypePost, Title: "Draft", Slug: "draft"}
+	require.NoError(t, handler.Handle(ctx, posts.Change{Op: posts.OpCreate, After: draft}))
+
+	// A failing mailer keeps the posts for the next digest
+	outbox.err = errors.New("smtp is down")
+	_, err = svc.SendNewsletterDigest(ctx)
+	assert.ErrorIs(t, err, outbox.err)
+	outbox.err = nil
+
+	sent, err = svc.SendNewsletterDigest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	require.Len(t, outbox.messages, 1)
+	msg := outbox.messages[0]
+	assert.Equal(t, "active@example.com", msg.To)
+	assert.Equal(t, "New on okblog: Hello", msg.Subject)
+	assert.Contains(t, msg.Body, "https://okblog.example/hello%20world")
+	assert.NotContains(t, msg.Body, "About")
+	assert.Equal(t, "unsubscribe-active", linkToken(t, msg.Body, "newsletter/unsubscribe"))
+
+	// Posts go out once
+	sent, err = svc.SendNewsletterDigest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Len(t, outbox.messages, 1)
+}
+
+func TestSendNewsletterDigest_Replicas(t *testing.T) {
+	ctx := context.Background()
+	outbox := &memoryOutbox{}
+	svc, repo := newNewsletterService(outbox)
+	// Another replica's service on the same database
+	replica := NewService(repo, log.NewNopLogger(), WithNewsletter(outbox, NewsletterConfig{
+		ConfirmURL:     "https://okblog.example/newsletter/confirm",
+		UnsubscribeURL: "https://okblog.example/newsletter/unsubscribe",
+		SiteURL:        "https://okblog.example/",
+	}))
+
+	now := time.Now()
+	require.NoError(t, repo.CreateSubscriber(ctx, model.Subscriber{
+		ID: uuid.New().String(), Email: "active@example.com", ConfirmTokenHash: "hash", ConfirmExpiresAt: now.Add(time.Hour),
+		UnsubscribeToken: "unsubscribe", CreatedAt: now,
+	}))
+	_, err := repo.ConfirmSubscriber(ctx, "hash", now)
+	require.NoError(t, err)
+	require.NoError(t, svc.QueueNewsletterPost(ctx, model.NewsletterPost{ID: "post-1", Title: "Hello", Slug: "hello"}))
+
+	// A digest in progress holds its posts
+	claimed, err := repo.ClaimNewsletterPosts(ctx, now, now.Add(newsletterDigestLease))
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	sent, err := replica.SendNewsletterDigest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Empty(t, outbox.messages)
+
+	// A digest that sent nothing gives them back
+	require.NoError(t, repo.ReleaseNewsletterPosts(ctx, []string{"post-1"}))
+	sent, err = svc.SendNewsletterDigest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	sent, err = replica.SendNewsletterDigest(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Len(t, outbox.messages, 1)
+}
+
+func TestWriteSubscribersCSV(t *testing.T) {
+	createdAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	confirmedAt := createdAt.Add(time.Hour)
+
+	var b strings.Builder
+	require.NoError(t, WriteSubscribersCSV(&b, []model.Subscriber{
+		{ID: "1", Email: "reader@example.com", CreatedAt: createdAt, ConfirmedAt: &confirmedAt},
+		{ID: "2", Email: "=cmd|' /C calc'!A0@example.com", CreatedAt: createdAt},
+	}))
+	assert.Equal(t, "id,email,status,created_at,confirmed_at,unsubscribed_at\n"+
+		"1,reader@example.com,active,2024-06-01T12:00:00Z,2024-06-01T13:00:00Z,\n"+
+		"2,'=cmd|' /C calc'!A0@example.com,pending,2024-06-01T12:00:00Z,,\n", b.String())
+}
+
+func TestAuthorStats(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger())
+	profileID := uuid.New().String()
+	require.NoError(t, repo.CreateProfile(ctx, model.Profile{
+		ID: profileID, Username: "author", Email: "author@example.com", Role: model.RoleUser,
+		CreatedAt: time.Now(), UpdatedAt: time.Now(),
+	}))
+
+	publishedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	changeTime := publishedAt.Add(time.Minute)
+	draft := &posts.Post{ID: "post-1", ProfileID: profileID, Type: posts.TypePost}
+	published := &posts.Post{ID: "post-1", ProfileID: profileID, Type: posts.TypePost, IsPublished: true, PublishedAt: publishedAt, ViewCount: 7}
+	page := &posts.Post{ID: "page-1", ProfileID: profileID, Type: posts.TypePage, IsPublished: true, PublishedAt: publishedAt}
+	changes := []posts.Change{
+		{Op: posts.OpCreate, After: draft, Time: changeTime},
+		{Op: posts.OpCreate, After: &posts.Post{ID: "post-2", ProfileID: profileID, Type: posts.TypePost}, Time: changeTime},
+		{Op: posts.OpUpdate, Before: draft, After: published, Time: changeTime.Add(time.Second)},
+		{Op: posts.OpCreate, After: page, Time: changeTime},
+		// Replayed out of order, the older change is ignored
+		{Op: posts.OpCreate, After: draft, Time: changeTime},
+		{Op: posts.OpDelete, Before: &posts.Post{ID: "post-2", ProfileID: profileID, Type: posts.TypePost}, Time: changeTime.Add(time.Second)},
+	}
+	handler := AuthorStatsHandler(svc)
+	for _, change := range changes {
+		require.NoError(t, handler.Handle(ctx, change))
+	}
+
+	stats, err := svc.GetAuthorStats(ctx, profileID)
+	require.NoError(t, err)
+	assert.Equal(t, &model.AuthorStats{
+		ProfileID:       profileID,
+		PublishedCount:  1,
+		DraftCount:      0,
+		TotalViews:      7,
+		LastPublishedAt: &publishedAt,
+	}, stats)
+
+	_, err = svc.GetAuthorStats(ctx, uuid.New().String())
+	assert.Equal(t, ErrProfileNotFound, err)
+}
+
+// webhookReceiver records the deliveries it gets and answers with status
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	w.WriteHeader(r.status)
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// events returns the types of the events received so far
+func (r *webhookReceiver) events(t *testing.T) []string {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := []string{}
+	for _, body := range r.bodies {
+		var event model.WebhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		events = append(events, event.Type)
+	}
+	return events
+}
+
+func newWebhookService(t *testing.T, config WebhookConfig) (Service, context.Context, *webhookReceiver, *httptest.Server) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)), WithWebhooks(webhook.NewHTTPSender(time.Second), config))
+
+	admin := model.Profile{ID: uuid.New().String(), Username: "admin", Email: "admin@example.com", Role: model.RoleAdmin, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	require.NoError(t, repo.CreateProfile(context.Background(), admin))
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: admin.ID, Role: model.RoleAdmin})
+
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return svc, ctx, receiver, server
+}
+
+func TestWebhooks(t *testing.T) {
+	svc, ctx, receiver, server := newWebhookService(t, WebhookConfig{})
+
+	// Only admins manage webhooks, and URLs and events are checked
+	user := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: "user-id", Role: model.RoleUser})
+	_, err := svc.CreateWebhook(user, model.CreateWebhookRequest{URL: server.URL, Events: []string{model.EventProfileCreated}})
+	assert.Equal(t, ErrForbidden, err)
+	var verr *ValidationError
+	_, err = svc.CreateWebhook(ctx, model.CreateWebhookRequest{URL: "ftp://hooks.example.com", Events: []string{"profile.renamed"}})
+	require.ErrorAs(t, err, &verr)
+	assert.Len(t, verr.Fields, 2)
+
+	hook, err := svc.CreateWebhook(ctx, model.CreateWebhookRequest{
+		URL:    server.URL,
+		Events: []string{model.EventProfileCreated, model.EventNewDeviceLogin, model.EventProfileCreated},
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, hook.Secret)
+	assert.Equal(t, []string{model.EventProfileCreated, model.EventNewDeviceLogin}, hook.Events)
+
+	// The secret is only shown once
+	hooks, err := svc.ListWebhooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, hooks, 1)
+	assert.Empty(t, hooks[0].Secret)
+
+	// Creating a profile delivers a signed event
+	profile, err := svc.CreateProfile(ctx, model.CreateProfileRequest{Username: "writer", Email: "writer@example.com", Password: "correct-Horse-battery-9"})
+	require.NoError(t, err)
+	delivered, err := svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+
+	require.Len(t, receiver.requests, 1)
+	req := receiver.requests[0]
+	assert.Equal(t, model.EventProfileCreated, req.Header.Get(webhook.HeaderEvent))
+	timestamp, err := strconv.ParseInt(req.Header.Get(webhook.HeaderTimestamp), 10, 64)
+	require.NoError(t, err)
+	assert.True(t, webhook.Verify(hook.Secret, timestamp, receiver.bodies[0], req.Header.Get(webhook.HeaderSignature)))
+	var event model.WebhookEvent
+	require.NoError(t, json.Unmarshal(receiver.bodies[0], &event))
+	assert.Equal(t, model.WebhookProfile{ID: profile.ID, Username: "writer", Role: model.RoleUser}, event.Profile)
+	assert.NotContains(t, string(receiver.bodies[0]), "writer@example.com")
+
+	deliveries, err := svc.ListWebhookDeliveries(ctx, hook.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, req.Header.Get(webhook.HeaderDelivery), deliveries[0].ID)
+	assert.Equal(t, model.DeliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, http.StatusNoContent, deliveries[0].ResponseStatus)
+	assert.NotNil(t, deliveries[0].DeliveredAt)
+
+	// Nothing left to send
+	delivered, err = svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+
+	require.NoError(t, svc.DeleteWebhook(ctx, hook.ID))
+	assert.Equal(t, ErrWebhookNotFound, svc.DeleteWebhook(ctx, hook.ID))
+	_, err = svc.ListWebhookDeliveries(ctx, hook.ID)
+	assert.Equal(t, ErrWebhookNotFound, err)
+}
+
+func TestWebhooks_NewDeviceLogin(t *testing.T) {
+	svc, ctx, receiver, server := newWebhookService(t, WebhookConfig{})
+	_, err := svc.CreateWebhook(ctx, model.CreateWebhookRequest{URL: server.URL, Events: []string{model.EventNewDeviceLogin}})
+	require.NoError(t, err)
+	_, err = svc.CreateProfile(ctx, model.CreateProfileRequest{Username: "writer", Email: "writer@example.com", Password: "correct-Horse-battery-9"})
+	require.NoError(t, err)
+
+	login := func(userAgent string) {
+		t.Helper()
+		client := NewContextWithClient(context.Background(), model.ClientInfo{UserAgent: userAgent, IP: "192.0.2.1"})
+		_, err := svc.Login(client, model.LoginRequest{Username: "writer", Password: "correct-Horse-battery-9"})
+		require.NoError(t, err)
+	}
+	login("Firefox")
+	login("Firefox")
+	login("Safari")
+
+	delivered, err := svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, delivered, "the second login is from a known device")
+	assert.Equal(t, []string{model.EventNewDeviceLogin, model.EventNewDeviceLogin}, receiver.events(t))
+
+	userAgents := []string{}
+	for _, body := range receiver.bodies {
+		var event model.WebhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		require.NotNil(t, event.Device)
+		assert.Equal(t, "192.0.2.1", event.Device.IP)
+		userAgents = append(userAgents, event.Device.UserAgent)
+	}
+	assert.ElementsMatch(t, []string{"Firefox", "Safari"}, userAgents)
+}
+
+func TestWebhooks_Retries(t *testing.T) {
+	svc, ctx, receiver, server := newWebhookService(t, WebhookConfig{MaxAttempts: 2, RetryBackoff: 20 * time.Millisecond})
+	hook, err := svc.CreateWebhook(ctx, model.CreateWebhookRequest{URL: server.URL, Events: []string{model.EventProfileCreated, model.EventProfileDeleted}})
+	require.NoError(t, err)
+	profile, err := svc.CreateProfile(ctx, model.CreateProfileRequest{Username: "writer", Email: "writer@example.com", Password: "correct-Horse-battery-9"})
+	require.NoError(t, err)
+
+	receiver.setStatus(http.StatusInternalServerError)
+	delivered, err := svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+
+	deliveries, err := svc.ListWebhookDeliveries(ctx, hook.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, model.DeliveryPending, deliveries[0].Status)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].ResponseStatus)
+	assert.Contains(t, deliveries[0].LastError, "500")
+
+	// The retry waits for the backoff
+	delivered, err = svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Len(t, receiver.requests, 1)
+
+	// The receiver recovers in time for the deletion, not for the retry
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, svc.DeleteProfile(ctx, profile.ID))
+	delivered, err = svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, delivered)
+	assert.Len(t, receiver.requests, 3)
+
+	deliveries, err = svc.ListWebhookDeliveries(ctx, hook.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	statuses := map[string]string{}
+	for _, delivery := range deliveries {
+		statuses[delivery.Event] = delivery.Status
+	}
+	assert.Equal(t, model.DeliveryFailed, statuses[model.EventProfileCreated], "out of attempts")
+	assert.Equal(t, model.DeliveryPending, statuses[model.EventProfileDeleted])
+
+	receiver.setStatus(http.StatusOK)
+	time.Sleep(30 * time.Millisecond)
+	delivered, err = svc.DeliverWebhooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, []string{model.EventProfileCreated, model.EventProfileCreated, model.EventProfileDeleted, model.EventProfileDeleted}, receiver.events(t))
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	svc := NewService(new(MockRepository), log.NewNopLogger(), WithWebhooks(webhook.NewHTTPSender(0), WebhookConfig{})).(*profileService)
+
+	assert.Equal(t, 30*time.Second, svc.webhookRetryBackoff(1))
+	assert.Equal(t, time.Minute, svc.webhookRetryBackoff(2))
+	assert.Equal(t, 4*time.Minute, svc.webhookRetryBackoff(4))
+	assert.Equal(t, time.Hour, svc.webhookRetryBackoff(8))
+	assert.Equal(t, time.Hour, svc.webhookRetryBackoff(100))
+}
+
+func TestImpersonate(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+	now := time.Now()
+	admin := model.Profile{ID: uuid.New().String(), Username: "admin", Email: "admin@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	writer := model.Profile{ID: uuid.New().String(), Username: "writer", Email: "writer@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), admin))
+	require.NoError(t, repo.CreateProfile(context.Background(), writer))
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: admin.ID, Username: "admin", Role: model.RoleAdmin})
+
+	resp, err := svc.Impersonate(ctx, writer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, writer.ID, resp.Profile.ID)
+	assert.WithinDuration(t, now.Add(DefaultImpersonationTTL), resp.ExpiresAt, time.Minute)
+
+	// The token is the writer's, with the admin as the actor
+	claims, err := svc.ValidateToken(context.Background(), resp.Token)
+	require.NoError(t, err)
+	assert.Equal(t, writer.ID, claims.UserID)
+	assert.Equal(t, model.RoleUser, claims.Role)
+	assert.Equal(t, &model.Actor{UserID: admin.ID, Username: "admin"}, claims.Actor)
+
+	session, err := repo.GetSession(context.Background(), claims.SessionID)
+	require.NoError(t, err)
+	assert.Equal(t, admin.ID, session.ImpersonatorID)
+
+	events, err := svc.ListAuditEvents(ctx, model.AuditEventFilter{ProfileID: writer.ID})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, model.AuditImpersonationStarted, events[0].Action)
+	assert.Equal(t, admin.ID, events[0].ActorID)
+	assert.Equal(t, session.ID, events[0].Target)
+
+	// Changes made with the token are recorded, the writer's own aren't
+	impersonated := NewContextWithClaims(context.Background(), claims)
+	assert.NoError(t, svc.RevokeSession(impersonated, writer.ID, session.ID))
+	events, err = svc.ListAuditEvents(ctx, model.AuditEventFilter{ActorID: admin.ID})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, model.AuditSessionRevoked, events[0].Action)
+	own := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: writer.ID, Role: model.RoleUser})
+	_, err = svc.RevokeOtherSessions(own, writer.ID)
+	require.NoError(t, err)
+	events, err = svc.ListAuditEvents(ctx, model.AuditEventFilter{ProfileID: writer.ID})
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	// The revoked session takes the token with it
+	_, err = svc.ValidateToken(context.Background(), resp.Token)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, err = svc.Impersonate(ctx, admin.ID)
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+	_, err = svc.Impersonate(ctx, uuid.New().String())
+	assert.Equal(t, ErrProfileNotFound, err)
+	_, err = svc.Impersonate(own, admin.ID)
+	assert.Equal(t, ErrForbidden, err)
+	_, err = svc.ListAuditEvents(own, model.AuditEventFilter{})
+	assert.Equal(t, ErrForbidden, err)
+
+	// An impersonation token can't start another impersonation
+	nested := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: writer.ID, Role: model.RoleAdmin, Actor: &model.Actor{UserID: admin.ID}})
+	_, err = svc.Impersonate(nested, uuid.New().String())
+	assert.Equal(t, ErrForbidden, err)
+
+	_, err = svc.LockProfile(ctx, writer.ID)
+	require.NoError(t, err)
+	_, err = svc.Impersonate(ctx, writer.ID)
+	assert.Equal(t, ErrAccountLocked, err)
+}
+
+func TestImpersonate_ProfileChanges(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+	now := time.Now()
+	admin := model.Profile{ID: uuid.New().String(), Username: "admin", Email: "admin@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	writer := model.Profile{ID: uuid.New().String(), Username: "writer", Email: "writer@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), admin))
+	require.NoError(t, repo.CreateProfile(context.Background(), writer))
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: admin.ID, Username: "admin", Role: model.RoleAdmin})
+
+	resp, err := svc.Impersonate(ctx, writer.ID)
+	require.NoError(t, err)
+	claims, err := svc.ValidateToken(context.Background(), resp.Token)
+	require.NoError(t, err)
+	impersonated := NewContextWithClaims(context.Background(), claims)
+
+	_, err = svc.UpdateProfile(impersonated, writer.ID, model.UpdateProfileRequest{Bio: "Edited by an admin"})
+	require.NoError(t, err)
+	require.NoError(t, svc.DeleteProfile(impersonated, writer.ID))
+
+	events, err := svc.ListAuditEvents(ctx, model.AuditEventFilter{ProfileID: writer.ID})
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, model.AuditProfileDeleted, events[0].Action)
+	assert.Equal(t, model.AuditProfileUpdated, events[1].Action)
+	assert.Equal(t, admin.ID, events[1].ActorID)
+	assert.Equal(t, writer.ID, events[1].Target)
+}
+
+func TestValidateToken_ImpersonatorDemoted(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+	now := time.Now()
+	admin := model.Profile{ID: uuid.New().String(), Username: "admin", Email: "admin@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	other := model.Profile{ID: uuid.New().String(), Username: "other", Email: "other@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	writer := model.Profile{ID: uuid.New().String(), Username: "writer", Email: "writer@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	for _, profile := range []model.Profile{admin, other, writer} {
+		require.NoError(t, repo.CreateProfile(context.Background(), profile))
+	}
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: admin.ID, Username: "admin", Role: model.RoleAdmin})
+
+	resp, err := svc.Impersonate(ctx, writer.ID)
+	require.NoError(t, err)
+	_, err = svc.ValidateToken(context.Background(), resp.Token)
+	require.NoError(t, err)
+
+	// The token only lives as long as the admin does
+	otherCtx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: other.ID, Role: model.RoleAdmin})
+	_, err = svc.SetRole(otherCtx, admin.ID, model.RoleUser)
+	require.NoError(t, err)
+	_, err = svc.ValidateToken(context.Background(), resp.Token)
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestPreferences(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+	now := time.Now()
+	writer := model.Profile{ID: uuid.New().String(), Username: "writer", Email: "writer@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	other := model.Profile{ID: uuid.New().String(), Username: "other", Email: "other@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), writer))
+	require.NoError(t, repo.CreateProfile(context.Background(), other))
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: writer.ID, Role: model.RoleUser})
+
+	preferences, err := svc.GetPreferences(ctx, writer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{}, preferences)
+
+	yes, no := true, false
+	_, err = svc.UpdatePreferences(ctx, writer.ID, model.PreferencesUpdate{Set: model.Preferences{
+		Locale:        "fr-FR",
+		Editor:        &model.EditorPreferences{Mode: model.EditorMarkdown, FontSize: 14, SpellCheck: &yes},
+		Notifications: &model.NotificationPreferences{Email: &yes},
+	}})
+	require.NoError(t, err)
+
+	// Only the fields in the update change, down to the nested documents
+	preferences, err = svc.UpdatePreferences(ctx, writer.ID, model.PreferencesUpdate{Set: model.Preferences{
+		Timezone: "Europe/Paris",
+		Editor:   &model.EditorPreferences{Theme: model.ThemeDark, SpellCheck: &no},
+	}})
+	require.NoError(t, err)
+	expected := &model.Preferences{
+		Locale:        "fr-FR",
+		Timezone:      "Europe/Paris",
+		Editor:        &model.EditorPreferences{Mode: model.EditorMarkdown, Theme: model.ThemeDark, FontSize: 14, SpellCheck: &no},
+		Notifications: &model.NotificationPreferences{Email: &yes},
+	}
+	assert.Equal(t, expected, preferences)
+	preferences, err = svc.GetPreferences(ctx, writer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected, preferences)
+
+	testCases := []struct {
+		name   string
+		req    model.PreferencesUpdate
+		fields []string
+	}{
+		{name: "Locale", req: model.PreferencesUpdate{Set: model.Preferences{Locale: "french"}}, fields: []string{"locale"}},
+		{name: "Unknown Timezone", req: model.PreferencesUpdate{Set: model.Preferences{Timezone: "Europe/Atlantis"}}, fields: []string{"timezone"}},
+		{name: "Local Timezone", req: model.PreferencesUpdate{Set: model.Preferences{Timezone: "Local"}}, fields: []string{"timezone"}},
+		{name: "Malformed Timezone", req: model.PreferencesUpdate{Set: model.Preferences{Timezone: "../etc/passwd"}}, fields: []string{"timezone"}},
+		{
+			name:   "Editor",
+			req:    model.PreferencesUpdate{Set: model.Preferences{Editor: &model.EditorPreferences{Mode: "vim", Theme: "neon", FontSize: 72}}},
+			fields: []string{"editor.mode", "editor.theme", "editor.fontSize"},
+		},
+		{name: "Unset Unknown", req: model.PreferencesUpdate{Unset: []string{"locale", "editor.font"}}, fields: []string{"editor.font"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := svc.UpdatePreferences(ctx, writer.ID, tc.req)
+			var verr *ValidationError
+			require.ErrorAs(t, err, &verr)
+			assert.Len(t, verr.Fields, len(tc.fields))
+			for _, field := range tc.fields {
+				assert.Contains(t, verr.Fields, field)
+			}
+		})
+	}
+	// Rejected updates leave the stored preferences alone
+	preferences, err = svc.GetPreferences(ctx, writer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected, preferences)
+
+	// Unset fields are cleared, and nested documents with them once empty
+	preferences, err = svc.UpdatePreferences(ctx, writer.ID, model.PreferencesUpdate{
+		Set:   model.Preferences{Locale: "de-DE"},
+		Unset: []string{"timezone", "editor.fontSize", "notifications.email"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{
+		Locale: "de-DE",
+		Editor: &model.EditorPreferences{Mode: model.EditorMarkdown, Theme: model.ThemeDark, SpellCheck: &no},
+	}, preferences)
+	preferences, err = svc.UpdatePreferences(ctx, writer.ID, model.PreferencesUpdate{Unset: []string{"locale", "editor"}})
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{}, preferences)
+
+	_, err = svc.GetPreferences(ctx, other.ID)
+	assert.Equal(t, ErrForbidden, err)
+	_, err = svc.UpdatePreferences(ctx, other.ID, model.PreferencesUpdate{Set: model.Preferences{Locale: "en"}})
+	assert.Equal(t, ErrForbidden, err)
+	admin := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: uuid.New().String(), Role: model.RoleAdmin})
+	_, err = svc.GetPreferences(admin, other.ID)
+	assert.NoError(t, err)
+	_, err = svc.GetPreferences(admin, uuid.New().String())
+	assert.Equal(t, ErrProfileNotFound, err)
+}
+
+func TestPreferences_ConcurrentUpdates(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t)))
+
+	now := time.Now()
+	writer := model.Profile{ID: uuid.New().String(), Username: "writer", Email: "writer@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), writer))
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: writer.ID, Role: model.RoleUser})
+
+	// Updates of different fields racing each other all make it in
+	yes := true
+	updates := []model.Preferences{
+		{Locale: "fr-FR"},
+		{Timezone: "Europe/Paris"},
+		{Editor: &model.EditorPreferences{FontSize: 16}},
+		{Editor: &model.EditorPreferences{Theme: model.ThemeDark}},
+		{Notifications: &model.NotificationPreferences{Email: &yes}},
+	}
+	var wg sync.WaitGroup
+	for _, update := range updates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.UpdatePreferences(ctx, writer.ID, model.PreferencesUpdate{Set: update})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	preferences, err := svc.GetPreferences(ctx, writer.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &model.Preferences{
+		Locale:        "fr-FR",
+		Timezone:      "Europe/Paris",
+		Editor:        &model.EditorPreferences{Theme: model.ThemeDark, FontSize: 16},
+		Notifications: &model.NotificationPreferences{Email: &yes},
+	}, preferences)
+}
+
+func TestPreferences_TokenClaims(t *testing.T) {
+	repo := repository.NewMemoryRepository()
+	svc := NewService(repo, log.NewNopLogger(), WithPasswordHasher(testHasher(t))).(*profileService)
+
+	now := time.Now()
+	admin := model.Profile{ID: uuid.New().String(), Username: "admin", Email: "admin@example.com", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	writer := model.Profile{ID: uuid.New().String(), Username: "writer", Email: "writer@example.com", Role: model.RoleUser, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, repo.CreateProfile(context.Background(), admin))
+	require.NoError(t, repo.CreateProfile(context.Background(), writer))
+	ctx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: writer.ID, Role: model.RoleUser})
+
+	// Tokens of profiles without preferences have no locale or timezone
+	resp, err := svc.startSession(context.Background(), &writer)
+	require.NoError(t, err)
+	claims, err := svc.ValidateToken(context.Background(), resp.Token)
+	require.NoError(t, err)
+	assert.Empty(t, claims.Locale)
+	assert.Empty(t, claims.Timezone)
+
+	_, err = svc.UpdatePreferences(ctx, writer.ID, model.PreferencesUpdate{Set: model.Preferences{Locale: "pt-BR", Timezone: "America/Sao_Paulo"}})
+	require.NoError(t, err)
+	resp, err = svc.startSession(context.Background(), &writer)
+	require.NoError(t, err)
+	claims, err = svc.ValidateToken(context.Background(), resp.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "pt-BR", claims.Locale)
+	assert.Equal(t, "America/Sao_Paulo", claims.Timezone)
+
+	// Impersonation tokens carry them too, and the changes made with them
+	// are audited
+	adminCtx := NewContextWithClaims(context.Background(), &model.TokenClaims{UserID: admin.ID, Username: "admin", Role: model.RoleAdmin})
+	impersonation, err := svc.Impersonate(adminCtx, writer.ID)
+	require.NoError(t, err)
+	claims, err = svc.ValidateToken(context.Background(), impersonation.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "pt-BR", claims.Locale)
+	_, err = svc.UpdatePreferences(NewContextWithClaims(context.Background(), claims), writer.ID, model.PreferencesUpdate{Set: model.Preferences{Locale: "en"}})
+	require.NoError(t, err)
+	events, err := svc.ListAuditEvents(adminCtx, model.AuditEventFilter{ProfileID: writer.ID})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, model.AuditPreferencesUpdated, events[0].Action)
+}
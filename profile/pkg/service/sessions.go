@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/google/uuid"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// DefaultSessionTouchInterval is how often ValidateToken records the last
+// use of a session. Validations in between don't write to the database.
+const DefaultSessionTouchInterval = time.Minute
+
+// maxUserAgentLength is the length of the user_agent column
+const maxUserAgentLength = 512
+
+// clientUserAgent returns the user agent of the request as sessions store it
+func clientUserAgent(ctx context.Context) string {
+	userAgent := ClientFromContext(ctx).UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return userAgent
+}
+
+// createSession records a login of profile from the client of the request
+func (s *profileService) createSession(ctx context.Context, profileID string, now, expiresAt time.Time) (*model.Session, error) {
+	session := model.Session{
+		ID:         uuid.New().String(),
+		ProfileID:  profileID,
+		UserAgent:  clientUserAgent(ctx),
+		IP:         ClientFromContext(ctx).IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  expiresAt,
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// checkSession makes sure the session of a token is still active and
+// records its use at most once per touch interval. A failure to record is
+// only logged. impersonatorID is the admin behind an impersonation token:
+// impersonation sessions only take their own tokens.
+func (s *profileService) checkSession(ctx context.Context, sessionID, userID, impersonatorID string) error {
+	session, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil {
+		if err.Error() == "session not found" {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	now := time.Now()
+	if session.ProfileID != userID || session.ImpersonatorID != impersonatorID || !session.Active(now) {
+		requestid.Logger(ctx, s.logger).Log("msg", "Rejected token of inactive session", "session", sessionID)
+		return ErrInvalidToken
+	}
+
+	if now.Sub(session.LastSeenAt) >= s.sessionTouchInterval {
+		if err := s.repo.TouchSession(ctx, sessionID, now); err != nil {
+			requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to touch session", "session", sessionID)
+		}
+	}
+	return nil
+}
+
+// checkSessionlessToken rejects tokens without a session once they are no
+// longer accepted, and until then those of profiles that were deleted,
+// locked or given another role since the token was issued
+func (s *profileService) checkSessionlessToken(ctx context.Context, claims *JWTClaims) error {
+	if !s.sessionlessTokens {
+		requestid.Logger(ctx, s.logger).Log("msg", "Rejected token without session", "profile", claims.UserID)
+		return ErrInvalidToken
+	}
+
+	profile, err := s.repo.GetProfile(ctx, claims.UserID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return ErrInvalidToken
+		}
+		return err
+	}
+	// Tokens issued before roles existed belong to regular users
+	role := claims.Role
+	if role == "" {
+		role = model.RoleUser
+	}
+	if profile.Locked() || profile.Role != role {
+		requestid.Logger(ctx, s.logger).Log("msg", "Rejected token without session of changed profile", "profile", claims.UserID)
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (s *profileService) ListSessions(ctx context.Context, profileID string) ([]model.Session, error) {
+	caller, err := requireProfileAccess(ctx, profileID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := s.repo.ListActiveSessions(ctx, profileID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == caller.SessionID
+	}
+	return sessions, nil
+}
+
+func (s *profileService) RevokeSession(ctx context.Context, profileID, sessionID string) error {
+	if _, err := requireProfileAccess(ctx, profileID); err != nil {
+		return err
+	}
+
+	err := s.repo.RevokeSession(ctx, profileID, sessionID, time.Now())
+	if err != nil {
+		if err.Error() == "session not found" {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	s.auditImpersonation(ctx, model.AuditSessionRevoked, sessionID)
+	return nil
+}
+
+func (s *profileService) RevokeOtherSessions(ctx context.Context, profileID string) (int, error) {
+	caller, err := requireProfileAccess(ctx, profileID)
+	if err != nil {
+		return 0, err
+	}
+
+	// An admin acting on someone else's profile has no session there to keep
+	keep := ""
+	if caller.UserID == profileID {
+		keep = caller.SessionID
+	}
+	n, err := s.repo.RevokeOtherSessions(ctx, profileID, keep, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	s.auditImpersonation(ctx, model.AuditSessionsRevoked, profileID)
+	return n, nil
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/posts"
+)
+
+func (s *profileService) RecordAuthorPost(ctx context.Context, post model.AuthorPost) error {
+	return s.repo.SaveAuthorPost(ctx, post)
+}
+
+func (s *profileService) GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error) {
+	if _, err := s.repo.GetProfile(ctx, profileID); err != nil {
+		if err.Error() == "profile not found" {
+			return nil, ErrProfileNotFound
+		}
+		return nil, err
+	}
+	return s.repo.GetAuthorStats(ctx, profileID)
+}
+
+// AuthorStatsHandler records the state of every post after a change on the
+// posts topic. Deleted posts, and posts that became pages, stop counting.
+// The Debezium time of the change is the version of the state, so replayed
+// and reordered changes can't overwrite a newer state.
+func AuthorStatsHandler(svc Service) posts.Handler {
+	return posts.HandlerFunc(func(ctx context.Context, change posts.Change) error {
+		post, deleted := change.After, change.Op == posts.OpDelete || change.After == nil
+		if deleted {
+			post = change.Before
+		}
+
+		state := model.AuthorPost{
+			ID:          post.ID,
+			ProfileID:   post.ProfileID,
+			IsPublished: post.IsPublished,
+			ViewCount:   post.ViewCount,
+			Deleted:     deleted || post.Type != posts.TypePost,
+		}
+		if !post.PublishedAt.IsZero() {
+			publishedAt := post.PublishedAt
+			state.PublishedAt = &publishedAt
+		}
+		// Changes without a time can't be ordered, any timed change wins
+		if !change.Time.IsZero() {
+			state.Version = change.Time.UnixMilli()
+		}
+		return svc.RecordAuthorPost(ctx, state)
+	})
+}
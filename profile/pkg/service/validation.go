@@ -0,0 +1,255 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+)
+
+// Field limits for registration. Text columns in the profiles table are VARCHAR(255).
+const (
+	maxColumnLength   = 255
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	maxPasswordLength = 128
+)
+
+// reservedUsernames can't be registered because they clash with routes or
+// would be mistaken for system accounts
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"root":          true,
+	"system":        true,
+	"support":       true,
+	"login":         true,
+	"register":      true,
+	"profile":       true,
+	"profiles":      true,
+	"me":            true,
+	"null":          true,
+	"undefined":     true,
+}
+
+// ValidationError reports which request fields are invalid and why.
+// It matches ErrInvalidInput with errors.Is.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, 0, len(fields))
+	for _, field := range fields {
+		msgs = append(msgs, field+": "+e.Fields[field])
+	}
+	return ErrInvalidInput.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidInput
+}
+
+// add records the first problem found for a field
+func (e *ValidationError) add(field, msg string) {
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	if _, exists := e.Fields[field]; !exists {
+		e.Fields[field] = msg
+	}
+}
+
+// PasswordPolicy describes the requirements a new password has to meet
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// MinScore is the minimum strength score, from 0 (weakest) to 4
+	MinScore int
+	// Breached holds known breached passwords, lowercased
+	Breached map[string]bool
+	// MaxBytes is the most bytes a password can take, 0 for no limit beyond
+	// maxPasswordLength characters. The service sets it from its hasher.
+	MaxBytes int
+}
+
+// DefaultPasswordPolicy returns the policy used when none is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength: 8,
+		MinScore:  2,
+	}
+}
+
+// LoadBreachedPasswords reads a newline separated list of breached passwords.
+// Empty lines and lines starting with # are ignored.
+func LoadBreachedPasswords(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open breached password list: %w", err)
+	}
+	defer f.Close()
+
+	breached := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read breached password list: %w", err)
+	}
+	return breached, nil
+}
+
+// PasswordScore rates a password from 0 to 4 based on its length and the
+// number of character classes it uses
+func PasswordScore(password string) int {
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+
+	classes := 0
+	for _, has := range []bool{hasLower, hasUpper, hasDigit, hasSymbol} {
+		if has {
+			classes++
+		}
+	}
+
+	score := 0
+	length := utf8.RuneCountInString(password)
+	if length >= 8 {
+		score++
+	}
+	if length >= 12 {
+		score++
+	}
+	if classes >= 2 {
+		score++
+	}
+	if classes >= 3 {
+		score++
+	}
+	return score
+}
+
+// Check returns a description of the first rule the password breaks, or an
+// empty string if it satisfies the policy
+func (p PasswordPolicy) Check(password string) string {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Sprintf("must be at least %d characters", p.MinLength)
+	}
+	if length > maxPasswordLength {
+		return fmt.Sprintf("must be at most %d characters", maxPasswordLength)
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		return fmt.Sprintf("must be at most %d bytes, fewer characters outside of ASCII", p.MaxBytes)
+	}
+	if p.Breached[strings.ToLower(password)] {
+		return "has appeared in a data breach, choose another"
+	}
+	if PasswordScore(password) < p.MinScore {
+		return "is too weak, use a longer password with a mix of letters, digits and symbols"
+	}
+	return ""
+}
+
+// validateRegistration checks every field of a registration request and
+// returns a *ValidationError listing all invalid fields
+func validateRegistration(req model.RegisterProfileRequest, policy PasswordPolicy) error {
+	verr := &ValidationError{}
+
+	if msg := checkUsername(req.Username); msg != "" {
+		verr.add("username", msg)
+	}
+
+	if msg := checkEmail(req.Email); msg != "" {
+		verr.add("email", msg)
+	}
+
+	if req.Password == "" {
+		verr.add("password", "is required")
+	} else if msg := policy.Check(req.Password); msg != "" {
+		verr.add("password", msg)
+	}
+
+	if utf8.RuneCountInString(req.FirstName) > maxColumnLength {
+		verr.add("firstName", fmt.Sprintf("must be at most %d characters", maxColumnLength))
+	}
+	if utf8.RuneCountInString(req.LastName) > maxColumnLength {
+		verr.add("lastName", fmt.Sprintf("must be at most %d characters", maxColumnLength))
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func checkUsername(username string) string {
+	if username == "" {
+		return "is required"
+	}
+	length := utf8.RuneCountInString(username)
+	if length < minUsernameLength || length > maxUsernameLength {
+		return fmt.Sprintf("must be between %d and %d characters", minUsernameLength, maxUsernameLength)
+	}
+	for i, r := range username {
+		isAlnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if i == 0 && !isAlnum {
+			return "must start with a letter or digit"
+		}
+		if !isAlnum && r != '_' && r != '-' && r != '.' {
+			return "may only contain letters, digits, '_', '-' and '.'"
+		}
+	}
+	if reservedUsernames[strings.ToLower(username)] {
+		return "is reserved"
+	}
+	return ""
+}
+
+func checkEmail(email string) string {
+	if email == "" {
+		return "is required"
+	}
+	if utf8.RuneCountInString(email) > maxColumnLength {
+		return fmt.Sprintf("must be at most %d characters", maxColumnLength)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "is not a valid email address"
+	}
+	at := strings.LastIndex(email, "@")
+	if !strings.Contains(email[at+1:], ".") {
+		return "is not a valid email address"
+	}
+	return ""
+}
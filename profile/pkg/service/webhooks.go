@@ -0,0 +1,382 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/webhook"
+	"github.com/google/uuid"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Defaults of WebhookConfig
+const (
+	DefaultWebhookMaxAttempts  = 8
+	DefaultWebhookRetryBackoff = 30 * time.Second
+)
+
+const (
+	// maxWebhookRetryBackoff caps the doubling of the retry backoff
+	maxWebhookRetryBackoff = time.Hour
+	// webhookSecretBytes is the entropy of a webhook secret
+	webhookSecretBytes = 32
+	// webhookClaimBatch deliveries are claimed at a time, and leased for
+	// webhookLease, which must be longer than sending a batch takes
+	webhookClaimBatch = 10
+	webhookLease      = 5 * time.Minute
+	// webhookDeliveryLogSize is how many deliveries ListWebhookDeliveries
+	// returns
+	webhookDeliveryLogSize = 100
+	// maxWebhookErrorLength keeps a chatty receiver out of the delivery log
+	maxWebhookErrorLength = 512
+)
+
+// WebhookConfig configures the delivery of webhooks, see WithWebhooks
+type WebhookConfig struct {
+	// MaxAttempts is how many times a delivery is attempted before it is
+	// marked failed
+	MaxAttempts int
+	// RetryBackoff is the wait before the first retry. It doubles with
+	// every attempt, up to an hour.
+	RetryBackoff time.Duration
+}
+
+// WithWebhooks records the profile events for the webhooks subscribed to
+// them. DeliverWebhooks sends them with sender.
+func WithWebhooks(sender webhook.Sender, config WebhookConfig) Option {
+	return func(s *profileService) {
+		if config.MaxAttempts <= 0 {
+			config.MaxAttempts = DefaultWebhookMaxAttempts
+		}
+		if config.RetryBackoff <= 0 {
+			config.RetryBackoff = DefaultWebhookRetryBackoff
+		}
+		s.webhookSender = sender
+		s.webhooks = config
+	}
+}
+
+func (s *profileService) webhooksEnabled() bool {
+	return s.webhookSender != nil
+}
+
+// newWebhookSecret returns a random secret to sign deliveries with
+func newWebhookSecret() (string, error) {
+	b := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *profileService) CreateWebhook(ctx context.Context, req model.CreateWebhookRequest) (*model.Webhook, error) {
+	caller, err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	verr := &ValidationError{}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		verr.add("url", "must be an absolute http or https URL")
+	}
+	events, msg := checkWebhookEvents(req.Events)
+	if msg != "" {
+		verr.add("events", msg)
+	}
+	if len(verr.Fields) > 0 {
+		return nil, verr
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to generate webhook secret")
+		return nil, err
+	}
+
+	hook := model.Webhook{
+		ID:        uuid.New().String(),
+		URL:       req.URL,
+		Events:    events,
+		Secret:    secret,
+		CreatedBy: caller.UserID,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateWebhook(ctx, hook); err != nil {
+		return nil, err
+	}
+	s.auditImpersonation(ctx, model.AuditWebhookCreated, hook.ID)
+
+	// The secret is only ever shown here
+	return &hook, nil
+}
+
+// checkWebhookEvents returns the events without duplicates, or why they
+// can't be subscribed to
+func checkWebhookEvents(events []string) ([]string, string) {
+	if len(events) == 0 {
+		return nil, "must not be empty"
+	}
+	known := map[string]bool{}
+	for _, event := range model.WebhookEvents {
+		known[event] = true
+	}
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, event := range events {
+		if !known[event] {
+			return nil, "unknown event " + event
+		}
+		if !seen[event] {
+			seen[event] = true
+			unique = append(unique, event)
+		}
+	}
+	return unique, ""
+}
+
+func (s *profileService) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	webhooks, err := s.repo.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return webhooks, nil
+}
+
+func (s *profileService) DeleteWebhook(ctx context.Context, id string) error {
+	if _, err := requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	err := s.repo.DeleteWebhook(ctx, id)
+	if err != nil {
+		if err.Error() == "webhook not found" {
+			return ErrWebhookNotFound
+		}
+		return err
+	}
+	s.auditImpersonation(ctx, model.AuditWebhookDeleted, id)
+	return nil
+}
+
+func (s *profileService) ListWebhookDeliveries(ctx context.Context, webhookID string) ([]model.WebhookDelivery, error) {
+	if _, err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.repo.GetWebhook(ctx, webhookID); err != nil {
+		if err.Error() == "webhook not found" {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, err
+	}
+	return s.repo.ListWebhookDeliveries(ctx, webhookID, webhookDeliveryLogSize)
+}
+
+// subscribedWebhooks returns the webhooks that receive event. Failures are
+// only logged: events are a side effect of changes that already happened.
+func (s *profileService) subscribedWebhooks(ctx context.Context, event string) []model.Webhook {
+	if !s.webhooksEnabled() {
+		return nil
+	}
+	webhooks, err := s.repo.ListWebhooks(ctx)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to list webhooks", "event", event)
+		return nil
+	}
+	subscribed := []model.Webhook{}
+	for _, w := range webhooks {
+		if w.Subscribed(event) {
+			subscribed = append(subscribed, w)
+		}
+	}
+	return subscribed
+}
+
+// emitWebhookEvent records a delivery of the event about profile for every
+// webhook subscribed to it
+func (s *profileService) emitWebhookEvent(ctx context.Context, event string, profile *model.Profile) {
+	s.enqueueWebhookEvent(ctx, s.subscribedWebhooks(ctx, event), model.WebhookEvent{Type: event, Profile: webhookProfile(profile)})
+}
+
+// enqueueWebhookEvent records a delivery of event for each of webhooks. They
+// share the payload, and are sent by DeliverWebhooks.
+func (s *profileService) enqueueWebhookEvent(ctx context.Context, webhooks []model.Webhook, event model.WebhookEvent) {
+	if len(webhooks) == 0 {
+		return
+	}
+
+	logger := requestid.Logger(ctx, s.logger)
+	now := time.Now()
+	event.ID = uuid.New().String()
+	event.CreatedAt = now
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Log("err", err, "msg", "Failed to encode webhook event", "event", event.Type)
+		return
+	}
+
+	for _, w := range webhooks {
+		err := s.repo.CreateWebhookDelivery(ctx, model.WebhookDelivery{
+			ID:            uuid.New().String(),
+			WebhookID:     w.ID,
+			Event:         event.Type,
+			Payload:       string(payload),
+			Status:        model.DeliveryPending,
+			CreatedAt:     now,
+			NextAttemptAt: now,
+		})
+		if err != nil {
+			logger.Log("err", err, "msg", "Failed to record webhook delivery", "event", event.Type, "webhook", w.ID)
+		}
+	}
+}
+
+func webhookProfile(profile *model.Profile) model.WebhookProfile {
+	return model.WebhookProfile{ID: profile.ID, Username: profile.Username, Role: profile.Role}
+}
+
+// newDeviceLoginWebhooks returns the webhooks to notify of a login of the
+// profile from the client of the request, or nil when one of its active
+// sessions already has the user agent. It runs before the session of the
+// login is created, which would always match.
+func (s *profileService) newDeviceLoginWebhooks(ctx context.Context, profileID string, now time.Time) []model.Webhook {
+	webhooks := s.subscribedWebhooks(ctx, model.EventNewDeviceLogin)
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	sessions, err := s.repo.ListActiveSessions(ctx, profileID, now)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Log("err", err, "msg", "Failed to list sessions for new device check", "id", profileID)
+		return nil
+	}
+	userAgent := clientUserAgent(ctx)
+	for _, session := range sessions {
+		if session.UserAgent == userAgent {
+			return nil
+		}
+	}
+	return webhooks
+}
+
+func (s *profileService) DeliverWebhooks(ctx context.Context) (int, error) {
+	if !s.webhooksEnabled() {
+		return 0, nil
+	}
+
+	webhooks := map[string]*model.Webhook{}
+	delivered := 0
+	for {
+		now := time.Now()
+		claimed, err := s.repo.ClaimWebhookDeliveries(ctx, now, now.Add(webhookLease), webhookClaimBatch)
+		if err != nil {
+			return delivered, err
+		}
+
+		for _, delivery := range claimed {
+			w, ok := webhooks[delivery.WebhookID]
+			if !ok {
+				w, err = s.repo.GetWebhook(ctx, delivery.WebhookID)
+				if err != nil && err.Error() != "webhook not found" {
+					return delivered, err
+				}
+				// A deleted webhook took its deliveries with it
+				webhooks[delivery.WebhookID] = w
+			}
+			if w == nil {
+				continue
+			}
+
+			ok, err := s.attemptDelivery(ctx, w, delivery)
+			if err != nil {
+				return delivered, err
+			}
+			if ok {
+				delivered++
+			}
+		}
+
+		if len(claimed) < webhookClaimBatch {
+			return delivered, nil
+		}
+	}
+}
+
+// attemptDelivery sends a delivery and records the outcome. It reports
+// whether the receiver accepted it. When ctx is canceled during the attempt
+// nothing is recorded, and the delivery is retried once its lease expired.
+func (s *profileService) attemptDelivery(ctx context.Context, w *model.Webhook, delivery model.WebhookDelivery) (bool, error) {
+	status, sendErr := s.webhookSender.Send(ctx, webhook.Request{
+		URL:        w.URL,
+		Secret:     w.Secret,
+		Event:      delivery.Event,
+		DeliveryID: delivery.ID,
+		Body:       []byte(delivery.Payload),
+	})
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	now := time.Now()
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	delivery.NextAttemptAt = now
+	switch {
+	case sendErr == nil:
+		delivery.Status = model.DeliveryDelivered
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= s.webhooks.MaxAttempts:
+		delivery.Status = model.DeliveryFailed
+		delivery.LastError = truncate(sendErr.Error(), maxWebhookErrorLength)
+	default:
+		delivery.LastError = truncate(sendErr.Error(), maxWebhookErrorLength)
+		delivery.NextAttemptAt = now.Add(s.webhookRetryBackoff(delivery.Attempts))
+	}
+
+	logger := requestid.Logger(ctx, s.logger)
+	if sendErr != nil {
+		logger.Log("err", sendErr, "msg", "Failed to deliver webhook", "webhook", w.ID, "delivery", delivery.ID,
+			"attempt", delivery.Attempts, "status", delivery.Status)
+	}
+	if err := s.repo.UpdateWebhookDelivery(ctx, delivery); err != nil {
+		logger.Log("err", err, "msg", "Failed to record webhook delivery attempt", "delivery", delivery.ID)
+		return false, err
+	}
+	return sendErr == nil, nil
+}
+
+// webhookRetryBackoff is the wait after the given number of failed attempts
+func (s *profileService) webhookRetryBackoff(attempts int) time.Duration {
+	backoff := s.webhooks.RetryBackoff
+	for i := 1; i < attempts && backoff < maxWebhookRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWebhookRetryBackoff {
+		backoff = maxWebhookRetryBackoff
+	}
+	return backoff
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+// Hashes of accounts migrated from WordPress are verified here so authors
+// can keep their password. They are never produced by the service: a
+// successful login always rehashes them with the preferred algorithm.
+
+// phpassItoa64 is the alphabet phpass uses for its own base64 variant
+const phpassItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// PhpassVerifier verifies portable phpass hashes ($P$ and $H$) used by
+// WordPress before 6.8
+type PhpassVerifier struct{}
+
+func (PhpassVerifier) Matches(encoded string) bool {
+	return len(encoded) == 34 && (strings.HasPrefix(encoded, "$P$") || strings.HasPrefix(encoded, "$H$"))
+}
+
+func (v PhpassVerifier) Verify(password, encoded string) (bool, error) {
+	if !v.Matches(encoded) {
+		return false, ErrMalformedHash
+	}
+
+	countLog2 := strings.IndexByte(phpassItoa64, encoded[3])
+	if countLog2 < 7 || countLog2 > 30 {
+		return false, ErrMalformedHash
+	}
+	count := 1 << countLog2
+	salt := encoded[4:12]
+
+	sum := md5.Sum([]byte(salt + password))
+	hash := sum[:]
+	for i := 0; i < count; i++ {
+		sum = md5.Sum(append(hash, password...))
+		hash = sum[:]
+	}
+
+	computed := encoded[:12] + phpassEncode64(hash)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(encoded)) == 1, nil
+}
+
+// phpassEncode64 is phpass' encode64, which packs bytes little-endian
+func phpassEncode64(input []byte) string {
+	var out strings.Builder
+	count := len(input)
+	i := 0
+	for {
+		value := int(input[i])
+		i++
+		out.WriteByte(phpassItoa64[value&0x3f])
+		if i < count {
+			value |= int(input[i]) << 8
+		}
+		out.WriteByte(phpassItoa64[(value>>6)&0x3f])
+		if i >= count {
+			break
+		}
+		i++
+		if i < count {
+			value |= int(input[i]) << 16
+		}
+		out.WriteByte(phpassItoa64[(value>>12)&0x3f])
+		if i >= count {
+			break
+		}
+		i++
+		out.WriteByte(phpassItoa64[(value>>18)&0x3f])
+		if i >= count {
+			break
+		}
+	}
+	return out.String()
+}
+
+// WordPressBcryptVerifier verifies the $wp$ hashes introduced in WordPress
+// 6.8: bcrypt over the base64 encoded HMAC-SHA384 of the trimmed password
+type WordPressBcryptVerifier struct{}
+
+func (WordPressBcryptVerifier) Matches(encoded string) bool {
+	return strings.HasPrefix(encoded, "$wp$2")
+}
+
+func (WordPressBcryptVerifier) Verify(password, encoded string) (bool, error) {
+	mac := hmac.New(sha512.New384, []byte("wp-sha384"))
+	// Same characters as PHP's trim()
+	mac.Write([]byte(strings.Trim(password, " \t\n\r\x00\x0B")))
+	prehashed := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	return BcryptHasher{}.Verify(prehashed, strings.TrimPrefix(encoded, "$wp"))
+}
@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// InstrumentationName is the name of the tracers created by the profile service
+const InstrumentationName = "github.com/ganis/okblog/profile"
+
+// Supported exporters
+const (
+	ExporterNone     = "none"
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterOTLPHTTP = "otlp-http"
+	ExporterNewRelic = "newrelic"
+)
+
+// newRelicEndpoint is New Relic's OTLP endpoint for US accounts. EU accounts
+// set Endpoint to otlp.eu01.nr-data.net.
+const newRelicEndpoint = "otlp.nr-data.net"
+
+// Config selects and configures the span exporter
+type Config struct {
+	Exporter    string
+	ServiceName string
+	// Endpoint is host:port of the collector. Empty uses the exporter default.
+	Endpoint string
+	Insecure bool
+	// Headers are sent with every export request, e.g. for authentication
+	Headers map[string]string
+	// SampleRatio is the fraction of new traces that are recorded. Traces
+	// started upstream follow the sampling decision of the caller.
+	SampleRatio float64
+	// NewRelicLicenseKey authenticates the newrelic exporter
+	NewRelicLicenseKey string
+}
+
+// Setup installs the global tracer provider and the W3C trace context and
+// baggage propagators. The returned function flushes pending spans and must be
+// called on shutdown. With ExporterNone spans are propagated but not exported.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	exporter, err := newExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", config.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("create resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, config Config) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case ExporterNone, "":
+		return nil, nil
+	case ExporterOTLPGRPC:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(config.Headers)}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case ExporterOTLPHTTP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithHeaders(config.Headers)}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case ExporterNewRelic:
+		if config.NewRelicLicenseKey == "" {
+			return nil, fmt.Errorf("the %s exporter needs a license key", ExporterNewRelic)
+		}
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = newRelicEndpoint
+		}
+		headers := map[string]string{"api-key": config.NewRelicLicenseKey}
+		for k, v := range config.Headers {
+			headers[k] = v
+		}
+		return otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpoint(endpoint),
+			otlptracehttp.WithHeaders(headers),
+		)
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter %q", config.Exporter)
+	}
+}
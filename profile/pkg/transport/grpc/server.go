@@ -0,0 +1,352 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/ganis/okblog/profile/pkg/endpoint"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/transport/grpc/pb"
+	"github.com/go-kit/kit/transport"
+	kitgrpc "github.com/go-kit/kit/transport/grpc"
+	"github.com/go-kit/log"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server is the gRPC server of the profile service. Besides the profile API
+// it serves the standard health checking protocol and server reflection.
+type Server struct {
+	*grpc.Server
+	health *health.Server
+}
+
+// NewServer creates a gRPC server that serves the same endpoints as the HTTP
+// transport, wrapped with the same endpoint middlewares
+func NewServer(svc service.Service, logger log.Logger, middlewares ...endpoint.Middleware) *Server {
+	endpoints := endpoint.MakeEndpoints(svc, logger, middlewares...)
+
+	s := &Server{
+		Server: grpc.NewServer(),
+		health: health.NewServer(),
+	}
+
+	pb.RegisterProfileServiceServer(s.Server, NewProfileServer(endpoints, logger))
+	healthpb.RegisterHealthServer(s.Server, s.health)
+	reflection.Register(s.Server)
+
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	s.health.SetServingStatus(pb.ProfileService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+
+	return s
+}
+
+// Shutdown reports NOT_SERVING to health checks and waits for pending RPCs.
+// RPCs still running when ctx is done are cancelled.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+// profileServer adapts the go-kit endpoints to pb.ProfileServiceServer
+type profileServer struct {
+	pb.UnimplementedProfileServiceServer
+	register      kitgrpc.Handler
+	login         kitgrpc.Handler
+	validateToken kitgrpc.Handler
+	get           kitgrpc.Handler
+	update        kitgrpc.Handler
+	delete        kitgrpc.Handler
+}
+
+// NewProfileServer creates the ProfileService implementation for a set of endpoints
+func NewProfileServer(endpoints endpoint.Endpoints, logger log.Logger) pb.ProfileServiceServer {
+	options := []kitgrpc.ServerOption{
+		kitgrpc.ServerBefore(requestIDFromMetadata, traceContextFromMetadata, clientInfoFromMetadata, authorizationFromMetadata),
+		kitgrpc.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+	}
+
+	return &profileServer{
+		register:      kitgrpc.NewServer(endpoints.RegisterProfile, decodeRegisterRequest, encodeProfileResponse, options...),
+		login:         kitgrpc.NewServer(endpoints.Login, decodeLoginRequest, encodeLoginResponse, options...),
+		validateToken: kitgrpc.NewServer(endpoints.ValidateToken, decodeValidateTokenRequest, encodeValidateTokenResponse, options...),
+		get:           kitgrpc.NewServer(endpoints.GetProfile, decodeGetRequest, encodeProfileResponse, options...),
+		update:        kitgrpc.NewServer(endpoints.UpdateProfile, decodeUpdateRequest, encodeProfileResponse, options...),
+		delete:        kitgrpc.NewServer(endpoints.DeleteProfile, decodeDeleteRequest, encodeDeleteResponse, options...),
+	}
+}
+
+func (s *profileServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.Profile, error) {
+	_, resp, err := s.register.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return resp.(*pb.Profile), nil
+}
+
+func (s *profileServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginResponse, error) {
+	_, resp, err := s.login.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return resp.(*pb.LoginResponse), nil
+}
+
+func (s *profileServer) ValidateToken(ctx context.Context, req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+	_, resp, err := s.validateToken.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return resp.(*pb.ValidateTokenResponse), nil
+}
+
+func (s *profileServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.Profile, error) {
+	_, resp, err := s.get.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return resp.(*pb.Profile), nil
+}
+
+func (s *profileServer) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.Profile, error) {
+	_, resp, err := s.update.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return resp.(*pb.Profile), nil
+}
+
+func (s *profileServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	_, resp, err := s.delete.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return resp.(*pb.DeleteResponse), nil
+}
+
+// encodeError maps service errors to gRPC status codes. Unknown errors are
+// reported as Internal without the underlying message.
+func encodeError(err error) error {
+	switch {
+	case errors.Is(err, service.ErrInvalidInput):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, service.ErrInvalidCredentials), errors.Is(err, service.ErrInvalidToken),
+		errors.Is(err, service.ErrUnauthenticated), errors.Is(err, endpoint.ErrMissingAuthorization),
+		errors.Is(err, endpoint.ErrInvalidAuthorization):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, service.ErrRegistrationDisabled), errors.Is(err, service.ErrInvalidInvitation),
+		errors.Is(err, service.ErrAccountLocked), errors.Is(err, service.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, service.ErrProfileNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Internal, "an unexpected error occurred")
+	}
+}
+
+// requestIDFromMetadata puts the x-request-id of the call, or a new ID, on the
+// context and sends it back in the response header
+func requestIDFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	var id string
+	if values := md.Get(requestid.Header); len(values) > 0 {
+		id = values[0]
+	}
+	id = requestid.Sanitize(id)
+	grpc.SetHeader(ctx, metadata.Pairs(requestid.Header, id))
+	return requestid.NewContext(ctx, id)
+}
+
+// clientInfoFromMetadata puts the user agent and peer address of the call on
+// the context for the sessions created by Login
+func clientInfoFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	var client model.ClientInfo
+	if values := md.Get("user-agent"); len(values) > 0 {
+		client.UserAgent = values[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		client.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(client.IP); err == nil {
+			client.IP = host
+		}
+	}
+	return service.NewContextWithClient(ctx, client)
+}
+
+// authorizationFromMetadata puts the authorization metadata of the call on
+// the context for endpoint.AuthenticationMiddleware
+func authorizationFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if values := md.Get("authorization"); len(values) > 0 {
+		return endpoint.NewContextWithAuthorization(ctx, values[0])
+	}
+	return ctx
+}
+
+// traceContextFromMetadata continues the trace of the caller from the
+// traceparent metadata
+func traceContextFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// metadataCarrier adapts gRPC metadata to propagation.TextMapCarrier
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func decodeRegisterRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.RegisterRequest)
+	return model.RegisterProfileRequest{
+		Username:  req.Username,
+		Email:     req.Email,
+		Password:  req.Password,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Bio:       req.Bio,
+
+		InvitationCode: req.InvitationCode,
+	}, nil
+}
+
+func decodeLoginRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.LoginRequest)
+	return model.LoginRequest{Username: req.Username, Password: req.Password}, nil
+}
+
+func decodeValidateTokenRequest(ctx context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.ValidateTokenRequest)
+	token := req.Token
+	if token == "" {
+		token = bearerToken(ctx)
+	}
+	return model.TokenValidationRequest{Token: token}, nil
+}
+
+// bearerToken reads the token from "authorization: Bearer <token>" metadata
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		parts := strings.SplitN(value, " ", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+func decodeGetRequest(_ context.Context, request interface{}) (interface{}, error) {
+	return request.(*pb.GetRequest).Id, nil
+}
+
+func decodeUpdateRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.UpdateRequest)
+	return endpoint.UpdateProfileRequest{
+		ID: req.Id,
+		Data: model.UpdateProfileRequest{
+			FirstName: req.FirstName,
+			LastName:  req.LastName,
+			Bio:       req.Bio,
+		},
+	}, nil
+}
+
+func decodeDeleteRequest(_ context.Context, request interface{}) (interface{}, error) {
+	return request.(*pb.DeleteRequest).Id, nil
+}
+
+func encodeProfileResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return toPBProfile(response.(*model.Profile)), nil
+}
+
+func encodeLoginResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(*model.LoginResponse)
+	return &pb.LoginResponse{Profile: toPBProfile(resp.Profile), Token: resp.Token}, nil
+}
+
+func encodeValidateTokenResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(model.TokenValidationResponse)
+	out := &pb.ValidateTokenResponse{Valid: resp.Valid}
+	if resp.Claims != nil {
+		out.Claims = &pb.TokenClaims{
+			UserId:    resp.Claims.UserID,
+			Username:  resp.Claims.Username,
+			IssuedAt:  timestamppb.New(resp.Claims.IssuedAt),
+			ExpiresAt: timestamppb.New(resp.Claims.ExpiresAt),
+			Role:      resp.Claims.Role,
+			SessionId: resp.Claims.SessionID,
+			Locale:    resp.Claims.Locale,
+			Timezone:  resp.Claims.Timezone,
+		}
+		if actor := resp.Claims.Actor; actor != nil {
+			out.Claims.ImpersonatorId = actor.UserID
+			out.Claims.ImpersonatorUsername = actor.Username
+		}
+	}
+	return out, nil
+}
+
+func encodeDeleteResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return &pb.DeleteResponse{}, nil
+}
+
+func toPBProfile(profile *model.Profile) *pb.Profile {
+	if profile == nil {
+		return nil
+	}
+	return &pb.Profile{
+		Id:        profile.ID,
+		Username:  profile.Username,
+		Email:     profile.Email,
+		FirstName: profile.FirstName,
+		LastName:  profile.LastName,
+		Bio:       profile.Bio,
+		CreatedAt: timestamppb.New(profile.CreatedAt),
+		UpdatedAt: timestamppb.New(profile.UpdatedAt),
+		Role:      profile.Role,
+	}
+}
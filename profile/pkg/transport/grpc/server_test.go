@@ -0,0 +1,586 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/service"
+	"github.com/ganis/okblog/profile/pkg/transport/grpc/pb"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// MockService is a mock implementation of service.Service
+type MockService struct {
+	mock.Mock
+}
+
+func (m *MockService) RegisterProfile(ctx context.Context, req model.RegisterProfileRequest) (*model.Profile, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) Login(ctx context.Context, req model.LoginRequest) (*model.LoginResponse, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.LoginResponse), args.Error(1)
+}
+
+func (m *MockService) RequestMagicLink(ctx context.Context, req model.MagicLinkRequest) error {
+	args := m.Called(ctx, req)
+	return args.Error(0)
+}
+
+func (m *MockService) RedeemMagicLink(ctx context.Context, req model.RedeemMagicLinkRequest) (*model.LoginResponse, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.LoginResponse), args.Error(1)
+}
+
+func (m *MockService) GetProfile(ctx context.Context, id string) (*model.Profile, error) {
+	args := m.Called(ctx, id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) UpdateProfile(ctx context.Context, id string, req model.UpdateProfileRequest) (*model.Profile, error) {
+	args := m.Called(ctx, id, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) DeleteProfile(ctx context.Context, id string) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockService) ValidateToken(ctx context.Context, token string) (*model.TokenClaims, error) {
+	args := m.Called(ctx, token)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.TokenClaims), args.Error(1)
+}
+
+func (m *MockService) CreateInvitation(ctx context.Context, req model.CreateInvitationRequest) (*model.Invitation, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Invitation), args.Error(1)
+}
+
+func (m *MockService) ListInvitations(ctx context.Context) ([]model.Invitation, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Invitation), args.Error(1)
+}
+
+func (m *MockService) RevokeInvitation(ctx context.Context, id string) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockService) ListSessions(ctx context.Context, profileID string) ([]model.Session, error) {
+	args := m.Called(ctx, profileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Session), args.Error(1)
+}
+
+func (m *MockService) RevokeSession(ctx context.Context, profileID, sessionID string) error {
+	args := m.Called(ctx, profileID, sessionID)
+	return args.Error(0)
+}
+
+func (m *MockService) RevokeOtherSessions(ctx context.Context, profileID string) (int, error) {
+	args := m.Called(ctx, profileID)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) GetPreferences(ctx context.Context, profileID string) (*model.Preferences, error) {
+	args := m.Called(ctx, profileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Preferences), args.Error(1)
+}
+
+func (m *MockService) UpdatePreferences(ctx context.Context, profileID string, req model.PreferencesUpdate) (*model.Preferences, error) {
+	args := m.Called(ctx, profileID, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Preferences), args.Error(1)
+}
+
+func (m *MockService) CreateProfile(ctx context.Context, req model.CreateProfileRequest) (*model.Profile, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) ResetPassword(ctx context.Context, id, password string) error {
+	args := m.Called(ctx, id, password)
+	return args.Error(0)
+}
+
+func (m *MockService) SetRole(ctx context.Context, id, role string) (*model.Profile, error) {
+	args := m.Called(ctx, id, role)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) LockProfile(ctx context.Context, id string) (*model.Profile, error) {
+	args := m.Called(ctx, id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) UnlockProfile(ctx context.Context, id string) (*model.Profile, error) {
+	args := m.Called(ctx, id)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Profile), args.Error(1)
+}
+
+func (m *MockService) Impersonate(ctx context.Context, profileID string) (*model.ImpersonationResponse, error) {
+	args := m.Called(ctx, profileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.ImpersonationResponse), args.Error(1)
+}
+
+func (m *MockService) ListAuditEvents(ctx context.Context, filter model.AuditEventFilter) ([]model.AuditEvent, error) {
+	args := m.Called(ctx, filter)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.AuditEvent), args.Error(1)
+}
+
+func (m *MockService) Subscribe(ctx context.Context, req model.SubscribeRequest) error {
+	args := m.Called(ctx, req)
+	return args.Error(0)
+}
+
+func (m *MockService) ConfirmSubscription(ctx context.Context, req model.SubscriptionTokenRequest) error {
+	args := m.Called(ctx, req)
+	return args.Error(0)
+}
+
+func (m *MockService) Unsubscribe(ctx context.Context, req model.SubscriptionTokenRequest) error {
+	args := m.Called(ctx, req)
+	return args.Error(0)
+}
+
+func (m *MockService) ListSubscribers(ctx context.Context) ([]model.Subscriber, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Subscriber), args.Error(1)
+}
+
+func (m *MockService) QueueNewsletterPost(ctx context.Context, post model.NewsletterPost) error {
+	args := m.Called(ctx, post)
+	return args.Error(0)
+}
+
+func (m *MockService) SendNewsletterDigest(ctx context.Context) (int, error) {
+	args := m.Called(ctx)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) RecordAuthorPost(ctx context.Context, post model.AuthorPost) error {
+	args := m.Called(ctx, post)
+	return args.Error(0)
+}
+
+func (m *MockService) GetAuthorStats(ctx context.Context, profileID string) (*model.AuthorStats, error) {
+	args := m.Called(ctx, profileID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.AuthorStats), args.Error(1)
+}
+
+func (m *MockService) CreateWebhook(ctx context.Context, req model.CreateWebhookRequest) (*model.Webhook, error) {
+	args := m.Called(ctx, req)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*model.Webhook), args.Error(1)
+}
+
+func (m *MockService) ListWebhooks(ctx context.Context) ([]model.Webhook, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.Webhook), args.Error(1)
+}
+
+func (m *MockService) DeleteWebhook(ctx context.Context, id string) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockService) ListWebhookDeliveries(ctx context.Context, webhookID string) ([]model.WebhookDelivery, error) {
+	args := m.Called(ctx, webhookID)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]model.WebhookDelivery), args.Error(1)
+}
+
+func (m *MockService) DeliverWebhooks(ctx context.Context) (int, error) {
+	args := m.Called(ctx)
+	return args.Int(0), args.Error(1)
+}
+
+func setupMockServer(t *testing.T) (*MockService, *grpc.ClientConn) {
+	mockSvc := new(MockService)
+	server := NewServer(mockSvc, log.NewNopLogger())
+
+	listener := bufconn.Listen(1024 * 1024)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return mockSvc, conn
+}
+
+func TestRegister(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	req := model.RegisterProfileRequest{
+		Username:  "testuser",
+		Email:     "test@example.com",
+		Password:  "password123",
+		FirstName: "Test",
+		LastName:  "User",
+		Bio:       "This is a test user",
+
+		InvitationCode: "the-code",
+	}
+	now := time.Now().UTC()
+	expectedProfile := &model.Profile{
+		ID:        uuid.New().String(),
+		Username:  req.Username,
+		Email:     req.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Bio:       req.Bio,
+		Role:      model.RoleUser,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	mockSvc.On("RegisterProfile", mock.Anything, req).Return(expectedProfile, nil)
+
+	// Call the RPC
+	profile, err := client.Register(context.Background(), &pb.RegisterRequest{
+		Username:  req.Username,
+		Email:     req.Email,
+		Password:  req.Password,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Bio:       req.Bio,
+
+		InvitationCode: req.InvitationCode,
+	})
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, expectedProfile.ID, profile.Id)
+	assert.Equal(t, expectedProfile.Username, profile.Username)
+	assert.Equal(t, model.RoleUser, profile.Role)
+	assert.True(t, now.Equal(profile.CreatedAt.AsTime()))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestLogin_InvalidCredentials(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	req := model.LoginRequest{Username: "testuser", Password: "wrongpassword"}
+	mockSvc.On("Login", mock.Anything, req).Return(nil, service.ErrInvalidCredentials)
+
+	// Call the RPC
+	_, err := client.Login(context.Background(), &pb.LoginRequest{Username: req.Username, Password: req.Password})
+
+	// Assertions
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestValidateToken_FromMetadata(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	now := time.Now().UTC()
+	claims := &model.TokenClaims{
+		UserID:    "1234567890",
+		Username:  "testuser",
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	mockSvc.On("ValidateToken", mock.Anything, "some.jwt.token").Return(claims, nil)
+
+	// Call the RPC with the token in the metadata instead of the request
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer some.jwt.token")
+	resp, err := client.ValidateToken(ctx, &pb.ValidateTokenRequest{})
+
+	// Assertions
+	require.NoError(t, err)
+	assert.True(t, resp.Valid)
+	assert.Equal(t, claims.UserID, resp.Claims.UserId)
+	assert.Equal(t, claims.Username, resp.Claims.Username)
+	mockSvc.AssertExpectations(t)
+}
+
+func TestValidateToken_Impersonation(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	now := time.Now().UTC()
+	claims := &model.TokenClaims{
+		UserID:    "1234567890",
+		Username:  "testuser",
+		SessionID: "session-id",
+		IssuedAt:  now,
+		ExpiresAt: now.Add(15 * time.Minute),
+		Actor:     &model.Actor{UserID: "admin-id", Username: "admin"},
+	}
+	mockSvc.On("ValidateToken", mock.Anything, "impersonation.jwt.token").Return(claims, nil)
+
+	// Call the RPC
+	resp, err := client.ValidateToken(context.Background(), &pb.ValidateTokenRequest{Token: "impersonation.jwt.token"})
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, claims.UserID, resp.Claims.UserId)
+	assert.Equal(t, "admin-id", resp.Claims.ImpersonatorId)
+	assert.Equal(t, "admin", resp.Claims.ImpersonatorUsername)
+	mockSvc.AssertExpectations(t)
+}
+
+func TestValidateToken_Preferences(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	now := time.Now().UTC()
+	claims := &model.TokenClaims{
+		UserID:    "1234567890",
+		Username:  "testuser",
+		IssuedAt:  now,
+		ExpiresAt: now.Add(time.Hour),
+		Locale:    "pt-BR",
+		Timezone:  "America/Sao_Paulo",
+	}
+	mockSvc.On("ValidateToken", mock.Anything, "valid.jwt.token").Return(claims, nil)
+
+	resp, err := client.ValidateToken(context.Background(), &pb.ValidateTokenRequest{Token: "valid.jwt.token"})
+
+	require.NoError(t, err)
+	assert.Equal(t, "pt-BR", resp.Claims.Locale)
+	assert.Equal(t, "America/Sao_Paulo", resp.Claims.Timezone)
+	mockSvc.AssertExpectations(t)
+}
+
+func TestValidateToken_Invalid(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	mockSvc.On("ValidateToken", mock.Anything, "invalid.token.format").Return(nil, service.ErrInvalidToken)
+
+	// Call the RPC
+	_, err := client.ValidateToken(context.Background(), &pb.ValidateTokenRequest{Token: "invalid.token.format"})
+
+	// Assertions
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestGet_NotFound(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	id := uuid.New().String()
+	mockSvc.On("GetProfile", mock.Anything, id).Return(nil, service.ErrProfileNotFound)
+
+	// Call the RPC
+	_, err := client.Get(context.Background(), &pb.GetRequest{Id: id})
+
+	// Assertions
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	mockSvc.AssertExpectations(t)
+}
+
+// withToken expects the given bearer token of profileID and returns the
+// outgoing context sending it along with a matcher for contexts carrying its
+// claims
+func withToken(mockSvc *MockService, token, profileID string) (context.Context, interface{}) {
+	claims := &model.TokenClaims{UserID: profileID, Username: "testuser", Role: model.RoleUser}
+	mockSvc.On("ValidateToken", mock.Anything, token).Return(claims, nil)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	return ctx, mock.MatchedBy(func(ctx context.Context) bool {
+		return service.ClaimsFromContext(ctx) == claims
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	id := uuid.New().String()
+	ctx, authenticated := withToken(mockSvc, "owner.jwt.token", id)
+	updateReq := model.UpdateProfileRequest{FirstName: "Updated", LastName: "Name", Bio: "Updated bio"}
+	expectedProfile := &model.Profile{ID: id, Username: "testuser", FirstName: "Updated", LastName: "Name", Bio: "Updated bio"}
+	mockSvc.On("UpdateProfile", authenticated, id, updateReq).Return(expectedProfile, nil)
+
+	// Call the RPC
+	profile, err := client.Update(ctx, &pb.UpdateRequest{Id: id, FirstName: "Updated", LastName: "Name", Bio: "Updated bio"})
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, "Updated", profile.FirstName)
+	mockSvc.AssertExpectations(t)
+}
+
+func TestUpdate_Unauthenticated(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	id := uuid.New().String()
+	mockSvc.On("ValidateToken", mock.Anything, "expired.jwt.token").Return(nil, service.ErrInvalidToken)
+
+	// Neither a missing nor an invalid token reaches the service
+	_, err := client.Update(context.Background(), &pb.UpdateRequest{Id: id, Bio: "Hacked"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic dXNlcjpwYXNz")
+	_, err = client.Delete(ctx, &pb.DeleteRequest{Id: id})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer expired.jwt.token")
+	_, err = client.Delete(ctx, &pb.DeleteRequest{Id: id})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestDelete_OtherProfile(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	id := uuid.New().String()
+	ctx, authenticated := withToken(mockSvc, "other.jwt.token", uuid.New().String())
+	mockSvc.On("DeleteProfile", authenticated, id).Return(service.ErrForbidden)
+
+	_, err := client.Delete(ctx, &pb.DeleteRequest{Id: id})
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestDelete_InternalErrorIsHidden(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	id := uuid.New().String()
+	ctx, authenticated := withToken(mockSvc, "owner.jwt.token", id)
+	mockSvc.On("DeleteProfile", authenticated, id).Return(assert.AnError)
+
+	// Call the RPC
+	_, err := client.Delete(ctx, &pb.DeleteRequest{Id: id})
+
+	// Assertions
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, err.Error(), assert.AnError.Error())
+	mockSvc.AssertExpectations(t)
+}
+
+func TestRequestID(t *testing.T) {
+	mockSvc, conn := setupMockServer(t)
+	client := pb.NewProfileServiceClient(conn)
+
+	// Setup mock service
+	id := uuid.New().String()
+	mockSvc.On("GetProfile", mock.MatchedBy(func(ctx context.Context) bool {
+		return requestid.FromContext(ctx) == "trace-42"
+	}), id).Return(&model.Profile{ID: id}, nil)
+
+	// Call the RPC
+	var header metadata.MD
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "trace-42")
+	_, err := client.Get(ctx, &pb.GetRequest{Id: id}, grpc.Header(&header))
+
+	// Assertions
+	require.NoError(t, err)
+	assert.Equal(t, []string{"trace-42"}, header.Get("x-request-id"))
+	mockSvc.AssertExpectations(t)
+}
+
+func TestHealthCheck(t *testing.T) {
+	_, conn := setupMockServer(t)
+	client := healthpb.NewHealthClient(conn)
+
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: pb.ProfileService_ServiceDesc.ServiceName})
+
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
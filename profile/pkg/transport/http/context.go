@@ -0,0 +1,188 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/endpoint"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/service"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// Route names, used to configure per-route timeouts
+const (
+	RouteRegister        = "register"
+	RouteLogin           = "login"
+	RouteMagicLink       = "magic-link"
+	RouteRedeemMagicLink = "redeem-magic-link"
+	RouteValidateToken   = "validate-token"
+	RouteGetProfile      = "get-profile"
+	RouteUpdateProfile   = "update-profile"
+	RouteDeleteProfile   = "delete-profile"
+
+	RouteCreateInvitation = "create-invitation"
+	RouteListInvitations  = "list-invitations"
+	RouteRevokeInvitation = "revoke-invitation"
+
+	RouteCreateWebhook         = "create-webhook"
+	RouteListWebhooks          = "list-webhooks"
+	RouteDeleteWebhook         = "delete-webhook"
+	RouteListWebhookDeliveries = "list-webhook-deliveries"
+
+	RouteListSessions        = "list-sessions"
+	RouteRevokeSession       = "revoke-session"
+	RouteRevokeOtherSessions = "revoke-other-sessions"
+
+	RouteGetPreferences    = "get-preferences"
+	RouteUpdatePreferences = "update-preferences"
+
+	RouteSubscribe           = "subscribe"
+	RouteConfirmSubscription = "confirm-subscription"
+	RouteUnsubscribe         = "unsubscribe"
+	RouteExportSubscribers   = "export-subscribers"
+
+	RouteGetAuthorStats = "get-author-stats"
+
+	RouteImpersonate     = "impersonate"
+	RouteListAuditEvents = "list-audit-events"
+)
+
+// DefaultRouteTimeout applies to routes without an entry in the timeouts map
+const DefaultRouteTimeout = 5 * time.Second
+
+// DefaultRouteTimeouts returns the deadlines of the routes that need more
+// than DefaultRouteTimeout. Register and login hash passwords, which is
+// deliberately slow, and subscriptions wait for the mail to be sent. Magic
+// links are sent after the response, so their route has the default.
+func DefaultRouteTimeouts() map[string]time.Duration {
+	return map[string]time.Duration{
+		RouteRegister:  10 * time.Second,
+		RouteLogin:     10 * time.Second,
+		RouteSubscribe: 10 * time.Second,
+	}
+}
+
+// RequestIDMiddleware puts the request ID on the request context and echoes it
+// in the response. A valid X-Request-ID from the client is kept, otherwise a
+// new ID is generated.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestid.Sanitize(r.Header.Get(requestid.Header))
+
+		// Keep the header in sync for go-kit's PopulateRequestContext
+		r.Header.Set(requestid.Header, id)
+		w.Header().Set(requestid.Header, id)
+
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
+}
+
+// unmatchedRoute labels requests that don't match any route, so scanners
+// can't create a time series per path
+const unmatchedRoute = "unmatched"
+
+type routeContextKey struct{}
+
+// RouteMiddleware matches the request against router once and puts the
+// template of the route on the context, for the tracing and instrumenting
+// middlewares to read with routeFromContext
+func RouteMiddleware(router *mux.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := unmatchedRoute
+			var match mux.RouteMatch
+			if router.Match(r, &match) && match.Route != nil {
+				if template, err := match.Route.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeContextKey{}, route)))
+		})
+	}
+}
+
+// routeFromContext returns the route template put on ctx by RouteMiddleware
+func routeFromContext(ctx context.Context) string {
+	if route, ok := ctx.Value(routeContextKey{}).(string); ok {
+		return route
+	}
+	return unmatchedRoute
+}
+
+// timeoutHandler bounds the request context of next by d. The handler keeps
+// running after the deadline; the context makes database calls give up.
+func timeoutHandler(d time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// PopulateClientInfo returns a kithttp.RequestFunc that puts the user agent
+// and address of the client on the context for service.ClientFromContext.
+// X-Real-IP and X-Forwarded-For are only read on requests from one of the
+// trusted proxies, since anyone else can set them.
+func PopulateClientInfo(trusted []netip.Prefix) kithttp.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		return service.NewContextWithClient(ctx, model.ClientInfo{
+			UserAgent: r.UserAgent(),
+			IP:        clientIP(r, trusted),
+		})
+	}
+}
+
+// clientIP returns the address of the client of a request. Behind a trusted
+// proxy that's X-Real-IP, or else the last X-Forwarded-For entry not added
+// by a trusted proxy; the entries before it may be made up by the client.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return ip.Unmap().String()
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if ip = ip.Unmap(); !isTrustedProxy(ip.String(), trusted) || i == 0 {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// isTrustedProxy reports whether addr is in one of the trusted prefixes
+func isTrustedProxy(addr string, trusted []netip.Prefix) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PopulateAuthorization is a kithttp.RequestFunc that puts the Authorization
+// header on the context for endpoint.AuthenticationMiddleware
+func PopulateAuthorization(ctx context.Context, r *http.Request) context.Context {
+	return endpoint.NewContextWithAuthorization(ctx, r.Header.Get("Authorization"))
+}
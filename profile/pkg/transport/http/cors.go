@@ -0,0 +1,129 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/requestid"
+)
+
+// CORSConfig is the cross-origin policy of the HTTP server. CORS is off while
+// AllowedOrigins is empty, which is right behind the nginx gateway: it
+// answers preflight requests and adds the headers itself.
+type CORSConfig struct {
+	// AllowedOrigins are exact origins like https://admin.okblog.dev, or "*"
+	// for any origin
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read
+	ExposedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response
+	MaxAge time.Duration
+}
+
+// DefaultCORSConfig returns the methods and headers the API uses, with no
+// allowed origins
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type", requestid.Header},
+		ExposedHeaders: []string{requestid.Header},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// WithCORS answers preflight requests and adds CORS headers to the responses
+// for the allowed origins
+func WithCORS(cfg CORSConfig) ServerOption {
+	return func(s *Server) {
+		s.cors = cfg
+	}
+}
+
+// CORSMiddleware applies cfg to every request with an Origin header.
+// Preflight requests are answered here and never reach next; a disallowed
+// origin, method or header gets a 204 without CORS headers, which the browser
+// reports as a failed preflight.
+func CORSMiddleware(cfg CORSConfig) func(http.Handler) http.Handler {
+	anyOrigin := false
+	origins := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		origins[strings.ToLower(origin)] = true
+	}
+	methods := make(map[string]bool, len(cfg.AllowedMethods))
+	for _, method := range cfg.AllowedMethods {
+		methods[strings.ToUpper(method)] = true
+	}
+	headers := make(map[string]bool, len(cfg.AllowedHeaders))
+	for _, header := range cfg.AllowedHeaders {
+		headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	allowedHeaders := func(requested string) bool {
+		for _, header := range strings.Split(requested, ",") {
+			if header = strings.TrimSpace(header); header != "" && !headers[http.CanonicalHeaderKey(header)] {
+				return false
+			}
+		}
+		return true
+	}
+	allowOrigin := func(h http.Header, origin string) {
+		// A wildcard can't be combined with credentials, so the origin is
+		// echoed whenever credentials are allowed
+		if anyOrigin && !cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			allowed := anyOrigin || origins[strings.ToLower(origin)]
+			h := w.Header()
+
+			requestMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method == http.MethodOptions && requestMethod != "" {
+				h.Add("Vary", "Origin")
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				if allowed && methods[strings.ToUpper(requestMethod)] && allowedHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+					allowOrigin(h, origin)
+					h.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+					if len(cfg.AllowedHeaders) > 0 {
+						h.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+					}
+					if cfg.MaxAge > 0 {
+						h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+					}
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			h.Add("Vary", "Origin")
+			if allowed {
+				allowOrigin(h, origin)
+				if len(cfg.ExposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,228 +1,244 @@
 package http
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"strings"
-	"time"
+	"sort"
+	"strconv"
 
+	"github.com/ganis/okblog/profile/pkg/endpoint"
 	"github.com/ganis/okblog/profile/pkg/model"
 	"github.com/ganis/okblog/profile/pkg/service"
-	"github.com/go-kit/kit/endpoint"
-	"github.com/go-kit/log"
-	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/gorilla/mux"
 )
 
-type Endpoints struct {
-	RegisterProfile endpoint.Endpoint
-	Login           endpoint.Endpoint
-	ValidateToken   endpoint.Endpoint
-	GetProfile      endpoint.Endpoint
-	UpdateProfile   endpoint.Endpoint
-	DeleteProfile   endpoint.Endpoint
-}
-
-// EndpointLoggingMiddleware returns an endpoint middleware that logs endpoint performance
-func EndpointLoggingMiddleware(logger log.Logger) endpoint.Middleware {
-	return func(next endpoint.Endpoint) endpoint.Endpoint {
-		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-			defer func(begin time.Time) {
-				logger.Log(
-					"endpoint_time", time.Since(begin),
-					"err", err,
-				)
-			}(time.Now())
-			return next(ctx, request)
-		}
+func DecodeRegisterProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.RegisterProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	return req, nil
 }
 
-func MakeEndpoints(svc service.Service, logger log.Logger) Endpoints {
-	// Create a middleware for all endpoints
-	loggingMiddleware := EndpointLoggingMiddleware(logger)
-
-	return Endpoints{
-		RegisterProfile: loggingMiddleware(makeRegisterProfileEndpoint(svc)),
-		Login:           loggingMiddleware(makeLoginEndpoint(svc)),
-		ValidateToken:   loggingMiddleware(makeValidateTokenEndpoint(svc)),
-		GetProfile:      loggingMiddleware(makeGetProfileEndpoint(svc)),
-		UpdateProfile:   loggingMiddleware(makeUpdateProfileEndpoint(svc)),
-		DeleteProfile:   loggingMiddleware(makeDeleteProfileEndpoint(svc)),
+func DecodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	return req, nil
 }
 
-func makeRegisterProfileEndpoint(svc service.Service) endpoint.Endpoint {
-	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		txn := newrelic.FromContext(ctx)
-		var segment *newrelic.Segment
-		if txn != nil {
-			segment = txn.StartSegment("RegisterProfile")
-			defer segment.End()
-		}
-
-		req := request.(model.RegisterProfileRequest)
-		profile, err := svc.RegisterProfile(ctx, req)
-		if err != nil {
-			return nil, err
-		}
-		return profile, nil
+func DecodeRequestMagicLinkRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.MagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	return req, nil
 }
 
-func makeLoginEndpoint(svc service.Service) endpoint.Endpoint {
-	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		txn := newrelic.FromContext(ctx)
-		var segment *newrelic.Segment
-		if txn != nil {
-			segment = txn.StartSegment("Login")
-			defer segment.End()
-		}
-
-		req := request.(model.LoginRequest)
-		loginResponse, err := svc.Login(ctx, req)
-		if err != nil {
-			return nil, err
-		}
-		return loginResponse, nil
+func DecodeRedeemMagicLinkRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.RedeemMagicLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	return req, nil
 }
 
-func makeValidateTokenEndpoint(svc service.Service) endpoint.Endpoint {
-	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		txn := newrelic.FromContext(ctx)
-		var segment *newrelic.Segment
-		if txn != nil {
-			segment = txn.StartSegment("ValidateToken")
-			defer segment.End()
-		}
-
-		req := request.(model.TokenValidationRequest)
-		claims, err := svc.ValidateToken(ctx, req.Token)
-		if err != nil {
-			if err == service.ErrInvalidToken {
-				return nil, errors.New("unauthorized: invalid token")
-			}
-			return nil, err
-		}
-		return model.TokenValidationResponse{Valid: true, Claims: claims}, nil
+func DecodeValidateTokenRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	token, err := endpoint.BearerToken(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
 	}
+	return model.TokenValidationRequest{Token: token}, nil
 }
 
-func makeGetProfileEndpoint(svc service.Service) endpoint.Endpoint {
-	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		txn := newrelic.FromContext(ctx)
-		var segment *newrelic.Segment
-		if txn != nil {
-			segment = txn.StartSegment("GetProfile")
-			defer segment.End()
-		}
-
-		id := request.(string)
-		profile, err := svc.GetProfile(ctx, id)
-		if err != nil {
-			return nil, err
-		}
-		return profile, nil
-	}
+func DecodeGetProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
 }
 
-func makeUpdateProfileEndpoint(svc service.Service) endpoint.Endpoint {
-	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		txn := newrelic.FromContext(ctx)
-		var segment *newrelic.Segment
-		if txn != nil {
-			segment = txn.StartSegment("UpdateProfile")
-			defer segment.End()
-		}
+func DecodeGetAuthorStatsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
 
-		req := request.(struct {
-			ID   string                     `json:"id"`
-			Data model.UpdateProfileRequest `json:"data"`
-		})
-		profile, err := svc.UpdateProfile(ctx, req.ID, req.Data)
-		if err != nil {
-			return nil, err
-		}
-		return profile, nil
+func DecodeUpdateProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req endpoint.UpdateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	return req, nil
 }
 
-func makeDeleteProfileEndpoint(svc service.Service) endpoint.Endpoint {
-	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		txn := newrelic.FromContext(ctx)
-		var segment *newrelic.Segment
-		if txn != nil {
-			segment = txn.StartSegment("DeleteProfile")
-			defer segment.End()
-		}
-
-		id := request.(string)
-		err := svc.DeleteProfile(ctx, id)
-		if err != nil {
-			return nil, err
-		}
-		return nil, nil
-	}
+func DecodeDeleteProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
 }
 
-func DecodeRegisterProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	var req model.RegisterProfileRequest
+func DecodeCreateInvitationRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.CreateInvitationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
 	return req, nil
 }
 
-func DecodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	var req model.LoginRequest
+func DecodeListInvitationsRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func DecodeRevokeInvitationRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
+
+func DecodeCreateWebhookRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.CreateWebhookRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
 	return req, nil
 }
 
-func DecodeValidateTokenRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return nil, errors.New("missing Authorization header")
-	}
+func DecodeListWebhooksRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func DecodeDeleteWebhookRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
+
+func DecodeListWebhookDeliveriesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
+
+func DecodeListSessionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
 
-	// Check if the header has the Bearer prefix
-	tokenParts := strings.Split(authHeader, " ")
-	if len(tokenParts) != 2 || strings.ToLower(tokenParts[0]) != "bearer" {
-		return nil, errors.New("invalid Authorization header format, expected 'Bearer token'")
+func DecodeRevokeSessionRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return endpoint.RevokeSessionRequest{ProfileID: vars["id"], SessionID: vars["sessionId"]}, nil
+}
+
+func DecodeRevokeOtherSessionsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
+
+func DecodeGetPreferencesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
+}
+
+// DecodeUpdatePreferencesRequest rejects unknown fields, which the schema
+// doesn't allow and would otherwise be dropped without a word. A field set to
+// null is unset.
+func DecodeUpdatePreferencesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := endpoint.UpdatePreferencesRequest{ProfileID: mux.Vars(r)["id"]}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	req.Unset, err = nullFields(body, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+	}
+	return req, nil
+}
 
-	token := tokenParts[1]
-	if token == "" {
-		return nil, errors.New("empty token in Authorization header")
+// nullFields returns the paths of the fields of the JSON object doc that are
+// null, looking into the objects it holds. The paths are sorted.
+func nullFields(doc []byte, prefix string) ([]string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return nil, err
 	}
+	var paths []string
+	for name, value := range fields {
+		value = bytes.TrimSpace(value)
+		switch {
+		case string(value) == "null":
+			paths = append(paths, prefix+name)
+		case len(value) > 0 && value[0] == '{':
+			nested, err := nullFields(value, prefix+name+".")
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, nested...)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
 
-	return model.TokenValidationRequest{Token: token}, nil
+func DecodeImpersonateRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return mux.Vars(r)["id"], nil
 }
 
-func DecodeGetProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return r.URL.Query().Get("id"), nil
+func DecodeListAuditEventsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	filter := model.AuditEventFilter{ProfileID: query.Get("profile"), ActorID: query.Get("actor")}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%w: limit must be a positive integer", ErrMalformedRequest)
+		}
+		filter.Limit = n
+	}
+	return filter, nil
 }
 
-func DecodeUpdateProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	var req struct {
-		ID   string                     `json:"id"`
-		Data model.UpdateProfileRequest `json:"data"`
+func DecodeSubscribeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.SubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
+	return req, nil
+}
+
+func DecodeSubscriptionTokenRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	var req model.SubscriptionTokenRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrMalformedRequest, err)
 	}
 	return req, nil
 }
 
-func DecodeDeleteProfileRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return r.URL.Query().Get("id"), nil
+func DecodeExportSubscribersRequest(_ context.Context, _ *http.Request) (interface{}, error) {
+	return nil, nil
 }
 
 func EncodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	return json.NewEncoder(w).Encode(response)
 }
+
+// EncodeNoContentResponse is used by endpoints that have nothing to return
+func EncodeNoContentResponse(_ context.Context, w http.ResponseWriter, _ interface{}) error {
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// EncodeCreatedResponse is used by endpoints that create a resource
+func EncodeCreatedResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(response)
+}
+
+// EncodeAcceptedResponse is used by endpoints whose work completes out of band
+func EncodeAcceptedResponse(_ context.Context, w http.ResponseWriter, _ interface{}) error {
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// EncodeSubscribersCSV writes the subscriber export as a CSV attachment
+func EncodeSubscribersCSV(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="subscribers.csv"`)
+	return service.WriteSubscribersCSV(w, response.([]model.Subscriber))
+}
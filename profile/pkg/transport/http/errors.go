@@ -0,0 +1,163 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ganis/okblog/profile/pkg/endpoint"
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/service"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// ProblemContentType is the media type used for error responses (RFC 7807)
+const ProblemContentType = "application/problem+json"
+
+// Stable problem type identifiers. Clients should switch on these rather than
+// on the human readable title or detail.
+const (
+	ProblemTypeInvalidInput         = "urn:okblog:profile:invalid-input"
+	ProblemTypeMalformedRequest     = "urn:okblog:profile:malformed-request"
+	ProblemTypeInvalidCredentials   = "urn:okblog:profile:invalid-credentials"
+	ProblemTypeInvalidToken         = "urn:okblog:profile:invalid-token"
+	ProblemTypeInvalidMagicLink     = "urn:okblog:profile:invalid-magic-link"
+	ProblemTypeMagicLinksDisabled   = "urn:okblog:profile:magic-links-disabled"
+	ProblemTypeMissingAuthorization = "urn:okblog:profile:missing-authorization"
+	ProblemTypeInvalidAuthorization = "urn:okblog:profile:invalid-authorization"
+	ProblemTypeUnauthenticated      = "urn:okblog:profile:unauthenticated"
+	ProblemTypeRegistrationDisabled = "urn:okblog:profile:registration-disabled"
+	ProblemTypeInvalidInvitation    = "urn:okblog:profile:invalid-invitation"
+	ProblemTypeInvitationNotFound   = "urn:okblog:profile:invitation-not-found"
+	ProblemTypeForbidden            = "urn:okblog:profile:forbidden"
+	ProblemTypeAccountLocked        = "urn:okblog:profile:account-locked"
+	ProblemTypeSessionNotFound      = "urn:okblog:profile:session-not-found"
+	ProblemTypeProfileNotFound      = "urn:okblog:profile:profile-not-found"
+	ProblemTypeNewsletterDisabled   = "urn:okblog:profile:newsletter-disabled"
+	ProblemTypeInvalidSubscription  = "urn:okblog:profile:invalid-subscription-token"
+	ProblemTypeWebhookNotFound      = "urn:okblog:profile:webhook-not-found"
+	ProblemTypeRouteNotFound        = "urn:okblog:profile:route-not-found"
+	ProblemTypeMethodNotAllowed     = "urn:okblog:profile:method-not-allowed"
+	ProblemTypeTimeout              = "urn:okblog:profile:timeout"
+	ProblemTypeInternal             = "urn:okblog:profile:internal-error"
+)
+
+var (
+	// ErrMalformedRequest is returned when a request body can't be decoded
+	ErrMalformedRequest = errors.New("malformed request body")
+	// errRouteNotFound and errMethodNotAllowed are used by the router fallbacks
+	errRouteNotFound    = errors.New("no route matches the request path")
+	errMethodNotAllowed = errors.New("method not allowed for this route")
+)
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// Errors maps request fields to what is wrong with them
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// problemMapping ties a known error to the problem it is reported as
+type problemMapping struct {
+	err    error
+	typ    string
+	title  string
+	status int
+}
+
+// problemMappings is checked in order with errors.Is, so wrapped errors match too
+var problemMappings = []problemMapping{
+	{service.ErrInvalidInput, ProblemTypeInvalidInput, "Invalid input", http.StatusBadRequest},
+	{ErrMalformedRequest, ProblemTypeMalformedRequest, "Malformed request", http.StatusBadRequest},
+	{service.ErrInvalidCredentials, ProblemTypeInvalidCredentials, "Invalid credentials", http.StatusUnauthorized},
+	{service.ErrInvalidToken, ProblemTypeInvalidToken, "Invalid token", http.StatusUnauthorized},
+	{service.ErrInvalidMagicLink, ProblemTypeInvalidMagicLink, "Invalid magic link", http.StatusUnauthorized},
+	{service.ErrMagicLinksDisabled, ProblemTypeMagicLinksDisabled, "Magic links disabled", http.StatusForbidden},
+	{endpoint.ErrMissingAuthorization, ProblemTypeMissingAuthorization, "Missing authorization", http.StatusUnauthorized},
+	{endpoint.ErrInvalidAuthorization, ProblemTypeInvalidAuthorization, "Invalid authorization", http.StatusUnauthorized},
+	{service.ErrUnauthenticated, ProblemTypeUnauthenticated, "Authentication required", http.StatusUnauthorized},
+	{service.ErrForbidden, ProblemTypeForbidden, "Forbidden", http.StatusForbidden},
+	{service.ErrAccountLocked, ProblemTypeAccountLocked, "Account locked", http.StatusForbidden},
+	{service.ErrRegistrationDisabled, ProblemTypeRegistrationDisabled, "Registration disabled", http.StatusForbidden},
+	{service.ErrInvalidInvitation, ProblemTypeInvalidInvitation, "Invalid invitation", http.StatusForbidden},
+	{service.ErrInvitationNotFound, ProblemTypeInvitationNotFound, "Invitation not found", http.StatusNotFound},
+	{service.ErrSessionNotFound, ProblemTypeSessionNotFound, "Session not found", http.StatusNotFound},
+	{service.ErrProfileNotFound, ProblemTypeProfileNotFound, "Profile not found", http.StatusNotFound},
+	{service.ErrNewsletterDisabled, ProblemTypeNewsletterDisabled, "Newsletter disabled", http.StatusForbidden},
+	{service.ErrInvalidSubscriptionToken, ProblemTypeInvalidSubscription, "Invalid subscription link", http.StatusBadRequest},
+	{service.ErrWebhookNotFound, ProblemTypeWebhookNotFound, "Webhook not found", http.StatusNotFound},
+	{errRouteNotFound, ProblemTypeRouteNotFound, "Not found", http.StatusNotFound},
+	{errMethodNotAllowed, ProblemTypeMethodNotAllowed, "Method not allowed", http.StatusMethodNotAllowed},
+	{context.DeadlineExceeded, ProblemTypeTimeout, "Request timed out", http.StatusGatewayTimeout},
+}
+
+// NewProblem builds the problem details for an error. Unknown errors are
+// reported as internal errors without leaking the underlying message.
+func NewProblem(ctx context.Context, err error) Problem {
+	problem := Problem{
+		Type:   ProblemTypeInternal,
+		Title:  "Internal server error",
+		Status: http.StatusInternalServerError,
+		Detail: "An unexpected error occurred",
+	}
+
+	// Drivers report a query cancelled by the route deadline in their own words
+	if ctx.Err() == context.DeadlineExceeded && !isKnownError(err) {
+		err = context.DeadlineExceeded
+	}
+
+	for _, m := range problemMappings {
+		if errors.Is(err, m.err) {
+			problem.Type = m.typ
+			problem.Title = m.title
+			problem.Status = m.status
+			problem.Detail = err.Error()
+			break
+		}
+	}
+
+	var verr *service.ValidationError
+	if errors.As(err, &verr) {
+		problem.Detail = "One or more fields are invalid"
+		problem.Errors = verr.Fields
+	}
+
+	if path, ok := ctx.Value(kithttp.ContextKeyRequestPath).(string); ok {
+		problem.Instance = path
+	}
+	problem.RequestID = requestid.FromContext(ctx)
+
+	return problem
+}
+
+// isKnownError reports whether err has a problem mapping
+func isKnownError(err error) bool {
+	for _, m := range problemMappings {
+		if errors.Is(err, m.err) {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeError is the go-kit ErrorEncoder for every route of the profile API
+func EncodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	problem := NewProblem(ctx, err)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// problemHandler returns a handler that always answers with the problem for err
+func problemHandler(err error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := kithttp.PopulateRequestContext(r.Context(), r)
+		EncodeError(ctx, err, w)
+	})
+}
@@ -0,0 +1,107 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/go-kit/log/level"
+)
+
+// readinessTimeout bounds how long /readyz waits for its checks
+const readinessTimeout = 2 * time.Second
+
+// Dependency statuses reported by /readyz
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// ReadinessCheck reports whether a dependency the service needs is usable
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// DependencyStatus is the result of a single readiness check. Why a check
+// failed is only logged, as /readyz is served to anyone.
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Took   string `json:"took"`
+}
+
+// ReadinessResponse is the body of /readyz
+type ReadinessResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// WithReadinessChecks adds dependency checks to /readyz
+func WithReadinessChecks(checks ...ReadinessCheck) ServerOption {
+	return func(s *Server) {
+		s.readinessChecks = append(s.readinessChecks, checks...)
+	}
+}
+
+// Drain makes /readyz fail so load balancers stop sending new requests while
+// the server shuts down. In-flight requests are not affected.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// handleLiveness reports that the process is up. It doesn't look at any
+// dependency, so a database outage doesn't get the container restarted.
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	EncodeResponse(r.Context(), w, map[string]string{"status": StatusOK})
+}
+
+// handleReadiness runs every readiness check concurrently and answers 503 if
+// any of them fails or the server is draining
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	resp := ReadinessResponse{
+		Status:       StatusOK,
+		Dependencies: make(map[string]DependencyStatus, len(s.readinessChecks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range s.readinessChecks {
+		wg.Add(1)
+		go func(check ReadinessCheck) {
+			defer wg.Done()
+			begin := time.Now()
+			err := check.Check(ctx)
+
+			status := DependencyStatus{Status: StatusOK, Took: time.Since(begin).String()}
+			if err != nil {
+				status.Status = StatusUnavailable
+				level.Warn(requestid.Logger(ctx, s.logger)).Log("msg", "Readiness check failed", "dependency", check.Name, "err", err)
+			}
+
+			mu.Lock()
+			resp.Dependencies[check.Name] = status
+			if err != nil {
+				resp.Status = StatusUnavailable
+			}
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	if s.draining.Load() {
+		resp.Status = StatusUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,38 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// InstrumentingMiddleware returns a handler that records the duration of HTTP
+// requests by method, route template and status code. The route template is
+// put on the context by RouteMiddleware.
+func InstrumentingMiddleware(duration metrics.Histogram) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			begin := time.Now()
+
+			// Create a wrapper for the response writer to capture status code
+			wrapper := &responseWriterWrapper{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+
+			route := routeFromContext(r.Context())
+
+			defer func() {
+				duration.With(
+					"method", r.Method,
+					"route", route,
+					"status", strconv.Itoa(wrapper.statusCode),
+				).Observe(time.Since(begin).Seconds())
+			}()
+
+			next.ServeHTTP(wrapper, r)
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/ganis/okblog/profile/pkg/requestid"
 	"github.com/go-kit/log"
 )
 
@@ -20,7 +21,7 @@ func LoggingMiddleware(logger log.Logger) func(http.Handler) http.Handler {
 			}
 
 			defer func() {
-				logger.Log(
+				requestid.Logger(r.Context(), logger).Log(
 					"method", r.Method,
 					"path", r.URL.Path,
 					"status", wrapper.statusCode,
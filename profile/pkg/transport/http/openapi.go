@@ -0,0 +1,320 @@
+package http
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/endpoint"
+	"github.com/ganis/okblog/profile/pkg/model"
+)
+
+// Paths of the OpenAPI document and of the page that renders it
+const (
+	OpenAPIPath = "/api/profiles/openapi.json"
+	DocsPath    = "/api/profiles/docs"
+)
+
+// OpenAPIVersion is the version of the profile API in the document
+const OpenAPIVersion = "1.0.0"
+
+//go:embed docs.html
+var docsPage []byte
+
+// openAPIDocument is an OpenAPI 3.1 document, limited to what the profile API uses
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+// openAPIInfo describes the API
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// openAPIOperation is one method of a path
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+// openAPIParameter is a path or query parameter
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+// openAPIRequestBody is the JSON body of an operation
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+// openAPIResponse is a response of an operation, with or without a body
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+// openAPIMediaType holds the schema of a body
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+// openAPIComponents holds the named schemas and the bearer security scheme
+type openAPIComponents struct {
+	Schemas         map[string]*jsonSchema           `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+// openAPISecurityScheme describes how requests authenticate
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+// jsonSchema is the subset of JSON Schema 2020-12 the generator produces
+type jsonSchema struct {
+	Ref        string                 `json:"$ref,omitempty"`
+	Type       string                 `json:"type,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+	Enum       []string               `json:"enum,omitempty"`
+	Items      *jsonSchema            `json:"items,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	Required   []string               `json:"required,omitempty"`
+	// AdditionalProperties is false for structs and a schema for maps
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+}
+
+// bearerScheme is the name of the security scheme of authenticated routes
+const bearerScheme = "bearerAuth"
+
+// schemaNames renames types whose name is taken by another schema
+var schemaNames = map[reflect.Type]string{
+	reflect.TypeOf(endpoint.UpdateProfileRequest{}): "UpdateProfileEnvelope",
+}
+
+// fieldEnums lists the values of JSON fields that only take a few
+var fieldEnums = map[string][]string{
+	"role":  {model.RoleUser, model.RoleAdmin},
+	"mode":  {model.EditorMarkdown, model.EditorRichText},
+	"theme": {model.ThemeLight, model.ThemeDark, model.ThemeSystem},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// newOpenAPI builds the document of routes. Schemas are generated from the
+// request and response types with their JSON tags: fields without omitempty
+// are required, and objects allow no other properties.
+func newOpenAPI(routes []apiRoute) *openAPIDocument {
+	schemas := &schemaGenerator{schemas: map[string]*jsonSchema{}, names: map[reflect.Type]string{}}
+	problem := &openAPIResponse{
+		Description: "Problem details (RFC 7807)",
+		Content:     map[string]openAPIMediaType{ProblemContentType: {Schema: schemas.schema(reflect.TypeOf(Problem{}))}},
+	}
+
+	doc := &openAPIDocument{
+		OpenAPI: "3.1.0",
+		Info: openAPIInfo{
+			Title:       "okblog profile API",
+			Version:     OpenAPIVersion,
+			Description: "Profiles, authentication, invitations, sessions, impersonation, newsletter subscriptions and author statistics. Errors are RFC 7807 problems whose type identifies the error.",
+		},
+		Paths: map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: schemas.schemas,
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				bearerScheme: {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		for _, method := range route.methods {
+			op := &openAPIOperation{
+				OperationID: operationID(route.name, method, len(route.methods) > 1),
+				Summary:     route.summary,
+				Description: route.description,
+				Parameters:  append(pathParameters(route.path), route.query...),
+				Responses:   map[string]*openAPIResponse{"default": problem},
+			}
+			if route.request != nil {
+				op.RequestBody = &openAPIRequestBody{
+					Required: true,
+					Content:  map[string]openAPIMediaType{"application/json": {Schema: schemas.schema(reflect.TypeOf(route.request))}},
+				}
+			}
+			success := &openAPIResponse{Description: http.StatusText(route.status)}
+			if route.response != nil {
+				contentType := route.contentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				success.Content = map[string]openAPIMediaType{contentType: {Schema: schemas.schema(reflect.TypeOf(route.response))}}
+			}
+			op.Responses[strconv.Itoa(route.status)] = success
+			if route.auth {
+				op.Security = []map[string][]string{{bearerScheme: {}}}
+			}
+
+			if doc.Paths[route.path] == nil {
+				doc.Paths[route.path] = map[string]*openAPIOperation{}
+			}
+			doc.Paths[route.path][strings.ToLower(method)] = op
+		}
+	}
+	return doc
+}
+
+// operationID turns a route name like revoke-session into revokeSession. Routes
+// with several methods get the method appended.
+func operationID(name, method string, several bool) string {
+	parts := strings.Split(name, "-")
+	if several {
+		parts = append(parts, strings.ToLower(method))
+	}
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+	return strings.Join(parts, "")
+}
+
+// pathParameters returns the {name} segments of a mux path template
+func pathParameters(path string) []openAPIParameter {
+	var params []openAPIParameter
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params = append(params, openAPIParameter{
+				Name:     strings.Trim(segment, "{}"),
+				In:       "path",
+				Required: true,
+				Schema:   &jsonSchema{Type: "string"},
+			})
+		}
+	}
+	return params
+}
+
+// schemaGenerator turns Go types into schemas. Structs become named
+// components referenced with $ref.
+type schemaGenerator struct {
+	schemas map[string]*jsonSchema
+	names   map[reflect.Type]string
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) *jsonSchema {
+	if t == timeType {
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		return &jsonSchema{Ref: "#/components/schemas/" + g.component(t)}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	default:
+		return &jsonSchema{}
+	}
+}
+
+// component registers the schema of a struct once and returns its name
+func (g *schemaGenerator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name, ok := schemaNames[t]
+	if !ok {
+		name = t.Name()
+	}
+	g.names[t] = name
+
+	object := &jsonSchema{Type: "object", Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+	g.schemas[name] = object
+	g.addFields(object, t)
+	sort.Strings(object.Required)
+	return name
+}
+
+// addFields adds the fields of struct t as encoding/json encodes them.
+// Embedded structs without a tag are flattened.
+func (g *schemaGenerator) addFields(object *jsonSchema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addFields(object, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := g.schema(field.Type)
+		if enum, ok := fieldEnums[name]; ok && schema.Type == "string" {
+			schema.Enum = enum
+		}
+		object.Properties[name] = schema
+		if !strings.Contains(opts, "omitempty") {
+			object.Required = append(object.Required, name)
+		}
+	}
+}
+
+// openAPIHandler serves the document, encoded once
+func openAPIHandler(doc *openAPIDocument) http.Handler {
+	body, err := json.MarshalIndent(doc, "", "  ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			EncodeError(r.Context(), err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// docsHandler serves a page that renders the document with Swagger UI
+func docsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docsPage)
+	})
+}
@@ -0,0 +1,278 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/endpoint"
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/go-kit/log"
+	"github.com/gorilla/mux"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// The contract tests check the served OpenAPI document against the router and
+// against real responses, so a handler change that isn't reflected in the
+// document fails here.
+
+// fetchOpenAPI returns the document served by server, decoded as a plain value
+// for the schema compiler
+func fetchOpenAPI(t *testing.T, server http.Handler) interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	doc, err := jsonschema.UnmarshalJSON(rec.Body)
+	require.NoError(t, err)
+	return doc
+}
+
+// compileSchema compiles the schema at pointer in the document
+func compileSchema(t *testing.T, doc interface{}, pointer ...string) *jsonschema.Schema {
+	t.Helper()
+	for i, token := range pointer {
+		pointer[i] = strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+	}
+
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	require.NoError(t, c.AddResource("openapi.json", doc))
+	schema, err := c.Compile("openapi.json#/" + strings.Join(pointer, "/"))
+	require.NoError(t, err, pointer)
+	return schema
+}
+
+// documentedOperations returns "METHOD path" of every operation in doc
+func documentedOperations(doc interface{}) []string {
+	var operations []string
+	for path, item := range doc.(map[string]interface{})["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			operations = append(operations, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+func TestOpenAPI_MatchesRouter(t *testing.T) {
+	server := NewServer(new(MockService), log.NewNopLogger())
+	doc := fetchOpenAPI(t, server)
+
+	var routed []string
+	err := server.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") || path == OpenAPIPath || path == DocsPath {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		require.NoError(t, err, path)
+		for _, method := range methods {
+			routed = append(routed, method+" "+path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Strings(routed)
+
+	assert.Equal(t, routed, documentedOperations(doc))
+}
+
+func TestOpenAPI_DocumentsRequestTypes(t *testing.T) {
+	// Every documented body must be what the route's decoder produces
+	for _, route := range apiRoutes(endpoint.Endpoints{}) {
+		if route.request == nil {
+			continue
+		}
+		t.Run(route.name, func(t *testing.T) {
+			body, err := json.Marshal(route.request)
+			require.NoError(t, err)
+			decoded, err := route.decode(context.Background(), httptest.NewRequest(route.methods[0], route.path, bytes.NewReader(body)))
+			require.NoError(t, err)
+			assert.Equal(t, reflect.TypeOf(route.request), reflect.TypeOf(decoded))
+		})
+	}
+}
+
+// contractService answers every call with fully populated values, so every
+// documented field shows up in a response
+func contractService() *MockService {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	profile := &model.Profile{
+		ID: "profile-id", Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "Doe",
+		Bio: "Bio", Role: model.RoleAdmin, CreatedAt: now, UpdatedAt: now,
+	}
+	login := &model.LoginResponse{Profile: profile, Token: "token"}
+	invitation := &model.Invitation{
+		ID: "invitation-id", Email: "bob@example.com", Role: model.RoleUser, Code: "code", CreatedBy: "profile-id",
+		CreatedAt: now, ExpiresAt: later, UsedAt: &now, UsedBy: "bob-id", RevokedAt: &now,
+	}
+	session := model.Session{
+		ID: "session-id", ProfileID: "profile-id", UserAgent: "Mozilla/5.0", IP: "192.0.2.1",
+		CreatedAt: now, LastSeenAt: now, ExpiresAt: later, RevokedAt: &now, ImpersonatorID: "admin-id", Current: true,
+	}
+	subscriber := model.Subscriber{
+		ID: "subscriber-id", Email: "reader@example.com", CreatedAt: now, ConfirmedAt: &now, UnsubscribedAt: &later,
+	}
+	stats := &model.AuthorStats{
+		ProfileID: "profile-id", PublishedCount: 3, DraftCount: 1, TotalViews: 42, LastPublishedAt: &now,
+	}
+	webhook := &model.Webhook{
+		ID: "webhook-id", URL: "https://hooks.example.com/okblog", Events: []string{model.EventProfileCreated},
+		Secret: "secret", CreatedBy: "profile-id", CreatedAt: now,
+	}
+	delivery := model.WebhookDelivery{
+		ID: "delivery-id", WebhookID: "webhook-id", Event: model.EventProfileCreated, Status: model.DeliveryDelivered,
+		Attempts: 2, ResponseStatus: http.StatusOK, LastError: "timeout", CreatedAt: now, NextAttemptAt: now, DeliveredAt: &now,
+	}
+	claims := &model.TokenClaims{
+		UserID: "profile-id", Username: "alice", Role: model.RoleAdmin, SessionID: "session-id", IssuedAt: now, ExpiresAt: later,
+		Locale: "en-GB", Timezone: "Europe/London", Actor: &model.Actor{UserID: "admin-id", Username: "admin"},
+	}
+	yes := true
+	preferences := &model.Preferences{
+		Locale: "en-GB", Timezone: "Europe/London",
+		Editor:        &model.EditorPreferences{Mode: model.EditorMarkdown, Theme: model.ThemeDark, FontSize: 16, SpellCheck: &yes, Autosave: &yes},
+		Notifications: &model.NotificationPreferences{Email: &yes, NewDeviceLogin: &yes},
+	}
+	impersonation := &model.ImpersonationResponse{Profile: profile, Token: "token", ExpiresAt: later}
+	audit := model.AuditEvent{
+		ID: "audit-id", Action: model.AuditImpersonationStarted, ProfileID: "profile-id", ActorID: "admin-id",
+		Target: "session-id", RequestID: "request-id", IP: "192.0.2.1", CreatedAt: now,
+	}
+
+	svc := new(MockService)
+	svc.On("RegisterProfile", mock.Anything, mock.Anything).Return(profile, nil)
+	svc.On("Login", mock.Anything, mock.Anything).Return(login, nil)
+	svc.On("RequestMagicLink", mock.Anything, mock.Anything).Return(nil)
+	svc.On("RedeemMagicLink", mock.Anything, mock.Anything).Return(login, nil)
+	svc.On("ValidateToken", mock.Anything, mock.Anything).Return(claims, nil)
+	svc.On("GetProfile", mock.Anything, mock.Anything).Return(profile, nil)
+	svc.On("UpdateProfile", mock.Anything, mock.Anything, mock.Anything).Return(profile, nil)
+	svc.On("DeleteProfile", mock.Anything, mock.Anything).Return(nil)
+	svc.On("CreateInvitation", mock.Anything, mock.Anything).Return(invitation, nil)
+	svc.On("ListInvitations", mock.Anything).Return([]model.Invitation{*invitation}, nil)
+	svc.On("RevokeInvitation", mock.Anything, mock.Anything).Return(nil)
+	svc.On("CreateWebhook", mock.Anything, mock.Anything).Return(webhook, nil)
+	svc.On("ListWebhooks", mock.Anything).Return([]model.Webhook{*webhook}, nil)
+	svc.On("DeleteWebhook", mock.Anything, mock.Anything).Return(nil)
+	svc.On("ListWebhookDeliveries", mock.Anything, mock.Anything).Return([]model.WebhookDelivery{delivery}, nil)
+	svc.On("ListSessions", mock.Anything, mock.Anything).Return([]model.Session{session}, nil)
+	svc.On("RevokeSession", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	svc.On("RevokeOtherSessions", mock.Anything, mock.Anything).Return(3, nil)
+	svc.On("GetPreferences", mock.Anything, mock.Anything).Return(preferences, nil)
+	svc.On("UpdatePreferences", mock.Anything, mock.Anything, mock.Anything).Return(preferences, nil)
+	svc.On("Subscribe", mock.Anything, mock.Anything).Return(nil)
+	svc.On("ConfirmSubscription", mock.Anything, mock.Anything).Return(nil)
+	svc.On("Unsubscribe", mock.Anything, mock.Anything).Return(nil)
+	svc.On("ListSubscribers", mock.Anything).Return([]model.Subscriber{subscriber}, nil)
+	svc.On("GetAuthorStats", mock.Anything, mock.Anything).Return(stats, nil)
+	svc.On("Impersonate", mock.Anything, mock.Anything).Return(impersonation, nil)
+	svc.On("ListAuditEvents", mock.Anything, mock.Anything).Return([]model.AuditEvent{audit}, nil)
+	return svc
+}
+
+func TestOpenAPI_MatchesResponses(t *testing.T) {
+	server := NewServer(contractService(), log.NewNopLogger())
+	doc := fetchOpenAPI(t, server)
+	paths := doc.(map[string]interface{})["paths"].(map[string]interface{})
+
+	for _, operation := range documentedOperations(doc) {
+		method, path, _ := strings.Cut(operation, " ")
+		spec := paths[path].(map[string]interface{})[strings.ToLower(method)].(map[string]interface{})
+
+		t.Run(operation, func(t *testing.T) {
+			// Each operation documents one success status next to the problems
+			var status string
+			for code := range spec["responses"].(map[string]interface{}) {
+				if code != "default" {
+					status = code
+				}
+			}
+			require.NotEmpty(t, status)
+
+			url := strings.NewReplacer("{id}", "profile-id", "{sessionId}", "session-id").Replace(path)
+			var body bytes.Buffer
+			if _, ok := spec["requestBody"]; ok {
+				body.WriteString("{}")
+			}
+			req := httptest.NewRequest(method, url, &body)
+			req.Header.Set("Authorization", "Bearer token")
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+
+			require.Equal(t, status, strconv.Itoa(rec.Code), rec.Body.String())
+			content, ok := spec["responses"].(map[string]interface{})[status].(map[string]interface{})["content"]
+			if !ok {
+				assert.Empty(t, rec.Body.String(), "the document has no body for %s", status)
+				return
+			}
+			if _, ok := content.(map[string]interface{})["application/json"]; !ok {
+				// Other media types are documented as a string
+				require.Len(t, content, 1)
+				for contentType := range content.(map[string]interface{}) {
+					mediaType, _, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+					require.NoError(t, err)
+					assert.Equal(t, contentType, mediaType)
+				}
+				assert.NotEmpty(t, rec.Body.String())
+				return
+			}
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			response, err := jsonschema.UnmarshalJSON(rec.Body)
+			require.NoError(t, err)
+			schema := compileSchema(t, doc, "paths", path, strings.ToLower(method), "responses", status, "content", "application/json", "schema")
+			assert.NoError(t, schema.Validate(response))
+		})
+	}
+}
+
+func TestOpenAPI_MatchesProblems(t *testing.T) {
+	_, server, testServer := setupMockServer()
+	defer testServer.Close()
+	doc := fetchOpenAPI(t, server)
+
+	// An authenticated route called without a token
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/profiles/invitations", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	problem, err := jsonschema.UnmarshalJSON(rec.Body)
+	require.NoError(t, err)
+	schema := compileSchema(t, doc, "paths", "/api/profiles/invitations", "get", "responses", "default", "content", ProblemContentType, "schema")
+	assert.NoError(t, schema.Validate(problem))
+
+	// The schema is strict, so a field the handlers don't send is caught
+	assert.Error(t, schema.Validate(map[string]interface{}{"type": "x", "title": "x", "status": 400, "unknown": true}))
+}
+
+func TestDocsPage(t *testing.T) {
+	_, _, testServer := setupMockServer()
+	defer testServer.Close()
+
+	resp, err := http.Get(testServer.URL + DocsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	var page bytes.Buffer
+	page.ReadFrom(resp.Body)
+	assert.Contains(t, page.String(), `url: "openapi.json"`)
+}
@@ -1,201 +1,572 @@
 package http
 
 import (
-	"context"
 	"net/http"
-	"strings"
+	"net/netip"
+	"sync/atomic"
+	"time"
 
+	"github.com/ganis/okblog/profile/pkg/endpoint"
+	"github.com/ganis/okblog/profile/pkg/model"
 	"github.com/ganis/okblog/profile/pkg/service"
+	kitendpoint "github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/transport"
+	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/go-kit/log"
 	"github.com/gorilla/mux"
-	"github.com/newrelic/go-agent/v3/newrelic"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server struct {
 	svc      service.Service
 	router   *mux.Router
 	logger   log.Logger
-	newRelic *newrelic.Application
+	handler  http.Handler
+	timeouts map[string]time.Duration
+	cors     CORSConfig
+	proxies  []netip.Prefix
+
+	readinessChecks []ReadinessCheck
+	draining        atomic.Bool
+
+	endpointMiddlewares []endpoint.Middleware
+	requestDuration     metrics.Histogram
+	metricsHandler      http.Handler
+	tracerProvider      trace.TracerProvider
+}
+
+// ServerOption configures optional behaviour of the HTTP server
+type ServerOption func(*Server)
+
+// WithRouteTimeouts overrides the request deadline of the named routes. Routes
+// without an entry use DefaultRouteTimeout.
+func WithRouteTimeouts(timeouts map[string]time.Duration) ServerOption {
+	return func(s *Server) {
+		for route, d := range timeouts {
+			s.timeouts[route] = d
+		}
+	}
+}
+
+// WithTrustedProxies sets the addresses of the proxies whose X-Real-IP and
+// X-Forwarded-For headers give the client address. Without it the headers
+// are ignored.
+func WithTrustedProxies(proxies ...netip.Prefix) ServerOption {
+	return func(s *Server) {
+		s.proxies = proxies
+	}
+}
+
+// WithEndpointMiddleware wraps every endpoint with the given middlewares
+func WithEndpointMiddleware(middlewares ...endpoint.Middleware) ServerOption {
+	return func(s *Server) {
+		s.endpointMiddlewares = append(s.endpointMiddlewares, middlewares...)
+	}
+}
+
+// WithInstrumenting records the duration of every request, see InstrumentingMiddleware
+func WithInstrumenting(requestDuration metrics.Histogram) ServerOption {
+	return func(s *Server) {
+		s.requestDuration = requestDuration
+	}
+}
+
+// WithMetricsHandler serves handler, typically a Prometheus exporter, on /metrics
+func WithMetricsHandler(handler http.Handler) ServerOption {
+	return func(s *Server) {
+		s.metricsHandler = handler
+	}
 }
 
-func NewServer(svc service.Service, logger log.Logger, newRelicApp *newrelic.Application) *Server {
+// WithTracerProvider sets the provider of the HTTP and endpoint spans. The
+// global provider is used by default.
+func WithTracerProvider(tp trace.TracerProvider) ServerOption {
+	return func(s *Server) {
+		s.tracerProvider = tp
+	}
+}
+
+func NewServer(svc service.Service, logger log.Logger, opts ...ServerOption) *Server {
 	s := &Server{
-		svc:      svc,
-		router:   mux.NewRouter(),
-		logger:   logger,
-		newRelic: newRelicApp,
+		svc:            svc,
+		router:         mux.NewRouter(),
+		logger:         logger,
+		timeouts:       DefaultRouteTimeouts(),
+		tracerProvider: otel.GetTracerProvider(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 	s.routes()
+
+	var handler http.Handler = s.router
+	if len(s.cors.AllowedOrigins) > 0 {
+		handler = CORSMiddleware(s.cors)(handler)
+	}
+	if s.requestDuration != nil {
+		handler = InstrumentingMiddleware(s.requestDuration)(handler)
+	}
+	handler = LoggingMiddleware(s.logger)(handler)
+	handler = TracingMiddleware(s.tracerProvider)(handler)
+	handler = RouteMiddleware(s.router)(handler)
+	s.handler = RequestIDMiddleware(handler)
+
 	return s
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var handler http.Handler = s.router
-
-	handler = LoggingMiddleware(s.logger)(handler)
+	s.handler.ServeHTTP(w, r)
+}
 
-	if s.newRelic != nil {
-		handler = NewRelicMiddleware(s.newRelic, s.logger)(handler)
-	}
+// apiRoute is an operation of the profile API. The router and the OpenAPI
+// document are both built from apiRoutes, so they can't disagree on paths
+// and methods.
+type apiRoute struct {
+	name        string
+	methods     []string
+	path        string
+	summary     string
+	description string
+	// auth marks routes that need a bearer token
+	auth bool
+	// query lists the optional query parameters
+	query []openAPIParameter
+	// request and response are zero values of the JSON bodies, nil for none
+	request  interface{}
+	response interface{}
+	status   int
+	// contentType is the media type of the response, JSON when empty
+	contentType string
 
-	handler.ServeHTTP(w, r)
+	endpoint kitendpoint.Endpoint
+	decode   kithttp.DecodeRequestFunc
+	encode   kithttp.EncodeResponseFunc
 }
 
-func (s *Server) routes() {
-	endpoints := MakeEndpoints(s.svc, s.logger)
+// apiRoutes lists the API in registration order. Fixed paths come before
+// /api/profiles/{id} so they aren't taken for a profile ID.
+func apiRoutes(e endpoint.Endpoints) []apiRoute {
+	return []apiRoute{
+		{
+			name:        RouteRegister,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/register",
+			summary:     "Register a profile",
+			description: "Needs an invitation code unless registration is open or no profile exists yet. The first profile becomes admin.",
+			request:     model.RegisterProfileRequest{},
+			response:    model.Profile{},
+			status:      http.StatusOK,
 
-	s.router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		EncodeResponse(context.Background(), w, "ok")
-	}).Methods(http.MethodGet, http.MethodOptions)
+			endpoint: e.RegisterProfile,
+			decode:   DecodeRegisterProfileRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:     RouteLogin,
+			methods:  []string{http.MethodPost},
+			path:     "/api/profiles/login",
+			summary:  "Log in with username and password",
+			request:  model.LoginRequest{},
+			response: model.LoginResponse{},
+			status:   http.StatusOK,
 
-	s.router.HandleFunc("/api/profiles/register", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost && r.Method != http.MethodOptions {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+			endpoint: e.Login,
+			decode:   DecodeLoginRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteMagicLink,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/login/magic",
+			summary:     "Email a one-time login link",
+			description: "Always accepted, so the response doesn't tell whether the address has an account. The email is sent in the background, at most 3 per address every 15 minutes.",
+			request:     model.MagicLinkRequest{},
+			status:      http.StatusAccepted,
 
-		// Skip processing for OPTIONS requests
-		if r.Method == http.MethodOptions {
-			return
-		}
+			endpoint: e.RequestMagicLink,
+			decode:   DecodeRequestMagicLinkRequest,
+			encode:   EncodeAcceptedResponse,
+		},
+		{
+			name:     RouteRedeemMagicLink,
+			methods:  []string{http.MethodPost},
+			path:     "/api/profiles/login/magic/redeem",
+			summary:  "Log in with a magic link",
+			request:  model.RedeemMagicLinkRequest{},
+			response: model.LoginResponse{},
+			status:   http.StatusOK,
 
-		req, err := DecodeRegisterProfileRequest(context.Background(), r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+			endpoint: e.RedeemMagicLink,
+			decode:   DecodeRedeemMagicLinkRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteValidateToken,
+			methods:     []string{http.MethodPost, http.MethodGet, http.MethodPut, http.MethodDelete},
+			path:        "/api/profiles/validate-token",
+			summary:     "Validate a token",
+			description: "Used by the gateway to authenticate requests, which keep their method.",
+			auth:        true,
+			response:    model.TokenValidationResponse{},
+			status:      http.StatusOK,
 
-		response, err := endpoints.RegisterProfile(context.Background(), req)
-		if err != nil {
-			if err == service.ErrInvalidInput {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+			endpoint: e.ValidateToken,
+			decode:   DecodeValidateTokenRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteCreateInvitation,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/invitations",
+			summary:     "Invite someone",
+			description: "Admin only. The code is only returned here.",
+			auth:        true,
+			request:     model.CreateInvitationRequest{},
+			response:    model.Invitation{},
+			status:      http.StatusCreated,
 
-		EncodeResponse(context.Background(), w, response)
-	}).Methods(http.MethodPost, http.MethodOptions)
+			endpoint: e.CreateInvitation,
+			decode:   DecodeCreateInvitationRequest,
+			encode:   EncodeCreatedResponse,
+		},
+		{
+			name:        RouteListInvitations,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/invitations",
+			summary:     "List pending invitations",
+			description: "Admin only.",
+			auth:        true,
+			response:    []model.Invitation{},
+			status:      http.StatusOK,
 
-	s.router.HandleFunc("/api/profiles/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost && r.Method != http.MethodOptions {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+			endpoint: e.ListInvitations,
+			decode:   DecodeListInvitationsRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteRevokeInvitation,
+			methods:     []string{http.MethodDelete},
+			path:        "/api/profiles/invitations/{id}",
+			summary:     "Revoke an invitation",
+			description: "Admin only.",
+			auth:        true,
+			status:      http.StatusNoContent,
 
-		// Skip processing for OPTIONS requests
-		if r.Method == http.MethodOptions {
-			return
-		}
+			endpoint: e.RevokeInvitation,
+			decode:   DecodeRevokeInvitationRequest,
+			encode:   EncodeNoContentResponse,
+		},
+		{
+			name:        RouteCreateWebhook,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/webhooks",
+			summary:     "Add a webhook",
+			description: "Admin only. The secret that signs the deliveries is only returned here.",
+			auth:        true,
+			request:     model.CreateWebhookRequest{},
+			response:    model.Webhook{},
+			status:      http.StatusCreated,
 
-		req, err := DecodeLoginRequest(context.Background(), r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+			endpoint: e.CreateWebhook,
+			decode:   DecodeCreateWebhookRequest,
+			encode:   EncodeCreatedResponse,
+		},
+		{
+			name:        RouteListWebhooks,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/webhooks",
+			summary:     "List webhooks",
+			description: "Admin only.",
+			auth:        true,
+			response:    []model.Webhook{},
+			status:      http.StatusOK,
 
-		response, err := endpoints.Login(context.Background(), req)
-		if err != nil {
-			if err == service.ErrInvalidInput || err == service.ErrInvalidCredentials {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+			endpoint: e.ListWebhooks,
+			decode:   DecodeListWebhooksRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteDeleteWebhook,
+			methods:     []string{http.MethodDelete},
+			path:        "/api/profiles/webhooks/{id}",
+			summary:     "Delete a webhook",
+			description: "Admin only. Pending deliveries are dropped.",
+			auth:        true,
+			status:      http.StatusNoContent,
 
-		EncodeResponse(context.Background(), w, response)
-	}).Methods(http.MethodPost, http.MethodOptions)
+			endpoint: e.DeleteWebhook,
+			decode:   DecodeDeleteWebhookRequest,
+			encode:   EncodeNoContentResponse,
+		},
+		{
+			name:        RouteListWebhookDeliveries,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/webhooks/{id}/deliveries",
+			summary:     "List the latest deliveries of a webhook",
+			description: "Admin only. The last 100 deliveries, newest first, with the outcome of their last attempt.",
+			auth:        true,
+			response:    []model.WebhookDelivery{},
+			status:      http.StatusOK,
 
-	s.router.HandleFunc("/api/profiles/validate-token", func(w http.ResponseWriter, r *http.Request) {
-		// Skip processing for OPTIONS requests
-		if r.Method == http.MethodOptions {
-			return
-		}
+			endpoint: e.ListWebhookDeliveries,
+			decode:   DecodeListWebhookDeliveriesRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteListAuditEvents,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/audit",
+			summary:     "List the audit trail",
+			description: "Admin only. Newest first: every impersonation and every change made with an impersonation token.",
+			auth:        true,
+			query: []openAPIParameter{
+				{Name: "profile", In: "query", Description: "Only the entries about this profile", Schema: &jsonSchema{Type: "string"}},
+				{Name: "actor", In: "query", Description: "Only the entries of this admin", Schema: &jsonSchema{Type: "string"}},
+				{Name: "limit", In: "query", Description: "At most this many entries, 100 by default and 1000 at most", Schema: &jsonSchema{Type: "integer"}},
+			},
+			response: []model.AuditEvent{},
+			status:   http.StatusOK,
 
-		req, err := DecodeValidateTokenRequest(context.Background(), r)
-		if err != nil {
-			// Handle Authorization header errors with 401 Unauthorized
-			if strings.Contains(err.Error(), "Authorization header") || strings.Contains(err.Error(), "token") {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+			endpoint: e.ListAuditEvents,
+			decode:   DecodeListAuditEventsRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteSubscribe,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/newsletter/subscribe",
+			summary:     "Subscribe to the newsletter",
+			description: "Emails a confirmation link, at most once an hour while the subscription is pending. Always accepted, so the response doesn't tell whether the address already subscribed.",
+			request:     model.SubscribeRequest{},
+			status:      http.StatusAccepted,
 
-		response, err := endpoints.ValidateToken(context.Background(), req)
-		if err != nil {
-			if err == service.ErrInvalidInput {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			// Return 401 for invalid token errors
-			if strings.Contains(err.Error(), "unauthorized: invalid token") {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+			endpoint: e.Subscribe,
+			decode:   DecodeSubscribeRequest,
+			encode:   EncodeAcceptedResponse,
+		},
+		{
+			name:    RouteConfirmSubscription,
+			methods: []string{http.MethodPost},
+			path:    "/api/profiles/newsletter/confirm",
+			summary: "Confirm a newsletter subscription",
+			request: model.SubscriptionTokenRequest{},
+			status:  http.StatusNoContent,
 
-		EncodeResponse(context.Background(), w, response)
-	}).Methods(http.MethodPost, http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+			endpoint: e.ConfirmSubscription,
+			decode:   DecodeSubscriptionTokenRequest,
+			encode:   EncodeNoContentResponse,
+		},
+		{
+			name:        RouteUnsubscribe,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/newsletter/unsubscribe",
+			summary:     "Unsubscribe from the newsletter",
+			description: "Takes the token of the link in every digest. Unsubscribing twice succeeds.",
+			request:     model.SubscriptionTokenRequest{},
+			status:      http.StatusNoContent,
 
-	s.router.HandleFunc("/api/profiles/{id}", func(w http.ResponseWriter, r *http.Request) {
-		// Skip processing for OPTIONS requests
-		if r.Method == http.MethodOptions {
-			return
-		}
+			endpoint: e.Unsubscribe,
+			decode:   DecodeSubscriptionTokenRequest,
+			encode:   EncodeNoContentResponse,
+		},
+		{
+			name:        RouteExportSubscribers,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/newsletter/subscribers",
+			summary:     "Export newsletter subscribers",
+			description: "Admin only. CSV with the columns id, email, status, created_at, confirmed_at and unsubscribed_at.",
+			auth:        true,
+			response:    "",
+			status:      http.StatusOK,
+			contentType: "text/csv",
 
-		vars := mux.Vars(r)
-		id := vars["id"]
-
-		switch r.Method {
-		case http.MethodGet:
-			response, err := endpoints.GetProfile(context.Background(), id)
-			if err != nil {
-				if err == service.ErrProfileNotFound {
-					http.Error(w, err.Error(), http.StatusNotFound)
-					return
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			EncodeResponse(context.Background(), w, response)
-
-		case http.MethodPut:
-			req, err := DecodeUpdateProfileRequest(context.Background(), r)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			response, err := endpoints.UpdateProfile(context.Background(), req)
-			if err != nil {
-				if err == service.ErrProfileNotFound {
-					http.Error(w, err.Error(), http.StatusNotFound)
-					return
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			EncodeResponse(context.Background(), w, response)
-
-		case http.MethodDelete:
-			_, err := endpoints.DeleteProfile(context.Background(), id)
-			if err != nil {
-				if err == service.ErrProfileNotFound {
-					http.Error(w, err.Error(), http.StatusNotFound)
-					return
-				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusNoContent)
-
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+			endpoint: e.ExportSubscribers,
+			decode:   DecodeExportSubscribersRequest,
+			encode:   EncodeSubscribersCSV,
+		},
+		{
+			name:        RouteListSessions,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/{id}/sessions",
+			summary:     "List the active sessions of a profile",
+			description: "For the profile itself or an admin.",
+			auth:        true,
+			response:    []model.Session{},
+			status:      http.StatusOK,
+
+			endpoint: e.ListSessions,
+			decode:   DecodeListSessionsRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteRevokeOtherSessions,
+			methods:     []string{http.MethodDelete},
+			path:        "/api/profiles/{id}/sessions",
+			summary:     "Revoke every other session",
+			description: "Revokes every session of the profile but the one making the request.",
+			auth:        true,
+			response:    model.RevokeSessionsResponse{},
+			status:      http.StatusOK,
+
+			endpoint: e.RevokeOtherSessions,
+			decode:   DecodeRevokeOtherSessionsRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:    RouteRevokeSession,
+			methods: []string{http.MethodDelete},
+			path:    "/api/profiles/{id}/sessions/{sessionId}",
+			summary: "Revoke a session",
+			auth:    true,
+			status:  http.StatusNoContent,
+
+			endpoint: e.RevokeSession,
+			decode:   DecodeRevokeSessionRequest,
+			encode:   EncodeNoContentResponse,
+		},
+		{
+			name:        RouteGetPreferences,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/{id}/preferences",
+			summary:     "Get the preferences of a profile",
+			description: "For the profile itself or an admin. Fields that were never set are left out.",
+			auth:        true,
+			response:    model.Preferences{},
+			status:      http.StatusOK,
+
+			endpoint: e.GetPreferences,
+			decode:   DecodeGetPreferencesRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteUpdatePreferences,
+			methods:     []string{http.MethodPut},
+			path:        "/api/profiles/{id}/preferences",
+			summary:     "Update the preferences of a profile",
+			description: "For the profile itself or an admin. Only the fields in the body change, editor and notifications included, a field set to null is cleared, and the result is validated against the preferences schema. Tokens carry the locale and timezone from when they were issued.",
+			auth:        true,
+			request:     endpoint.UpdatePreferencesRequest{},
+			response:    model.Preferences{},
+			status:      http.StatusOK,
+
+			endpoint: e.UpdatePreferences,
+			decode:   DecodeUpdatePreferencesRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteImpersonate,
+			methods:     []string{http.MethodPost},
+			path:        "/api/profiles/{id}/impersonate",
+			summary:     "Impersonate a profile",
+			description: "Admin only. Returns a short-lived token of the profile whose act claim names the admin. It can't impersonate in turn, and is recorded in the audit trail.",
+			auth:        true,
+			response:    model.ImpersonationResponse{},
+			status:      http.StatusOK,
+
+			endpoint: e.Impersonate,
+			decode:   DecodeImpersonateRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteGetAuthorStats,
+			methods:     []string{http.MethodGet},
+			path:        "/api/profiles/{id}/stats",
+			summary:     "Get the post statistics of a profile",
+			description: "Counted from the post service's change stream, so they can lag behind it by a few seconds. Pages are not counted.",
+			response:    model.AuthorStats{},
+			status:      http.StatusOK,
+
+			endpoint: e.GetAuthorStats,
+			decode:   DecodeGetAuthorStatsRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:     RouteGetProfile,
+			methods:  []string{http.MethodGet},
+			path:     "/api/profiles/{id}",
+			summary:  "Get a profile",
+			response: model.Profile{},
+			status:   http.StatusOK,
+
+			endpoint: e.GetProfile,
+			decode:   DecodeGetProfileRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteUpdateProfile,
+			methods:     []string{http.MethodPut},
+			path:        "/api/profiles/{id}",
+			summary:     "Update a profile",
+			description: "For the profile itself or an admin. The profile is identified by the id of the body, not by the path. Empty fields are left unchanged.",
+			auth:        true,
+			request:     endpoint.UpdateProfileRequest{},
+			response:    model.Profile{},
+			status:      http.StatusOK,
+
+			endpoint: e.UpdateProfile,
+			decode:   DecodeUpdateProfileRequest,
+			encode:   EncodeResponse,
+		},
+		{
+			name:        RouteDeleteProfile,
+			methods:     []string{http.MethodDelete},
+			path:        "/api/profiles/{id}",
+			summary:     "Delete a profile",
+			description: "For the profile itself or an admin.",
+			auth:        true,
+			status:      http.StatusNoContent,
+
+			endpoint: e.DeleteProfile,
+			decode:   DecodeDeleteProfileRequest,
+			encode:   EncodeNoContentResponse,
+		},
+	}
+}
+
+func (s *Server) routes() {
+	middlewares := append([]endpoint.Middleware{endpoint.TracingMiddleware(s.tracerProvider)}, s.endpointMiddlewares...)
+	endpoints := endpoint.MakeEndpoints(s.svc, s.logger, middlewares...)
+
+	options := []kithttp.ServerOption{
+		kithttp.ServerBefore(kithttp.PopulateRequestContext, PopulateClientInfo(s.proxies), PopulateAuthorization),
+		kithttp.ServerErrorHandler(transport.NewLogErrorHandler(s.logger)),
+		kithttp.ServerErrorEncoder(EncodeError),
+	}
+
+	s.router.NotFoundHandler = problemHandler(errRouteNotFound)
+	s.router.MethodNotAllowedHandler = problemHandler(errMethodNotAllowed)
+
+	// /health is kept for existing probes; new ones should use /livez and /readyz
+	s.router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		EncodeResponse(r.Context(), w, "ok")
+	}).Methods(http.MethodGet)
+	s.router.HandleFunc("/livez", s.handleLiveness).Methods(http.MethodGet)
+	s.router.HandleFunc("/readyz", s.handleReadiness).Methods(http.MethodGet)
+	if s.metricsHandler != nil {
+		s.router.Handle("/metrics", s.metricsHandler).Methods(http.MethodGet)
+	}
+
+	routes := apiRoutes(endpoints)
+	s.router.Handle(OpenAPIPath, openAPIHandler(newOpenAPI(routes))).Methods(http.MethodGet)
+	s.router.Handle(DocsPath, docsHandler()).Methods(http.MethodGet)
+
+	for _, route := range routes {
+		s.router.Handle(route.path, s.withTimeout(route.name, kithttp.NewServer(
+			route.endpoint,
+			route.decode,
+			route.encode,
+			options...,
+		))).Methods(route.methods...)
+	}
+}
+
+// withTimeout bounds the request context of a route by its configured timeout
+func (s *Server) withTimeout(route string, next http.Handler) http.Handler {
+	d, ok := s.timeouts[route]
+	if !ok {
+		d = DefaultRouteTimeout
+	}
+	return timeoutHandler(d, next)
 }
@@ -0,0 +1,53 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/ganis/okblog/profile/pkg/requestid"
+	"github.com/ganis/okblog/profile/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware returns a handler that starts a server span for every
+// request. The trace context of the caller is taken from the traceparent
+// header, and spans are named after the route template put on the context
+// by RouteMiddleware.
+func TracingMiddleware(tp trace.TracerProvider) func(http.Handler) http.Handler {
+	tracer := tp.Tracer(tracing.InstrumentationName)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			route := routeFromContext(r.Context())
+			ctx, span := tracer.Start(ctx, r.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", route),
+					attribute.String("url.path", r.URL.Path),
+					attribute.String("user_agent.original", r.UserAgent()),
+					attribute.String("request_id", requestid.FromContext(r.Context())),
+				),
+			)
+			defer span.End()
+
+			// Create a wrapper for the response writer to capture status code
+			wrapper := &responseWriterWrapper{
+				ResponseWriter: w,
+				statusCode:     http.StatusOK,
+			}
+
+			next.ServeHTTP(wrapper, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", wrapper.statusCode))
+			if wrapper.statusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(wrapper.statusCode))
+			}
+		})
+	}
+}
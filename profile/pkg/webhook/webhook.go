@@ -0,0 +1,125 @@
+// Package webhook delivers the events of the profile service to the URLs
+// admins subscribed. Every request is signed with the secret of its webhook,
+// so receivers can check it came from the profile service.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of every delivery
+const (
+	HeaderEvent     = "X-Okblog-Event"
+	HeaderDelivery  = "X-Okblog-Delivery"
+	HeaderTimestamp = "X-Okblog-Timestamp"
+	HeaderSignature = "X-Okblog-Signature"
+)
+
+// DefaultTimeout is how long a receiver has to answer
+const DefaultTimeout = 10 * time.Second
+
+// signaturePrefix names the algorithm, so it can change without breaking
+// receivers that check it
+const signaturePrefix = "sha256="
+
+// maxResponseBody is how much of a response is read before the connection is
+// reused. Receivers only need to answer with a status.
+const maxResponseBody = 64 << 10
+
+// Request is one attempt at delivering an event
+type Request struct {
+	URL    string
+	Secret string
+	Event  string
+	// DeliveryID is the same for every attempt, so receivers can drop
+	// deliveries they already processed
+	DeliveryID string
+	Body       []byte
+}
+
+// Sender delivers requests. It returns the status of the response, if there
+// was one, and an error unless the status is 2xx.
+type Sender interface {
+	Send(ctx context.Context, req Request) (int, error)
+}
+
+// Sign returns the signature of body sent at timestamp: the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with secret. The timestamp is signed too, so
+// a captured request can't be replayed later with a new one.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is the signature of body sent at
+// timestamp. It is what a receiver written in Go would run.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// HTTPSender posts requests as JSON
+type HTTPSender struct {
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewHTTPSender returns a sender whose requests time out after timeout.
+// Redirects are not followed: a receiver that moved must be updated by an
+// admin, not trusted to send signed events elsewhere.
+func NewHTTPSender(timeout time.Duration) *HTTPSender {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &HTTPSender{
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		now: time.Now,
+	}
+}
+
+// Send implements Sender
+func (s *HTTPSender) Send(ctx context.Context, req Request) (int, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := s.now().Unix()
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "okblog-profile-webhook")
+	httpReq.Header.Set(HeaderEvent, req.Event)
+	httpReq.Header.Set(HeaderDelivery, req.DeliveryID)
+	httpReq.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	httpReq.Header.Set(HeaderSignature, Sign(req.Secret, timestamp, req.Body))
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"type":"profile.created"}`)
+	signature := Sign("secret", 1718000000, body)
+
+	assert.Equal(t, "sha256=", signature[:7])
+	assert.Len(t, signature, 7+64)
+	assert.True(t, Verify("secret", 1718000000, body, signature))
+	assert.False(t, Verify("other", 1718000000, body, signature))
+	assert.False(t, Verify("secret", 1718000001, body, signature))
+	assert.False(t, Verify("secret", 1718000000, []byte(`{}`), signature))
+	assert.False(t, Verify("secret", 1718000000, body, signature[7:]))
+}
+
+func TestHTTPSender(t *testing.T) {
+	body := []byte(`{"type":"profile.created"}`)
+	var received *http.Request
+	var receivedBody []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	sender := NewHTTPSender(time.Second)
+	sender.now = func() time.Time { return time.Unix(1718000000, 0) }
+	status, err := sender.Send(context.Background(), Request{
+		URL: receiver.URL + "/hooks", Secret: "secret", Event: "profile.created", DeliveryID: "delivery-id", Body: body,
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, http.MethodPost, received.Method)
+	assert.Equal(t, "/hooks", received.URL.Path)
+	assert.Equal(t, "application/json", received.Header.Get("Content-Type"))
+	assert.Equal(t, "profile.created", received.Header.Get(HeaderEvent))
+	assert.Equal(t, "delivery-id", received.Header.Get(HeaderDelivery))
+	assert.Equal(t, body, receivedBody)
+
+	timestamp, err := strconv.ParseInt(received.Header.Get(HeaderTimestamp), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1718000000), timestamp)
+	assert.True(t, Verify("secret", timestamp, receivedBody, received.Header.Get(HeaderSignature)))
+}
+
+func TestHTTPSender_Failures(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			http.Error(w, "boom", http.StatusInternalServerError)
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer receiver.Close()
+
+	sender := NewHTTPSender(50 * time.Millisecond)
+	send := func(path string) (int, error) {
+		return sender.Send(context.Background(), Request{URL: receiver.URL + path, Secret: "secret", Body: []byte(`{}`)})
+	}
+
+	status, err := send("/error")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.EqualError(t, err, "receiver answered 500 Internal Server Error")
+
+	// Redirects are failures, not followed
+	status, err = send("/moved")
+	assert.Equal(t, http.StatusFound, status)
+	assert.Error(t, err)
+
+	status, err = send("/slow")
+	assert.Equal(t, 0, status)
+	assert.Error(t, err)
+}
@@ -0,0 +1,173 @@
+package wordpress
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ganis/okblog/profile/pkg/model"
+	"github.com/google/uuid"
+)
+
+// Supported export formats
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// registeredLayout is the format of wp_users.user_registered
+const registeredLayout = "2006-01-02 15:04:05"
+
+// User is a row of the wp_users table
+type User struct {
+	ID          string
+	Login       string
+	Pass        string
+	Nicename    string
+	Email       string
+	Registered  string
+	DisplayName string
+}
+
+// ParseUsers reads wp_users rows exported as JSON or CSV.
+//
+// JSON can either be a plain array of row objects or a phpMyAdmin export,
+// where the rows are in the "data" member of the "table" item. CSV must have
+// a header row with the wp_users column names.
+func ParseUsers(r io.Reader, format string) ([]User, error) {
+	var rows []map[string]string
+	var err error
+
+	switch format {
+	case FormatJSON:
+		rows, err = parseJSONRows(r)
+	case FormatCSV:
+		rows, err = parseCSVRows(r)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(rows))
+	for _, row := range rows {
+		users = append(users, User{
+			ID:          row["ID"],
+			Login:       row["user_login"],
+			Pass:        row["user_pass"],
+			Nicename:    row["user_nicename"],
+			Email:       row["user_email"],
+			Registered:  row["user_registered"],
+			DisplayName: row["display_name"],
+		})
+	}
+	return users, nil
+}
+
+func parseJSONRows(r io.Reader) ([]map[string]string, error) {
+	// Numbers are kept as written: as float64 a large ID would print as 1e+06
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var items []map[string]interface{}
+	if err := decoder.Decode(&items); err != nil {
+		return nil, fmt.Errorf("decode JSON export: %w", err)
+	}
+
+	// phpMyAdmin wraps the rows in a table item next to header items
+	for _, item := range items {
+		if item["type"] == "table" {
+			data, ok := item["data"].([]interface{})
+			if !ok {
+				return nil, errors.New("table item has no data array")
+			}
+			items = make([]map[string]interface{}, 0, len(data))
+			for _, d := range data {
+				if row, ok := d.(map[string]interface{}); ok {
+					items = append(items, row)
+				}
+			}
+			break
+		}
+	}
+
+	rows := make([]map[string]string, 0, len(items))
+	for _, item := range items {
+		row := make(map[string]string, len(item))
+		for key, value := range item {
+			switch value := value.(type) {
+			case nil:
+			case json.Number:
+				row[key] = value.String()
+			default:
+				row[key] = fmt.Sprint(value)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseCSVRows(r io.Reader) ([]map[string]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read CSV export: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("CSV export is empty")
+	}
+
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(column)] = record[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Validate reports whether the row has what's needed to create a profile
+func (u User) Validate() error {
+	if u.Login == "" {
+		return errors.New("user_login is empty")
+	}
+	if u.Email == "" {
+		return errors.New("user_email is empty")
+	}
+	if u.Pass == "" {
+		return errors.New("user_pass is empty")
+	}
+	return nil
+}
+
+// Profile maps the row to a new profile. The WordPress password hash is kept
+// as is; it is upgraded the first time the author logs in.
+func (u User) Profile(now time.Time) model.Profile {
+	createdAt, err := time.Parse(registeredLayout, u.Registered)
+	if err != nil || createdAt.IsZero() {
+		createdAt = now
+	}
+
+	firstName, lastName, _ := strings.Cut(strings.TrimSpace(u.DisplayName), " ")
+
+	return model.Profile{
+		ID:        uuid.New().String(),
+		Username:  u.Login,
+		Email:     u.Email,
+		Password:  u.Pass,
+		FirstName: firstName,
+		LastName:  strings.TrimSpace(lastName),
+		Role:      model.RoleUser,
+		CreatedAt: createdAt,
+		UpdatedAt: now,
+	}
+}
@@ -0,0 +1,88 @@
+package wordpress
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsers_JSON(t *testing.T) {
+	input := `[{"ID": 1234567, "user_login": "ganis", "user_pass": "$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0", "user_email": "ganis@example.com", "user_registered": "2015-03-01 10:20:30", "display_name": "Ganis Zulfa"}]`
+
+	users, err := ParseUsers(strings.NewReader(input), FormatJSON)
+
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "1234567", users[0].ID, "large IDs aren't printed in exponent form")
+	assert.Equal(t, "ganis", users[0].Login)
+	assert.Equal(t, "$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0", users[0].Pass)
+	assert.Equal(t, "ganis@example.com", users[0].Email)
+}
+
+func TestParseUsers_PhpMyAdminJSON(t *testing.T) {
+	input := `[
+		{"type":"header","version":"5.2.1","comment":"Export to JSON plugin for PHPMyAdmin"},
+		{"type":"database","name":"wordpress"},
+		{"type":"table","name":"wp_users","database":"wordpress","data":
+			[
+				{"ID":"1","user_login":"ganis","user_pass":"$wp$2y$10$abc","user_email":"ganis@example.com","user_registered":"2015-03-01 10:20:30","display_name":"Ganis"},
+				{"ID":"2","user_login":"guest","user_pass":"$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0","user_email":"guest@example.com","user_registered":"2016-01-01 00:00:00","display_name":"guest"}
+			]
+		}
+	]`
+
+	users, err := ParseUsers(strings.NewReader(input), FormatJSON)
+
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "ganis", users[0].Login)
+	assert.Equal(t, "$wp$2y$10$abc", users[0].Pass)
+	assert.Equal(t, "guest", users[1].Login)
+}
+
+func TestParseUsers_CSV(t *testing.T) {
+	input := "ID,user_login,user_pass,user_nicename,user_email,user_registered,display_name\n" +
+		"1,ganis,$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0,ganis,ganis@example.com,2015-03-01 10:20:30,Ganis Zulfa\n"
+
+	users, err := ParseUsers(strings.NewReader(input), FormatCSV)
+
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "ganis", users[0].Login)
+	assert.Equal(t, "Ganis Zulfa", users[0].DisplayName)
+}
+
+func TestParseUsers_UnsupportedFormat(t *testing.T) {
+	_, err := ParseUsers(strings.NewReader(""), "xml")
+	assert.Error(t, err)
+}
+
+func TestUserProfile(t *testing.T) {
+	now := time.Now()
+	user := User{
+		ID:          "1",
+		Login:       "ganis",
+		Pass:        "$P$BabcdefghoTxhl3SXmFk9JMqnsp3cw0",
+		Email:       "ganis@example.com",
+		Registered:  "2015-03-01 10:20:30",
+		DisplayName: "Ganis Zulfa Santoso",
+	}
+
+	assert.NoError(t, user.Validate())
+
+	profile := user.Profile(now)
+	assert.NotEmpty(t, profile.ID)
+	assert.Equal(t, "ganis", profile.Username)
+	assert.Equal(t, "ganis@example.com", profile.Email)
+	assert.Equal(t, user.Pass, profile.Password) // Hash is kept for the first login
+	assert.Equal(t, "Ganis", profile.FirstName)
+	assert.Equal(t, "Zulfa Santoso", profile.LastName)
+	assert.Equal(t, time.Date(2015, 3, 1, 10, 20, 30, 0, time.UTC), profile.CreatedAt)
+	assert.Equal(t, now, profile.UpdatedAt)
+
+	// Missing fields are reported
+	assert.Error(t, User{Login: "ganis", Email: "ganis@example.com"}.Validate())
+}
@@ -12,8 +12,11 @@ echo "Creating database $DB_NAME if it doesn't exist..."
 psql -h $DB_HOST -p $DB_PORT -U $DB_USER -tc "SELECT 1 FROM pg_database WHERE datname = '$DB_NAME'" | grep -q 1 || \
     psql -h $DB_HOST -p $DB_PORT -U $DB_USER -c "CREATE DATABASE $DB_NAME"
 
-# Apply migrations
+# Apply every pending migration and record it in schema_migrations, so
+# profilectl migrate picks up from here after upgrades
 echo "Applying migrations..."
-psql -h $DB_HOST -p $DB_PORT -U $DB_USER -d $DB_NAME -f ../migrations/001_create_profiles_table.sql
+cd "$(dirname "$0")/.." || exit 1
+export DB_USER DB_PASSWORD DB_NAME DB_HOST DB_PORT
+go run ./cmd/profilectl migrate || exit 1
 
 echo "Database initialization complete!" 
\ No newline at end of file